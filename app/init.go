@@ -15,12 +15,32 @@ func Setup(cfg config.Config) *models.Services {
 	services, err := models.NewServices(
 		models.WithGorm(dbCfg.Dialect(), dbCfg.ConnectionInfo()),
 		models.WithLogMode(!cfg.IsProd()),
+		models.WithEventBus(),
 		models.WithUser(cfg.Pepper, cfg.HMACKey),
 		models.WithTweet(),
 		models.WithTag(),
 		models.WithTagging(),
 		models.WithLike(),
 		models.WithFollow(),
+		models.WithBlock(),
+		models.WithMute(),
+		models.WithTimeline(),
+		models.WithStream(),
+		models.WithMessage(),
+		models.WithNotification(),
+		models.WithSearch(),
+		models.WithAPIToken(cfg.HMACKey),
+		models.WithSession(cfg.HMACKey),
+		models.WithExport(),
+		models.WithImport(),
+		models.WithWebhook(cfg.WebhooksAllowPrivate),
+		models.WithSubscriber("likes_count", models.CountLikes, models.EventLikeAdded, models.EventLikeRemoved),
+		models.WithSubscriber("replies_count", models.CountReplies, models.EventTweetCreated, models.EventTweetDeleted),
+		models.WithSubscriber("taggings", models.TagTweet, models.EventTweetCreated, models.EventTweetUpdated),
+		models.WithNotificationSubscriber(),
+		models.WithWebhookSubscriber(),
+		models.WithStreamListener(),
+		models.WithAsyncSubscriber("webhooks_cleanup", models.DeleteWebhooks, models.EventUserDeleted),
 	)
 	utils.Must(err)
 	services.AutoMigrate()
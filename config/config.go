@@ -48,6 +48,18 @@ type Config struct {
 	HMACKey  string         `json:"hmac_key"`
 	Database PostgresConfig `json:"database"`
 	Mailgun  MailgunConfig  `json:"mailgun"`
+	// RequireVerifiedEmail stops users who have not verified
+	// their email address from tweeting, liking and following.
+	// They can still read.
+	RequireVerifiedEmail bool `json:"require_verified_email"`
+	// Admins are the IDs of the users who can register global
+	// webhooks, which get the events of every user. IDs are
+	// used since usernames can be changed and taken over.
+	Admins []uint `json:"admins"`
+	// WebhooksAllowPrivate lets webhooks be sent to loopback
+	// and private addresses. It is only meant for testing
+	// receivers running on the same machine.
+	WebhooksAllowPrivate bool `json:"webhooks_allow_private"`
 }
 
 func (c Config) IsProd() bool {
@@ -68,6 +80,8 @@ func TestConfig() Config {
 	cfg := DefaultConfig()
 	cfg.Port = 3005
 	cfg.Database.Name = "chirp_test"
+	cfg.Admins = []uint{1} // samsmith
+	cfg.WebhooksAllowPrivate = true
 	return cfg
 }
 
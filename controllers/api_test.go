@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"chirp.com/app"
 	"chirp.com/config"
+	"chirp.com/email"
 	"chirp.com/middleware"
 	"chirp.com/models"
 	"chirp.com/testdata"
@@ -25,6 +26,7 @@ type apiTestCase struct {
 	body     interface{}
 	status   int
 	remember string //sets remember_token on http cookie
+	bearer   string //sets the Authorization header
 	got      map[string]interface{}
 	want     interface{}
 }
@@ -32,7 +34,7 @@ type apiTestCase struct {
 /*
 Tests the given API endpoint
  */
-func testAPI(router http.Handler, method, URL string, body interface{}, remember string) *httptest.ResponseRecorder {
+func testAPI(router http.Handler, method, URL string, body interface{}, remember, bearer string) *httptest.ResponseRecorder {
 	var bodyBytes []byte
 	if body != nil {
 		b, err := json.Marshal(body)
@@ -52,6 +54,9 @@ func testAPI(router http.Handler, method, URL string, body interface{}, remember
 		}
 		req.AddCookie(&cookie)
 	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
 	res := httptest.NewRecorder()
 	router.ServeHTTP(res, req)
 	return res
@@ -60,7 +65,7 @@ func testAPI(router http.Handler, method, URL string, body interface{}, remember
 func runAPITests(t *testing.T, router http.Handler, tests []apiTestCase) {
 	for _, test := range tests {
 		t.Run(test.tag, func(t *testing.T) {
-			res := testAPI(router, test.method, test.url, test.body, test.remember)
+			res := testAPI(router, test.method, test.url, test.body, test.remember, test.bearer)
 			assert.Equal(t, test.status, res.Code, test.tag)
 			if test.want == nil {
 				return
@@ -101,6 +106,17 @@ func toMap(obj interface{}, removeFields ...string) map[string]interface{} {
 	return inInterface
 }
 
+/*
+Builds the expected envelope of a paginated list
+ */
+func toPage(items ...map[string]interface{}) map[string]interface{} {
+	data := make([]interface{}, len(items))
+	for i, item := range items {
+		data[i] = item
+	}
+	return map[string]interface{}{"data": data}
+}
+
 func deleteFields(m map[string]interface{}, fields ...string) {
 	for _, field := range fields {
 		delete(m, field)
@@ -108,7 +124,7 @@ func deleteFields(m map[string]interface{}, fields ...string) {
 }
 
 func deleteUnwantedFields(m map[string]interface{}, fields ...string) {
-	s := []string{"created_at", "updated_at", "deleted_at"}
+	s := []string{"created_at", "updated_at", "deleted_at", "last_used_at", "last_seen_at", "expires_at"}
 	s = append(s, fields...)
 	deleteFields(m, s...)
 	for _, v := range m {
@@ -132,15 +148,40 @@ func getSetup() (*models.Services, http.Handler) {
 	router := app.NewRouter()
 	cfg := config.TestConfig()
 	services := app.Setup(cfg)
+	services.Start()
 	testdata.ResetDB(cfg)
-	usersAPI := NewUsers(services.User, services.Like, services.Follow, services.Tweet, nil)
-	tweetsAPI := NewTweets(services.Tweet, services.Like, services.Tag, services.Tagging)
+	usersAPI := NewUsers(services.User, services.Like, services.Follow, services.Block, services.Mute, services.Tweet, services.Session, email.NewClient())
+	tweetsAPI := NewTweets(services.Tweet, services.Like, services.Block, services.User)
 	tagsAPI := NewTags(services.Tag, services.Tagging)
+	timelineAPI := NewTimeline(services.Timeline)
+	notificationsAPI := NewNotifications(services.Notification)
+	searchAPI := NewSearch(services.Search)
+	apiTokensAPI := NewAPITokens(services.APIToken)
+	sessionsAPI := NewSessions(services.Session)
+	exportsAPI := NewExports(services.Export)
+	importsAPI := NewImports(services.Import)
+	messagesAPI := NewMessages(services.Message, services.User)
+	webhooksAPI := NewWebhooks(services.Webhook, cfg.Admins)
+	streamAPI := NewStream(services.Stream)
 	//init middleware
-	userMw := middleware.NewUserMw(services.User)
+	userMw := middleware.NewUserMw(services.User, services.APIToken, services.Session)
 	requireUserMw := middleware.NewRequireUserMw(userMw)
-	ServeUserResource(router, usersAPI, &requireUserMw)
-	ServeTweetResource(router, tweetsAPI, &requireUserMw)
+	requireVerifiedMw := middleware.NewRequireVerifiedUserMw(requireUserMw, cfg.RequireVerifiedEmail)
+	requireSessionMw := middleware.NewRequireSessionMw(requireUserMw)
+	socketsAPI := NewSockets(tweetsAPI, usersAPI, services.Stream, &requireVerifiedMw)
+	ServeTimelineResource(router, timelineAPI, &requireUserMw)
+	ServeNotificationResource(router, notificationsAPI, &requireUserMw)
+	ServeSearchResource(router, searchAPI)
+	ServeAPITokenResource(router, apiTokensAPI, &requireSessionMw)
+	ServeSessionResource(router, sessionsAPI, &requireUserMw)
+	ServeExportResource(router, exportsAPI, &requireUserMw)
+	ServeImportResource(router, importsAPI, &requireVerifiedMw)
+	ServeMessageResource(router, messagesAPI, &requireUserMw)
+	ServeWebhookResource(router, webhooksAPI, &requireUserMw)
+	ServeStreamResource(router, streamAPI, &requireUserMw)
+	ServeSocketResource(router, socketsAPI, &requireUserMw)
+	ServeUserResource(router, usersAPI, &requireUserMw, &requireVerifiedMw)
+	ServeTweetResource(router, tweetsAPI, &requireUserMw, &requireVerifiedMw)
 	ServeTagResource(router, tagsAPI, &requireUserMw)
 	return services, userMw.Apply(router)
 }
@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"chirp.com/context"
+	"chirp.com/errors"
+	"chirp.com/internal/utils"
+	"chirp.com/middleware"
+	"chirp.com/models"
+	"github.com/gorilla/mux"
+)
+
+type APITokens struct {
+	ts models.APITokenService
+}
+
+func NewAPITokens(ts models.APITokenService) *APITokens {
+	return &APITokens{
+		ts: ts,
+	}
+}
+
+// ServeAPITokenResource must be called before
+// ServeUserResource since /{username} would otherwise match
+// /tokens. Tokens can only be managed from a session so a
+// leaked token cannot be used to mint more.
+func ServeAPITokenResource(r *mux.Router, t *APITokens, m *middleware.RequireSession) {
+	r.HandleFunc("/tokens", m.ApplyFn(t.Index)).Methods("GET")
+	r.HandleFunc("/tokens", m.ApplyFn(t.Create)).Methods("POST")
+	r.HandleFunc("/tokens/{id:[0-9]+}/delete", m.ApplyFn(t.Delete)).Methods("POST")
+}
+
+// Index lists the signed in user's API tokens, newest first.
+// The tokens themselves are never returned again after they
+// are created.
+//
+// GET /tokens
+func (t *APITokens) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	tokens, err := t.ts.ByUserID(user.ID)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	utils.Render(w, tokens)
+}
+
+// APITokenForm is used to create an API token. Scope is either
+// read or write and defaults to read.
+type APITokenForm struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+// Create renders the new token including its raw value, which
+// the client has to store since it cannot be looked up later.
+//
+// POST /tokens
+func (t *APITokens) Create(w http.ResponseWriter, r *http.Request) {
+	var form APITokenForm
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&form); err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	user := context.User(r.Context())
+	token := models.APIToken{
+		UserID: user.ID,
+		Name:   form.Name,
+		Scope:  form.Scope,
+	}
+	if err := t.ts.Create(&token); err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	utils.Render(w, token)
+}
+
+// Delete revokes one of the signed in user's API tokens.
+//
+// POST /tokens/:id/delete
+func (t *APITokens) Delete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	user := context.User(r.Context())
+	err = t.ts.Delete(user.ID, uint(id))
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		utils.RenderAPIError(w, errors.NotFound("Token"))
+	default:
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+	}
+}
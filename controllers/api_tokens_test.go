@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"chirp.com/models"
+)
+
+func TestAPITokens(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	// vincetester
+	readToken := models.APIToken{UserID: 6, Name: "script", Scope: models.ScopeRead}
+	writeToken := models.APIToken{UserID: 6, Name: "mobile", Scope: models.ScopeWrite}
+	for _, token := range []*models.APIToken{&readToken, &writeToken} {
+		if err := services.APIToken.Create(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []apiTestCase{
+		{
+			tag:    "list tokens requires a user",
+			method: "GET",
+			url:    "/tokens",
+			status: http.StatusUnauthorized,
+		},
+		{
+			tag:    "list tokens",
+			method: "GET",
+			url:    "/tokens",
+			status: http.StatusOK,
+			want: []map[string]interface{}{
+				toMap(models.APIToken{ID: writeToken.ID, Name: "mobile", Scope: models.ScopeWrite}),
+				toMap(models.APIToken{ID: readToken.ID, Name: "script", Scope: models.ScopeRead}),
+			},
+			remember: tokenUserRequired,
+		},
+		{
+			tag:    "invalid token",
+			method: "GET",
+			url:    "/tokens",
+			status: http.StatusUnauthorized,
+			bearer: "not-a-token",
+		},
+		{
+			tag:    "read token cannot write",
+			method: "POST",
+			url:    "/duasings/1001/like",
+			status: http.StatusForbidden,
+			bearer: readToken.Token,
+		},
+		{
+			tag:    "tokens cannot list tokens",
+			method: "GET",
+			url:    "/tokens",
+			status: http.StatusForbidden,
+			bearer: readToken.Token,
+		},
+		{
+			tag:    "tokens cannot create tokens",
+			method: "POST",
+			url:    "/tokens",
+			body:   APITokenForm{Name: "another", Scope: models.ScopeWrite},
+			status: http.StatusForbidden,
+			bearer: writeToken.Token,
+		},
+		{
+			tag:    "tokens cannot revoke tokens",
+			method: "POST",
+			url:    "/tokens/" + strconv.Itoa(int(readToken.ID)) + "/delete",
+			status: http.StatusForbidden,
+			bearer: writeToken.Token,
+		},
+		{
+			tag:      "create token with invalid scope",
+			method:   "POST",
+			url:      "/tokens",
+			body:     APITokenForm{Name: "another", Scope: "admin"},
+			status:   http.StatusUnprocessableEntity,
+			remember: tokenUserRequired,
+		},
+		{
+			tag:      "revoke token that does not exist",
+			method:   "POST",
+			url:      "/tokens/1000/delete",
+			status:   http.StatusNotFound,
+			remember: tokenUserRequired,
+		},
+		{
+			tag:      "revoke token",
+			method:   "POST",
+			url:      "/tokens/" + strconv.Itoa(int(readToken.ID)) + "/delete",
+			status:   http.StatusOK,
+			remember: tokenUserRequired,
+		},
+		{
+			tag:    "revoked token is rejected",
+			method: "GET",
+			url:    "/home",
+			status: http.StatusUnauthorized,
+			bearer: readToken.Token,
+		},
+	}
+	runAPITests(t, router, testCases)
+}
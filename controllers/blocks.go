@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"net/http"
+
+	"chirp.com/context"
+	"chirp.com/errors"
+	"chirp.com/internal/utils"
+	"chirp.com/models"
+)
+
+// errBlocked is rendered when the signed in user tries to act
+// on a user they blocked or were blocked by.
+const errBlocked = "You cannot interact with this user"
+
+// viewerID returns the ID of the signed in user, or zero when
+// the request is signed out.
+func viewerID(r *http.Request) uint {
+	if user := context.User(r.Context()); user != nil {
+		return user.ID
+	}
+	return 0
+}
+
+// blockedWith reports whether the signed in user and the user
+// have blocked each other. If the lookup fails an error is
+// rendered and ok is false.
+func (u *Users) blockedWith(w http.ResponseWriter, r *http.Request, user *models.User) (blocked, ok bool) {
+	id := viewerID(r)
+	if id == 0 {
+		return false, true
+	}
+	blocked, err := u.bs.Blocked(user.ID, id)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return false, false
+	}
+	return blocked, true
+}
+
+// Block removes the follows between the signed in user and the
+// user, in both directions, and stops the user from following
+// them or acting on their tweets.
+//
+// POST /:username/block
+func (u *Users) Block(w http.ResponseWriter, r *http.Request) {
+	blocked := u.getUser(w, r)
+	if blocked == nil {
+		return
+	}
+	blocker := context.User(r.Context())
+	block := models.Block{
+		BlockerID: blocker.ID,
+		UserID:    blocked.ID,
+	}
+	if err := u.bs.Create(&block); err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, blocked, ""))
+		return
+	}
+	utils.Render(w, blocked)
+}
+
+// Unblock does not restore the follows removed by Block.
+//
+// POST /:username/block/delete
+func (u *Users) Unblock(w http.ResponseWriter, r *http.Request) {
+	blocked := u.getUser(w, r)
+	if blocked == nil {
+		return
+	}
+	blocker := context.User(r.Context())
+	if _, err := u.bs.GetBlock(blocked.ID, blocker.ID); err != nil {
+		utils.RenderAPIError(w, errors.NotFound("Block on this user"))
+		return
+	}
+	if err := u.bs.Delete(blocked.ID, blocker.ID); err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	utils.Render(w, blocked)
+}
+
+// GetBlocks returns the users the signed in user blocked.
+//
+// GET /blocks?limit=20&before=:cursor
+func (u *Users) GetBlocks(w http.ResponseWriter, r *http.Request) {
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	users, next, err := u.bs.GetUserBlockingPaginated(user.ID, page)
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	renderPage(w, users, next)
+}
+
+// Mute hides the user's tweets and notifications from the
+// signed in user. The muted user is not told.
+//
+// POST /:username/mute
+func (u *Users) Mute(w http.ResponseWriter, r *http.Request) {
+	muted := u.getUser(w, r)
+	if muted == nil {
+		return
+	}
+	muter := context.User(r.Context())
+	mute := models.Mute{
+		MuterID: muter.ID,
+		UserID:  muted.ID,
+	}
+	if err := u.ms.Create(&mute); err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, muted, ""))
+		return
+	}
+	utils.Render(w, muted)
+}
+
+// POST /:username/mute/delete
+func (u *Users) Unmute(w http.ResponseWriter, r *http.Request) {
+	muted := u.getUser(w, r)
+	if muted == nil {
+		return
+	}
+	muter := context.User(r.Context())
+	if _, err := u.ms.GetMute(muted.ID, muter.ID); err != nil {
+		utils.RenderAPIError(w, errors.NotFound("Mute on this user"))
+		return
+	}
+	if err := u.ms.Delete(muted.ID, muter.ID); err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	utils.Render(w, muted)
+}
+
+// GetMutes returns the users the signed in user muted.
+//
+// GET /mutes?limit=20&before=:cursor
+func (u *Users) GetMutes(w http.ResponseWriter, r *http.Request) {
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	users, next, err := u.ms.GetUserMutingPaginated(user.ID, page)
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	renderPage(w, users, next)
+}
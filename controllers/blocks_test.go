@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"chirp.com/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// pageTweetIDs returns the IDs of the tweets in a page.
+func pageTweetIDs(t *testing.T, body []byte) []uint {
+	var page struct {
+		Data []models.Tweet `json:"data"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]uint, len(page.Data))
+	for i, tweet := range page.Data {
+		ids[i] = tweet.ID
+	}
+	return ids
+}
+
+// followNotifications returns the number of follow
+// notification groups of the token's user.
+func followNotifications(t *testing.T, router http.Handler, bearer string) int {
+	res := testAPI(router, "GET", "/notifications", nil, "", bearer)
+	assert.Equal(t, http.StatusOK, res.Code)
+	var groups struct {
+		Data []models.NotificationGroup `json:"data"`
+	}
+	json.NewDecoder(res.Body).Decode(&groups)
+	n := 0
+	for _, group := range groups.Data {
+		if group.Type == models.NotificationFollow {
+			n++
+		}
+	}
+	return n
+}
+
+// TestBlock has vincetester block bobbyd, who follows no one
+// but is followed by vincetester.
+func TestBlock(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	vince := models.APIToken{UserID: 6, Name: "mobile", Scope: models.ScopeWrite}
+	bob := models.APIToken{UserID: 4, Name: "mobile", Scope: models.ScopeWrite}
+	for _, token := range []*models.APIToken{&vince, &bob} {
+		if err := services.APIToken.Create(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res := testAPI(router, "POST", "/vincetester/follow", nil, "", bob.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, 1, followNotifications(t, router, vince.Token))
+
+	runAPITests(t, router, []apiTestCase{
+		{
+			tag:    "signed out",
+			method: "POST",
+			url:    "/bobbyd/block",
+			status: http.StatusUnauthorized,
+		},
+		{
+			tag:    "block yourself",
+			method: "POST",
+			url:    "/vincetester/block",
+			status: http.StatusUnprocessableEntity,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "block",
+			method: "POST",
+			url:    "/bobbyd/block",
+			status: http.StatusOK,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "block twice",
+			method: "POST",
+			url:    "/bobbyd/block",
+			status: http.StatusUnprocessableEntity,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "blocked user cannot follow",
+			method: "POST",
+			url:    "/vincetester/follow",
+			status: http.StatusForbidden,
+			bearer: bob.Token,
+		},
+		{
+			tag:    "blocker cannot follow",
+			method: "POST",
+			url:    "/bobbyd/follow",
+			status: http.StatusForbidden,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "blocked user cannot like",
+			method: "POST",
+			url:    "/vincetester/1005/like",
+			status: http.StatusForbidden,
+			bearer: bob.Token,
+		},
+		{
+			tag:    "blocked user cannot retweet",
+			method: "POST",
+			url:    "/vincetester/1005/retweet",
+			status: http.StatusForbidden,
+			bearer: bob.Token,
+		},
+		{
+			tag:    "blocked user cannot reply",
+			method: "POST",
+			url:    "/vincetester/1005/reply",
+			body:   TweetForm{Post: "hey"},
+			status: http.StatusForbidden,
+			bearer: bob.Token,
+		},
+	})
+
+	_, err := services.Follow.GetFollow(4, 6)
+	assert.Equal(t, models.ErrNotFound, err, "the blocker's follow is removed")
+	_, err = services.Follow.GetFollow(6, 4)
+	assert.Equal(t, models.ErrNotFound, err, "the blocked user's follow is removed")
+	assert.Equal(t, 0, followNotifications(t, router, vince.Token), "the follow notification is undone")
+
+	res = testAPI(router, "GET", "/vincetester/tweets", nil, "", bob.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Empty(t, pageTweetIDs(t, res.Body.Bytes()), "the blocker's tweets are hidden")
+	res = testAPI(router, "GET", "/bobbyd/tweets", nil, "", vince.Token)
+	assert.Empty(t, pageTweetIDs(t, res.Body.Bytes()), "the blocked user's tweets are hidden")
+	res = testAPI(router, "GET", "/bobbyd/tweets", nil, "", "")
+	assert.Equal(t, []uint{1003}, pageTweetIDs(t, res.Body.Bytes()), "signed out users see every tweet")
+
+	res = testAPI(router, "GET", "/search?q=guitar", nil, "", "")
+	assert.Equal(t, []uint{1003}, pageTweetIDs(t, res.Body.Bytes()))
+	res = testAPI(router, "GET", "/search?q=guitar", nil, "", vince.Token)
+	assert.Empty(t, pageTweetIDs(t, res.Body.Bytes()), "search leaves out blocked users")
+
+	res = testAPI(router, "GET", "/blocks", nil, "", vince.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	var blocks struct {
+		Data []models.User `json:"data"`
+	}
+	json.NewDecoder(res.Body).Decode(&blocks)
+	if assert.Len(t, blocks.Data, 1) {
+		assert.Equal(t, "bobbyd", blocks.Data[0].Username)
+	}
+
+	runAPITests(t, router, []apiTestCase{
+		{
+			tag:    "unblock",
+			method: "POST",
+			url:    "/bobbyd/block/delete",
+			status: http.StatusOK,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "unblock twice",
+			method: "POST",
+			url:    "/bobbyd/block/delete",
+			status: http.StatusNotFound,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "follow after unblocking",
+			method: "POST",
+			url:    "/vincetester/follow",
+			status: http.StatusOK,
+			bearer: bob.Token,
+		},
+	})
+}
+
+// TestMute has vincetester mute bobbyd, whom they follow.
+func TestMute(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	vince := models.APIToken{UserID: 6, Name: "mobile", Scope: models.ScopeWrite}
+	bob := models.APIToken{UserID: 4, Name: "mobile", Scope: models.ScopeWrite}
+	for _, token := range []*models.APIToken{&vince, &bob} {
+		if err := services.APIToken.Create(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res := testAPI(router, "GET", "/home", nil, "", vince.Token)
+	assert.Contains(t, pageTweetIDs(t, res.Body.Bytes()), uint(1003))
+
+	runAPITests(t, router, []apiTestCase{
+		{
+			tag:    "mute yourself",
+			method: "POST",
+			url:    "/vincetester/mute",
+			status: http.StatusUnprocessableEntity,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "mute",
+			method: "POST",
+			url:    "/bobbyd/mute",
+			status: http.StatusOK,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "mute twice",
+			method: "POST",
+			url:    "/bobbyd/mute",
+			status: http.StatusUnprocessableEntity,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "muted user can still like",
+			method: "POST",
+			url:    "/vincetester/1005/like",
+			status: http.StatusOK,
+			bearer: bob.Token,
+		},
+	})
+
+	_, err := services.Follow.GetFollow(4, 6)
+	assert.NoError(t, err, "muting keeps the follow")
+
+	res = testAPI(router, "GET", "/home", nil, "", vince.Token)
+	assert.NotContains(t, pageTweetIDs(t, res.Body.Bytes()), uint(1003))
+	res = testAPI(router, "GET", "/bobbyd/tweets", nil, "", vince.Token)
+	assert.Equal(t, []uint{1003}, pageTweetIDs(t, res.Body.Bytes()), "profiles of muted users are not filtered")
+
+	res = testAPI(router, "GET", "/notifications", nil, "", vince.Token)
+	var groups struct {
+		Data []models.NotificationGroup `json:"data"`
+	}
+	json.NewDecoder(res.Body).Decode(&groups)
+	assert.Empty(t, groups.Data)
+
+	res = testAPI(router, "GET", "/mutes", nil, "", vince.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	var mutes struct {
+		Data []models.User `json:"data"`
+	}
+	json.NewDecoder(res.Body).Decode(&mutes)
+	if assert.Len(t, mutes.Data, 1) {
+		assert.Equal(t, "bobbyd", mutes.Data[0].Username)
+	}
+
+	res = testAPI(router, "POST", "/bobbyd/mute/delete", nil, "", vince.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	res = testAPI(router, "GET", "/notifications", nil, "", vince.Token)
+	groups.Data = nil
+	json.NewDecoder(res.Body).Decode(&groups)
+	if assert.Len(t, groups.Data, 1) {
+		assert.Equal(t, []string{"bobbyd"}, groups.Data[0].Actors)
+	}
+}
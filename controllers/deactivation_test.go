@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"chirp.com/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDeactivate deletes an account, restores it by signing in,
+// deletes it again and purges it once the deactivation period
+// is over.
+func TestDeactivate(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	signup := SignUpForm{
+		Name:     "Leaving Soon",
+		Username: "leaver",
+		Email:    "leaver@gmail.com",
+		Password: "password123",
+	}
+	res := testAPI(router, "POST", "/signup", signup, "", "")
+	if !assert.Equal(t, http.StatusOK, res.Code) {
+		t.Fatalf("signup failed: %s", res.Body.String())
+	}
+	remember := sessionCookie(res.Result().Cookies())
+
+	res = testAPI(router, "POST", "/tweets", TweetForm{Post: "going away"}, remember, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	var tweet struct {
+		ID uint `json:"id"`
+	}
+	json.NewDecoder(res.Body).Decode(&tweet)
+	tweetURL := "/leaver/" + strconv.Itoa(int(tweet.ID))
+
+	// vincetester likes and retweets the tweet and follows leaver
+	apiToken := models.APIToken{UserID: 6, Name: "mobile", Scope: models.ScopeWrite}
+	if err := services.APIToken.Create(&apiToken); err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{tweetURL + "/like", tweetURL + "/retweet", "/leaver/follow"} {
+		res = testAPI(router, "POST", url, nil, "", apiToken.Token)
+		assert.Equal(t, http.StatusOK, res.Code, url)
+	}
+	// leaver likes, retweets and replies to one of kanye's tweets
+	for _, url := range []string{"/kanye_west/1006/like", "/kanye_west/1006/retweet"} {
+		res = testAPI(router, "POST", url, nil, remember, "")
+		assert.Equal(t, http.StatusOK, res.Code, url)
+	}
+	res = testAPI(router, "POST", "/kanye_west/1006/reply", TweetForm{Post: "bye"}, remember, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	var reply struct {
+		ID uint `json:"id"`
+	}
+	json.NewDecoder(res.Body).Decode(&reply)
+
+	// shown checks whether the tweets of leaver are shown to
+	// vincetester
+	shown := func(want bool) {
+		res := testAPI(router, "GET", tweetURL, nil, "", apiToken.Token)
+		assert.Equal(t, want, res.Code == http.StatusOK, "show")
+		res = testAPI(router, "GET", "/home", nil, "", apiToken.Token)
+		assert.Equal(t, want, containsID(pageTweetIDs(t, res.Body.Bytes()), tweet.ID), "home")
+		res = testAPI(router, "GET", "/search?q=going+away", nil, "", apiToken.Token)
+		assert.Equal(t, want, containsID(pageTweetIDs(t, res.Body.Bytes()), tweet.ID), "search")
+		res = testAPI(router, "GET", "/kanye_west/1006/thread", nil, "", apiToken.Token)
+		assert.Equal(t, want, containsID(threadTweetIDs(t, res.Body.Bytes()), reply.ID), "thread")
+	}
+	shown(true)
+
+	runAPITests(t, router, []apiTestCase{
+		{
+			tag:      "wrong password",
+			method:   "DELETE",
+			url:      "/me",
+			body:     DeactivateForm{Password: "wrong-password"},
+			status:   http.StatusUnprocessableEntity,
+			remember: remember,
+		},
+		{
+			tag:      "deactivate",
+			method:   "DELETE",
+			url:      "/me",
+			body:     DeactivateForm{Password: "password123"},
+			status:   http.StatusOK,
+			remember: remember,
+		},
+		{
+			tag:    "profile is hidden",
+			method: "GET",
+			url:    "/leaver",
+			status: http.StatusNotFound,
+		},
+		{
+			tag:      "signed out",
+			method:   "PATCH",
+			url:      "/me",
+			body:     ProfileForm{},
+			status:   http.StatusUnauthorized,
+			remember: remember,
+		},
+	})
+
+	shown(false)
+
+	login := LoginForm{Email: signup.Email, Password: signup.Password}
+	res = testAPI(router, "POST", "/login", login, "", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	res = testAPI(router, "GET", "/leaver", nil, "", "")
+	assert.Equal(t, http.StatusOK, res.Code, "signing in restores the account")
+	shown(true)
+
+	remember = sessionCookie(res.Result().Cookies())
+	user, err := services.User.ByUsername("leaver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := services.User.Deactivate(user, signup.Password); err != nil {
+		t.Fatal(err)
+	}
+	n, err := services.User.PurgeDeactivated()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "accounts in their deactivation period are kept")
+
+	deactivatedAt := time.Now().Add(-models.DeactivationPeriod - time.Hour)
+	user.DeactivatedAt = &deactivatedAt
+	if err := services.User.Update(user); err != nil {
+		t.Fatal(err)
+	}
+	res = testAPI(router, "POST", "/login", login, "", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, res.Code, "too late to restore")
+
+	n, err = services.User.PurgeDeactivated()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = services.User.ByID(user.ID)
+	assert.Equal(t, models.ErrNotFound, err)
+	_, err = services.Tweet.ByID(tweet.ID)
+	assert.Equal(t, models.ErrNotFound, err)
+	retweets, err := services.Tweet.ByUsername("vincetester")
+	assert.NoError(t, err)
+	for _, rt := range retweets {
+		assert.NotEqual(t, tweet.ID, rt.RetweetID, "retweets of purged tweets are deleted")
+	}
+
+	kanye, err := services.Tweet.ByID(1006)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, services.Like.GetTotalLikes(1006), kanye.LikesCount)
+	assert.Equal(t, services.Tweet.GetTotalReplies(1006), kanye.RepliesCount)
+	assert.Equal(t, uint(0), kanye.RetweetsCount)
+}
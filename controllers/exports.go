@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"chirp.com/context"
+	"chirp.com/errors"
+	"chirp.com/internal/utils"
+	"chirp.com/middleware"
+	"chirp.com/models"
+	"github.com/gorilla/mux"
+)
+
+type Exports struct {
+	es models.ExportService
+}
+
+func NewExports(es models.ExportService) *Exports {
+	return &Exports{
+		es: es,
+	}
+}
+
+// ServeExportResource must be called before ServeUserResource
+// since /{username}/... would otherwise match /me/export.
+func ServeExportResource(r *mux.Router, e *Exports, m *middleware.RequireUser) {
+	r.HandleFunc("/me/export", m.ApplyFn(e.Create)).Methods("POST")
+	r.HandleFunc("/me/export/{id:[0-9]+}", m.ApplyFn(e.Show)).Methods("GET")
+	r.HandleFunc("/me/export/{id:[0-9]+}/download", m.ApplyFn(e.Download)).Methods("GET")
+}
+
+// Create starts building an archive of the signed in user's
+// data. Its status can be checked with Show until it is ready
+// to download.
+//
+// POST /me/export
+func (e *Exports) Create(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	export, err := e.es.Request(user)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	utils.Render(w, export)
+}
+
+// GET /me/export/:id
+func (e *Exports) Show(w http.ResponseWriter, r *http.Request) {
+	export := e.exportByID(w, r)
+	if export == nil {
+		return
+	}
+	utils.Render(w, export)
+}
+
+// GET /me/export/:id/download
+func (e *Exports) Download(w http.ResponseWriter, r *http.Request) {
+	export := e.exportByID(w, r)
+	if export == nil {
+		return
+	}
+	if export.Status != models.ExportReady {
+		utils.RenderAPIError(w, errors.SetCustomError(models.ErrExportNotReady, export, ""))
+		return
+	}
+	if err := e.es.LoadArchive(export); err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	user := context.User(r.Context())
+	filename := fmt.Sprintf("chirp-%s-%s.zip", user.Username, export.CreatedAt.Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(export.Archive)))
+	w.Write(export.Archive)
+}
+
+func (e *Exports) exportByID(w http.ResponseWriter, r *http.Request) *models.Export {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return nil
+	}
+	user := context.User(r.Context())
+	export, err := e.es.ByID(user.ID, uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			utils.RenderAPIError(w, errors.NotFound("Export"))
+		default:
+			utils.RenderAPIError(w, errors.InternalServerError(err))
+		}
+		return nil
+	}
+	return export
+}
@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"chirp.com/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExport(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	// vincetester
+	apiToken := models.APIToken{UserID: 6, Name: "export", Scope: models.ScopeWrite}
+	if err := services.APIToken.Create(&apiToken); err != nil {
+		t.Fatal(err)
+	}
+
+	res := testAPI(router, "POST", "/me/export", nil, "", "")
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+
+	res = testAPI(router, "POST", "/me/export", nil, "", apiToken.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	var export models.Export
+	json.NewDecoder(res.Body).Decode(&export)
+	url := "/me/export/" + strconv.Itoa(int(export.ID))
+
+	// the archive is built in the background
+	for i := 0; i < 50 && export.Status == models.ExportPending; i++ {
+		time.Sleep(100 * time.Millisecond)
+		res = testAPI(router, "GET", url, nil, "", apiToken.Token)
+		assert.Equal(t, http.StatusOK, res.Code)
+		json.NewDecoder(res.Body).Decode(&export)
+	}
+	assert.Equal(t, models.ExportReady, export.Status)
+
+	// exports of other users cannot be seen
+	otherToken := models.APIToken{UserID: 5, Name: "export", Scope: models.ScopeRead}
+	if err := services.APIToken.Create(&otherToken); err != nil {
+		t.Fatal(err)
+	}
+	res = testAPI(router, "GET", url+"/download", nil, "", otherToken.Token)
+	assert.Equal(t, http.StatusNotFound, res.Code)
+
+	res = testAPI(router, "GET", url+"/download", nil, "", apiToken.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "application/zip", res.Header().Get("Content-Type"))
+	body := res.Body.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tweets []models.Tweet
+	for _, f := range zr.File {
+		if f.Name != "tweets.json" {
+			continue
+		}
+		rc, _ := f.Open()
+		json.NewDecoder(rc).Decode(&tweets)
+		rc.Close()
+	}
+	assert.NotEmpty(t, tweets)
+	for _, tweet := range tweets {
+		assert.Equal(t, "vincetester", tweet.Username)
+	}
+
+	// a user only ever has one pending export
+	pending := models.Export{UserID: 6, Status: models.ExportPending}
+	if err := services.Export.Create(&pending); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, services.Export.Create(&models.Export{UserID: 6, Status: models.ExportPending}))
+	res = testAPI(router, "POST", "/me/export", nil, "", apiToken.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	json.NewDecoder(res.Body).Decode(&export)
+	assert.Equal(t, pending.ID, export.ID)
+}
@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"net/http"
+
+	"chirp.com/context"
+	"chirp.com/errors"
+	"chirp.com/internal/utils"
+	"chirp.com/models"
+)
+
+// tweetsHidden reports whether the user's tweets are hidden
+// from the signed in user, either because of a block or because
+// the user is protected and not followed by them. If a lookup
+// fails an error is rendered and ok is false.
+func (u *Users) tweetsHidden(w http.ResponseWriter, r *http.Request, user *models.User) (hidden, ok bool) {
+	blocked, ok := u.blockedWith(w, r, user)
+	if !ok || blocked {
+		return blocked, ok
+	}
+	if !user.Protected {
+		return false, true
+	}
+	id := viewerID(r)
+	if id == 0 {
+		return true, true
+	}
+	if id == user.ID {
+		return false, true
+	}
+	_, err := u.fs.GetFollow(user.ID, id)
+	switch err {
+	case nil:
+		return false, true
+	case models.ErrNotFound:
+		return true, true
+	default:
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return false, false
+	}
+}
+
+// requestFollow asks the protected followee to approve the
+// follower.
+func (u *Users) requestFollow(followee, follower *models.User) (*models.FollowRequest, *errors.APIError) {
+	req := models.FollowRequest{
+		UserID:     followee.ID,
+		FollowerID: follower.ID,
+	}
+	if err := u.fs.CreateRequest(&req); err != nil {
+		return nil, errors.SetCustomError(err, followee, "")
+	}
+	return &req, nil
+}
+
+func (u *Users) cancelFollowRequest(w http.ResponseWriter, followee, follower *models.User) {
+	if err := u.fs.CancelRequest(followee.ID, follower.ID); err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	utils.Render(w, followee)
+}
+
+// GetFollowRequests returns the users waiting for the signed in
+// user to approve their follow requests.
+//
+// GET /follow_requests?limit=20&before=:cursor
+func (u *Users) GetFollowRequests(w http.ResponseWriter, r *http.Request) {
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	users, next, err := u.fs.GetRequestsPaginated(user.ID, page)
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	renderPage(w, users, next)
+}
+
+// ApproveFollowRequest makes the user a follower of the signed
+// in user.
+//
+// POST /follow_requests/:username/approve
+func (u *Users) ApproveFollowRequest(w http.ResponseWriter, r *http.Request) {
+	followee := context.User(r.Context())
+	_, req := u.followRequest(w, r, followee)
+	if req == nil {
+		return
+	}
+	follow, err := u.fs.Approve(req)
+	switch err {
+	case nil:
+	case models.ErrFollowBlocked:
+		utils.RenderAPIError(w, errors.Forbidden(errBlocked))
+		return
+	default:
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	follow.User = followee
+	utils.Render(w, follow)
+}
+
+// POST /follow_requests/:username/reject
+func (u *Users) RejectFollowRequest(w http.ResponseWriter, r *http.Request) {
+	followee := context.User(r.Context())
+	follower, req := u.followRequest(w, r, followee)
+	if req == nil {
+		return
+	}
+	if err := u.fs.RejectRequest(req.UserID, req.FollowerID); err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	utils.Render(w, follower)
+}
+
+// followRequest looks up the request that the user in the URL
+// made to follow the followee. If there is none an error is
+// rendered and nil is returned.
+func (u *Users) followRequest(w http.ResponseWriter, r *http.Request, followee *models.User) (*models.User, *models.FollowRequest) {
+	follower := u.getUser(w, r)
+	if follower == nil {
+		return nil, nil
+	}
+	req, err := u.fs.GetRequest(followee.ID, follower.ID)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			utils.RenderAPIError(w, errors.NotFound("Follow request"))
+		default:
+			utils.RenderAPIError(w, errors.InternalServerError(err))
+		}
+		return nil, nil
+	}
+	return follower, req
+}
@@ -0,0 +1,278 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"chirp.com/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestProtectedAccount has vincetester and bobbyd ask to follow
+// a protected account, which approves vincetester and rejects
+// bobbyd.
+func TestProtectedAccount(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	signup := SignUpForm{
+		Name:     "Private Pat",
+		Username: "private_pat",
+		Email:    "pat@gmail.com",
+		Password: "password123",
+	}
+	res := testAPI(router, "POST", "/signup", signup, "", "")
+	if !assert.Equal(t, http.StatusOK, res.Code) {
+		t.Fatalf("signup failed: %s", res.Body.String())
+	}
+	remember := sessionCookie(res.Result().Cookies())
+	protected := true
+	res = testAPI(router, "PATCH", "/me", ProfileForm{Protected: &protected}, remember, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	res = testAPI(router, "POST", "/tweets", TweetForm{Post: "a very secret tweet", Tags: []string{"secret"}}, remember, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	var tweet struct {
+		ID uint `json:"id"`
+	}
+	json.NewDecoder(res.Body).Decode(&tweet)
+	tweetURL := "/private_pat/" + strconv.Itoa(int(tweet.ID))
+
+	vince := models.APIToken{UserID: 6, Name: "mobile", Scope: models.ScopeWrite}
+	bob := models.APIToken{UserID: 4, Name: "mobile", Scope: models.ScopeWrite}
+	dua := models.APIToken{UserID: 3, Name: "mobile", Scope: models.ScopeWrite}
+	for _, token := range []*models.APIToken{&vince, &bob, &dua} {
+		if err := services.APIToken.Create(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// hidden checks that the listings do not show the tweet to
+	// the bearer, who does not follow the protected account.
+	hidden := func(bearer string) {
+		for _, url := range []string{"/private_pat/tweets", "/tags/secret", "/search?q=secret"} {
+			res := testAPI(router, "GET", url, nil, "", bearer)
+			assert.NotContains(t, pageTweetIDs(t, res.Body.Bytes()), tweet.ID, url)
+		}
+	}
+	hidden("")
+
+	res = testAPI(router, "POST", "/private_pat/follow", nil, "", vince.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	var req models.FollowRequest
+	json.NewDecoder(res.Body).Decode(&req)
+	assert.False(t, req.CreatedAt.IsZero(), "a follow request is rendered")
+	_, err := services.Follow.GetFollow(req.UserID, 6)
+	assert.Equal(t, models.ErrNotFound, err, "protected accounts are not followed right away")
+	hidden(vince.Token)
+
+	runAPITests(t, router, []apiTestCase{
+		{
+			tag:    "request twice",
+			method: "POST",
+			url:    "/private_pat/follow",
+			status: http.StatusUnprocessableEntity,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "request by bobbyd",
+			method: "POST",
+			url:    "/private_pat/follow",
+			status: http.StatusOK,
+			bearer: bob.Token,
+		},
+		{
+			tag:    "bobbyd cancels the request",
+			method: "POST",
+			url:    "/private_pat/follow/delete",
+			status: http.StatusOK,
+			bearer: bob.Token,
+		},
+		{
+			tag:    "request by bobbyd again",
+			method: "POST",
+			url:    "/private_pat/follow",
+			status: http.StatusOK,
+			bearer: bob.Token,
+		},
+	})
+
+	res = testAPI(router, "GET", "/follow_requests", nil, remember, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	var requests struct {
+		Data []models.User `json:"data"`
+	}
+	json.NewDecoder(res.Body).Decode(&requests)
+	if assert.Len(t, requests.Data, 2) {
+		assert.Equal(t, "bobbyd", requests.Data[0].Username)
+		assert.Equal(t, "vincetester", requests.Data[1].Username)
+	}
+
+	res = testAPI(router, "GET", "/notifications", nil, remember, "")
+	var groups struct {
+		Data []models.NotificationGroup `json:"data"`
+	}
+	json.NewDecoder(res.Body).Decode(&groups)
+	if assert.Len(t, groups.Data, 1) {
+		assert.Equal(t, models.NotificationFollowRequest, groups.Data[0].Type)
+		assert.Equal(t, "bobbyd and vincetester requested to follow you", groups.Data[0].Message)
+	}
+
+	runAPITests(t, router, []apiTestCase{
+		{
+			tag:      "approve vincetester",
+			method:   "POST",
+			url:      "/follow_requests/vincetester/approve",
+			status:   http.StatusOK,
+			remember: remember,
+		},
+		{
+			tag:      "approve twice",
+			method:   "POST",
+			url:      "/follow_requests/vincetester/approve",
+			status:   http.StatusNotFound,
+			remember: remember,
+		},
+		{
+			tag:      "reject bobbyd",
+			method:   "POST",
+			url:      "/follow_requests/bobbyd/reject",
+			status:   http.StatusOK,
+			remember: remember,
+		},
+		{
+			tag:    "followers cannot retweet",
+			method: "POST",
+			url:    tweetURL + "/retweet",
+			status: http.StatusForbidden,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "followers can like",
+			method: "POST",
+			url:    tweetURL + "/like",
+			status: http.StatusOK,
+			bearer: vince.Token,
+		}, {
+			tag:    "request by bobbyd once more",
+			method: "POST",
+			url:    "/private_pat/follow",
+			status: http.StatusOK,
+			bearer: bob.Token,
+		},
+		{
+			tag:    "bobbyd blocks the protected account",
+			method: "POST",
+			url:    "/private_pat/block",
+			status: http.StatusOK,
+			bearer: bob.Token,
+		},
+		{
+			tag:      "blocking removes the request",
+			method:   "POST",
+			url:      "/follow_requests/bobbyd/approve",
+			status:   http.StatusNotFound,
+			remember: remember,
+		},
+	})
+
+	_, err = services.Follow.GetFollow(req.UserID, 6)
+	assert.NoError(t, err, "vincetester follows once approved")
+	_, err = services.Follow.GetFollow(req.UserID, 4)
+	assert.Equal(t, models.ErrNotFound, err, "bobbyd was rejected")
+	hidden(bob.Token)
+	for _, url := range []string{"/private_pat/tweets", "/tags/secret", "/search?q=secret", "/vincetester/likes"} {
+		res := testAPI(router, "GET", url, nil, "", vince.Token)
+		assert.Contains(t, pageTweetIDs(t, res.Body.Bytes()), tweet.ID, url)
+	}
+	res = testAPI(router, "GET", "/vincetester/likes", nil, "", "")
+	assert.NotContains(t, pageTweetIDs(t, res.Body.Bytes()), tweet.ID, "likes listings hide protected tweets")
+
+	// the protected account replies in its own thread and in
+	// vincetester's, and quotes vincetester's tweet
+	post := func(url, remember, bearer string) uint {
+		res := testAPI(router, "POST", url, TweetForm{Post: "secret"}, remember, bearer)
+		if !assert.Equal(t, http.StatusOK, res.Code, url) {
+			t.Fatalf("posting failed: %s", res.Body.String())
+		}
+		var posted struct {
+			ID uint `json:"id"`
+		}
+		json.NewDecoder(res.Body).Decode(&posted)
+		return posted.ID
+	}
+	reply := post(tweetURL+"/reply", remember, "")
+	answer := post("/vincetester/1005/reply", remember, "")
+	vinceAnswer := post("/vincetester/1005/reply", "", vince.Token)
+	nested := post("/vincetester/"+strconv.Itoa(int(vinceAnswer))+"/reply", remember, "")
+	vinceReply := post(tweetURL+"/reply", "", vince.Token)
+	quote := post("/vincetester/1005/retweet", remember, "")
+
+	for _, c := range []struct {
+		bearer string
+		seen   bool
+	}{{"", false}, {bob.Token, false}, {vince.Token, true}} {
+		res := testAPI(router, "GET", tweetURL, nil, "", c.bearer)
+		assert.Equal(t, c.seen, res.Code == http.StatusOK, "show")
+		res = testAPI(router, "GET", tweetURL+"/thread", nil, "", c.bearer)
+		if c.seen {
+			assert.ElementsMatch(t, []uint{reply, vinceReply}, threadTweetIDs(t, res.Body.Bytes()))
+		} else {
+			assert.Equal(t, http.StatusNotFound, res.Code, "thread")
+		}
+		res = testAPI(router, "GET", "/vincetester/"+strconv.Itoa(int(vinceReply))+"/thread", nil, "", c.bearer)
+		assert.Equal(t, c.seen, containsID(threadTweetIDs(t, res.Body.Bytes()), tweet.ID), "ancestors")
+		res = testAPI(router, "GET", "/vincetester/1005/thread", nil, "", c.bearer)
+		ids := threadTweetIDs(t, res.Body.Bytes())
+		assert.Equal(t, c.seen, containsID(ids, answer), "replies")
+		assert.Equal(t, c.seen, containsID(ids, nested), "descendants")
+		assert.True(t, containsID(ids, vinceAnswer))
+		res = testAPI(router, "GET", "/vincetester/1005/quotes", nil, "", c.bearer)
+		assert.Equal(t, c.seen, containsID(pageTweetIDs(t, res.Body.Bytes()), quote), "quotes")
+	}
+
+	// pending requests are approved when the account is no
+	// longer protected
+	res = testAPI(router, "POST", "/private_pat/follow", nil, "", dua.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	protected = false
+	res = testAPI(router, "PATCH", "/me", ProfileForm{Protected: &protected}, remember, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	_, err = services.Follow.GetFollow(req.UserID, 3)
+	assert.NoError(t, err)
+	res = testAPI(router, "GET", "/private_pat/tweets", nil, "", "")
+	assert.Contains(t, pageTweetIDs(t, res.Body.Bytes()), tweet.ID)
+}
+
+// threadTweetIDs returns the IDs of the ancestors of a thread
+// and of its replies at any depth.
+func threadTweetIDs(t *testing.T, body []byte) []uint {
+	var thread models.Thread
+	if err := json.Unmarshal(body, &thread); err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint
+	for _, tweet := range thread.Ancestors {
+		ids = append(ids, tweet.ID)
+	}
+	var add func(replies []models.ThreadReply)
+	add = func(replies []models.ThreadReply) {
+		for _, reply := range replies {
+			ids = append(ids, reply.ID)
+			add(reply.Replies)
+		}
+	}
+	add(thread.Replies)
+	return ids
+}
+
+func containsID(ids []uint, id uint) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
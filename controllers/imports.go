@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	stderrors "errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"chirp.com/context"
+	"chirp.com/errors"
+	"chirp.com/internal/utils"
+	"chirp.com/middleware"
+	"chirp.com/models"
+	"github.com/gorilla/mux"
+)
+
+// maxImportSize is the largest archive accepted by the import
+// endpoint. Bigger archives can be imported from the command
+// line.
+const maxImportSize = 32 << 20
+
+type Imports struct {
+	is models.ImportService
+}
+
+func NewImports(is models.ImportService) *Imports {
+	return &Imports{
+		is: is,
+	}
+}
+
+// ServeImportResource must be called before ServeUserResource
+// since /{username}/... would otherwise match /me/import.
+// Importing creates tweets, so it needs a verified user just
+// like tweeting does.
+func ServeImportResource(r *mux.Router, i *Imports, vm *middleware.RequireVerifiedUser) {
+	r.HandleFunc("/me/import", vm.ApplyFn(i.Create)).Methods("POST")
+}
+
+// Create imports an archive of JSON lines into the signed in
+// user's tweets. The archive is either the request body or the
+// "archive" file of a multipart form.
+//
+// POST /me/import
+func (i *Imports) Create(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	var archive io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("archive")
+		if tooLarge(err) {
+			utils.RenderAPIError(w, errors.RequestTooLarge(err))
+			return
+		}
+		if err != nil {
+			utils.RenderAPIError(w, errors.InvalidData(err))
+			return
+		}
+		defer file.Close()
+		archive = file
+	}
+	user := context.User(r.Context())
+	result, err := i.is.Import(user, archive)
+	if tooLarge(err) {
+		// The tweets of the lines read before the limit are
+		// kept and are skipped when the archive is imported
+		// again from the command line.
+		utils.RenderAPIError(w, errors.RequestTooLarge(err))
+		return
+	}
+	if err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	utils.Render(w, result)
+}
+
+// tooLarge reports whether err is the body going over the
+// limit set by http.MaxBytesReader.
+func tooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return stderrors.As(err, &maxErr)
+}
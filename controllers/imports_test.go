@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"chirp.com/models"
+	"github.com/stretchr/testify/assert"
+)
+
+const testArchive = `{"id": "a1", "post": "first #old", "created_at": "2015-03-01T10:00:00Z", "tags": ["history"]}
+{"id": "a2", "created_at": "2015-03-02T10:00:00Z", "retweet_of": "a1"}
+{"id": "a3", "post": "no date"}
+not json
+
+{"id": "a4", "post": "quoting", "created_at": "2015-03-03T10:00:00Z", "retweet_of": "missing"}
+`
+
+func TestImport(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	// vincetester
+	apiToken := models.APIToken{UserID: 6, Name: "import", Scope: models.ScopeWrite}
+	if err := services.APIToken.Create(&apiToken); err != nil {
+		t.Fatal(err)
+	}
+	before, err := services.Tweet.ByUsername("vincetester")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantErrors := []models.ImportRowError{
+		{Line: 3, ID: "a3", Error: models.ErrImportCreatedAtRequired.Public()},
+		{Line: 4, Error: "line is not valid JSON"},
+		{Line: 6, ID: "a4", Error: models.ErrImportRetweetNotFound.Public()},
+	}
+	for _, want := range []models.ImportResult{
+		{Imported: 2, Errors: wantErrors},
+		// importing again skips the rows imported already
+		{Skipped: 2, Errors: wantErrors},
+	} {
+		req, _ := http.NewRequest("POST", "/me/import", strings.NewReader(testArchive))
+		req.Header.Set("Authorization", "Bearer "+apiToken.Token)
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusOK, res.Code)
+		var got models.ImportResult
+		json.NewDecoder(res.Body).Decode(&got)
+		assert.Equal(t, want, got)
+	}
+
+	after, err := services.Tweet.ByUsername("vincetester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, after, len(before)+2) {
+		return
+	}
+	var original, retweet models.Tweet
+	for _, tweet := range after {
+		switch tweet.Post {
+		case "first #old":
+			original = tweet
+		case "":
+			retweet = tweet
+		}
+	}
+	assert.True(t, original.CreatedAt.Equal(time.Date(2015, 3, 1, 10, 0, 0, 0, time.UTC)))
+	assert.Equal(t, original.ID, retweet.RetweetID)
+	assert.Equal(t, uint(1), original.RetweetsCount)
+	taggings, err := services.Tagging.GetTaggings(original.ID)
+	assert.Nil(t, err)
+	assert.Len(t, taggings, 2, "tags and hashtags are both tagged")
+
+	// blank lines are skipped, so only the size is over the limit
+	req, _ := http.NewRequest("POST", "/me/import", strings.NewReader(strings.Repeat("\n", maxImportSize+1)))
+	req.Header.Set("Authorization", "Bearer "+apiToken.Token)
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.Code)
+}
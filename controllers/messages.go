@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"chirp.com/context"
+	"chirp.com/errors"
+	"chirp.com/internal/utils"
+	"chirp.com/middleware"
+	"chirp.com/models"
+	"chirp.com/pkg/unique"
+	"github.com/gorilla/mux"
+)
+
+type Messages struct {
+	ms models.MessageService
+	us models.UserService
+}
+
+func NewMessages(ms models.MessageService, us models.UserService) *Messages {
+	return &Messages{
+		ms: ms,
+		us: us,
+	}
+}
+
+// ServeMessageResource must be called before ServeUserResource
+// and ServeTweetResource since /{username} and
+// /{_username}/{id} would otherwise match /messages and
+// /messages/{id}.
+func ServeMessageResource(r *mux.Router, m *Messages, mw *middleware.RequireUser) {
+	r.HandleFunc("/messages", mw.ApplyFn(m.Index)).Methods("GET")
+	r.HandleFunc("/messages", mw.ApplyFn(m.Create)).Methods("POST")
+	r.HandleFunc("/messages/{id:[0-9]+}", mw.ApplyFn(m.Show)).Methods("GET")
+	r.HandleFunc("/messages/{id:[0-9]+}", mw.ApplyFn(m.Send)).Methods("POST")
+	r.HandleFunc("/messages/{id:[0-9]+}/read", mw.ApplyFn(m.MarkRead)).Methods("POST")
+	r.HandleFunc("/messages/{id:[0-9]+}/delete", mw.ApplyFn(m.Delete)).Methods("POST")
+}
+
+// MessageForm starts a conversation with the users in To, or
+// sends a message to an existing conversation when To is left
+// out.
+type MessageForm struct {
+	To   []string `json:"to"`
+	Body string   `json:"body"`
+}
+
+// Index returns the signed in user's conversations, most
+// recently active first.
+//
+// GET /messages?limit=20&before=:cursor
+func (m *Messages) Index(w http.ResponseWriter, r *http.Request) {
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	convs, next, err := m.ms.Conversations(user.ID, page)
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	renderPage(w, convs, next)
+}
+
+// Create sends the first message of a conversation. Messaging
+// a single user continues the conversation already held with
+// them.
+//
+// POST /messages
+func (m *Messages) Create(w http.ResponseWriter, r *http.Request) {
+	var form MessageForm
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&form); err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	var recipients []models.User
+	for _, username := range unique.Strings(form.To, utils.NormalizeText) {
+		recipient, err := m.us.ByUsername(username)
+		if err == models.ErrNotFound || (err == nil && recipient.Deactivated()) {
+			utils.RenderAPIError(w, errors.NotFound("User "+username))
+			return
+		}
+		if err != nil {
+			utils.RenderAPIError(w, errors.InternalServerError(err))
+			return
+		}
+		recipients = append(recipients, *recipient)
+	}
+	user := context.User(r.Context())
+	conv, err := m.ms.Start(user, recipients, &models.Message{Body: form.Body})
+	if err != nil {
+		renderMessageError(w, err)
+		return
+	}
+	utils.Render(w, conv)
+}
+
+// Show returns the messages of the conversation, newest first.
+//
+// GET /messages/:id?limit=20&before=:cursor
+func (m *Messages) Show(w http.ResponseWriter, r *http.Request) {
+	id, ok := conversationID(w, r)
+	if !ok {
+		return
+	}
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	messages, next, err := m.ms.Messages(user.ID, id, page)
+	if err != nil {
+		renderMessageError(w, err)
+		return
+	}
+	renderPage(w, messages, next)
+}
+
+// Send adds a message to the conversation.
+//
+// POST /messages/:id
+func (m *Messages) Send(w http.ResponseWriter, r *http.Request) {
+	id, ok := conversationID(w, r)
+	if !ok {
+		return
+	}
+	var form MessageForm
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&form); err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	user := context.User(r.Context())
+	msg := models.Message{Body: form.Body}
+	if err := m.ms.Send(user, id, &msg); err != nil {
+		renderMessageError(w, err)
+		return
+	}
+	utils.Render(w, &msg)
+}
+
+// MarkRead marks the whole conversation as read.
+//
+// POST /messages/:id/read
+func (m *Messages) MarkRead(w http.ResponseWriter, r *http.Request) {
+	m.update(w, r, m.ms.MarkRead)
+}
+
+// Delete removes the conversation's messages for the signed in
+// user only. The conversation shows up again if someone sends
+// a new message.
+//
+// POST /messages/:id/delete
+func (m *Messages) Delete(w http.ResponseWriter, r *http.Request) {
+	m.update(w, r, m.ms.Delete)
+}
+
+// update applies fn to the signed in user's side of the
+// conversation and renders the conversation.
+func (m *Messages) update(w http.ResponseWriter, r *http.Request, fn func(userID, conversationID uint) error) {
+	id, ok := conversationID(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	if err := fn(user.ID, id); err != nil {
+		renderMessageError(w, err)
+		return
+	}
+	conv, err := m.ms.Conversation(user.ID, id)
+	if err != nil {
+		renderMessageError(w, err)
+		return
+	}
+	utils.Render(w, conv)
+}
+
+func conversationID(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func renderMessageError(w http.ResponseWriter, err error) {
+	switch err {
+	case models.ErrNotFound:
+		utils.RenderAPIError(w, errors.NotFound("Conversation"))
+	case models.ErrMessageBlocked, models.ErrMessageFollowersOnly:
+		utils.RenderAPIError(w, errors.Forbidden(err.(errors.PublicError).Public()))
+	default:
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+	}
+}
@@ -0,0 +1,233 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"chirp.com/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMessages has vincetester message duasings, who reads and
+// deletes the conversation, and start a group with bobbyd.
+func TestMessages(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	vince := models.APIToken{UserID: 6, Name: "mobile", Scope: models.ScopeWrite}
+	dua := models.APIToken{UserID: 3, Name: "mobile", Scope: models.ScopeWrite}
+	bob := models.APIToken{UserID: 4, Name: "mobile", Scope: models.ScopeWrite}
+	for _, token := range []*models.APIToken{&vince, &dua, &bob} {
+		if err := services.APIToken.Create(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := func(bearer string, to ...string) models.Conversation {
+		res := testAPI(router, "POST", "/messages", MessageForm{To: to, Body: "hey!"}, "", bearer)
+		if !assert.Equal(t, http.StatusOK, res.Code) {
+			t.Fatalf("starting a conversation failed: %s", res.Body.String())
+		}
+		var conv models.Conversation
+		json.NewDecoder(res.Body).Decode(&conv)
+		return conv
+	}
+	conversations := func(bearer string) []models.Conversation {
+		res := testAPI(router, "GET", "/messages", nil, "", bearer)
+		assert.Equal(t, http.StatusOK, res.Code)
+		var page struct {
+			Data []models.Conversation `json:"data"`
+		}
+		json.NewDecoder(res.Body).Decode(&page)
+		return page.Data
+	}
+
+	direct := start(vince.Token, "duasings")
+	assert.True(t, direct.Direct)
+	assert.ElementsMatch(t, []string{"duasings", "vincetester"}, direct.Participants)
+	assert.Equal(t, 0, direct.UnreadCount, "senders have read their own messages")
+	again := start(vince.Token, "DuaSings")
+	assert.Equal(t, direct.ID, again.ID, "direct conversations are reused")
+	convURL := "/messages/" + strconv.Itoa(int(direct.ID))
+	res := testAPI(router, "POST", convURL, MessageForm{Body: "are you there?"}, "", vince.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	convs := conversations(dua.Token)
+	if assert.Len(t, convs, 1) {
+		assert.Equal(t, 3, convs[0].UnreadCount)
+		if assert.NotNil(t, convs[0].LastMessage) {
+			assert.Equal(t, "are you there?", convs[0].LastMessage.Body)
+			assert.Equal(t, "vincetester", convs[0].LastMessage.Sender)
+		}
+	}
+
+	res = testAPI(router, "GET", convURL+"?limit=2", nil, "", dua.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	var page struct {
+		Data       []models.Message `json:"data"`
+		NextCursor string           `json:"next_cursor"`
+	}
+	json.NewDecoder(res.Body).Decode(&page)
+	if assert.Len(t, page.Data, 2) && assert.NotEmpty(t, page.NextCursor) {
+		assert.Equal(t, "are you there?", page.Data[0].Body, "newest messages come first")
+		res = testAPI(router, "GET", convURL+"?limit=2&before="+page.NextCursor, nil, "", dua.Token)
+		json.NewDecoder(res.Body).Decode(&page)
+		assert.Len(t, page.Data, 1)
+		assert.Empty(t, page.NextCursor)
+	}
+
+	runAPITests(t, router, []apiTestCase{
+		{
+			tag:    "only participants can read",
+			method: "GET",
+			url:    convURL,
+			status: http.StatusNotFound,
+			bearer: bob.Token,
+		},
+		{
+			tag:    "only participants can send",
+			method: "POST",
+			url:    convURL,
+			body:   MessageForm{Body: "hi"},
+			status: http.StatusNotFound,
+			bearer: bob.Token,
+		},
+		{
+			tag:    "empty message",
+			method: "POST",
+			url:    convURL,
+			body:   MessageForm{Body: "  "},
+			status: http.StatusUnprocessableEntity,
+			bearer: dua.Token,
+		},
+		{
+			tag:    "message yourself",
+			method: "POST",
+			url:    "/messages",
+			body:   MessageForm{To: []string{"vincetester"}, Body: "hi"},
+			status: http.StatusUnprocessableEntity,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "message unknown user",
+			method: "POST",
+			url:    "/messages",
+			body:   MessageForm{To: []string{"nobody_here"}, Body: "hi"},
+			status: http.StatusNotFound,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "mark read",
+			method: "POST",
+			url:    convURL + "/read",
+			status: http.StatusOK,
+			bearer: dua.Token,
+		},
+	})
+	assert.Equal(t, 0, conversations(dua.Token)[0].UnreadCount)
+
+	// deleting only clears duasings' side
+	res = testAPI(router, "POST", convURL+"/delete", nil, "", dua.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Empty(t, conversations(dua.Token))
+	res = testAPI(router, "GET", convURL, nil, "", dua.Token)
+	json.NewDecoder(res.Body).Decode(&page)
+	assert.Empty(t, page.Data)
+	res = testAPI(router, "GET", convURL, nil, "", vince.Token)
+	json.NewDecoder(res.Body).Decode(&page)
+	assert.Len(t, page.Data, 3)
+	res = testAPI(router, "POST", convURL, MessageForm{Body: "hello?"}, "", vince.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	convs = conversations(dua.Token)
+	if assert.Len(t, convs, 1, "new messages bring the conversation back") {
+		assert.Equal(t, 1, convs[0].UnreadCount)
+	}
+
+	group := start(vince.Token, "duasings", "bobbyd")
+	assert.False(t, group.Direct)
+	assert.NotEqual(t, direct.ID, group.ID)
+	assert.Len(t, group.Participants, 3)
+	res = testAPI(router, "POST", "/messages/"+strconv.Itoa(int(group.ID)), MessageForm{Body: "hi all"}, "", bob.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	convs = conversations(vince.Token)
+	if assert.Len(t, convs, 2) {
+		assert.Equal(t, group.ID, convs[0].ID, "most recently active first")
+		assert.Equal(t, 1, convs[0].UnreadCount)
+	}
+}
+
+func TestMessagePermissions(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	vince := models.APIToken{UserID: 6, Name: "mobile", Scope: models.ScopeWrite}
+	dua := models.APIToken{UserID: 3, Name: "mobile", Scope: models.ScopeWrite}
+	kanye := models.APIToken{UserID: 2, Name: "mobile", Scope: models.ScopeWrite}
+	for _, token := range []*models.APIToken{&vince, &dua, &kanye} {
+		if err := services.APIToken.Create(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	followersOnly := true
+	res := testAPI(router, "PATCH", "/me", ProfileForm{DMFollowersOnly: &followersOnly}, "", kanye.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	runAPITests(t, router, []apiTestCase{
+		{
+			tag:    "message a user who only accepts followers",
+			method: "POST",
+			url:    "/messages",
+			body:   MessageForm{To: []string{"kanye_west"}, Body: "hi"},
+			status: http.StatusForbidden,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "message as a follower",
+			method: "POST",
+			url:    "/messages",
+			body:   MessageForm{To: []string{"kanye_west"}, Body: "hi"},
+			status: http.StatusOK,
+			bearer: dua.Token,
+		},
+		{
+			tag:    "block duasings",
+			method: "POST",
+			url:    "/duasings/block",
+			status: http.StatusOK,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "message a blocked user",
+			method: "POST",
+			url:    "/messages",
+			body:   MessageForm{To: []string{"duasings"}, Body: "hi"},
+			status: http.StatusForbidden,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "message a user who blocked you",
+			method: "POST",
+			url:    "/messages",
+			body:   MessageForm{To: []string{"vincetester"}, Body: "hi"},
+			status: http.StatusForbidden,
+			bearer: dua.Token,
+		},
+		{
+			tag:    "follow kanye_west",
+			method: "POST",
+			url:    "/kanye_west/follow",
+			status: http.StatusOK,
+			bearer: vince.Token,
+		},
+		{
+			tag:    "message once following",
+			method: "POST",
+			url:    "/messages",
+			body:   MessageForm{To: []string{"kanye_west"}, Body: "hi"},
+			status: http.StatusOK,
+			bearer: vince.Token,
+		},
+	})
+}
@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"chirp.com/context"
+	"chirp.com/errors"
+	"chirp.com/internal/utils"
+	"chirp.com/middleware"
+	"chirp.com/models"
+	"github.com/gorilla/mux"
+)
+
+type Notifications struct {
+	ns models.NotificationService
+}
+
+func NewNotifications(ns models.NotificationService) *Notifications {
+	return &Notifications{
+		ns: ns,
+	}
+}
+
+// ServeNotificationResource must be called before
+// ServeUserResource since /{username} would otherwise match
+// /notifications.
+func ServeNotificationResource(r *mux.Router, n *Notifications, m *middleware.RequireUser) {
+	r.HandleFunc("/notifications", m.ApplyFn(n.Index)).Methods("GET")
+	r.HandleFunc("/notifications/read", m.ApplyFn(n.MarkRead)).Methods("POST")
+}
+
+// Index returns the signed in user's notifications grouped by
+// type and tweet, most recently active first.
+//
+// GET /notifications?limit=20&before=:cursor
+func (n *Notifications) Index(w http.ResponseWriter, r *http.Request) {
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	groups, next, err := n.ns.Groups(user.ID, page)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	renderPage(w, groups, next)
+}
+
+// MarkReadForm selects the notification group to mark as read.
+// An empty form marks every notification as read.
+type MarkReadForm struct {
+	Type    string `json:"type"`
+	TweetID uint   `json:"tweet_id"`
+}
+
+// POST /notifications/read
+func (n *Notifications) MarkRead(w http.ResponseWriter, r *http.Request) {
+	var form MarkReadForm
+	dec := json.NewDecoder(r.Body)
+	err := dec.Decode(&form)
+	if err != nil && err != io.EOF {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	user := context.User(r.Context())
+	err = n.ns.MarkRead(user.ID, form.Type, form.TweetID)
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+}
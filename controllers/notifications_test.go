@@ -0,0 +1,29 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNotifications(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	testCases := []apiTestCase{
+		{
+			tag:    "notifications require a user",
+			method: "GET",
+			url:    "/notifications",
+			status: http.StatusUnauthorized,
+		},
+		{
+			tag:      "mark notifications with an unknown type as read",
+			method:   "POST",
+			url:      "/notifications/read",
+			body:     MarkReadForm{Type: "poke"},
+			status:   http.StatusUnprocessableEntity,
+			remember: tokenUserRequired,
+		},
+	}
+	runAPITests(t, router, testCases)
+}
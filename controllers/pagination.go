@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"chirp.com/errors"
+	"chirp.com/internal/utils"
+	"chirp.com/models"
+)
+
+// Page is the envelope every paginated list is rendered in.
+// NextCursor is empty on the last page and should be passed
+// back using the same before or after parameter that was used
+// to request this page.
+type Page struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// parsePage reads the limit, before and after query params.
+// If they are invalid an error is rendered and false is
+// returned.
+//
+// ?limit=20&before=:cursor
+func parsePage(w http.ResponseWriter, r *http.Request) (models.Page, bool) {
+	q := r.URL.Query()
+	var limit int
+	if s := q.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil {
+			utils.RenderAPIError(w, errors.InvalidData(err))
+			return models.Page{}, false
+		}
+	}
+	page, err := models.NewPage(limit, q.Get("before"), q.Get("after"))
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return models.Page{}, false
+	}
+	return page, true
+}
+
+func renderPage(w http.ResponseWriter, data interface{}, next string) {
+	utils.Render(w, Page{
+		Data:       data,
+		NextCursor: next,
+	})
+}
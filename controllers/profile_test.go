@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+// TestUpdateProfile changes each profile field and checks that
+// links under the old username redirect to the new one.
+func TestUpdateProfile(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	signup := SignUpForm{
+		Name:     "Profile Tester",
+		Username: "profiler",
+		Email:    "profiler@gmail.com",
+		Password: "password123",
+	}
+	res := testAPI(router, "POST", "/signup", signup, "", "")
+	if !assert.Equal(t, http.StatusOK, res.Code) {
+		t.Fatalf("signup failed: %s", res.Body.String())
+	}
+	remember := sessionCookie(res.Result().Cookies())
+
+	res = testAPI(router, "POST", "/tweets", TweetForm{Post: "before the rename"}, remember, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	var tweet struct {
+		ID uint `json:"id"`
+	}
+	json.NewDecoder(res.Body).Decode(&tweet)
+	tweetID := strconv.Itoa(int(tweet.ID))
+
+	runAPITests(t, router, []apiTestCase{
+		{
+			tag:    "requires a user",
+			method: "PATCH",
+			url:    "/me",
+			body:   ProfileForm{Name: strPtr("Nobody")},
+			status: http.StatusUnauthorized,
+		},
+		{
+			tag:      "change name",
+			method:   "PATCH",
+			url:      "/me",
+			body:     ProfileForm{Name: strPtr("  Profile Person ")},
+			status:   http.StatusOK,
+			want:     map[string]interface{}{"username": "profiler", "name": "Profile Person", "email": "profiler@gmail.com"},
+			remember: remember,
+		},
+		{
+			tag:      "name too long",
+			method:   "PATCH",
+			url:      "/me",
+			body:     ProfileForm{Name: strPtr("abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyz")},
+			status:   http.StatusUnprocessableEntity,
+			remember: remember,
+		},
+		{
+			tag:      "change email without the current password",
+			method:   "PATCH",
+			url:      "/me",
+			body:     ProfileForm{Email: strPtr("new@gmail.com")},
+			status:   http.StatusUnprocessableEntity,
+			remember: remember,
+		},
+		{
+			tag:      "change email with the wrong password",
+			method:   "PATCH",
+			url:      "/me",
+			body:     ProfileForm{Email: strPtr("new@gmail.com"), CurrentPassword: "wrong-password"},
+			status:   http.StatusUnprocessableEntity,
+			remember: remember,
+		},
+		{
+			tag:      "change email",
+			method:   "PATCH",
+			url:      "/me",
+			body:     ProfileForm{Email: strPtr("New@gmail.com"), CurrentPassword: "password123"},
+			status:   http.StatusOK,
+			want:     map[string]interface{}{"username": "profiler", "name": "Profile Person", "email": "new@gmail.com"},
+			remember: remember,
+		},
+		{
+			tag:      "username taken",
+			method:   "PATCH",
+			url:      "/me",
+			body:     ProfileForm{Username: strPtr("samsmith")},
+			status:   http.StatusUnprocessableEntity,
+			remember: remember,
+		},
+		{
+			tag:      "username must begin with a letter",
+			method:   "PATCH",
+			url:      "/me",
+			body:     ProfileForm{Username: strPtr("9lives")},
+			status:   http.StatusUnprocessableEntity,
+			remember: remember,
+		},
+		{
+			tag:      "change username",
+			method:   "PATCH",
+			url:      "/me",
+			body:     ProfileForm{Username: strPtr("Renamed")},
+			status:   http.StatusOK,
+			want:     map[string]interface{}{"username": "renamed", "name": "Profile Person", "email": "new@gmail.com"},
+			remember: remember,
+		},
+		{
+			tag:    "new username",
+			method: "GET",
+			url:    "/renamed",
+			status: http.StatusOK,
+		},
+		{
+			tag:      "change password",
+			method:   "PATCH",
+			url:      "/me",
+			body:     ProfileForm{Password: strPtr("newpassword123"), CurrentPassword: "password123"},
+			status:   http.StatusOK,
+			remember: remember,
+		},
+	})
+
+	tweets, err := services.Tweet.ByUsername("renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, tweets, 1, "tweets move to the new username")
+
+	redirects := map[string]string{
+		"/profiler":                "/renamed",
+		"/profiler/tweets?limit=1": "/renamed/tweets?limit=1",
+		"/profiler/" + tweetID:     "/renamed/" + tweetID,
+	}
+	for from, to := range redirects {
+		res := testAPI(router, "GET", from, nil, "", "")
+		assert.Equal(t, http.StatusTemporaryRedirect, res.Code, from)
+		assert.Equal(t, to, res.Header().Get("Location"), from)
+	}
+
+	res = testAPI(router, "POST", "/login", LoginForm{Email: "new@gmail.com", Password: "newpassword123"}, "", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+}
@@ -0,0 +1,76 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"chirp.com/context"
+	"chirp.com/errors"
+	"chirp.com/internal/utils"
+	"chirp.com/models"
+	"github.com/gorilla/mux"
+)
+
+type Search struct {
+	ss models.SearchService
+}
+
+func NewSearch(ss models.SearchService) *Search {
+	return &Search{
+		ss: ss,
+	}
+}
+
+// ServeSearchResource must be called before ServeUserResource
+// since /{username} would otherwise match /search.
+func ServeSearchResource(r *mux.Router, s *Search) {
+	r.HandleFunc("/search", s.Tweets).Methods("GET")
+	r.HandleFunc("/users/search", s.Users).Methods("GET")
+}
+
+// Tweets returns the tweets matching the query, best matches
+// first. Besides plain words the query supports "quoted
+// phrases", from:username, #tag, since:2006-01-02 and
+// until:2006-01-02.
+//
+// GET /search?q=:query&limit=20&before=:cursor
+func (s *Search) Tweets(w http.ResponseWriter, r *http.Request) {
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	tweets, next, err := s.ss.Tweets(r.URL.Query().Get("q"), viewerID(r), page)
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	renderPage(w, tweets, next)
+}
+
+// Users returns the users whose username or name matches the
+// query, for @mention autocomplete. Accounts the signed in user
+// follows are listed first.
+//
+// GET /users/search?q=:query&limit=10
+func (s *Search) Users(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var limit int
+	if l := q.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			utils.RenderAPIError(w, errors.InvalidData(err))
+			return
+		}
+	}
+	var callerID uint
+	if user := context.User(r.Context()); user != nil {
+		callerID = user.ID
+	}
+	users, err := s.ss.Users(q.Get("q"), callerID, limit)
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	utils.Render(w, users)
+}
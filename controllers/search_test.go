@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"chirp.com/models"
+)
+
+func TestSearch(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+	tt := newTweetsTester()
+	ut := newUsersTester()
+
+	testCases := []apiTestCase{
+		{
+			tag:    "search by word",
+			method: "GET",
+			url:    "/search?q=amazing",
+			status: http.StatusOK,
+			want:   toPage(toMap(tt.tweetsFromSetup[1006])),
+		},
+		{
+			tag:    "search by phrase",
+			method: "GET",
+			url:    "/search?q=%22first+tweet%22",
+			status: http.StatusOK,
+			want:   toPage(toMap(tt.tweetsFromSetup[1001])),
+		},
+		{
+			tag:    "search by word from a user",
+			method: "GET",
+			url:    "/search?q=tweet+from:duasings",
+			status: http.StatusOK,
+			want: toPage(
+				toMap(tt.tweetsFromSetup[1002]),
+				toMap(tt.tweetsFromSetup[1001]),
+			),
+		},
+		{
+			tag:    "search without a query",
+			method: "GET",
+			url:    "/search?q=",
+			status: http.StatusUnprocessableEntity,
+		},
+		{
+			tag:    "search with an invalid date",
+			method: "GET",
+			url:    "/search?q=tweet+since:yesterday",
+			status: http.StatusUnprocessableEntity,
+		},
+		{
+			tag:    "search users by username prefix",
+			method: "GET",
+			url:    "/users/search?q=@kan",
+			status: http.StatusOK,
+			want:   []map[string]interface{}{toMap(publicUser(ut.users[kanye_west]))},
+		},
+		{
+			tag:    "search users by a word of their name",
+			method: "GET",
+			url:    "/users/search?q=dylan",
+			status: http.StatusOK,
+			want:   []map[string]interface{}{toMap(publicUser(ut.users[bobbyd]))},
+		},
+		{
+			tag:    "search users with a typo",
+			method: "GET",
+			url:    "/users/search?q=samsmth",
+			status: http.StatusOK,
+			want:   []map[string]interface{}{toMap(publicUser(ut.users[samsmith]))},
+		},
+		{
+			tag:    "search users without a query",
+			method: "GET",
+			url:    "/users/search?q=",
+			status: http.StatusUnprocessableEntity,
+		},
+	}
+	runAPITests(t, router, testCases)
+}
+
+// publicUser strips the fields that user search leaves out.
+func publicUser(user *models.User) *models.User {
+	return &models.User{
+		Username: user.Username,
+		Name:     user.Name,
+	}
+}
@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"chirp.com/context"
+	"chirp.com/errors"
+	"chirp.com/internal/utils"
+	"chirp.com/middleware"
+	"chirp.com/models"
+	"github.com/gorilla/mux"
+)
+
+type Sessions struct {
+	ss models.SessionService
+}
+
+func NewSessions(ss models.SessionService) *Sessions {
+	return &Sessions{
+		ss: ss,
+	}
+}
+
+// ServeSessionResource must be called before
+// ServeUserResource since /{username} would otherwise match
+// /sessions.
+func ServeSessionResource(r *mux.Router, s *Sessions, m *middleware.RequireUser) {
+	r.HandleFunc("/sessions", m.ApplyFn(s.Index)).Methods("GET")
+	r.HandleFunc("/sessions/delete", m.ApplyFn(s.DeleteOthers)).Methods("POST")
+	r.HandleFunc("/sessions/{id:[0-9]+}/delete", m.ApplyFn(s.Delete)).Methods("POST")
+}
+
+// Index lists the devices the signed in user is signed in on,
+// most recently used first.
+//
+// GET /sessions
+func (s *Sessions) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	sessions, err := s.ss.ByUserID(user.ID)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	if current := context.Session(r.Context()); current != nil {
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == current.ID
+		}
+	}
+	utils.Render(w, sessions)
+}
+
+// Delete signs the user out of one of their sessions.
+//
+// POST /sessions/:id/delete
+func (s *Sessions) Delete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	user := context.User(r.Context())
+	err = s.ss.Delete(user.ID, uint(id))
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		utils.RenderAPIError(w, errors.NotFound("Session"))
+	default:
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+	}
+}
+
+// DeleteOthers signs the user out of every session but the
+// one making the request. Requests made with an API token
+// sign the user out of every session.
+//
+// POST /sessions/delete
+func (s *Sessions) DeleteOthers(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var keepID uint
+	if current := context.Session(r.Context()); current != nil {
+		keepID = current.ID
+	}
+	if err := s.ss.DeleteOthers(user.ID, keepID); err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+}
+
+// setSessionCookie sets the remember_token cookie. The cookie
+// is only marked Secure when the request came in over HTTPS so
+// signing in still works locally.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	cookie := http.Cookie{
+		Name:     "remember_token",
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+}
+
+// clientIP returns the IP address the request was made from.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"chirp.com/models"
+)
+
+func TestSessions(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	// vincetester, whose session is seeded with an ID of 2
+	token := models.APIToken{UserID: 6, Name: "script", Scope: models.ScopeWrite}
+	if err := services.APIToken.Create(&token); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []apiTestCase{
+		{
+			tag:    "list sessions requires a user",
+			method: "GET",
+			url:    "/sessions",
+			status: http.StatusUnauthorized,
+		},
+		{
+			tag:    "list sessions",
+			method: "GET",
+			url:    "/sessions",
+			status: http.StatusOK,
+			want: []map[string]interface{}{
+				toMap(models.Session{ID: 2, UserAgent: "test", IP: "127.0.0.1"}),
+			},
+			bearer: token.Token,
+		},
+		{
+			tag:    "revoke another user's session",
+			method: "POST",
+			url:    "/sessions/1/delete",
+			status: http.StatusNotFound,
+			bearer: token.Token,
+		},
+		{
+			tag:    "revoke session",
+			method: "POST",
+			url:    "/sessions/2/delete",
+			status: http.StatusOK,
+			bearer: token.Token,
+		},
+		{
+			tag:    "revoked session is gone",
+			method: "GET",
+			url:    "/sessions",
+			status: http.StatusOK,
+			want:   []map[string]interface{}{},
+			bearer: token.Token,
+		},
+		{
+			tag:    "revoke all other sessions",
+			method: "POST",
+			url:    "/sessions/delete",
+			status: http.StatusOK,
+			bearer: token.Token,
+		},
+	}
+	runAPITests(t, router, testCases)
+}
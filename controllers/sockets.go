@@ -0,0 +1,409 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"chirp.com/context"
+	"chirp.com/errors"
+	"chirp.com/internal/utils"
+	"chirp.com/middleware"
+	"chirp.com/models"
+	"chirp.com/pkg/websocket"
+	"github.com/gorilla/mux"
+)
+
+// Types of socket commands
+const (
+	SocketTweet       = "tweet"
+	SocketLike        = "like"
+	SocketFollow      = "follow"
+	SocketSubscribe   = "subscribe"
+	SocketUnsubscribe = "unsubscribe"
+)
+
+// Types of the messages sent on sockets. Event messages carry
+// the same events as /stream.
+const (
+	socketResult = "result"
+	socketError  = "error"
+	socketEvent  = "event"
+)
+
+const (
+	// socketCommandRate is the number of commands a second
+	// each connection may send, in bursts of up to
+	// socketCommandBurst.
+	socketCommandRate  = 5
+	socketCommandBurst = 20
+	// socketMaxCommand is the size of the largest command in
+	// bytes.
+	socketMaxCommand = 16 << 10
+	// socketSendBuffer is the number of replies that may wait
+	// to be written before the connection is dropped.
+	socketSendBuffer = 32
+	// socketMaxTopics is the number of users and tags each
+	// connection may subscribe to.
+	socketMaxTopics = 50
+)
+
+var (
+	// socketPingPeriod is how often the server pings clients.
+	socketPingPeriod = 30 * time.Second
+	// socketReadTimeout closes connections that send nothing,
+	// not even pongs, for longer than this.
+	socketReadTimeout = 2*socketPingPeriod + 10*time.Second
+	// socketWriteTimeout drops clients that stop reading.
+	socketWriteTimeout = 10 * time.Second
+)
+
+type Sockets struct {
+	tweets *Tweets
+	users  *Users
+	ss     models.StreamService
+	vm     *middleware.RequireVerifiedUser
+}
+
+// NewSockets runs the commands with the same code as the REST
+// actions of the tweets and users controllers. The verified
+// user middleware is checked for the commands its routes
+// require it for, and the user is looked up again with the
+// credentials the socket was opened with before every command.
+func NewSockets(tweets *Tweets, users *Users, ss models.StreamService, vm *middleware.RequireVerifiedUser) *Sockets {
+	return &Sockets{
+		tweets: tweets,
+		users:  users,
+		ss:     ss,
+		vm:     vm,
+	}
+}
+
+// ServeSocketResource must be called before ServeUserResource
+// since /{username} would otherwise match /ws.
+func ServeSocketResource(r *mux.Router, s *Sockets, m *middleware.RequireUser) {
+	r.HandleFunc("/ws", m.ApplyFn(s.Connect)).Methods("GET")
+}
+
+// SocketCommand is a JSON message sent by clients. Its ID is
+// echoed back in the reply so that clients can match them.
+//
+//	{"id": "1", "type": "tweet", "post": "Hello", "tags": ["intro"]}
+//	{"id": "2", "type": "like", "tweet_id": 1003}
+//	{"id": "3", "type": "follow", "username": "bobbyd"}
+//	{"id": "4", "type": "subscribe", "tag": "music"}
+//	{"id": "5", "type": "unsubscribe", "username": "bobbyd"}
+type SocketCommand struct {
+	ID       string   `json:"id"`
+	Type     string   `json:"type"`
+	Post     string   `json:"post,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	TweetID  uint     `json:"tweet_id,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Tag      string   `json:"tag,omitempty"`
+}
+
+// SocketMessage is sent by the server, either as the result or
+// error of a command or as an event.
+type SocketMessage struct {
+	Type    string           `json:"type"`
+	ID      string           `json:"id,omitempty"`
+	Event   string           `json:"event,omitempty"`
+	EventID uint64           `json:"event_id,omitempty"`
+	Data    interface{}      `json:"data,omitempty"`
+	Error   *errors.APIError `json:"error,omitempty"`
+}
+
+// SubscriptionResult is the result of subscribe and
+// unsubscribe commands.
+type SubscriptionResult struct {
+	Topic string `json:"topic"`
+}
+
+// Connect upgrades the request to a WebSocket that takes
+// commands and pushes the signed in user's events, along with
+// the tweets of the users and tags they subscribe to.
+// Connections that send commands too fast get errors back and
+// connections that do not keep up with their messages are
+// closed. Sockets are closed once the session or API token
+// they were opened with is revoked or the user deactivated.
+//
+// GET /ws
+func (s *Sockets) Connect(w http.ResponseWriter, r *http.Request) {
+	// cookies are sent along with cross-site WebSocket
+	// handshakes, so other sites must not be able to open them
+	if !sameOrigin(r) {
+		utils.RenderAPIError(w, errors.Forbidden("Cross-origin WebSocket connections are not allowed"))
+		return
+	}
+	conn, err := websocket.Upgrade(w, r)
+	if err == websocket.ErrBadHandshake {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	user := context.User(r.Context())
+	sock := &socket{
+		conn:  conn,
+		auth:  r,
+		user:  user,
+		sub:   s.ss.Subscribe(user.ID, 0),
+		send:  make(chan SocketMessage, socketSendBuffer),
+		done:  make(chan struct{}),
+		limit: commandLimiter{tokens: socketCommandBurst, last: time.Now()},
+	}
+	defer sock.sub.Close()
+	go s.writeLoop(sock)
+	s.readLoop(sock)
+	close(sock.done)
+	conn.Close(websocket.CloseNormal, "")
+}
+
+// sameOrigin reports whether the request has no Origin header,
+// as with clients other than browsers, or one matching its
+// host.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// socket is a connection of the signed in user. Auth is the
+// request that opened it, whose credentials are checked again
+// while it is open.
+type socket struct {
+	conn     *websocket.Conn
+	auth     *http.Request
+	user     *models.User
+	canWrite bool
+	sub      *models.Subscription
+	send     chan SocketMessage
+	done     chan struct{}
+	limit    commandLimiter
+}
+
+// recheck reloads the user of the socket. It returns false,
+// having closed the socket, once the user signed out.
+func (s *Sockets) recheck(sock *socket) (bool, *errors.APIError) {
+	user, canWrite, err := s.vm.Recheck(sock.auth)
+	if err != nil {
+		return true, errors.InternalServerError(err)
+	}
+	if user == nil {
+		sock.conn.Close(websocket.ClosePolicy, "signed out")
+		return false, nil
+	}
+	sock.user, sock.canWrite = user, canWrite
+	return true, nil
+}
+
+func (s *Sockets) readLoop(sock *socket) {
+	sock.conn.SetReadLimit(socketMaxCommand)
+	sock.conn.SetReadTimeout(socketReadTimeout)
+	for {
+		data, err := sock.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var cmd SocketCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			sock.reply(SocketMessage{Type: socketError, Error: errors.InvalidData(err)})
+			continue
+		}
+		if !sock.limit.allow(time.Now()) {
+			sock.reply(SocketMessage{Type: socketError, ID: cmd.ID, Error: errors.TooManyRequests(errCommandRateLimited)})
+			continue
+		}
+		open, apiErr := s.recheck(sock)
+		if !open {
+			return
+		}
+		if apiErr != nil {
+			sock.reply(SocketMessage{Type: socketError, ID: cmd.ID, Error: apiErr})
+			continue
+		}
+		result, apiErr := s.run(sock, &cmd)
+		if apiErr != nil {
+			sock.reply(SocketMessage{Type: socketError, ID: cmd.ID, Error: apiErr})
+			continue
+		}
+		sock.reply(SocketMessage{Type: socketResult, ID: cmd.ID, Data: result})
+	}
+}
+
+var errCommandRateLimited = fmt.Errorf("Too many commands, please slow down")
+
+// run dispatches the command to the code shared with the REST
+// actions.
+func (s *Sockets) run(sock *socket, cmd *SocketCommand) (interface{}, *errors.APIError) {
+	switch cmd.Type {
+	case SocketTweet, SocketLike, SocketFollow:
+		if !sock.canWrite {
+			return nil, errors.Forbidden("The API token provided is read only.")
+		}
+		if apiErr := s.vm.Check(sock.user); apiErr != nil {
+			return nil, apiErr
+		}
+	}
+	switch cmd.Type {
+	case SocketTweet:
+		return s.tweets.post(sock.user, TweetForm{Post: cmd.Post, Tags: cmd.Tags})
+	case SocketLike:
+		tweet, err := s.tweets.ts.ByIDVisibleTo(cmd.TweetID, sock.user.ID)
+		switch err {
+		case nil:
+		case models.ErrNotFound:
+			return nil, errors.NotFound("Tweet")
+		default:
+			return nil, errors.InternalServerError(err)
+		}
+		if apiErr := s.tweets.like(tweet, sock.user); apiErr != nil {
+			return nil, apiErr
+		}
+		return tweet, nil
+	case SocketFollow:
+		followee, apiErr := s.user(cmd.Username)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+		return s.users.follow(followee, sock.user)
+	case SocketSubscribe, SocketUnsubscribe:
+		topic, apiErr := s.topic(cmd)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+		if cmd.Type == SocketUnsubscribe {
+			sock.sub.Unwatch(topic)
+		} else {
+			if sock.sub.Topics() >= socketMaxTopics {
+				return nil, errors.InvalidData(fmt.Errorf("at most %d users and tags can be subscribed to", socketMaxTopics))
+			}
+			sock.sub.Watch(topic)
+		}
+		return &SubscriptionResult{Topic: topic}, nil
+	}
+	return nil, errors.InvalidData(fmt.Errorf("unknown command type %q", cmd.Type))
+}
+
+// topic returns the stream topic of the user or tag of a
+// subscribe command. Users have to exist while any tag can be
+// subscribed to before it is first used.
+func (s *Sockets) topic(cmd *SocketCommand) (string, *errors.APIError) {
+	switch {
+	case cmd.Username != "" && cmd.Tag != "":
+		return "", errors.InvalidData(fmt.Errorf("subscribe to either a username or a tag"))
+	case cmd.Username != "":
+		user, apiErr := s.user(cmd.Username)
+		if apiErr != nil {
+			return "", apiErr
+		}
+		return models.UserTopic(user.Username), nil
+	case cmd.Tag != "":
+		return models.TagTopic(utils.NormalizeText(strings.TrimPrefix(cmd.Tag, "#"))), nil
+	}
+	return "", errors.InvalidData(fmt.Errorf("a username or a tag is required"))
+}
+
+// user looks up an active user by username.
+func (s *Sockets) user(username string) (*models.User, *errors.APIError) {
+	user, err := s.users.us.ByUsername(username)
+	if err == models.ErrNotFound || (err == nil && user.Deactivated()) {
+		return nil, errors.NotFound("User")
+	}
+	if err != nil {
+		return nil, errors.InternalServerError(err)
+	}
+	return user, nil
+}
+
+// reply queues the message. Clients that leave too many
+// messages unread are dropped.
+func (sock *socket) reply(msg SocketMessage) {
+	select {
+	case sock.send <- msg:
+	default:
+		sock.conn.Close(websocket.CloseTryAgainLater, "too slow")
+	}
+}
+
+// writeLoop writes the replies and events and pings the client
+// until the connection is done. Closing the connection on
+// errors stops the read loop too. Idle sockets are checked
+// for a revoked session with every ping.
+func (s *Sockets) writeLoop(sock *socket) {
+	ping := time.NewTicker(socketPingPeriod)
+	defer ping.Stop()
+	for {
+		var msg SocketMessage
+		select {
+		case <-sock.done:
+			return
+		case msg = <-sock.send:
+		case e, ok := <-sock.sub.Events:
+			if !ok {
+				// the stream dropped the subscription for
+				// falling behind
+				sock.conn.Close(websocket.CloseTryAgainLater, "too slow")
+				return
+			}
+			msg = SocketMessage{Type: socketEvent, Event: e.Type, EventID: e.ID, Data: e.Data}
+		case <-ping.C:
+			// sock.user belongs to the read loop
+			user, _, err := s.vm.Recheck(sock.auth)
+			if err == nil && user == nil {
+				sock.conn.Close(websocket.ClosePolicy, "signed out")
+				return
+			}
+			sock.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+			if err := sock.conn.Ping(); err != nil {
+				sock.conn.Close(websocket.CloseGoingAway, "")
+				return
+			}
+			continue
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		sock.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+		if err := sock.conn.WriteMessage(data); err != nil {
+			sock.conn.Close(websocket.CloseGoingAway, "")
+			return
+		}
+	}
+}
+
+// commandLimiter is a token bucket holding up to
+// socketCommandBurst commands and refilled at
+// socketCommandRate a second.
+type commandLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *commandLimiter) allow(now time.Time) bool {
+	l.tokens += now.Sub(l.last).Seconds() * socketCommandRate
+	if l.tokens > socketCommandBurst {
+		l.tokens = socketCommandBurst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,235 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"chirp.com/errors"
+	"chirp.com/models"
+	"chirp.com/pkg/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// socketReply is a SocketMessage as clients decode it.
+type socketReply struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id"`
+	Event   string          `json:"event"`
+	EventID uint64          `json:"event_id"`
+	Data    json.RawMessage `json:"data"`
+	Error   errors.APIError `json:"error"`
+}
+
+// openSocket connects to /ws with the bearer token and sends
+// the messages it reads on the returned channel.
+func openSocket(t *testing.T, server *httptest.Server, bearer string) (*websocket.Conn, <-chan socketReply) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+bearer)
+	conn, err := websocket.Dial(server.URL+"/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies := make(chan socketReply, 64)
+	go func() {
+		defer close(replies)
+		for {
+			data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var reply socketReply
+			json.Unmarshal(data, &reply)
+			replies <- reply
+		}
+	}()
+	return conn, replies
+}
+
+// sendCommand sends the command and returns its reply, skipping
+// events and the replies to other commands.
+func sendCommand(t *testing.T, conn *websocket.Conn, replies <-chan socketReply, cmd SocketCommand) socketReply {
+	data, _ := json.Marshal(cmd)
+	if err := conn.WriteMessage(data); err != nil {
+		t.Fatal(err)
+	}
+	return nextReply(t, replies, func(r socketReply) bool {
+		return r.Type != socketEvent && r.ID == cmd.ID
+	})
+}
+
+func nextReply(t *testing.T, replies <-chan socketReply, match func(socketReply) bool) socketReply {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case r, ok := <-replies:
+			if !ok {
+				t.Fatal("socket closed waiting for a reply")
+			}
+			if match(r) {
+				return r
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for a reply")
+		}
+	}
+}
+
+// TestSockets has samsmith subscribe to a tag that duasings
+// tweets with over the socket, then like the tweet and follow
+// duasings.
+func TestSockets(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	sam := models.APIToken{UserID: 1, Name: "mobile", Scope: models.ScopeWrite}
+	dua := models.APIToken{UserID: 3, Name: "mobile", Scope: models.ScopeWrite}
+	for _, token := range []*models.APIToken{&sam, &dua} {
+		if err := services.APIToken.Create(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := websocket.Dial(server.URL+"/ws", nil)
+	if handshakeErr, ok := err.(*websocket.HandshakeError); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, http.StatusUnauthorized, handshakeErr.Response.StatusCode)
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+sam.Token)
+	header.Set("Origin", "https://evil.example.com")
+	_, err = websocket.Dial(server.URL+"/ws", header)
+	if handshakeErr, ok := err.(*websocket.HandshakeError); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, http.StatusForbidden, handshakeErr.Response.StatusCode)
+	}
+
+	samConn, samReplies := openSocket(t, server, sam.Token)
+	defer samConn.Close(websocket.CloseNormal, "")
+	duaConn, duaReplies := openSocket(t, server, dua.Token)
+	defer duaConn.Close(websocket.CloseNormal, "")
+
+	reply := sendCommand(t, samConn, samReplies, SocketCommand{ID: "1", Type: SocketSubscribe, Tag: "#LiveJazz"})
+	assert.Equal(t, socketResult, reply.Type)
+	assert.JSONEq(t, `{"topic":"#livejazz"}`, string(reply.Data))
+	reply = sendCommand(t, samConn, samReplies, SocketCommand{ID: "2", Type: SocketSubscribe, Username: "nobody_here"})
+	assert.Equal(t, socketError, reply.Type)
+	assert.Equal(t, http.StatusNotFound, reply.Error.Status)
+
+	reply = sendCommand(t, duaConn, duaReplies, SocketCommand{ID: "1", Type: SocketTweet, Post: "Late set tonight", Tags: []string{"livejazz"}})
+	if !assert.Equal(t, socketResult, reply.Type, "%+v", reply.Error) {
+		t.FailNow()
+	}
+	var tweet models.Tweet
+	json.Unmarshal(reply.Data, &tweet)
+	assert.Equal(t, "Late set tonight", tweet.Post)
+	assert.Equal(t, "duasings", tweet.Username)
+
+	// samsmith does not follow duasings but watches the tag
+	event := nextReply(t, samReplies, func(r socketReply) bool {
+		return r.Type == socketEvent && r.Event == models.StreamTweet
+	})
+	var streamed models.Tweet
+	json.Unmarshal(event.Data, &streamed)
+	assert.Equal(t, tweet.ID, streamed.ID)
+
+	reply = sendCommand(t, samConn, samReplies, SocketCommand{ID: "3", Type: SocketLike, TweetID: tweet.ID})
+	assert.Equal(t, socketResult, reply.Type, "%+v", reply.Error)
+	res := testAPI(router, "GET", "/duasings/"+strconv.Itoa(int(tweet.ID)), nil, "", "")
+	var liked models.Tweet
+	json.NewDecoder(res.Body).Decode(&liked)
+	assert.Equal(t, uint(1), liked.LikesCount)
+	reply = sendCommand(t, samConn, samReplies, SocketCommand{ID: "4", Type: SocketLike, TweetID: 999999})
+	assert.Equal(t, http.StatusNotFound, reply.Error.Status)
+
+	reply = sendCommand(t, samConn, samReplies, SocketCommand{ID: "5", Type: SocketFollow, Username: "duasings"})
+	assert.Equal(t, socketResult, reply.Type, "%+v", reply.Error)
+	res = testAPI(router, "GET", "/samsmith/following", nil, "", "")
+	assert.Contains(t, res.Body.String(), "duasings")
+
+	reply = sendCommand(t, samConn, samReplies, SocketCommand{ID: "6", Type: "retweet"})
+	assert.Equal(t, http.StatusBadRequest, reply.Error.Status)
+}
+
+func TestSocketRevoked(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	read := models.APIToken{UserID: 1, Name: "script", Scope: models.ScopeRead}
+	if err := services.APIToken.Create(&read); err != nil {
+		t.Fatal(err)
+	}
+	conn, replies := openSocket(t, server, read.Token)
+	defer conn.Close(websocket.CloseNormal, "")
+
+	reply := sendCommand(t, conn, replies, SocketCommand{ID: "1", Type: SocketTweet, Post: "Read only"})
+	assert.Equal(t, http.StatusForbidden, reply.Error.Status, "read tokens cannot run write commands")
+	reply = sendCommand(t, conn, replies, SocketCommand{ID: "2", Type: SocketSubscribe, Tag: "music"})
+	assert.Equal(t, socketResult, reply.Type, "%+v", reply.Error)
+
+	if err := services.APIToken.Delete(1, read.ID); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(SocketCommand{ID: "3", Type: SocketSubscribe, Tag: "jazz"})
+	if err := conn.WriteMessage(data); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case r, ok := <-replies:
+			if !ok {
+				return
+			}
+			assert.NotEqual(t, "3", r.ID, "commands are not run once the token is revoked")
+		case <-timeout:
+			t.Fatal("socket was not closed after the token was revoked")
+		}
+	}
+}
+
+func TestSocketRateLimit(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	sam := models.APIToken{UserID: 1, Name: "mobile", Scope: models.ScopeWrite}
+	if err := services.APIToken.Create(&sam); err != nil {
+		t.Fatal(err)
+	}
+	conn, replies := openSocket(t, server, sam.Token)
+	defer conn.Close(websocket.CloseNormal, "")
+
+	limited := 0
+	for i := 0; i < socketCommandBurst+5; i++ {
+		reply := sendCommand(t, conn, replies, SocketCommand{ID: strconv.Itoa(i), Type: SocketSubscribe, Tag: "music"})
+		if reply.Type == socketError {
+			assert.Equal(t, http.StatusTooManyRequests, reply.Error.Status)
+			limited++
+		}
+	}
+	assert.NotZero(t, limited, "commands over the burst are turned down")
+}
+
+func TestCommandLimiter(t *testing.T) {
+	now := time.Now()
+	l := commandLimiter{tokens: socketCommandBurst, last: now}
+	for i := 0; i < socketCommandBurst; i++ {
+		assert.True(t, l.allow(now), "command %d is within the burst", i)
+	}
+	assert.False(t, l.allow(now))
+	assert.True(t, l.allow(now.Add(time.Second/socketCommandRate)), "tokens are refilled over time")
+	assert.False(t, l.allow(now.Add(time.Second/socketCommandRate)))
+	// the bucket never holds more than the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < socketCommandBurst; i++ {
+		assert.True(t, l.allow(later))
+	}
+	assert.False(t, l.allow(later))
+}
@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"chirp.com/context"
+	"chirp.com/errors"
+	"chirp.com/internal/utils"
+	"chirp.com/middleware"
+	"chirp.com/models"
+	"github.com/gorilla/mux"
+)
+
+// streamHeartbeat is how often a comment is written to idle
+// streams so that proxies and clients keep them open.
+var streamHeartbeat = 15 * time.Second
+
+type Stream struct {
+	ss models.StreamService
+}
+
+func NewStream(ss models.StreamService) *Stream {
+	return &Stream{
+		ss: ss,
+	}
+}
+
+// ServeStreamResource must be called before ServeUserResource
+// since /{username} would otherwise match /stream.
+func ServeStreamResource(r *mux.Router, s *Stream, m *middleware.RequireUser) {
+	r.HandleFunc("/stream", m.ApplyFn(s.Show)).Methods("GET")
+}
+
+// Show pushes the signed in user's events as Server-Sent
+// Events: new home timeline tweets, notifications, changed
+// like and retweet counts and direct messages. Clients resume
+// after a disconnect by sending the last event ID they got,
+// which EventSource does on its own.
+//
+// GET /stream
+func (s *Stream) Show(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		utils.RenderAPIError(w, errors.InternalServerError(fmt.Errorf("controllers: streaming is not supported")))
+		return
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		var err error
+		lastID, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			utils.RenderAPIError(w, errors.InvalidData(err))
+			return
+		}
+	}
+
+	user := context.User(r.Context())
+	sub := s.ss.Subscribe(user.ID, lastID)
+	defer sub.Close()
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	// stops nginx from buffering the stream
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-sub.Events:
+			if !ok {
+				// the client fell behind and resumes once it
+				// reconnects
+				return
+			}
+			err = writeStreamEvent(w, e)
+		case <-heartbeat.C:
+			_, err = io.WriteString(w, ": heartbeat\n\n")
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeStreamEvent(w io.Writer, e models.StreamEvent) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
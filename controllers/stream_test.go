@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"chirp.com/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// openStream connects to /stream with the bearer token and
+// sends the events it reads on the returned channel. Comments
+// such as heartbeats are sent as events without a type.
+func openStream(t *testing.T, server *httptest.Server, bearer, lastEventID string) (<-chan sseEvent, func()) {
+	req, _ := http.NewRequest("GET", server.URL+"/stream", nil)
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Equal(t, http.StatusOK, res.StatusCode) {
+		t.FailNow()
+	}
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer close(events)
+		var e sseEvent
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				events <- e
+				e = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				e.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				e.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return events, func() { res.Body.Close() }
+}
+
+// nextEvent returns the next event of the type, skipping
+// heartbeats and other events.
+func nextEvent(t *testing.T, events <-chan sseEvent, eventType string) sseEvent {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatalf("stream closed waiting for a %s event", eventType)
+			}
+			if e.event == eventType {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a %s event", eventType)
+		}
+	}
+}
+
+// TestStream has vincetester, who follows bobbyd, and bobbyd
+// listen while bobbyd tweets and duasings likes the tweet.
+func TestStream(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+	server := httptest.NewServer(router)
+	defer server.Close()
+	heartbeat := streamHeartbeat
+	streamHeartbeat = 50 * time.Millisecond
+	defer func() { streamHeartbeat = heartbeat }()
+
+	vince := models.APIToken{UserID: 6, Name: "mobile", Scope: models.ScopeWrite}
+	bob := models.APIToken{UserID: 4, Name: "mobile", Scope: models.ScopeWrite}
+	dua := models.APIToken{UserID: 3, Name: "mobile", Scope: models.ScopeWrite}
+	for _, token := range []*models.APIToken{&vince, &bob, &dua} {
+		if err := services.APIToken.Create(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res := testAPI(router, "GET", "/stream", nil, "", "")
+	assert.Equal(t, http.StatusUnauthorized, res.Code, "the stream requires a user")
+
+	vinceEvents, closeVince := openStream(t, server, vince.Token, "")
+	bobEvents, closeBob := openStream(t, server, bob.Token, "")
+	defer closeBob()
+	// heartbeats are sent while the stream is idle
+	nextEvent(t, vinceEvents, "")
+
+	res = testAPI(router, "POST", "/tweets", TweetForm{Post: "Live from the studio"}, "", bob.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	var tweet models.Tweet
+	json.NewDecoder(res.Body).Decode(&tweet)
+	e := nextEvent(t, vinceEvents, models.StreamTweet)
+	var streamed models.Tweet
+	json.Unmarshal([]byte(e.data), &streamed)
+	assert.Equal(t, tweet.ID, streamed.ID)
+	assert.Equal(t, "Live from the studio", streamed.Post)
+
+	tweetURL := "/bobbyd/" + strconv.Itoa(int(tweet.ID))
+	res = testAPI(router, "POST", tweetURL+"/like", nil, "", dua.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	e = nextEvent(t, vinceEvents, models.StreamCounts)
+	lastEventID := e.id
+	var counts models.TweetCounts
+	json.Unmarshal([]byte(e.data), &counts)
+	assert.Equal(t, models.TweetCounts{ID: tweet.ID, LikesCount: 1}, counts)
+	e = nextEvent(t, bobEvents, models.StreamNotification)
+	var notification models.NotificationEvent
+	json.Unmarshal([]byte(e.data), &notification)
+	assert.Equal(t, "duasings", notification.Actor)
+	assert.Equal(t, "duasings liked your tweet", notification.Message)
+
+	// vincetester misses a message and gets it on resuming
+	closeVince()
+	res = testAPI(router, "POST", "/messages", MessageForm{To: []string{"vincetester"}, Body: "did you hear it?"}, "", bob.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	vinceEvents, closeVince = openStream(t, server, vince.Token, lastEventID)
+	defer closeVince()
+	e = nextEvent(t, vinceEvents, models.StreamMessage)
+	var msg models.Message
+	json.Unmarshal([]byte(e.data), &msg)
+	assert.Equal(t, "did you hear it?", msg.Body)
+	assert.Equal(t, "bobbyd", msg.Sender)
+}
@@ -26,7 +26,7 @@ func ServeTagResource(r *mux.Router, t *Tags, m *middleware.RequireUser) {
 	r.HandleFunc("/tags/{name}", t.Show).Methods("GET")
 }
 
-// GET /tags/{:name}
+// GET /tags/{:name}?limit=20&before=:cursor
 func (t *Tags) Show(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	name := vars["name"]
@@ -35,12 +35,16 @@ func (t *Tags) Show(w http.ResponseWriter, r *http.Request) {
 		utils.RenderAPIError(w, errors.NotFound("Tag"))
 		return
 	}
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
 
-	tweets, err := t.taggingS.GetTweets(tag.ID)
+	tweets, next, err := t.taggingS.GetTweetsPaginated(tag.ID, viewerID(r), page)
 	if err != nil {
 		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
 		return
 	}
-	utils.Render(w, tweets)
+	renderPage(w, tweets, next)
 
 }
@@ -23,12 +23,12 @@ func (tt *tweetsTester) createTagTestCases() (testCases []apiTestCase) {
 		method: "GET",
 		url:    "/tags/lakers",
 		status: http.StatusOK,
-		want: []map[string]interface{}{
-			toMap(tt.tweetsFromSetup[1001]),
-			toMap(tt.tweetsFromSetup[1002]),
-			toMap(tt.tweetsFromSetup[1003]),
+		want: toPage(
 			toMap(tt.tweetsFromSetup[1005]),
-		},
+			toMap(tt.tweetsFromSetup[1003]),
+			toMap(tt.tweetsFromSetup[1002]),
+			toMap(tt.tweetsFromSetup[1001]),
+		),
 	}
 
 	postTweetWithTags := apiTestCase{
@@ -66,10 +66,33 @@ func (tt *tweetsTester) createTagTestCases() (testCases []apiTestCase) {
 		remember: tokenUserRequired,
 	}
 
+	postTweetWithHashtags := apiTestCase{
+		tag:    "post tweet with hashtags and mentions",
+		method: "POST",
+		body: TweetForm{
+			Post: "Go #Lakers cc @bobbyd @nobody",
+			Tags: []string{"okc"},
+		},
+		url:    "/tweets",
+		status: http.StatusOK,
+		want: toMap(&models.Tweet{
+			ID:       2,
+			Username: vinceTester,
+			Post:     "Go #Lakers cc @bobbyd @nobody",
+			Tags:     []string{"okc", "lakers"},
+			Entities: models.Entities{
+				{Type: models.EntityHashtag, Text: "lakers", Start: 3, End: 10},
+				{Type: models.EntityMention, Text: "bobbyd", Start: 14, End: 21},
+			},
+		}),
+		remember: tokenUserRequired,
+	}
+
 	testCases = append(testCases,
 		getTweetsWithTag,
 		postTweetWithTags,
 		updateTags,
+		postTweetWithHashtags,
 	)
 
 	return testCases
@@ -0,0 +1,46 @@
+package controllers
+
+import (
+	"net/http"
+
+	"chirp.com/context"
+	"chirp.com/errors"
+	"chirp.com/internal/utils"
+	"chirp.com/middleware"
+	"chirp.com/models"
+	"github.com/gorilla/mux"
+)
+
+type Timeline struct {
+	tls models.TimelineService
+}
+
+func NewTimeline(tls models.TimelineService) *Timeline {
+	return &Timeline{
+		tls: tls,
+	}
+}
+
+// ServeTimelineResource must be called before ServeUserResource
+// since /{username} would otherwise match /home.
+func ServeTimelineResource(r *mux.Router, t *Timeline, m *middleware.RequireUser) {
+	r.HandleFunc("/home", m.ApplyFn(t.Home)).Methods("GET")
+}
+
+// Home returns the tweets and retweets of the users that the
+// signed in user follows, newest first.
+//
+// GET /home?limit=20&before=:cursor
+func (t *Timeline) Home(w http.ResponseWriter, r *http.Request) {
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	tweets, next, err := t.tls.Home(user.ID, page)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	renderPage(w, tweets, next)
+}
@@ -0,0 +1,28 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTimeline(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	testCases := []apiTestCase{
+		{
+			tag:    "home timeline requires a user",
+			method: "GET",
+			url:    "/home",
+			status: http.StatusUnauthorized,
+		},
+		{
+			tag:      "home timeline with invalid cursor",
+			method:   "GET",
+			url:      "/home?before=not-a-cursor",
+			status:   http.StatusUnprocessableEntity,
+			remember: tokenUserRequired,
+		},
+	}
+	runAPITests(t, router, testCases)
+}
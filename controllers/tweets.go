@@ -3,7 +3,7 @@ package controllers
 import (
 	"chirp.com/models"
 	"encoding/json"
-	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
@@ -16,31 +16,37 @@ import (
 	"github.com/gorilla/mux"
 )
 
-func ServeTweetResource(r *mux.Router, t *Tweets, m *middleware.RequireUser) {
-	r.HandleFunc("/tweets", m.ApplyFn(t.Create)).Methods("POST")
+func ServeTweetResource(r *mux.Router, t *Tweets, m *middleware.RequireUser, vm *middleware.RequireVerifiedUser) {
+	r.HandleFunc("/tweets", vm.ApplyFn(t.Create)).Methods("POST")
 	r.HandleFunc("/tweets/{_username}/{id:[0-9]+}/delete", m.ApplyFn(t.Delete)).Methods("POST")
 	r.HandleFunc("/{_username}/{id:[0-9]+}", t.Show).Methods("GET")
 	r.HandleFunc("/{_username}/{id:[0-9]+}/update", m.ApplyFn(t.Update)).Methods("POST")
-	r.HandleFunc("/{_username}/{id:[0-9]+}/like", m.ApplyFn(t.LikeTweet)).Methods("POST")
+	r.HandleFunc("/{_username}/{id:[0-9]+}/like", vm.ApplyFn(t.LikeTweet)).Methods("POST")
 	r.HandleFunc("/{_username}/{id:[0-9]+}/like/delete", m.ApplyFn(t.DeleteLike)).Methods("POST")
 	r.HandleFunc("/{_username}/{id:[0-9]+}/liked", t.GetUsersWhoLiked).Methods("GET")
-	r.HandleFunc("/{_username}/{id:[0-9]+}/retweet", m.ApplyFn(t.CreateRetweet)).Methods("POST")
+	r.HandleFunc("/{_username}/{id:[0-9]+}/retweet", vm.ApplyFn(t.CreateRetweet)).Methods("POST")
+	r.HandleFunc("/{_username}/{id:[0-9]+}/retweet/delete", m.ApplyFn(t.DeleteRetweet)).Methods("POST")
+	r.HandleFunc("/{_username}/{id:[0-9]+}/quotes", t.GetQuotes).Methods("GET")
+	r.HandleFunc("/{_username}/{id:[0-9]+}/reply", vm.ApplyFn(t.Reply)).Methods("POST")
+	r.HandleFunc("/{_username}/{id:[0-9]+}/thread", t.Thread).Methods("GET")
 }
 
+// Tweets leaves the taggings, the counts, the notifications,
+// streaming and webhooks to the subscribers of the events
+// published by the services.
 type Tweets struct {
-	us       models.UserService
-	ts       models.TweetService
-	ls       models.LikeService
-	tagS     models.TagService
-	taggingS models.TaggingService
+	us models.UserService
+	ts models.TweetService
+	ls models.LikeService
+	bs models.BlockService
 }
 
-func NewTweets(ts models.TweetService, ls models.LikeService, tagS models.TagService, taggingS models.TaggingService) *Tweets {
+func NewTweets(ts models.TweetService, ls models.LikeService, bs models.BlockService, us models.UserService) *Tweets {
 	return &Tweets{
-		ts:       ts,
-		ls:       ls,
-		tagS:     tagS,
-		taggingS: taggingS,
+		us: us,
+		ts: ts,
+		ls: ls,
+		bs: bs,
 	}
 }
 
@@ -62,74 +68,29 @@ func (t *Tweets) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := context.User(r.Context())
-	uniqueTags := unique.Strings(form.Tags, utils.NormalizeText)
-	tweet := models.Tweet{
-		Post:     form.Post,
-		Username: user.Username,
-		Tags:     uniqueTags,
-	}
-	err = t.ts.Create(&tweet)
-	if err != nil {
-		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+	tweet, apiErr := t.post(user, form)
+	if apiErr != nil {
+		utils.RenderAPIError(w, apiErr)
 		return
 	}
-
-	t.createTags(w, &tweet)
-	utils.Render(w, &tweet)
-}
-
-/*
-Creates the tags in the given tweet
- */
-func (t *Tweets) createTags(w http.ResponseWriter, tweet *models.Tweet) {
-	for _, name := range tweet.Tags {
-		tag := &models.Tag{
-			Name: name,
-		}
-		err := t.tagS.Create(tag)
-
-		if err != nil && err != models.ErrTagExists {
-			utils.RenderAPIError(w, errors.SetCustomError(err, tag, ""))
-			return
-		}
-
-		err = t.createTagging(tweet, tag)
-		if err != nil {
-			if pErr, ok := err.(errors.PublicError); ok {
-				fmt.Println("Tagging Service: ", pErr.Public(), ": ", tag.Name)
-			} else {
-				log.Println(err)
-			}
-			return
-		}
-
-	}
+	utils.Render(w, tweet)
 }
 
 /*
- Create taggings associated with the tweet and tag
+Creates the user's tweet. Shared by Create and the tweet
+command of the WebSocket API.
  */
-func (t *Tweets) createTagging(tweet *models.Tweet, tag *models.Tag) error {
-	tagging := &models.Tagging{
-		TweetID: tweet.ID,
-		TagID:   tag.ID,
-	}
-	err := t.taggingS.Create(tagging)
-	if err != nil {
-		return err
+func (t *Tweets) post(user *models.User, form TweetForm) (*models.Tweet, *errors.APIError) {
+	tweet := models.Tweet{
+		Post:     form.Post,
+		Username: user.Username,
+		Tags:     unique.Strings(form.Tags, utils.NormalizeText),
 	}
-	return nil
-}
-
-/*
-Deletes the tagging between tweet and tag
- */
-func (t *Tweets) deleteTagging(tweet *models.Tweet, tag *models.Tag) error {
-	err := t.taggingS.Delete(tag.ID, tweet.ID)
+	err := t.ts.Create(&tweet)
 	if err != nil {
-		return err
+		return nil, errors.SetCustomError(err, nil, "")
 	}
-	return nil
+	return &tweet, nil
 }
 
 /*
@@ -148,6 +109,7 @@ func (t *Tweets) Delete(w http.ResponseWriter, r *http.Request) {
 	deletedTweet, err := t.ts.Delete(tweet.ID)
 	if err != nil {
 		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
 	}
 	utils.Render(w, deletedTweet)
 }
@@ -199,78 +161,17 @@ func (t *Tweets) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	tweet.Post = form.Post
-	err = t.updateTags(tweet, w, form)
-	if err != nil {
-		return
-	}
-
+	// hashtags in the post are added to the tags when the
+	// tweet is saved
+	tweet.Tags = unique.Strings(form.Tags, utils.NormalizeText)
 	err = t.ts.Update(tweet)
 	if err != nil {
 		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
 		return
 	}
-	t.createTags(w, tweet)
 	utils.Render(w, tweet)
 }
 
-/*
-Update the tags associated with the tweet
- */
-func (t *Tweets) updateTags(tweet *models.Tweet, w http.ResponseWriter, form TweetForm) error {
-	newTags := unique.Strings(form.Tags, utils.NormalizeText)
-	taggings, err := t.taggingS.GetTaggings(tweet.ID)
-	if err != nil {
-		utils.RenderAPIError(w, errors.InternalServerError(err))
-		return err
-	}
-	var oldTags []string
-	for _, tagging := range taggings {
-		tag, err := t.tagS.ByID(tagging.TagID)
-		if err != nil {
-			fmt.Println(tagging.TagID, ": ", err)
-			continue
-		}
-		oldTags = append(oldTags, tag.Name)
-	}
-	taggingsToDelete := diff(newTags, oldTags)
-
-	for _, tagname := range taggingsToDelete {
-		tag, err := t.tagS.ByName(tagname)
-		if err != nil {
-			utils.RenderAPIError(w, errors.NotFound(tagname))
-			return err
-		}
-
-		err = t.deleteTagging(tweet, tag)
-		if err != nil {
-			utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
-			return err
-		}
-	}
-	tweet.Tags = newTags
-	return nil
-}
-
-/*
-Get differences between the two slices
-Note: Using inefficent algo at the moment. Can be optimized using a map.
- */
-func diff(a, b []string) (diff []string) {
-	for _, bStr := range b {
-		var match bool
-		for _, aStr := range a {
-			if aStr == bStr {
-				match = true
-				break
-			}
-		}
-		if !match {
-			diff = append(diff, bStr)
-		}
-	}
-	return diff
-}
-
 /*
 Add a like to the tweet
  */
@@ -280,20 +181,31 @@ func (t *Tweets) LikeTweet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := context.User(r.Context())
+	if apiErr := t.like(tweet, user); apiErr != nil {
+		utils.RenderAPIError(w, apiErr)
+		return
+	}
+	utils.Render(w, tweet)
+}
+
+/*
+Adds the user's like to the tweet and reloads it with the
+new count. Shared by LikeTweet and the like command of the
+WebSocket API.
+ */
+func (t *Tweets) like(tweet *models.Tweet, user *models.User) *errors.APIError {
+	if apiErr := t.ownerRejection(tweet, user, false); apiErr != nil {
+		return apiErr
+	}
 	like := models.Like{
 		UserID:  user.ID,
 		TweetID: tweet.ID,
 	}
 	err := t.ls.Create(&like)
 	if err != nil {
-		utils.RenderAPIError(w, errors.SetCustomError(err, &tweet, ""))
-		return
-	}
-	err = t.updateLikesCount(w, tweet)
-	if err != nil {
-		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return errors.SetCustomError(err, &tweet, "")
 	}
-	utils.Render(w, tweet)
+	return t.reload(tweet)
 }
 
 /*
@@ -317,65 +229,233 @@ func (t *Tweets) DeleteLike(w http.ResponseWriter, r *http.Request) {
 		utils.RenderAPIError(w, errors.InternalServerError(err))
 		return
 	}
-	err = t.updateLikesCount(w, tweet)
-	if err != nil {
-		utils.RenderAPIError(w, errors.InternalServerError(err))
+	if apiErr := t.reload(tweet); apiErr != nil {
+		utils.RenderAPIError(w, apiErr)
+		return
 	}
 	utils.Render(w, tweet)
 
 }
 
+// GET /:username/:id/liked?limit=20&before=:cursor
 func (t *Tweets) GetUsersWhoLiked(w http.ResponseWriter, r *http.Request) {
-	var users []models.User
 	tweet := t.tweetByID(w, r)
 	if tweet == nil {
 		return
 	}
-	users, err := t.ls.GetUsers(tweet.ID)
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	users, next, err := t.ls.GetUsersPaginated(tweet.ID, page)
 	if err != nil {
 		utils.RenderAPIError(w, errors.NotFound("Tweet"))
 		return
 	}
-	utils.Render(w, users)
+	renderPage(w, users, next)
 }
 
+// CreateRetweet retweets the tweet. If a post is provided a
+// quote tweet is created instead, which can carry its own tags.
+//
 // POST /tweets/:username/:id/retweet
 func (t *Tweets) CreateRetweet(w http.ResponseWriter, r *http.Request) {
 	tweet := t.tweetByID(w, r)
 	if tweet == nil {
 		return
 	}
+	// the body is optional for plain retweets
+	var form TweetForm
+	dec := json.NewDecoder(r.Body)
+	err := dec.Decode(&form)
+	if err != nil && err != io.EOF {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
 	user := context.User(r.Context())
+	if t.rejectedByOwner(w, tweet, user, true) {
+		return
+	}
 
 	retweet := models.Tweet{
 		Username:  user.Username,
 		Retweet:   tweet,
 		RetweetID: tweet.ID,
 	}
-	err := t.ts.Create(&retweet)
+	if form.Post != "" {
+		retweet.Post = form.Post
+		retweet.Quote = true
+		retweet.Tags = unique.Strings(form.Tags, utils.NormalizeText)
+	}
+	err = t.ts.Create(&retweet)
 	if err != nil {
 		utils.RenderAPIError(w, errors.SetCustomError(err, &retweet, ""))
 		return
 	}
+	// reload the original so its RetweetsCount is current
+	if original, err := t.ts.ByID(tweet.ID); err == nil {
+		retweet.Retweet = original
+	}
 	utils.Render(w, retweet)
 }
 
+// DeleteRetweet undoes the signed in user's plain retweet of
+// the tweet and renders the original tweet.
+//
+// POST /:username/:id/retweet/delete
+func (t *Tweets) DeleteRetweet(w http.ResponseWriter, r *http.Request) {
+	tweet := t.tweetByID(w, r)
+	if tweet == nil {
+		return
+	}
+	user := context.User(r.Context())
+	retweet, err := t.ts.ByUsernameAndRetweetID(user.Username, tweet.ID)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			utils.RenderAPIError(w, errors.NotFound("Retweet of this tweet"))
+		default:
+			utils.RenderAPIError(w, errors.InternalServerError(err))
+		}
+		return
+	}
+	_, err = t.ts.Delete(retweet.ID)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	tweet, err = t.ts.ByID(tweet.ID)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	utils.Render(w, tweet)
+}
+
+// GET /:username/:id/quotes?limit=20&before=:cursor
+func (t *Tweets) GetQuotes(w http.ResponseWriter, r *http.Request) {
+	tweet := t.tweetByID(w, r)
+	if tweet == nil {
+		return
+	}
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	quotes, next, err := t.ts.QuotesPaginated(tweet.ID, viewerID(r), page)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	renderPage(w, quotes, next)
+}
+
+// Reply is rejected when the user and the owner of the parent
+// tweet have blocked each other.
+//
+// POST /:username/:id/reply
+func (t *Tweets) Reply(w http.ResponseWriter, r *http.Request) {
+	parent := t.tweetByID(w, r)
+	if parent == nil {
+		return
+	}
+	var form TweetForm
+	dec := json.NewDecoder(r.Body)
+	err := dec.Decode(&form)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	user := context.User(r.Context())
+	if t.rejectedByOwner(w, parent, user, false) {
+		return
+	}
+	reply := models.Tweet{
+		Post:        form.Post,
+		Username:    user.Username,
+		Tags:        unique.Strings(form.Tags, utils.NormalizeText),
+		InReplyToID: parent.ID,
+	}
+	err = t.ts.Create(&reply)
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	utils.Render(w, &reply)
+}
+
+// GET /:username/:id/thread?limit=20&before=:cursor
+func (t *Tweets) Thread(w http.ResponseWriter, r *http.Request) {
+	tweet := t.tweetByID(w, r)
+	if tweet == nil {
+		return
+	}
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	thread, err := t.ts.Thread(tweet, viewerID(r), page)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	utils.Render(w, thread)
+}
+
 /* HELPER METHODS */
 
 /*
-Updates number of likes on the tweet
+Renders an error and returns true if the user and the owner
+of the tweet have blocked each other, or if the tweet is
+being retweeted and its owner is protected
+ */
+func (t *Tweets) rejectedByOwner(w http.ResponseWriter, tweet *models.Tweet, user *models.User, retweet bool) bool {
+	apiErr := t.ownerRejection(tweet, user, retweet)
+	if apiErr != nil {
+		utils.RenderAPIError(w, apiErr)
+	}
+	return apiErr != nil
+}
+
+/*
+Returns the error rejectedByOwner renders, or nil
  */
-func (t *Tweets) updateLikesCount(w http.ResponseWriter, tweet *models.Tweet) error {
-	tweet.LikesCount = t.ls.GetTotalLikes(tweet.ID)
-	err := t.ts.Update(tweet)
+func (t *Tweets) ownerRejection(tweet *models.Tweet, user *models.User, retweet bool) *errors.APIError {
+	owner, err := t.us.ByUsername(tweet.Username)
+	if err == models.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return errors.InternalServerError(err)
+	}
+	if retweet && owner.Protected {
+		return errors.Forbidden("Tweets of protected accounts cannot be retweeted")
+	}
+	blocked, err := t.bs.Blocked(owner.ID, user.ID)
 	if err != nil {
-		return err
+		return errors.InternalServerError(err)
 	}
+	if blocked {
+		return errors.Forbidden(errBlocked)
+	}
+	return nil
+}
+
+/*
+Loads the tweet again once its counts have been updated
+ */
+func (t *Tweets) reload(tweet *models.Tweet) *errors.APIError {
+	updated, err := t.ts.ByID(tweet.ID)
+	if err != nil {
+		return errors.InternalServerError(err)
+	}
+	*tweet = *updated
 	return nil
 }
 
 /*
-Get tweet by tweet's ID
+Get tweet by tweet's ID. The tweets of protected accounts the
+signed in user does not follow are not found.
  */
 func (t *Tweets) tweetByID(w http.ResponseWriter, r *http.Request) *models.Tweet {
 	vars := mux.Vars(r)
@@ -387,7 +467,16 @@ func (t *Tweets) tweetByID(w http.ResponseWriter, r *http.Request) *models.Tweet
 		utils.RenderAPIError(w, errors.InvalidData(err))
 		return nil
 	}
-	tweet, err := t.ts.ByID(id)
+	tweet, err := t.ts.ByIDVisibleTo(id, viewerID(r))
+	if err == nil && utils.NormalizeText(vars["_username"]) != tweet.Username {
+		// The author may have changed their username since the
+		// link was shared.
+		renamed, err := t.us.ByPreviousUsername(vars["_username"])
+		if err == nil && renamed.Username == tweet.Username {
+			redirectToUsername(w, r, "_username", renamed.Username)
+			return nil
+		}
+	}
 	if err != nil {
 		switch err {
 		case models.ErrNotFound:
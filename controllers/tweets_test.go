@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"net/http"
+	"sort"
 	"testing"
 
 	"chirp.com/models"
@@ -86,6 +87,10 @@ func (tt *tweetsTester) getTweetsByUsername(username string) (ret []map[string]i
 	for _, t := range tt.tweetsFromTests {
 		tweets = append(tweets, t)
 	}
+	// paginated lists are ordered newest first
+	sort.Slice(tweets, func(i, j int) bool {
+		return tweets[i].ID > tweets[j].ID
+	})
 	for _, t := range tweets {
 		if t.Username == username {
 			ret = append(ret, toMap(t))
@@ -107,7 +112,7 @@ func (tt *tweetsTester) createTestCases() (testCases []apiTestCase) {
 		method:   "GET",
 		url:      "/duasings/tweets",
 		status:   http.StatusOK,
-		want:     tt.getTweetsByUsername(duasings),
+		want:     toPage(tt.getTweetsByUsername(duasings)...),
 		remember: tokenUserRequired,
 	}
 	postTweet := apiTestCase{
@@ -170,22 +175,102 @@ func (tt *tweetsTester) createTestCases() (testCases []apiTestCase) {
 		method: "GET",
 		url:    "/bobbyd/1003/liked",
 		status: http.StatusOK,
-		want: []map[string]interface{}{
-			toMap(tt.users[samsmith], "email"),
-			toMap(tt.users[kanye_west], "email"),
+		want: toPage(
 			toMap(tt.users[duasings], "email"),
-		},
+			toMap(tt.users[kanye_west], "email"),
+			toMap(tt.users[samsmith], "email"),
+		),
 		remember: tokenUserRequired,
 	}
 
+	retweeted := *tt.tweetsFromSetup[1006]
+	retweeted.RetweetsCount = 1
+	wantRetweet := *tt.tweetsFromTests[2]
+	wantRetweet.Retweet = &retweeted
 	createRetweet := apiTestCase{
 		tag:      "retweet tweet",
 		method:   "POST",
 		url:      "/kanye_west/1006/retweet",
 		status:   http.StatusOK,
-		want:     toMap(tt.tweetsFromTests[2]),
+		want:     toMap(wantRetweet),
+		remember: tokenUserRequired,
+	}
+	deleteRetweet := apiTestCase{
+		tag:      "undo retweet",
+		method:   "POST",
+		url:      "/kanye_west/1006/retweet/delete",
+		status:   http.StatusOK,
+		want:     toMap(tt.tweetsFromSetup[1006]),
+		remember: tokenUserRequired,
+	}
+	deleteMissingRetweet := apiTestCase{
+		tag:      "undo retweet that does not exist",
+		method:   "POST",
+		url:      "/kanye_west/1006/retweet/delete",
+		status:   http.StatusNotFound,
+		remember: tokenUserRequired,
+	}
+
+	quoteTweet := apiTestCase{
+		tag:    "quote tweet",
+		method: "POST",
+		body: TweetForm{
+			Post: "quoting kanye",
+		},
+		url:    "/kanye_west/1006/retweet",
+		status: http.StatusOK,
+		want: toMap(&models.Tweet{
+			ID:        4,
+			Username:  vinceTester,
+			Post:      "quoting kanye",
+			Retweet:   &retweeted,
+			RetweetID: 1006,
+			Quote:     true,
+		}),
 		remember: tokenUserRequired,
 	}
+	getQuotes := apiTestCase{
+		tag:    "get quotes of tweet",
+		method: "GET",
+		url:    "/kanye_west/1006/quotes",
+		status: http.StatusOK,
+		want: toPage(toMap(&models.Tweet{
+			ID:        4,
+			Username:  vinceTester,
+			Post:      "quoting kanye",
+			RetweetID: 1006,
+			Quote:     true,
+		})),
+	}
+
+	replyTweet := apiTestCase{
+		tag:    "reply to tweet",
+		method: "POST",
+		body: TweetForm{
+			Post: "replying in testing!",
+		},
+		url:    "/duasings/1001/reply",
+		status: http.StatusOK,
+		want: toMap(&models.Tweet{
+			ID:             3,
+			Username:       vinceTester,
+			Post:           "replying in testing!",
+			InReplyToID:    1001,
+			ConversationID: 1001,
+		}),
+		remember: tokenUserRequired,
+	}
+	getThread := apiTestCase{
+		tag:    "get thread of tweet without replies",
+		method: "GET",
+		url:    "/bobbyd/1003/thread",
+		status: http.StatusOK,
+		want: toMap(&models.Thread{
+			Ancestors: []models.Tweet{},
+			Tweet:     tt.tweetsFromSetup[1003],
+			Replies:   []models.ThreadReply{},
+		}),
+	}
 
 	testCases = append(testCases,
 		getTweet,
@@ -197,6 +282,12 @@ func (tt *tweetsTester) createTestCases() (testCases []apiTestCase) {
 		deleteLike,
 		getUsersWhoLiked,
 		createRetweet,
+		replyTweet,
+		getThread,
+		quoteTweet,
+		getQuotes,
+		deleteRetweet,
+		deleteMissingRetweet,
 	)
 	return testCases
 }
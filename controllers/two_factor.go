@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"chirp.com/context"
+	"chirp.com/errors"
+	"chirp.com/internal/utils"
+)
+
+// TwoFactorChallenge is rendered by Login and CompleteReset in
+// place of the user when a code is needed to finish signing in.
+type TwoFactorChallenge struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+}
+
+// TwoFactorForm is used to finish signing in, in which case
+// the challenge token is required, and to enable or disable
+// two-factor authentication. Code is either a TOTP code or a
+// recovery code.
+type TwoFactorForm struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+// RecoveryCodes is rendered once two-factor authentication is
+// enabled. The codes cannot be shown again.
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// LoginTwoFactor exchanges the challenge token from Login and
+// a valid code for a session.
+//
+// POST /login/2fa
+func (u *Users) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var form TwoFactorForm
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&form); err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	user, err := u.us.CompleteLogin(form.ChallengeToken, form.Code)
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	if err := u.signIn(w, r, user); err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	utils.Render(w, user)
+}
+
+// EnrollTOTP generates a new secret for the signed in user to
+// add to their authenticator app.
+//
+// POST /2fa/enroll
+func (u *Users) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	enrollment, err := u.us.EnrollTOTP(user)
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	utils.Render(w, enrollment)
+}
+
+// EnableTOTP turns on two-factor authentication once the user
+// proves their app works by sending a code.
+//
+// POST /2fa/enable
+func (u *Users) EnableTOTP(w http.ResponseWriter, r *http.Request) {
+	var form TwoFactorForm
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&form); err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	user := context.User(r.Context())
+	codes, err := u.us.EnableTOTP(user, form.Code)
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	utils.Render(w, RecoveryCodes{RecoveryCodes: codes})
+}
+
+// DisableTOTP turns off two-factor authentication.
+//
+// POST /2fa/disable
+func (u *Users) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	var form TwoFactorForm
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&form); err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	user := context.User(r.Context())
+	if err := u.us.DisableTOTP(user, form.Code); err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+}
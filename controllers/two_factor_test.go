@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"chirp.com/pkg/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestTwoFactor walks through enrolling, signing in with a
+// recovery code, resetting the password and disabling
+// two-factor authentication.
+func TestTwoFactor(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	signup := SignUpForm{
+		Name:     "Two Factor",
+		Username: "twofactor",
+		Email:    "twofactor@gmail.com",
+		Password: "password123",
+	}
+	res := testAPI(router, "POST", "/signup", signup, "", "")
+	if !assert.Equal(t, http.StatusOK, res.Code) {
+		t.Fatalf("signup failed: %s", res.Body.String())
+	}
+	remember := sessionCookie(res.Result().Cookies())
+
+	res = testAPI(router, "POST", "/2fa/enroll", nil, remember, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	var enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	json.NewDecoder(res.Body).Decode(&enrollment)
+	assert.Contains(t, enrollment.URI, "otpauth://totp/")
+
+	res = testAPI(router, "POST", "/2fa/enable", TwoFactorForm{Code: "000000x"}, remember, "")
+	assert.Equal(t, http.StatusUnprocessableEntity, res.Code)
+
+	code, _ := totp.Code(enrollment.Secret, totp.Step(time.Now()))
+	res = testAPI(router, "POST", "/2fa/enable", TwoFactorForm{Code: code}, remember, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	var recovery RecoveryCodes
+	json.NewDecoder(res.Body).Decode(&recovery)
+	assert.Len(t, recovery.RecoveryCodes, 10)
+
+	login := LoginForm{Email: signup.Email, Password: signup.Password}
+	res = testAPI(router, "POST", "/login", login, "", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Empty(t, sessionCookie(res.Result().Cookies()))
+	var challenge TwoFactorChallenge
+	json.NewDecoder(res.Body).Decode(&challenge)
+	assert.True(t, challenge.TwoFactorRequired)
+
+	// the code used to enable cannot be used again
+	res = testAPI(router, "POST", "/login/2fa", TwoFactorForm{ChallengeToken: challenge.ChallengeToken, Code: code}, "", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, res.Code)
+
+	form := TwoFactorForm{ChallengeToken: challenge.ChallengeToken, Code: recovery.RecoveryCodes[0]}
+	res = testAPI(router, "POST", "/login/2fa", form, "", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.NotEmpty(t, sessionCookie(res.Result().Cookies()))
+
+	// challenges and recovery codes are single use
+	res = testAPI(router, "POST", "/login/2fa", form, "", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, res.Code)
+
+	// a password reset does not skip the second step
+	token, err := services.User.InitiateReset(signup.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset := ResetPwForm{Token: token, Password: "new-password123"}
+	res = testAPI(router, "POST", "/reset", reset, "", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Empty(t, sessionCookie(res.Result().Cookies()))
+	challenge = TwoFactorChallenge{}
+	json.NewDecoder(res.Body).Decode(&challenge)
+	assert.True(t, challenge.TwoFactorRequired)
+
+	form = TwoFactorForm{ChallengeToken: challenge.ChallengeToken, Code: recovery.RecoveryCodes[1]}
+	res = testAPI(router, "POST", "/login/2fa", form, "", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	remember = sessionCookie(res.Result().Cookies())
+
+	res = testAPI(router, "POST", "/2fa/disable", TwoFactorForm{Code: recovery.RecoveryCodes[0]}, remember, "")
+	assert.Equal(t, http.StatusUnprocessableEntity, res.Code)
+	res = testAPI(router, "POST", "/2fa/disable", TwoFactorForm{Code: recovery.RecoveryCodes[2]}, remember, "")
+	assert.Equal(t, http.StatusOK, res.Code)
+}
+
+func sessionCookie(cookies []*http.Cookie) string {
+	for _, cookie := range cookies {
+		if cookie.Name == "remember_token" {
+			return cookie.Value
+		}
+	}
+	return ""
+}
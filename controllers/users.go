@@ -12,12 +12,20 @@ import (
 	"chirp.com/internal/utils"
 	"chirp.com/middleware"
 	"chirp.com/models"
-	"chirp.com/pkg/rand"
 	"github.com/gorilla/mux"
 )
 
 //the handler doesn't use {username} to look up the Tweet, but the user should be redirected to the correct username if the {username} doesn't match the Tweet's Username
-func ServeUserResource(r *mux.Router, u *Users, m *middleware.RequireUser) {
+func ServeUserResource(r *mux.Router, u *Users, m *middleware.RequireUser, vm *middleware.RequireVerifiedUser) {
+	r.HandleFunc("/me", m.ApplyFn(u.UpdateProfile)).Methods("PATCH")
+	r.HandleFunc("/me", m.ApplyFn(u.Deactivate)).Methods("DELETE")
+	r.HandleFunc("/verify", u.Verify).Methods("GET")
+	r.HandleFunc("/verify/resend", m.ApplyFn(u.ResendVerification)).Methods("POST")
+	r.HandleFunc("/blocks", m.ApplyFn(u.GetBlocks)).Methods("GET")
+	r.HandleFunc("/mutes", m.ApplyFn(u.GetMutes)).Methods("GET")
+	r.HandleFunc("/follow_requests", m.ApplyFn(u.GetFollowRequests)).Methods("GET")
+	r.HandleFunc("/follow_requests/{username}/approve", m.ApplyFn(u.ApproveFollowRequest)).Methods("POST")
+	r.HandleFunc("/follow_requests/{username}/reject", m.ApplyFn(u.RejectFollowRequest)).Methods("POST")
 	r.HandleFunc("/{username}", u.Show).Methods("GET")
 	r.HandleFunc("/{username}/tweets", u.GetTweets).Methods("GET")
 	r.HandleFunc("/{username}/likes", u.GetLikes).Methods("GET")
@@ -25,9 +33,19 @@ func ServeUserResource(r *mux.Router, u *Users, m *middleware.RequireUser) {
 	r.HandleFunc("/{username}/following", u.GetFollowing).Methods("GET")
 	r.HandleFunc("/signup", u.Create).Methods("POST")
 	r.HandleFunc("/login", u.Login).Methods("POST")
+	r.HandleFunc("/login/2fa", u.LoginTwoFactor).Methods("POST")
+	r.HandleFunc("/2fa/enroll", m.ApplyFn(u.EnrollTOTP)).Methods("POST")
+	r.HandleFunc("/2fa/enable", m.ApplyFn(u.EnableTOTP)).Methods("POST")
+	r.HandleFunc("/2fa/disable", m.ApplyFn(u.DisableTOTP)).Methods("POST")
 	r.HandleFunc("/logout", m.ApplyFn(u.Logout)).Methods("POST")
-	r.HandleFunc("/{username}/follow", m.ApplyFn(u.FollowUser)).Methods("POST")
+	r.HandleFunc("/forgot", u.InitiateReset).Methods("POST")
+	r.HandleFunc("/reset", u.CompleteReset).Methods("POST")
+	r.HandleFunc("/{username}/follow", vm.ApplyFn(u.FollowUser)).Methods("POST")
 	r.HandleFunc("/{username}/follow/delete", m.ApplyFn(u.UnfollowUser)).Methods("POST")
+	r.HandleFunc("/{username}/block", m.ApplyFn(u.Block)).Methods("POST")
+	r.HandleFunc("/{username}/block/delete", m.ApplyFn(u.Unblock)).Methods("POST")
+	r.HandleFunc("/{username}/mute", m.ApplyFn(u.Mute)).Methods("POST")
+	r.HandleFunc("/{username}/mute/delete", m.ApplyFn(u.Unmute)).Methods("POST")
 }
 
 type Users struct {
@@ -35,6 +53,9 @@ type Users struct {
 	ts      models.TweetService
 	ls      models.LikeService
 	fs      models.FollowService
+	bs      models.BlockService
+	ms      models.MuteService
+	ss      models.SessionService
 	emailer *email.Client
 }
 
@@ -42,12 +63,15 @@ type Users struct {
 // This function will panic if the templates are not
 // parsed correctly, and should only be used during
 // initial setup.
-func NewUsers(us models.UserService, ls models.LikeService, fs models.FollowService, ts models.TweetService, emailer *email.Client) *Users {
+func NewUsers(us models.UserService, ls models.LikeService, fs models.FollowService, bs models.BlockService, ms models.MuteService, ts models.TweetService, ss models.SessionService, emailer *email.Client) *Users {
 	return &Users{
 		us:      us,
 		ls:      ls,
 		fs:      fs,
+		bs:      bs,
+		ms:      ms,
 		ts:      ts,
+		ss:      ss,
 		emailer: emailer,
 	}
 }
@@ -81,8 +105,12 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		utils.RenderAPIError(w, errors.SetCustomError(err, &user, ""))
 		return
 	}
-	// u.emailer.Welcome(user.Name, user.Email)
-	err = u.signIn(w, &user)
+	// A failed verification email should not fail the signup,
+	// the user can ask for another one.
+	if err := u.sendVerification(&user); err != nil {
+		log.Println(err)
+	}
+	err = u.signIn(w, r, &user)
 	if err != nil {
 		utils.RenderAPIError(w, errors.SetCustomError(err, &user, ""))
 		return
@@ -104,24 +132,48 @@ func (u *Users) Show(w http.ResponseWriter, r *http.Request) {
 	utils.Render(w, user)
 }
 
-//GET /tweets/:username/tweets
+// GetTweets lists no tweets to users on either side of a
+// block with the user, nor to users who do not follow a
+// protected user.
+//
+//GET /tweets/:username/tweets?limit=20&before=:cursor
 func (u *Users) GetTweets(w http.ResponseWriter, r *http.Request) {
 	user := u.getUser(w, r)
 	if user == nil {
 		return
 	}
-	tweets, err := u.ts.ByUsername(user.Username)
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	hidden, ok := u.tweetsHidden(w, r, user)
+	if !ok {
+		return
+	}
+	if hidden {
+		renderPage(w, []models.Tweet{}, "")
+		return
+	}
+	tweets, next, err := u.ts.ByUsernamePaginated(user.Username, page)
 	if err != nil {
 		utils.RenderAPIError(w, errors.InternalServerError(err))
 		return
 	}
-	utils.Render(w, tweets)
+	renderPage(w, tweets, next)
 }
 
 func (u *Users) getUser(w http.ResponseWriter, r *http.Request) *models.User {
 	vars := mux.Vars(r)
 	username := vars["username"]
 	user, err := u.us.ByUsername(username)
+	if err == models.ErrNotFound {
+		// Links under a username that was recently changed
+		// keep working for a while.
+		if renamed, err := u.us.ByPreviousUsername(username); err == nil {
+			redirectToUsername(w, r, "username", renamed.Username)
+			return nil
+		}
+	}
 	if err != nil {
 		switch err {
 		case models.ErrNotFound:
@@ -132,11 +184,136 @@ func (u *Users) getUser(w http.ResponseWriter, r *http.Request) *models.User {
 		}
 		return nil
 	}
+	if user.Deactivated() {
+		utils.RenderAPIError(w, errors.NotFound("User"))
+		return nil
+	}
 	return user
 }
 
+// redirectToUsername sends the client to the current route
+// with the username in the varName path variable replaced.
+func redirectToUsername(w http.ResponseWriter, r *http.Request, varName, username string) {
+	vars := mux.Vars(r)
+	pairs := make([]string, 0, len(vars)*2)
+	for k, v := range vars {
+		if k == varName {
+			v = username
+		}
+		pairs = append(pairs, k, v)
+	}
+	url, err := mux.CurrentRoute(r).URLPath(pairs...)
+	if err != nil {
+		log.Println(err)
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	url.RawQuery = r.URL.RawQuery
+	http.Redirect(w, r, url.String(), http.StatusTemporaryRedirect)
+}
+
+// ProfileForm only changes the fields that are present.
+type ProfileForm struct {
+	Name            *string `json:"name"`
+	Username        *string `json:"username"`
+	Email           *string `json:"email"`
+	Password        *string `json:"password"`
+	Protected       *bool   `json:"protected"`
+	DMFollowersOnly *bool   `json:"dm_followers_only"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+// UpdateProfile changes the signed in user's profile. A new
+// email address is sent a verification link, and a new
+// password signs the user out of their other sessions. Pending
+// follow requests are approved when an account stops being
+// protected.
+//
+// PATCH /me
+func (u *Users) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	var form ProfileForm
+	dec := json.NewDecoder(r.Body)
+	err := dec.Decode(&form)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	user := context.User(r.Context())
+	oldEmail := user.Email
+	wasProtected := user.Protected
+	err = u.us.UpdateProfile(user, models.ProfileUpdate{
+		Name:            form.Name,
+		Username:        form.Username,
+		Email:           form.Email,
+		Password:        form.Password,
+		Protected:       form.Protected,
+		DMFollowersOnly: form.DMFollowersOnly,
+		CurrentPassword: form.CurrentPassword,
+	})
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	if user.Email != oldEmail {
+		if err := u.sendVerification(user); err != nil {
+			log.Println(err)
+		}
+	}
+	if form.Password != nil {
+		if err := u.signOutOthers(r, user); err != nil {
+			utils.RenderAPIError(w, errors.InternalServerError(err))
+			return
+		}
+	}
+	if wasProtected && !user.Protected {
+		if err := u.fs.ApproveAll(user.ID); err != nil {
+			utils.RenderAPIError(w, errors.InternalServerError(err))
+			return
+		}
+	}
+	utils.Render(w, user)
+}
+
+// DeactivateForm confirms the deletion of an account.
+type DeactivateForm struct {
+	Password string `json:"password"`
+}
+
+// Deactivate signs the user out everywhere and deletes their
+// account once models.DeactivationPeriod is over, unless they
+// sign in again before then.
+//
+// DELETE /me
+func (u *Users) Deactivate(w http.ResponseWriter, r *http.Request) {
+	var form DeactivateForm
+	dec := json.NewDecoder(r.Body)
+	err := dec.Decode(&form)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	user := context.User(r.Context())
+	if err := u.us.Deactivate(user, form.Password); err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	setSessionCookie(w, r, "", time.Now())
+}
+
+// signOutOthers revokes every session of the user except the
+// one the request was made with, if any.
+func (u *Users) signOutOthers(r *http.Request, user *models.User) error {
+	if session := context.Session(r.Context()); session != nil {
+		return u.ss.DeleteOthers(user.ID, session.ID)
+	}
+	return u.ss.DeleteByUser(user.ID)
+}
+
 // Login is used to verify the provided email address and
 // password and then log the user in if they are correct.
+// Users with two-factor authentication enabled are not signed
+// in yet, instead a challenge token is returned that has to be
+// sent to /login/2fa along with their code.
 //
 // POST /login
 func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
@@ -159,7 +336,12 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = u.signIn(w, user)
+	if user.TwoFactorEnabled() {
+		u.renderChallenge(w, user)
+		return
+	}
+
+	err = u.signIn(w, r, user)
 	if err != nil {
 		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
 		return
@@ -168,71 +350,201 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 	utils.Render(w, user)
 }
 
-// signIn is used to sign the given user in via cookies
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-	if user.Remember == "" {
-		token, err := rand.RememberToken()
-		if err != nil {
-			return err
-		}
-		user.Remember = token
-		err = u.us.Update(user)
-		if err != nil {
-			return err
-		}
+// renderChallenge renders the challenge token that users with
+// two-factor authentication enabled have to send to /login/2fa
+// along with their code to be signed in.
+func (u *Users) renderChallenge(w http.ResponseWriter, user *models.User) {
+	token, err := u.us.CreateLoginChallenge(user)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
 	}
+	utils.Render(w, TwoFactorChallenge{
+		TwoFactorRequired: true,
+		ChallengeToken:    token,
+	})
+}
 
-	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    user.Remember,
-		HttpOnly: true,
+// signIn is used to sign the given user in via cookies. A new
+// session is created for every sign in so other devices stay
+// signed in.
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	// Signing in cancels the deletion of a deactivated account.
+	if err := u.us.Restore(user); err != nil {
+		return err
 	}
-	// fmt.Println("remember token: ", user.Remember)
-	// fmt.Println("remember hash: ", user.RememberHash)
-
-	http.SetCookie(w, &cookie)
+	session := models.Session{
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+	}
+	if err := u.ss.Create(&session); err != nil {
+		return err
+	}
+	setSessionCookie(w, r, session.Token, session.ExpiresAt)
 	return nil
 }
 
 // Logout is used to delete a users session cookie (remember_token)
-// and then will update the user resource with a new remmeber
-// token.
+// and then will revoke the session so the cookie cannot be
+// used again. Other devices stay signed in.
 //
 // POST /logout
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
-	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    "",
-		Expires:  time.Now(),
-		HttpOnly: true,
-	}
-	http.SetCookie(w, &cookie)
+	setSessionCookie(w, r, "", time.Now())
 
-	//updating the user's rememember token to ensure the user in inaccessable through the expired cookie
 	user := context.User(r.Context())
 	if user == nil {
 		utils.RenderAPIError(w, errors.NotFound("User"))
 		return
 	}
-	token, _ := rand.RememberToken()
-	user.Remember = token
-	u.us.Update(user)
+	session := context.Session(r.Context())
+	if session == nil {
+		return
+	}
+	if err := u.ss.Delete(user.ID, session.ID); err != nil && err != models.ErrNotFound {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+}
+
+// ResetPwForm is used by both steps of the password reset
+// flow. Only the email is needed to start a reset.
+type ResetPwForm struct {
+	Email    string `json:"email"`
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// InitiateReset creates a password reset token for the
+// provided email address and sends the token to it.
+//
+// The response is the same whether or not an account uses the
+// email, and whether or not it has hit the rate limit, so this
+// cannot be used to find out who has an account.
+//
+// POST /forgot
+func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
+	var form ResetPwForm
+	dec := json.NewDecoder(r.Body)
+	err := dec.Decode(&form)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	token, err := u.us.InitiateReset(form.Email)
+	if err != nil {
+		if err != models.ErrNotFound && err != models.ErrResetRateLimited {
+			utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		}
+		return
+	}
+	err = u.emailer.ResetPw(form.Email, token)
+	if err != nil {
+		log.Println(err)
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+}
+
+// CompleteReset swaps the password of the user who owns the
+// reset token, signs them out of every existing session and
+// signs them in with a new one. A reset does not get around
+// two-factor authentication, users who have it enabled are
+// given a challenge the same way Login does.
+//
+// POST /reset
+func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
+	var form ResetPwForm
+	dec := json.NewDecoder(r.Body)
+	err := dec.Decode(&form)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	user, err := u.us.CompleteReset(form.Token, form.Password)
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	if user.TwoFactorEnabled() {
+		u.renderChallenge(w, user)
+		return
+	}
+	err = u.signIn(w, r, user)
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	utils.Render(w, user)
 }
 
-// GET /:username/likes
+// GET /verify?token=:token
+func (u *Users) Verify(w http.ResponseWriter, r *http.Request) {
+	user, err := u.us.CompleteVerification(r.URL.Query().Get("token"))
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	utils.Render(w, user)
+}
+
+// POST /verify/resend
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.sendVerification(user)
+	switch err {
+	case nil:
+	case models.ErrVerificationRateLimited:
+		utils.RenderAPIError(w, errors.TooManyRequests(err))
+	default:
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+	}
+}
+
+func (u *Users) sendVerification(user *models.User) error {
+	token, err := u.us.InitiateVerification(user)
+	if err != nil {
+		return err
+	}
+	return u.emailer.Verify(user.Name, user.Email, token)
+}
+
+// GetLikes lists no tweets to users on either side of a
+// block with the user, nor to users who do not follow a
+// protected user. The tweets the viewer cannot see are left
+// out of the list.
+//
+// GET /:username/likes?limit=20&before=:cursor
 func (u *Users) GetLikes(w http.ResponseWriter, r *http.Request) {
 	user := u.getUser(w, r)
 	if user == nil {
 		return
 	}
-	likedTweets, err := u.ls.GetUserLikes(user.ID)
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	hidden, ok := u.tweetsHidden(w, r, user)
+	if !ok {
+		return
+	}
+	if hidden {
+		renderPage(w, []models.Tweet{}, "")
+		return
+	}
+	likedTweets, next, err := u.ls.GetUserLikesPaginated(user.ID, viewerID(r), page)
 	if err != nil {
 		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
 	}
-	user.LikedTweets = likedTweets
-	utils.Render(w, user)
+	renderPage(w, likedTweets, next)
 }
 
+// FollowUser follows the user, unless their account is
+// protected in which case a models.FollowRequest is created
+// and rendered instead.
+//
 // POST /:username/follow
 func (u *Users) FollowUser(w http.ResponseWriter, r *http.Request) {
 	followee := u.getUser(w, r)
@@ -240,30 +552,51 @@ func (u *Users) FollowUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	follower := context.User(r.Context())
+	followed, apiErr := u.follow(followee, follower)
+	if apiErr != nil {
+		utils.RenderAPIError(w, apiErr)
+		return
+	}
+	utils.Render(w, followed)
+}
+
+// follow returns the models.Follow or, for protected
+// followees, the models.FollowRequest it created. It is shared
+// by FollowUser and the follow command of the WebSocket API.
+func (u *Users) follow(followee, follower *models.User) (interface{}, *errors.APIError) {
 	// //can't follow yourself
 	if followee.ID == follower.ID {
-		utils.RenderAPIError(w, errors.SetCustomError(models.ErrFollowSelf, followee, ""))
-		return
+		return nil, errors.SetCustomError(models.ErrFollowSelf, followee, "")
+	}
+	blocked, err := u.bs.Blocked(followee.ID, follower.ID)
+	if err != nil {
+		return nil, errors.InternalServerError(err)
+	}
+	if blocked {
+		return nil, errors.Forbidden(errBlocked)
+	}
+	if followee.Protected {
+		return u.requestFollow(followee, follower)
 	}
 	follow := models.Follow{
 		UserID:     followee.ID,
 		User:       followee,
 		FollowerID: follower.ID,
 	}
-	err := u.fs.Create(&follow)
+	err = u.fs.Create(&follow)
 	if err != nil {
-		utils.RenderAPIError(w, errors.SetCustomError(err, followee, ""))
-		return
+		return nil, errors.SetCustomError(err, followee, "")
 	}
 	// err = u.updateFollowCount(w, followee, follower)
 	// if err != nil {
 	// 	utils.RenderAPIError(w, errors.InternalServerError(err))
 	// 	return
 	// }
-	utils.Render(w, &follow)
-
+	return &follow, nil
 }
 
+// UnfollowUser also cancels a pending follow request.
+//
 // POST /:username/follow/delete
 func (u *Users) UnfollowUser(w http.ResponseWriter, r *http.Request) {
 	follower := context.User(r.Context())
@@ -272,6 +605,12 @@ func (u *Users) UnfollowUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	follow, err := u.fs.GetFollow(followee.ID, follower.ID)
+	if err == models.ErrNotFound {
+		if _, err := u.fs.GetRequest(followee.ID, follower.ID); err == nil {
+			u.cancelFollowRequest(w, followee, follower)
+			return
+		}
+	}
 	if err != nil {
 		utils.RenderAPIError(w, errors.NotFound("Follow on this user"))
 		return
@@ -290,34 +629,40 @@ func (u *Users) UnfollowUser(w http.ResponseWriter, r *http.Request) {
 	utils.Render(w, followee)
 }
 
-// GET /:username/followers
+// GET /:username/followers?limit=20&before=:cursor
 func (u *Users) GetFollowers(w http.ResponseWriter, r *http.Request) {
 	user := u.getUser(w, r)
 	if user == nil {
 		return
 	}
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
 
-	followers, err := u.fs.GetUserFollowers(user.ID)
+	followers, next, err := u.fs.GetUserFollowersPaginated(user.ID, page)
 
 	if err != nil {
 		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
 		return
 	}
-	user.Followers = followers
-	utils.Render(w, user)
+	renderPage(w, followers, next)
 }
 
-// GET /:username/following
+// GET /:username/following?limit=20&before=:cursor
 func (u *Users) GetFollowing(w http.ResponseWriter, r *http.Request) {
 	user := u.getUser(w, r)
 	if user == nil {
 		return
 	}
-	following, err := u.fs.GetUserFollowing(user.ID)
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	following, next, err := u.fs.GetUserFollowingPaginated(user.ID, page)
 	if err != nil {
 		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
 		return
 	}
-	user.Following = following
-	utils.Render(w, user)
+	renderPage(w, following, next)
 }
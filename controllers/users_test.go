@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"chirp.com/models"
+	"github.com/stretchr/testify/assert"
 )
 
 //usernames
@@ -27,6 +28,40 @@ func TestUsers(t *testing.T) {
 	runAPITests(t, router, testCases)
 }
 
+// TestCompleteReset checks that a reset token is not used up
+// by a password that is rejected.
+func TestCompleteReset(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	signup := SignUpForm{
+		Name:     "Reset Tester",
+		Username: "resettester",
+		Email:    "resettester@gmail.com",
+		Password: "password123",
+	}
+	res := testAPI(router, "POST", "/signup", signup, "", "")
+	if !assert.Equal(t, http.StatusOK, res.Code) {
+		t.Fatalf("signup failed: %s", res.Body.String())
+	}
+	token, err := services.User.InitiateReset(signup.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, password := range []string{"", "short"} {
+		res = testAPI(router, "POST", "/reset", ResetPwForm{Token: token, Password: password}, "", "")
+		assert.Equal(t, http.StatusUnprocessableEntity, res.Code, "password %q", password)
+	}
+	res = testAPI(router, "POST", "/login", LoginForm{Email: signup.Email, Password: signup.Password}, "", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	reset := ResetPwForm{Token: token, Password: "new-password123"}
+	res = testAPI(router, "POST", "/reset", reset, "", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	res = testAPI(router, "POST", "/reset", reset, "", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, res.Code)
+}
+
 type usersTester struct {
 	users map[string]*models.User
 }
@@ -115,24 +150,42 @@ func (ut *usersTester) createTestCases() (testCases []apiTestCase) {
 		remember: tokenAuthTesting,
 	}
 
-	userWithFollowers := *ut.users[bobbyd]
-	userWithFollowers.Followers = []models.User{*ut.users[samsmith], *ut.users[kanye_west], *ut.users[vinceTester]}
 	getFollowers := apiTestCase{
 		tag:    "get user's followers",
 		method: "GET",
 		url:    "/bobbyd/followers",
 		status: http.StatusOK,
-		want:   toMap(userWithFollowers),
+		want: toPage(
+			toMap(ut.users[vinceTester]),
+			toMap(ut.users[kanye_west]),
+			toMap(ut.users[samsmith]),
+		),
 	}
 
-	userWithFollowing := *ut.users[duasings]
-	userWithFollowing.Following = []models.User{*ut.users[kanye_west]}
 	getFollowing := apiTestCase{
 		tag:    "get users that use is following",
 		method: "GET",
 		url:    "/duasings/following",
 		status: http.StatusOK,
-		want:   toMap(userWithFollowing),
+		want:   toPage(toMap(ut.users[kanye_west])),
+	}
+
+	firstPage := toPage(toMap(ut.users[vinceTester]), toMap(ut.users[kanye_west]))
+	firstPage["next_cursor"] = models.EncodeCursor(2)
+	getFollowersPage := apiTestCase{
+		tag:    "get first page of user's followers",
+		method: "GET",
+		url:    "/bobbyd/followers?limit=2",
+		status: http.StatusOK,
+		want:   firstPage,
+	}
+
+	getFollowersNextPage := apiTestCase{
+		tag:    "get next page of user's followers",
+		method: "GET",
+		url:    "/bobbyd/followers?limit=2&before=" + models.EncodeCursor(2),
+		status: http.StatusOK,
+		want:   toPage(toMap(ut.users[samsmith])),
 	}
 
 	followUser := apiTestCase{
@@ -159,6 +212,27 @@ func (ut *usersTester) createTestCases() (testCases []apiTestCase) {
 		remember: tokenUserRequired,
 	}
 
+	resetWithInvalidToken := apiTestCase{
+		tag:    "reset password with invalid token",
+		method: "POST",
+		body: ResetPwForm{
+			Token:    "not-a-real-token",
+			Password: "new-super-secret-password",
+		},
+		url:    "/reset",
+		status: http.StatusUnprocessableEntity,
+	}
+
+	forgotUnknownEmail := apiTestCase{
+		tag:    "forgot password does not reveal unknown emails",
+		method: "POST",
+		body: ResetPwForm{
+			Email: "nobody@example.com",
+		},
+		url:    "/forgot",
+		status: http.StatusOK,
+	}
+
 	testCases = append(testCases,
 		getUser,
 		signUpUser,
@@ -166,8 +240,12 @@ func (ut *usersTester) createTestCases() (testCases []apiTestCase) {
 		logoutUser,
 		getFollowers,
 		getFollowing,
+		getFollowersPage,
+		getFollowersNextPage,
 		followUser,
 		deleteFollow,
+		resetWithInvalidToken,
+		forgotUnknownEmail,
 	)
 	return testCases
 }
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"chirp.com/middleware"
+	"chirp.com/models"
+)
+
+func TestVerifyEmail(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+
+	// vincetester
+	user, err := services.User.ByID(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := services.User.InitiateVerification(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// use up the rest of the resend limit
+	for i := 0; i < 2; i++ {
+		if _, err := services.User.InitiateVerification(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	apiToken := models.APIToken{UserID: 6, Name: "mobile", Scope: models.ScopeWrite}
+	if err := services.APIToken.Create(&apiToken); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []apiTestCase{
+		{
+			tag:    "invalid token",
+			method: "GET",
+			url:    "/verify?token=not-a-token",
+			status: http.StatusUnprocessableEntity,
+		},
+		{
+			tag:    "missing token",
+			method: "GET",
+			url:    "/verify",
+			status: http.StatusUnprocessableEntity,
+		},
+		{
+			tag:    "resend requires a user",
+			method: "POST",
+			url:    "/verify/resend",
+			status: http.StatusUnauthorized,
+		},
+		{
+			tag:    "resend is rate limited",
+			method: "POST",
+			url:    "/verify/resend",
+			status: http.StatusTooManyRequests,
+			bearer: apiToken.Token,
+		},
+		{
+			tag:    "verify",
+			method: "GET",
+			url:    "/verify?token=" + token,
+			status: http.StatusOK,
+		},
+		{
+			tag:    "token is single use",
+			method: "GET",
+			url:    "/verify?token=" + token,
+			status: http.StatusUnprocessableEntity,
+		},
+		{
+			tag:    "resend when already verified",
+			method: "POST",
+			url:    "/verify/resend",
+			status: http.StatusUnprocessableEntity,
+			bearer: apiToken.Token,
+		},
+	}
+	runAPITests(t, router, testCases)
+
+	user, err = services.User.ByID(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.EmailVerifiedAt == nil {
+		t.Error("email_verified_at was not set")
+	}
+}
+
+func TestRequireVerifiedUser(t *testing.T) {
+	services, _ := getSetup()
+	defer services.Close()
+
+	userMw := middleware.NewUserMw(services.User, services.APIToken, services.Session)
+	requireUserMw := middleware.NewRequireUserMw(userMw)
+	requireVerifiedMw := middleware.NewRequireVerifiedUserMw(requireUserMw, true)
+	router := userMw.Apply(requireVerifiedMw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// vincetester
+	apiToken := models.APIToken{UserID: 6, Name: "mobile", Scope: models.ScopeWrite}
+	if err := services.APIToken.Create(&apiToken); err != nil {
+		t.Fatal(err)
+	}
+
+	runAPITests(t, router, []apiTestCase{
+		{
+			tag:    "requires a user",
+			method: "POST",
+			url:    "/tweets",
+			status: http.StatusUnauthorized,
+		},
+		{
+			tag:    "unverified user",
+			method: "POST",
+			url:    "/tweets",
+			status: http.StatusForbidden,
+			bearer: apiToken.Token,
+		},
+	})
+
+	user, err := services.User.ByID(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := services.User.InitiateVerification(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := services.User.CompleteVerification(token); err != nil {
+		t.Fatal(err)
+	}
+
+	runAPITests(t, router, []apiTestCase{
+		{
+			tag:    "verified user",
+			method: "POST",
+			url:    "/tweets",
+			status: http.StatusOK,
+			bearer: apiToken.Token,
+		},
+	})
+}
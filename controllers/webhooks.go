@@ -0,0 +1,187 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"chirp.com/context"
+	"chirp.com/errors"
+	"chirp.com/internal/utils"
+	"chirp.com/middleware"
+	"chirp.com/models"
+	"github.com/gorilla/mux"
+)
+
+type Webhooks struct {
+	ws     models.WebhookService
+	admins map[uint]bool
+}
+
+// NewWebhooks takes the IDs of the admins, who are the only
+// users allowed to register global webhooks.
+func NewWebhooks(ws models.WebhookService, admins []uint) *Webhooks {
+	wh := Webhooks{
+		ws:     ws,
+		admins: make(map[uint]bool, len(admins)),
+	}
+	for _, id := range admins {
+		wh.admins[id] = true
+	}
+	return &wh
+}
+
+// ServeWebhookResource must be called before ServeUserResource
+// since /{username} would otherwise match /webhooks.
+func ServeWebhookResource(r *mux.Router, wh *Webhooks, m *middleware.RequireUser) {
+	r.HandleFunc("/webhooks", m.ApplyFn(wh.Index)).Methods("GET")
+	r.HandleFunc("/webhooks", m.ApplyFn(wh.Create)).Methods("POST")
+	r.HandleFunc("/webhooks/{id:[0-9]+}/delete", m.ApplyFn(wh.Delete)).Methods("POST")
+	r.HandleFunc("/webhooks/{id:[0-9]+}/deliveries", m.ApplyFn(wh.Deliveries)).Methods("GET")
+	r.HandleFunc("/webhooks/{id:[0-9]+}/deliveries/{delivery_id:[0-9]+}/redeliver", m.ApplyFn(wh.Redeliver)).Methods("POST")
+}
+
+// Index lists the signed in user's webhooks, newest first.
+//
+// GET /webhooks
+func (wh *Webhooks) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	webhooks, err := wh.ws.ByUserID(user.ID)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	utils.Render(w, webhooks)
+}
+
+// WebhookForm is used to register a webhook. Events are any of
+// models.WebhookEvents.
+type WebhookForm struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Global bool     `json:"global"`
+}
+
+// Create renders the new webhook including the secret its
+// deliveries are signed with.
+//
+// POST /webhooks
+func (wh *Webhooks) Create(w http.ResponseWriter, r *http.Request) {
+	var form WebhookForm
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&form); err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	user := context.User(r.Context())
+	if form.Global && !wh.admins[user.ID] {
+		utils.RenderAPIError(w, errors.Forbidden("Only admins can register global webhooks"))
+		return
+	}
+	webhook := models.Webhook{
+		UserID: user.ID,
+		URL:    form.URL,
+		Events: form.Events,
+		Global: form.Global,
+	}
+	if err := wh.ws.Create(&webhook); err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	utils.Render(w, webhook)
+}
+
+// Delete removes one of the signed in user's webhooks along
+// with its delivery log.
+//
+// POST /webhooks/:id/delete
+func (wh *Webhooks) Delete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	user := context.User(r.Context())
+	err = wh.ws.Delete(user.ID, uint(id))
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		utils.RenderAPIError(w, errors.NotFound("Webhook"))
+	default:
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+	}
+}
+
+// Deliveries returns the delivery log of the webhook, newest
+// first.
+//
+// GET /webhooks/:id/deliveries?limit=20&before=:cursor
+func (wh *Webhooks) Deliveries(w http.ResponseWriter, r *http.Request) {
+	webhook := wh.webhookByID(w, r)
+	if webhook == nil {
+		return
+	}
+	page, ok := parsePage(w, r)
+	if !ok {
+		return
+	}
+	deliveries, next, err := wh.ws.DeliveriesPaginated(webhook.ID, page)
+	if err != nil {
+		utils.RenderAPIError(w, errors.SetCustomError(err, nil, ""))
+		return
+	}
+	renderPage(w, deliveries, next)
+}
+
+// Redeliver sends the payload of a delivery again, as a new
+// delivery, and renders it while it is pending.
+//
+// POST /webhooks/:id/deliveries/:delivery_id/redeliver
+func (wh *Webhooks) Redeliver(w http.ResponseWriter, r *http.Request) {
+	webhook := wh.webhookByID(w, r)
+	if webhook == nil {
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["delivery_id"])
+	if err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return
+	}
+	delivery, err := wh.ws.DeliveryByID(webhook.ID, uint(id))
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		utils.RenderAPIError(w, errors.NotFound("Delivery"))
+		return
+	default:
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	redelivery, err := wh.ws.Redeliver(webhook, delivery)
+	if err != nil {
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+		return
+	}
+	utils.Render(w, redelivery)
+}
+
+// webhookByID renders an error and returns nil unless the
+// webhook in the URL belongs to the signed in user.
+func (wh *Webhooks) webhookByID(w http.ResponseWriter, r *http.Request) *models.Webhook {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RenderAPIError(w, errors.InvalidData(err))
+		return nil
+	}
+	user := context.User(r.Context())
+	webhook, err := wh.ws.ByID(user.ID, uint(id))
+	switch err {
+	case nil:
+		return webhook
+	case models.ErrNotFound:
+		utils.RenderAPIError(w, errors.NotFound("Webhook"))
+	default:
+		utils.RenderAPIError(w, errors.InternalServerError(err))
+	}
+	return nil
+}
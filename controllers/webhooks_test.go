@@ -0,0 +1,217 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"chirp.com/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type receivedHook struct {
+	event     string
+	signature string
+	body      string
+}
+
+// webhookReceiver sends the deliveries it gets on the returned
+// channel.
+func webhookReceiver() (*httptest.Server, <-chan receivedHook) {
+	received := make(chan receivedHook, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- receivedHook{
+			event:     r.Header.Get(models.WebhookEventHeader),
+			signature: r.Header.Get(models.WebhookSignatureHeader),
+			body:      string(body),
+		}
+	}))
+	return server, received
+}
+
+func nextHook(t *testing.T, received <-chan receivedHook) receivedHook {
+	select {
+	case hook := <-received:
+		return hook
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a delivery")
+	}
+	return receivedHook{}
+}
+
+// TestWebhooks has bobbyd get his tweets liked and samsmith, an
+// admin, watch every new tweet.
+func TestWebhooks(t *testing.T) {
+	services, router := getSetup()
+	defer services.Close()
+	receiver, received := webhookReceiver()
+	defer receiver.Close()
+
+	sam := models.APIToken{UserID: 1, Name: "bot", Scope: models.ScopeWrite}
+	bob := models.APIToken{UserID: 4, Name: "bot", Scope: models.ScopeWrite}
+	dua := models.APIToken{UserID: 3, Name: "mobile", Scope: models.ScopeWrite}
+	for _, token := range []*models.APIToken{&sam, &bob, &dua} {
+		if err := services.APIToken.Create(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runAPITests(t, router, []apiTestCase{
+		{
+			tag:    "webhooks require a user",
+			method: "GET",
+			url:    "/webhooks",
+			status: http.StatusUnauthorized,
+		},
+		{
+			tag:    "webhook URL must be http or https",
+			method: "POST",
+			url:    "/webhooks",
+			body:   WebhookForm{URL: "ftp://example.com", Events: []string{models.WebhookFollowed}},
+			status: http.StatusUnprocessableEntity,
+			bearer: bob.Token,
+		},
+		{
+			tag:    "webhook events must be known",
+			method: "POST",
+			url:    "/webhooks",
+			body:   WebhookForm{URL: receiver.URL, Events: []string{"tweet.edited"}},
+			status: http.StatusUnprocessableEntity,
+			bearer: bob.Token,
+		},
+		{
+			tag:    "only admins can register global webhooks",
+			method: "POST",
+			url:    "/webhooks",
+			body:   WebhookForm{URL: receiver.URL, Events: []string{models.WebhookTweetCreated}, Global: true},
+			status: http.StatusForbidden,
+			bearer: bob.Token,
+		},
+	})
+
+	res := testAPI(router, "POST", "/webhooks", WebhookForm{
+		URL:    receiver.URL,
+		Events: []string{models.WebhookTweetLiked, models.WebhookFollowed},
+	}, "", bob.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	var bobHook models.Webhook
+	json.NewDecoder(res.Body).Decode(&bobHook)
+	assert.NotEmpty(t, bobHook.Secret)
+	res = testAPI(router, "POST", "/webhooks", WebhookForm{
+		URL:    receiver.URL,
+		Events: []string{models.WebhookTweetCreated},
+		Global: true,
+	}, "", sam.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	var samHook models.Webhook
+	json.NewDecoder(res.Body).Decode(&samHook)
+
+	// samsmith's global webhook gets bobbyd's tweet
+	res = testAPI(router, "POST", "/tweets", TweetForm{Post: "New single out now"}, "", bob.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	var tweet models.Tweet
+	json.NewDecoder(res.Body).Decode(&tweet)
+	hook := nextHook(t, received)
+	assert.Equal(t, models.WebhookTweetCreated, hook.event)
+	assert.Equal(t, models.SignWebhook(samHook.Secret, hook.body), hook.signature)
+	var payload struct {
+		Event string              `json:"event"`
+		Data  models.WebhookEvent `json:"data"`
+	}
+	json.Unmarshal([]byte(hook.body), &payload)
+	assert.Equal(t, "bobbyd", payload.Data.User)
+	assert.Equal(t, tweet.ID, payload.Data.Tweet.ID)
+
+	tweetURL := "/bobbyd/" + strconv.Itoa(int(tweet.ID))
+	res = testAPI(router, "POST", tweetURL+"/like", nil, "", dua.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	hook = nextHook(t, received)
+	assert.Equal(t, models.WebhookTweetLiked, hook.event)
+	assert.Equal(t, models.SignWebhook(bobHook.Secret, hook.body), hook.signature)
+	json.Unmarshal([]byte(hook.body), &payload)
+	assert.Equal(t, models.WebhookEvent{User: "bobbyd", Actor: "duasings", Tweet: payload.Data.Tweet}, payload.Data)
+	assert.Equal(t, tweet.ID, payload.Data.Tweet.ID)
+
+	deliveriesURL := "/webhooks/" + strconv.Itoa(int(bobHook.ID)) + "/deliveries"
+	var deliveries struct {
+		Data []models.WebhookDelivery `json:"data"`
+	}
+	// the log is updated once the receiver has responded
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res = testAPI(router, "GET", deliveriesURL, nil, "", bob.Token)
+		assert.Equal(t, http.StatusOK, res.Code)
+		json.NewDecoder(res.Body).Decode(&deliveries)
+		if len(deliveries.Data) == 1 && deliveries.Data[0].Status == models.DeliverySucceeded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivery was not logged as succeeded: %+v", deliveries.Data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	delivery := deliveries.Data[0]
+	assert.Equal(t, models.WebhookTweetLiked, delivery.Event)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Equal(t, http.StatusOK, delivery.ResponseCode)
+	assert.Equal(t, hook.body, delivery.Payload)
+
+	redeliverURL := deliveriesURL + "/" + strconv.Itoa(int(delivery.ID)) + "/redeliver"
+	res = testAPI(router, "POST", redeliverURL, nil, "", bob.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	redelivered := nextHook(t, received)
+	assert.Equal(t, hook.body, redelivered.body)
+	assert.Equal(t, hook.signature, redelivered.signature)
+
+	runAPITests(t, router, []apiTestCase{
+		{
+			tag:    "deliveries of another user's webhook",
+			method: "GET",
+			url:    deliveriesURL,
+			status: http.StatusNotFound,
+			bearer: sam.Token,
+		},
+		{
+			tag:    "redeliver a delivery that does not exist",
+			method: "POST",
+			url:    deliveriesURL + "/100000/redeliver",
+			status: http.StatusNotFound,
+			bearer: bob.Token,
+		},
+		{
+			tag:    "delete another user's webhook",
+			method: "POST",
+			url:    "/webhooks/" + strconv.Itoa(int(bobHook.ID)) + "/delete",
+			status: http.StatusNotFound,
+			bearer: sam.Token,
+		},
+		{
+			tag:    "delete webhook",
+			method: "POST",
+			url:    "/webhooks/" + strconv.Itoa(int(bobHook.ID)) + "/delete",
+			status: http.StatusOK,
+			bearer: bob.Token,
+		},
+		{
+			tag:    "deleted webhook has no deliveries",
+			method: "GET",
+			url:    deliveriesURL,
+			status: http.StatusNotFound,
+			bearer: bob.Token,
+		},
+	})
+
+	// bobbyd's follows are no longer sent anywhere
+	res = testAPI(router, "POST", "/bobbyd/follow", nil, "", dua.Token)
+	assert.Equal(t, http.StatusOK, res.Code)
+	select {
+	case hook := <-received:
+		t.Errorf("unexpected delivery of %s", hook.event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
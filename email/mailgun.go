@@ -2,6 +2,7 @@ package email
 
 import (
 	"fmt"
+	"log"
 	"net/url"
 
 	mailgun "gopkg.in/mailgun/mailgun-go.v1"
@@ -11,6 +12,8 @@ const (
 	welcomeSubject = "Welcome to LensLocked.com!"
 	resetSubject   = "Instructions for resetting your password."
 	resetBaseURL   = "https://www.chirp.com/reset"
+	verifySubject  = "Please verify your email address."
+	verifyBaseURL  = "https://www.chirp.com/verify"
 )
 
 const welcomeText = `Hi there!
@@ -63,6 +66,30 @@ Best,<br/>
 LensLocked Support<br/>
 `
 
+const verifyTextTmpl = `Hi there!
+
+Thanks for signing up! Please follow the link below to verify your email address:
+
+%s
+
+The link expires in 48 hours. If you didn't create an account you can safely ignore this email.
+
+Best,
+Chirp Support
+`
+
+const verifyHTMLTmpl = `Hi there!<br/>
+<br/>
+Thanks for signing up! Please follow the link below to verify your email address:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+The link expires in 48 hours. If you didn't create an account you can safely ignore this email.<br/>
+<br/>
+Best,<br/>
+Chirp Support<br/>
+`
+
 func WithMailgun(domain, apiKey, publicKey string) ClientConfig {
 	return func(c *Client) {
 		mg := mailgun.NewMailgun(domain, apiKey, publicKey)
@@ -89,6 +116,9 @@ func NewClient(opts ...ClientConfig) *Client {
 	return &client
 }
 
+// Client sends emails through Mailgun. A client created
+// without WithMailgun logs the emails instead, which is useful
+// in development and tests.
 type Client struct {
 	from string
 	mg   mailgun.Mailgun
@@ -97,8 +127,17 @@ type Client struct {
 func (c *Client) Welcome(toName, toEmail string) error {
 	message := mailgun.NewMessage(c.from, welcomeSubject, welcomeText, buildEmail(toName, toEmail))
 	message.SetHtml(welcomeHTML)
-	_, _, err := c.mg.Send(message)
-	return err
+	return c.send(message, welcomeText)
+}
+
+func (c *Client) Verify(toName, toEmail, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	verifyUrl := verifyBaseURL + "?" + v.Encode()
+	verifyText := fmt.Sprintf(verifyTextTmpl, verifyUrl)
+	message := mailgun.NewMessage(c.from, verifySubject, verifyText, buildEmail(toName, toEmail))
+	message.SetHtml(fmt.Sprintf(verifyHTMLTmpl, verifyUrl, verifyUrl))
+	return c.send(message, verifyText)
 }
 
 func (c *Client) ResetPw(toEmail, token string) error {
@@ -109,6 +148,14 @@ func (c *Client) ResetPw(toEmail, token string) error {
 	message := mailgun.NewMessage(c.from, resetSubject, resetText, toEmail)
 	resetHTML := fmt.Sprintf(resetHTMLTmpl, resetUrl, resetUrl, token)
 	message.SetHtml(resetHTML)
+	return c.send(message, resetText)
+}
+
+func (c *Client) send(message *mailgun.Message, text string) error {
+	if c.mg == nil {
+		log.Printf("email: mailgun is not configured, not sending:\n%s", text)
+		return nil
+	}
 	_, _, err := c.mg.Send(message)
 	return err
 }
@@ -34,11 +34,26 @@ func Unauthorized(msg ...string) *APIError {
 	return NewAPIError(http.StatusUnauthorized, "UNAUTHORIZED", Params{"error": errMsg})
 }
 
+// Forbidden creates a new API error representing a request the user is not allowed to make (HTTP 403)
+func Forbidden(msg string) *APIError {
+	return NewAPIError(http.StatusForbidden, "FORBIDDEN", Params{"error": msg})
+}
+
 // InvalidData converts a data validation error into an API error (HTTP 400)
 func InvalidData(err error) *APIError {
 	return NewAPIError(http.StatusBadRequest, "INVALID_DATA", Params{"message": err.Error()})
 }
 
+// RequestTooLarge creates a new API error representing a request body over the size limit (HTTP 413)
+func RequestTooLarge(err error) *APIError {
+	return NewAPIError(http.StatusRequestEntityTooLarge, "REQUEST_TOO_LARGE", Params{"error": err.Error()})
+}
+
+// TooManyRequests creates a new API error representing a rate limited request (HTTP 429)
+func TooManyRequests(err error) *APIError {
+	return NewAPIError(http.StatusTooManyRequests, "TOO_MANY_REQUESTS", Params{"error": err.Error()})
+}
+
 // GeneralErrorMsg is displayed when any random error
 // is encountered by our backend.
 const GeneralErrorMsg = "Something went wrong. Please try again, and contact us if the problem persists."
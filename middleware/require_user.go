@@ -11,7 +11,9 @@ import (
 )
 
 type User struct {
-	userService models.UserService
+	userService     models.UserService
+	apiTokenService models.APITokenService
+	sessionService  models.SessionService
 }
 
 func (mw *User) Apply(next http.Handler) http.HandlerFunc {
@@ -30,6 +32,10 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 			next(w, r)
 			return
 		}
+		if token, ok := bearerToken(r); ok {
+			mw.applyToken(w, r, token, next)
+			return
+		}
 		cookie, err := r.Cookie("remember_token")
 		if err != nil {
 
@@ -37,21 +43,111 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		user, err := mw.userService.ByRemember(cookie.Value)
+		session, err := mw.sessionService.ByToken(cookie.Value)
 		if err != nil {
 
 			next(w, r)
 			return
 		}
+		user, err := mw.userService.ByID(session.UserID)
+		if err != nil {
+
+			next(w, r)
+			return
+		}
+		mw.sessionService.Seen(session)
 
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
+		ctx = context.WithSession(ctx, session)
 		r = r.WithContext(ctx)
 		next(w, r)
 
 	})
 }
 
+// applyToken authenticates the request with an API token.
+// Unlike a stale cookie, an invalid token is rejected rather
+// than treated as a signed out request, and read tokens may
+// only be used for GET requests.
+func (mw *User) applyToken(w http.ResponseWriter, r *http.Request, token string, next http.HandlerFunc) {
+	t, err := mw.apiTokenService.ByToken(token)
+	if err != nil {
+		utils.RenderAPIError(w, errors.Unauthorized("The API token provided is not valid."))
+		return
+	}
+	if !t.CanWrite() && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		utils.RenderAPIError(w, errors.Forbidden("The API token provided is read only."))
+		return
+	}
+	user, err := mw.userService.ByID(t.UserID)
+	if err != nil || user.Deactivated() {
+		utils.RenderAPIError(w, errors.Unauthorized("The API token provided is not valid."))
+		return
+	}
+	mw.apiTokenService.Touch(t.ID)
+
+	ctx := r.Context()
+	ctx = context.WithUser(ctx, user)
+	r = r.WithContext(ctx)
+	next(w, r)
+}
+
+// Recheck looks the user up again with the session cookie or
+// API token of a request that was already authenticated. It
+// is used by long lived connections such as WebSockets, which
+// must stop acting for the user once they sign out, reset
+// their password, revoke the token or deactivate their
+// account. The user is nil when the credentials are no longer
+// valid, and canWrite reports whether a token may be used to
+// change data.
+func (mw *User) Recheck(r *http.Request) (user *models.User, canWrite bool, err error) {
+	userID := uint(0)
+	canWrite = true
+	if token, ok := bearerToken(r); ok {
+		t, err := mw.apiTokenService.ByToken(token)
+		if err == models.ErrNotFound {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		userID, canWrite = t.UserID, t.CanWrite()
+	} else {
+		cookie, err := r.Cookie("remember_token")
+		if err != nil {
+			return nil, false, nil
+		}
+		session, err := mw.sessionService.ByToken(cookie.Value)
+		if err == models.ErrNotFound {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		userID = session.UserID
+	}
+	user, err = mw.userService.ByID(userID)
+	if err == models.ErrNotFound || (err == nil && user.Deactivated()) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return user, canWrite, nil
+}
+
+// bearerToken reads the token from an
+// "Authorization: Bearer <token>" header.
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
+
 // RequireUser assumes that User middleware has already been run
 // otherwise it will not work correctly.
 type RequireUser struct {
@@ -78,9 +174,11 @@ func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
-func NewUserMw(u models.UserService) User {
+func NewUserMw(u models.UserService, ts models.APITokenService, ss models.SessionService) User {
 	return User{
-		userService: u,
+		userService:     u,
+		apiTokenService: ts,
+		sessionService:  ss,
 	}
 }
 
@@ -89,3 +187,81 @@ func NewRequireUserMw(userMw User) RequireUser {
 		User: userMw,
 	}
 }
+
+// RequireVerifiedUser is the same as RequireUser but when the
+// verified email policy is turned on it also stops users who
+// have not verified their email address.
+type RequireVerifiedUser struct {
+	RequireUser
+	required bool
+}
+
+// Apply assumes that User middleware has already been run
+// otherwise it will not work correctly.
+func (mw *RequireVerifiedUser) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn assumes that User middleware has already been run
+// otherwise it will not work correctly.
+func (mw *RequireVerifiedUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.RequireUser.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if apiErr := mw.Check(user); apiErr != nil {
+			utils.RenderAPIError(w, apiErr)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// Check returns the error rendered to users who have not
+// verified their email address when they have to, or nil. It
+// is used where there is no request to apply the middleware
+// to, such as WebSocket commands.
+func (mw *RequireVerifiedUser) Check(user *models.User) *errors.APIError {
+	if mw.required && user.EmailVerifiedAt == nil {
+		return errors.Forbidden("You must verify your email address to perform this action.")
+	}
+	return nil
+}
+
+// NewRequireVerifiedUserMw only checks that the email address
+// is verified when required is true.
+func NewRequireVerifiedUserMw(requireUserMw RequireUser, required bool) RequireVerifiedUser {
+	return RequireVerifiedUser{
+		RequireUser: requireUserMw,
+		required:    required,
+	}
+}
+
+// RequireSession is the same as RequireUser but it stops
+// requests authenticated with an API token, so the actions it
+// guards can only be taken by a user who signed in.
+type RequireSession struct {
+	RequireUser
+}
+
+// Apply assumes that User middleware has already been run
+// otherwise it will not work correctly.
+func (mw *RequireSession) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn assumes that User middleware has already been run
+// otherwise it will not work correctly.
+func (mw *RequireSession) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.RequireUser.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		if context.Session(r.Context()) == nil {
+			utils.RenderAPIError(w, errors.Forbidden("API tokens cannot be used to perform this action."))
+			return
+		}
+		next(w, r)
+	})
+}
+
+func NewRequireSessionMw(requireUserMw RequireUser) RequireSession {
+	return RequireSession{
+		RequireUser: requireUserMw,
+	}
+}
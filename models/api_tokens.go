@@ -0,0 +1,213 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"chirp.com/pkg/hash"
+	"chirp.com/pkg/rand"
+	"github.com/jinzhu/gorm"
+)
+
+// Scopes of API tokens. Write tokens can also read.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// APIToken is a personal access token used by clients that
+// cannot hold on to the remember_token cookie. Token is only
+// set when the token is created, afterwards only its hash is
+// known.
+type APIToken struct {
+	ID         uint       `gorm:"primary_key" json:"id"`
+	UserID     uint       `gorm:"not null;index" json:"-"`
+	Name       string     `gorm:"not null" json:"name"`
+	Scope      string     `gorm:"not null" json:"scope"`
+	Token      string     `gorm:"-" json:"token,omitempty"`
+	TokenHash  string     `gorm:"not null;unique_index" json:"-"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// CanWrite reports whether the token may be used for requests
+// that change data.
+func (t *APIToken) CanWrite() bool {
+	return t.Scope == ScopeWrite
+}
+
+type APITokenService interface {
+	APITokenDB
+}
+
+type APITokenDB interface {
+	// ByToken looks up a token by its raw value.
+	ByToken(token string) (*APIToken, error)
+	ByUserID(userID uint) ([]APIToken, error)
+	// Create generates the token, which is returned in the
+	// Token field, and stores its hash.
+	Create(t *APIToken) error
+	// Touch records that the token has just been used.
+	Touch(id uint) error
+	// Delete revokes the user's token.
+	Delete(userID, id uint) error
+}
+
+func NewAPITokenService(db *gorm.DB, hmacKey string) APITokenService {
+	return &apiTokenService{
+		APITokenDB: &apiTokenValidator{
+			APITokenDB: &apiTokenGorm{db},
+			hmac:       hash.NewHMAC(hmacKey),
+		},
+	}
+}
+
+type apiTokenService struct {
+	APITokenDB
+}
+
+type apiTokenValidator struct {
+	APITokenDB
+	hmac hash.HMAC
+}
+
+func (atv *apiTokenValidator) ByToken(token string) (*APIToken, error) {
+	t := APIToken{Token: token}
+	if err := runAPITokenValFuncs(&t, atv.tokenRequired, atv.hmacToken); err != nil {
+		return nil, err
+	}
+	return atv.APITokenDB.ByToken(t.TokenHash)
+}
+
+func (atv *apiTokenValidator) Create(t *APIToken) error {
+	err := runAPITokenValFuncs(t,
+		atv.userIDRequired,
+		atv.normalizeName,
+		atv.nameRequired,
+		atv.scopeValid,
+		atv.setToken,
+		atv.hmacToken,
+	)
+	if err != nil {
+		return err
+	}
+	return atv.APITokenDB.Create(t)
+}
+
+func (atv *apiTokenValidator) Delete(userID, id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return atv.APITokenDB.Delete(userID, id)
+}
+
+type apiTokenValFunc func(*APIToken) error
+
+func runAPITokenValFuncs(t *APIToken, fns ...apiTokenValFunc) error {
+	for _, fn := range fns {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) userIDRequired(t *APIToken) error {
+	if t.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) normalizeName(t *APIToken) error {
+	t.Name = strings.TrimSpace(t.Name)
+	return nil
+}
+
+func (atv *apiTokenValidator) nameRequired(t *APIToken) error {
+	if t.Name == "" {
+		return ErrNameRequired
+	}
+	return nil
+}
+
+// scopeValid defaults the scope to read so tokens are only
+// given write access when it is asked for.
+func (atv *apiTokenValidator) scopeValid(t *APIToken) error {
+	t.Scope = strings.ToLower(strings.TrimSpace(t.Scope))
+	switch t.Scope {
+	case "":
+		t.Scope = ScopeRead
+	case ScopeRead, ScopeWrite:
+	default:
+		return ErrTokenScopeInvalid
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) setToken(t *APIToken) error {
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	t.Token = token
+	return nil
+}
+
+func (atv *apiTokenValidator) tokenRequired(t *APIToken) error {
+	if t.Token == "" {
+		return ErrTokenInvalid
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) hmacToken(t *APIToken) error {
+	t.TokenHash = atv.hmac.Hash(t.Token)
+	return nil
+}
+
+var _ APITokenDB = &apiTokenGorm{}
+
+type apiTokenGorm struct {
+	db *gorm.DB
+}
+
+func (atg *apiTokenGorm) ByToken(tokenHash string) (*APIToken, error) {
+	var t APIToken
+	err := first(atg.db.Where("token_hash = ?", tokenHash), &t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ByUserID returns the user's tokens, newest first.
+func (atg *apiTokenGorm) ByUserID(userID uint) ([]APIToken, error) {
+	tokens := []APIToken{}
+	err := atg.db.Where("user_id = ?", userID).Order("id desc").Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (atg *apiTokenGorm) Create(t *APIToken) error {
+	return atg.db.Create(t).Error
+}
+
+func (atg *apiTokenGorm) Touch(id uint) error {
+	return atg.db.Model(&APIToken{ID: id}).UpdateColumn("last_used_at", time.Now()).Error
+}
+
+// Delete returns ErrNotFound if the user has no such token so
+// users cannot revoke each other's tokens.
+func (atg *apiTokenGorm) Delete(userID, id uint) error {
+	db := atg.db.Where("id = ? AND user_id = ?", id, userID).Delete(&APIToken{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// blockedUsernamesSQL selects the usernames of the users on
+// the other side of a block with the user, whichever of them
+// blocked the other. It takes the user's ID twice.
+const blockedUsernamesSQL = `SELECT users.username FROM users JOIN blocks ON
+	(blocks.blocker_id = ? AND blocks.user_id = users.id) OR
+	(blocks.user_id = ? AND blocks.blocker_id = users.id)`
+
+// Block stops UserID from following BlockerID or acting on
+// their tweets, and hides the tweets of each from the other.
+type Block struct {
+	BlockerID uint      `gorm:"primary_key" json:"blocker_id"`
+	UserID    uint      `gorm:"primary_key" json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type BlockService interface {
+	BlockDB
+}
+
+type blockService struct {
+	BlockDB
+}
+
+func NewBlockService(db *gorm.DB, bus EventBus) BlockService {
+	bg := &blockGorm{db, bus}
+	return &blockService{
+		BlockDB: &blockValidator{bg},
+	}
+}
+
+type BlockDB interface {
+	// Create also removes the follows and follow requests
+	// between the two users, in both directions.
+	Create(block *Block) error
+	GetBlock(userID uint, blockerID uint) (*Block, error)
+	// Blocked reports whether either user has blocked the
+	// other.
+	Blocked(userID uint, otherID uint) (bool, error)
+	// GetUserBlockingPaginated returns a page of the users
+	// that the user blocked, ordered by user ID.
+	GetUserBlockingPaginated(blockerID uint, page Page) ([]User, string, error)
+	Delete(userID uint, blockerID uint) error
+}
+
+type blockValidator struct {
+	BlockDB
+}
+
+type blockValFunc func(*Block) error
+
+func runBlockValFuncs(block *Block, fns ...blockValFunc) error {
+	for _, fn := range fns {
+		if err := fn(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bv *blockValidator) Create(block *Block) error {
+	err := runBlockValFuncs(block, bv.idsRequired, bv.notSelf, bv.noDuplicates)
+	if err != nil {
+		return err
+	}
+	return bv.BlockDB.Create(block)
+}
+
+func (bv *blockValidator) idsRequired(b *Block) error {
+	if b.BlockerID <= 0 || b.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (bv *blockValidator) notSelf(b *Block) error {
+	if b.BlockerID == b.UserID {
+		return ErrBlockSelf
+	}
+	return nil
+}
+
+func (bv *blockValidator) noDuplicates(b *Block) error {
+	_, err := bv.GetBlock(b.UserID, b.BlockerID)
+	switch err {
+	case nil:
+		return ErrBlockExists
+	case ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+}
+
+type blockGorm struct {
+	db  *gorm.DB
+	bus EventBus
+}
+
+var _ BlockDB = &blockGorm{}
+
+func (bg *blockGorm) Create(block *Block) error {
+	tx := bg.db.Begin()
+	if err := tx.Create(block).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	// Follows and pending follow requests are removed both ways
+	var events []Event
+	for _, table := range []string{"follows", "follow_requests"} {
+		var removed []struct{ UserID, FollowerID uint }
+		err := tx.Raw(`DELETE FROM `+table+`
+			WHERE (user_id = ? AND follower_id = ?) OR (user_id = ? AND follower_id = ?)
+			RETURNING user_id, follower_id`,
+			block.UserID, block.BlockerID, block.BlockerID, block.UserID).
+			Scan(&removed).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, r := range removed {
+			if table == "follows" {
+				events = append(events, &FollowRemoved{UserID: r.UserID, FollowerID: r.FollowerID})
+			} else {
+				events = append(events, &FollowRequestCanceled{UserID: r.UserID, FollowerID: r.FollowerID})
+			}
+		}
+	}
+	dispatch, err := bg.bus.Publish(tx, events...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	dispatch()
+	return nil
+}
+
+func (bg *blockGorm) GetBlock(userID uint, blockerID uint) (*Block, error) {
+	var block Block
+	db := bg.db.Where("user_id = ? AND blocker_id = ?", userID, blockerID)
+	err := first(db, &block)
+	return &block, err
+}
+
+func (bg *blockGorm) Blocked(userID uint, otherID uint) (bool, error) {
+	var count int
+	err := bg.db.Model(&Block{}).
+		Where("(user_id = ? AND blocker_id = ?) OR (user_id = ? AND blocker_id = ?)",
+			userID, otherID, otherID, userID).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (bg *blockGorm) GetUserBlockingPaginated(blockerID uint, page Page) ([]User, string, error) {
+	var users []User
+	db := bg.db.Table("users").
+		Select("users.*").
+		Joins("JOIN blocks ON blocks.user_id = users.id AND blocks.blocker_id = ?", blockerID)
+	err := page.scope(db, "users.id").Find(&users).Error
+	if err != nil {
+		return nil, "", err
+	}
+	users, next := page.pageUsers(users)
+	return users, next, nil
+}
+
+func (bg *blockGorm) Delete(userID uint, blockerID uint) error {
+	block := Block{UserID: userID, BlockerID: blockerID}
+	return bg.db.Delete(&block).Error
+}
+
+// withoutBlocked leaves out of a tweets query the tweets of
+// the users on either side of a block with viewerID, along
+// with retweets and quotes of their tweets. Signed out
+// viewers have a zero viewerID and see every tweet.
+//
+// viewerID is either an ID or, to filter for many viewers at
+// once, a gorm.Expr naming the column that holds their IDs.
+func withoutBlocked(db *gorm.DB, viewerID interface{}) *gorm.DB {
+	if viewerID == uint(0) {
+		return db
+	}
+	return db.Where("tweets.username NOT IN ("+blockedUsernamesSQL+")", viewerID, viewerID).
+		Where(`NOT EXISTS (
+			SELECT 1 FROM tweets AS originals
+			WHERE originals.id = tweets.retweet_id AND originals.username IN (`+blockedUsernamesSQL+`))`,
+			viewerID, viewerID)
+}
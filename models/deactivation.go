@@ -0,0 +1,200 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// DeactivationPeriod is how long a deactivated account can be
+// restored by signing in before it is purged.
+const DeactivationPeriod = 30 * 24 * time.Hour
+
+// deactivatedUsernamesSQL selects the usernames of the
+// deactivated accounts.
+const deactivatedUsernamesSQL = `SELECT users.username FROM users
+	WHERE users.deactivated_at IS NOT NULL`
+
+// Deactivated reports whether the user has asked for their
+// account to be deleted.
+func (u *User) Deactivated() bool {
+	return u.DeactivatedAt != nil
+}
+
+// withoutDeactivated leaves out of a tweets query the tweets of
+// deactivated accounts along with plain retweets of them, as
+// if the accounts had been purged already. Quotes are kept
+// like they are by Purge.
+func withoutDeactivated(db *gorm.DB) *gorm.DB {
+	return db.Where("tweets.username NOT IN (" + deactivatedUsernamesSQL + ")").
+		Where(`NOT EXISTS (
+			SELECT 1 FROM tweets AS originals
+			WHERE originals.id = tweets.retweet_id AND NOT tweets.quote
+			AND originals.username IN (` + deactivatedUsernamesSQL + `))`)
+}
+
+type purgeDB interface {
+	// DeactivatedBefore returns the users deactivated before t.
+	DeactivatedBefore(t time.Time) ([]User, error)
+	// Purge hard deletes the user and everything they made.
+	Purge(user *User) error
+}
+
+func (us *userService) Deactivate(user *User, password string) error {
+	if err := us.comparePassword(user, password); err != nil {
+		return err
+	}
+	now := time.Now()
+	user.DeactivatedAt = &now
+	if err := us.Update(user); err != nil {
+		return err
+	}
+	return us.sessionDB.DeleteByUser(user.ID)
+}
+
+func (us *userService) Restore(user *User) error {
+	if !user.Deactivated() {
+		return nil
+	}
+	if time.Since(*user.DeactivatedAt) > DeactivationPeriod {
+		return ErrNotFound
+	}
+	user.DeactivatedAt = nil
+	return us.Update(user)
+}
+
+func (us *userService) PurgeDeactivated() (int, error) {
+	users, err := us.purgeDB.DeactivatedBefore(time.Now().Add(-DeactivationPeriod))
+	if err != nil {
+		return 0, err
+	}
+	for i := range users {
+		if err := us.purgeDB.Purge(&users[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(users), nil
+}
+
+var _ purgeDB = &purgeGorm{}
+
+type purgeGorm struct {
+	db  *gorm.DB
+	bus EventBus
+}
+
+func (pg *purgeGorm) DeactivatedBefore(t time.Time) ([]User, error) {
+	var users []User
+	err := pg.db.Where("deactivated_at < ?", t).Order("id").Find(&users).Error
+	return users, err
+}
+
+// Purge removes the user's tweets along with the plain
+// retweets of them, the likes, taggings and notifications of
+// those tweets, and the user's likes, follows, credentials and
+// history. Quotes of the user's tweets belong to whoever wrote
+// them and are kept.
+//
+// The likes, retweets and replies counts of the remaining
+// tweets the user liked, retweeted or replied to are counted
+// again afterwards. TweetDeleted is published for each of the
+// removed tweets that had not been deleted yet, before
+// UserDeleted.
+func (pg *purgeGorm) Purge(user *User) error {
+	tx := pg.db.Begin()
+	tweets, err := pg.purge(tx.Unscoped(), user)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	events := make([]Event, 0, len(tweets)+1)
+	for _, tweet := range tweets {
+		if tweet.DeletedAt == nil {
+			events = append(events, &TweetDeleted{Tweet: tweet})
+		}
+	}
+	events = append(events, &UserDeleted{UserID: user.ID, Username: user.Username})
+	dispatch, err := pg.bus.Publish(tx, events...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	dispatch()
+	return nil
+}
+
+// purge returns the tweets it removed.
+func (pg *purgeGorm) purge(tx *gorm.DB, user *User) ([]Tweet, error) {
+	var tweets []Tweet
+	err := tx.Where(`username = ? OR (quote = false AND retweet_id IN
+			(SELECT id FROM tweets WHERE username = ?))`, user.Username, user.Username).
+		Order("id").Find(&tweets).Error
+	if err != nil {
+		return nil, err
+	}
+	tweetIDs := make([]uint, len(tweets))
+	for i, tweet := range tweets {
+		tweetIDs[i] = tweet.ID
+	}
+
+	var rows []struct{ TweetID uint }
+	err = tx.Raw(`SELECT tweet_id FROM likes WHERE user_id = ?
+		UNION SELECT retweet_id FROM tweets WHERE username = ? AND retweet_id > 0
+		UNION SELECT in_reply_to_id FROM tweets WHERE username = ? AND in_reply_to_id > 0`,
+		user.ID, user.Username, user.Username).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	affected := make([]uint, len(rows))
+	for i, row := range rows {
+		affected[i] = row.TweetID
+	}
+
+	deletes := []struct {
+		where string
+		args  []interface{}
+		model interface{}
+	}{
+		{"user_id = ? OR tweet_id IN (?)", []interface{}{user.ID, tweetIDs}, &Like{}},
+		{"tweet_id IN (?)", []interface{}{tweetIDs}, &Tagging{}},
+		{"user_id = ? OR actor_id = ? OR tweet_id IN (?)", []interface{}{user.ID, user.ID, tweetIDs}, &Notification{}},
+		{"user_id = ? OR follower_id = ?", []interface{}{user.ID, user.ID}, &Follow{}},
+		{"user_id = ? OR follower_id = ?", []interface{}{user.ID, user.ID}, &FollowRequest{}},
+		{"user_id = ? OR blocker_id = ?", []interface{}{user.ID, user.ID}, &Block{}},
+		{"user_id = ? OR muter_id = ?", []interface{}{user.ID, user.ID}, &Mute{}},
+		{"sender_id = ?", []interface{}{user.ID}, &Message{}},
+		{"user_id = ?", []interface{}{user.ID}, &conversationParticipant{}},
+		{"id IN (?)", []interface{}{tweetIDs}, &Tweet{}},
+		{"user_id = ?", []interface{}{user.ID}, &Session{}},
+		{"user_id = ?", []interface{}{user.ID}, &APIToken{}},
+		{"user_id = ?", []interface{}{user.ID}, &recoveryCode{}},
+		{"user_id = ?", []interface{}{user.ID}, &loginChallenge{}},
+		{"user_id = ?", []interface{}{user.ID}, &emailVerification{}},
+		{"user_id = ?", []interface{}{user.ID}, &pwReset{}},
+		{"user_id = ?", []interface{}{user.ID}, &usernameChange{}},
+		{"user_id = ?", []interface{}{user.ID}, &Export{}},
+		{"user_id = ?", []interface{}{user.ID}, &tweetImport{}},
+		{"id = ?", []interface{}{user.ID}, &User{}},
+	}
+	for _, d := range deletes {
+		if err := tx.Where(d.where, d.args...).Delete(d.model).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	if len(affected) == 0 {
+		return tweets, nil
+	}
+	err = tx.Exec(`UPDATE tweets SET
+		likes_count = (SELECT COUNT(*) FROM likes WHERE likes.tweet_id = tweets.id),
+		retweets_count = (SELECT COUNT(*) FROM tweets r
+			WHERE r.retweet_id = tweets.id AND r.quote = false AND r.deleted_at IS NULL),
+		replies_count = (SELECT COUNT(*) FROM tweets r
+			WHERE r.in_reply_to_id = tweets.id AND r.deleted_at IS NULL)
+		WHERE id IN (?)`, affected).Error
+	return tweets, err
+}
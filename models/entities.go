@@ -0,0 +1,146 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"chirp.com/internal/utils"
+)
+
+// Types of entities found in a tweet's post
+const (
+	EntityHashtag = "hashtag"
+	EntityMention = "mention"
+	EntityURL     = "url"
+)
+
+var (
+	urlRegex     = regexp.MustCompile(`https?://[^\s]+`)
+	hashtagRegex = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_])(#[\p{L}\p{N}_]+)`)
+	mentionRegex = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_])(@[\p{L}\p{N}_]+(?:-[\p{L}\p{N}_]+)*)`)
+)
+
+// urlTrailingPunct is trimmed from the end of URLs since it
+// is usually part of the sentence rather than the link.
+const urlTrailingPunct = `.,!?;:'")]`
+
+// Entity is a hashtag, mention or URL found in a tweet's post.
+// Start and End are character (rune) offsets into the post,
+// with End being exclusive. Text holds the normalized tag name
+// for hashtags, the username for mentions and the link for
+// URLs.
+type Entity struct {
+	Type  string `json:"type"`
+	Text  string `json:"text"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// Entities is stored as a JSON column on the tweets table.
+type Entities []Entity
+
+// ExtractEntities finds the hashtags, mentions and URLs in
+// the text, ordered by where they start. Hashtags and mentions
+// that are part of a URL are ignored.
+func ExtractEntities(text string) Entities {
+	var entities Entities
+	var urls [][]int
+	for _, loc := range urlRegex.FindAllStringIndex(text, -1) {
+		start := loc[0]
+		end := start + len(strings.TrimRight(text[start:loc[1]], urlTrailingPunct))
+		urls = append(urls, []int{start, end})
+		entities = append(entities, newEntity(text, EntityURL, start, end, text[start:end]))
+	}
+	inURL := func(i int) bool {
+		for _, u := range urls {
+			if i >= u[0] && i < u[1] {
+				return true
+			}
+		}
+		return false
+	}
+	for _, loc := range hashtagRegex.FindAllStringSubmatchIndex(text, -1) {
+		start, end := loc[2], loc[3]
+		if inURL(start) {
+			continue
+		}
+		name := utils.NormalizeText(text[start+1 : end])
+		entities = append(entities, newEntity(text, EntityHashtag, start, end, name))
+	}
+	for _, loc := range mentionRegex.FindAllStringSubmatchIndex(text, -1) {
+		start, end := loc[2], loc[3]
+		if inURL(start) {
+			continue
+		}
+		username := utils.NormalizeText(text[start+1 : end])
+		entities = append(entities, newEntity(text, EntityMention, start, end, username))
+	}
+	sort.Slice(entities, func(i, j int) bool {
+		return entities[i].Start < entities[j].Start
+	})
+	return entities
+}
+
+// newEntity converts the byte offsets used by regexp into
+// character offsets.
+func newEntity(text, entityType string, start, end int, value string) Entity {
+	return Entity{
+		Type:  entityType,
+		Text:  value,
+		Start: utf8.RuneCountInString(text[:start]),
+		End:   utf8.RuneCountInString(text[:end]),
+	}
+}
+
+// Hashtags returns the tag names of the hashtag entities.
+func (e Entities) Hashtags() []string {
+	return e.texts(EntityHashtag)
+}
+
+// Mentions returns the usernames of the mention entities.
+func (e Entities) Mentions() []string {
+	return e.texts(EntityMention)
+}
+
+func (e Entities) texts(entityType string) []string {
+	var texts []string
+	for _, entity := range e {
+		if entity.Type == entityType {
+			texts = append(texts, entity.Text)
+		}
+	}
+	return texts
+}
+
+// Value implements driver.Valuer so Entities can be saved as
+// JSON by gorm.
+func (e Entities) Value() (driver.Value, error) {
+	if len(e) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Scan implements sql.Scanner so Entities can be read back
+// from the JSON column.
+func (e *Entities) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*e = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, e)
+	case string:
+		return json.Unmarshal([]byte(v), e)
+	}
+	return errors.New("models: cannot scan entities")
+}
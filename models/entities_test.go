@@ -0,0 +1,64 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractEntities(t *testing.T) {
+	tests := []struct {
+		text string
+		want Entities
+	}{
+		{
+			text: "no entities here",
+			want: nil,
+		},
+		{
+			text: "Go #Lakers! cc @bobbyd",
+			want: Entities{
+				{Type: EntityHashtag, Text: "lakers", Start: 3, End: 10},
+				{Type: EntityMention, Text: "bobbyd", Start: 15, End: 22},
+			},
+		},
+		{
+			text: "@vincent-xiao see https://chirp.com/#top.",
+			want: Entities{
+				{Type: EntityMention, Text: "vincent-xiao", Start: 0, End: 13},
+				{Type: EntityURL, Text: "https://chirp.com/#top", Start: 18, End: 40},
+			},
+		},
+		{
+			// offsets are in characters, not bytes
+			text: "café #über_alles",
+			want: Entities{
+				{Type: EntityHashtag, Text: "über_alles", Start: 5, End: 16},
+			},
+		},
+		{
+			// emails are not mentions
+			text: "mail bob@dylan.com",
+			want: nil,
+		},
+	}
+	for _, test := range tests {
+		got := ExtractEntities(test.text)
+		assert.Equal(t, test.want, got, test.text)
+	}
+}
+
+func TestEntitiesValue(t *testing.T) {
+	entities := Entities{{Type: EntityHashtag, Text: "okc", Start: 0, End: 4}}
+	v, err := entities.Value()
+	assert.Nil(t, err)
+
+	var got Entities
+	assert.Nil(t, got.Scan(v))
+	assert.Equal(t, entities, got)
+	assert.Equal(t, []string{"okc"}, got.Hashtags())
+
+	v, err = Entities{}.Value()
+	assert.Nil(t, err)
+	assert.Nil(t, v)
+}
@@ -3,6 +3,8 @@ package models
 import (
 	"strconv"
 	"strings"
+
+	"github.com/lib/pq"
 )
 
 const (
@@ -35,12 +37,6 @@ const (
 	// ErrIDInvalid is returned when an invalid ID is provided
 	// to a method like Delete.
 	ErrIDInvalid privateError = "models: ID provided was invalid"
-	// ErrRememberRequired is returned when a create or update
-	// is attempted without a user remember token hash
-	ErrRememberRequired privateError = "models: remember token is required"
-	// ErrRememberTooShort is returned when a remember token is
-	// not at least 32 bytes
-	ErrRememberTooShort privateError = "models: remember token must be at least 32 bytes"
 
 	ErrUserIDRequired   privateError = "models: user ID is required"
 	ErrCharMin          modelError   = "models: not enough characters"
@@ -54,6 +50,103 @@ const (
 	ErrRetweetExists    modelError   = "models: you have retweeted this tweet already"
 	ErrPostRequired     modelError   = "models: post is required"
 	ErrTokenInvalid     modelError   = "models: token provided is not valid"
+	// ErrResetRateLimited is returned when a user requests more
+	// password resets than pwResetLimit allows.
+	ErrResetRateLimited modelError = "models: too many password reset requests, please try again later"
+	// ErrCursorInvalid is returned when a pagination cursor
+	// cannot be decoded.
+	ErrCursorInvalid modelError = "models: cursor provided is not valid"
+	// ErrReplyParentNotFound is returned when a reply is made
+	// to a tweet that does not exist.
+	ErrReplyParentNotFound modelError = "models: the tweet being replied to does not exist"
+	// ErrNotificationTypeInvalid is returned when a notification
+	// type is not one of the Notification* constants.
+	ErrNotificationTypeInvalid modelError = "models: notification type is not valid"
+	// ErrSearchQueryRequired is returned when a search is made
+	// without any terms or operators.
+	ErrSearchQueryRequired modelError = "models: search query is required"
+	// ErrSearchDateInvalid is returned when the since: or until:
+	// operators are not formatted as YYYY-MM-DD.
+	ErrSearchDateInvalid modelError = "models: search dates must be formatted as YYYY-MM-DD"
+	// ErrTokenScopeInvalid is returned when an API token is
+	// created with a scope other than read or write.
+	ErrTokenScopeInvalid modelError = "models: token scope must be read or write"
+	// ErrTwoFactorCodeInvalid is returned when a TOTP or
+	// recovery code is wrong, expired or already used.
+	ErrTwoFactorCodeInvalid modelError = "models: two-factor code is not valid"
+	// ErrTwoFactorEnabled is returned when enrolling a user who
+	// already has two-factor authentication turned on.
+	ErrTwoFactorEnabled modelError = "models: two-factor authentication is already enabled"
+	// ErrTwoFactorNotEnabled is returned when turning off
+	// two-factor authentication for a user who does not use it.
+	ErrTwoFactorNotEnabled modelError = "models: two-factor authentication is not enabled"
+	// ErrTwoFactorNotEnrolled is returned when enabling
+	// two-factor authentication before enrolling.
+	ErrTwoFactorNotEnrolled modelError = "models: enroll in two-factor authentication first"
+	// ErrEmailVerified is returned when a verification email is
+	// requested for an address that is already verified.
+	ErrEmailVerified modelError = "models: email address is already verified"
+	// ErrVerificationRateLimited is returned when a user requests
+	// more verification emails than emailVerificationLimit allows.
+	ErrVerificationRateLimited modelError = "models: too many verification emails requested, please try again later"
+	// ErrUsernameTaken is returned when an update is attempted
+	// with a username that is already in use.
+	ErrUsernameTaken modelError = "models: username is already taken"
+	// ErrCurrentPasswordRequired is returned when the email
+	// address or password is changed without the current
+	// password.
+	ErrCurrentPasswordRequired modelError = "models: current password is required to change the email address or password"
+	// ErrExportNotReady is returned when an export is
+	// downloaded before it has been built.
+	ErrExportNotReady modelError = "models: export is not ready yet"
+	// ErrImportCreatedAtRequired is returned for archive rows
+	// without a created_at timestamp.
+	ErrImportCreatedAtRequired modelError = "models: created_at is required"
+	// ErrImportCreatedAtInvalid is returned for archive rows
+	// created in the future.
+	ErrImportCreatedAtInvalid modelError = "models: created_at cannot be in the future"
+	// ErrImportRetweetNotFound is returned when retweet_of does
+	// not refer to a post that has been imported.
+	ErrImportRetweetNotFound modelError = "models: retweet_of does not refer to an imported post"
+	ErrBlockSelf             modelError = "models: cannot block yourself"
+	ErrBlockExists           modelError = "models: you have blocked this user already"
+	ErrMuteSelf              modelError = "models: cannot mute yourself"
+	ErrMuteExists            modelError = "models: you have muted this user already"
+	// ErrFollowRequestExists is returned when a protected
+	// account is asked to be followed twice.
+	ErrFollowRequestExists modelError = "models: you have requested to follow this user already"
+	// ErrFollowBlocked is returned when a follow request is
+	// approved between users who have blocked each other.
+	ErrFollowBlocked modelError = "models: you cannot follow this user"
+	// ErrMessageRecipientsRequired is returned when a
+	// conversation is started without anyone to talk to.
+	ErrMessageRecipientsRequired modelError = "models: at least one recipient is required"
+	// ErrMessageTooManyRecipients is returned when a group
+	// conversation would have more than
+	// maxConversationParticipants participants.
+	ErrMessageTooManyRecipients modelError = "models: too many recipients"
+	// ErrMessageSelf is returned when the sender is one of the
+	// recipients.
+	ErrMessageSelf modelError = "models: cannot send a message to yourself"
+	// ErrMessageBlocked is returned when the sender and one of
+	// the recipients have blocked each other.
+	ErrMessageBlocked modelError = "models: you cannot message this user"
+	// ErrMessageFollowersOnly is returned when one of the
+	// recipients only accepts messages from their followers.
+	ErrMessageFollowersOnly modelError = "models: this user only accepts messages from their followers"
+	ErrMessageBodyRequired  modelError = "models: message is required"
+	// ErrWebhookURLInvalid is returned when a webhook URL is not
+	// an absolute http or https URL.
+	ErrWebhookURLInvalid modelError = "models: webhook URL must be an http or https URL"
+	// ErrWebhookEventsRequired is returned when a webhook is not
+	// subscribed to any events.
+	ErrWebhookEventsRequired modelError = "models: at least one event is required"
+	// ErrWebhookEventInvalid is returned when a webhook is
+	// subscribed to an event that is not one of WebhookEvents.
+	ErrWebhookEventInvalid modelError = "models: webhook event is not valid"
+	// ErrWebhookLimit is returned when a user registers more
+	// than maxWebhooks webhooks.
+	ErrWebhookLimit modelError = "models: too many webhooks, delete one first"
 )
 
 type modelError string
@@ -79,8 +172,15 @@ func (e modelError) customCharLimitError(n uint, name string) modelError {
 	if e == ErrCharMin {
 		e = modelError("models: " + name + " must be at least " + strconv.Itoa(int(n)) + " characters")
 	} else if e == ErrCharMax {
-		e = modelError("models: " + name + " must be at least " + strconv.Itoa(int(n)) + " characters")
+		e = modelError("models: " + name + " must be at most " + strconv.Itoa(int(n)) + " characters")
 	}
 
 	return e
 }
+
+// isUniqueViolation reports whether err is Postgres refusing a
+// row that breaks a unique index.
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
@@ -0,0 +1,625 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Names of the domain events
+const (
+	EventTweetCreated  = "tweet.created"
+	EventTweetUpdated  = "tweet.updated"
+	EventTweetDeleted  = "tweet.deleted"
+	EventLikeAdded     = "like.added"
+	EventLikeRemoved   = "like.removed"
+	EventFollowAdded   = "follow.added"
+	EventFollowRemoved = "follow.removed"
+	// The follow request events are published for protected
+	// accounts, see FollowRequest.
+	EventFollowRequested       = "follow_request.added"
+	EventFollowRequestCanceled = "follow_request.canceled"
+	EventFollowRequestRejected = "follow_request.rejected"
+	EventUserDeleted           = "user.deleted"
+)
+
+const (
+	// outboxMaxAttempts is how many times a subscriber is
+	// given an event before it is left in the outbox as failed.
+	outboxMaxAttempts = 10
+	// outboxBatchSize is the number of due events the worker
+	// picks up at a time.
+	outboxBatchSize = 100
+)
+
+var (
+	// outboxRetryDelay is the wait before the second attempt at
+	// an event. It doubles with every attempt after that.
+	outboxRetryDelay = 5 * time.Second
+	// outboxSyncGrace is how long the worker leaves the events
+	// of synchronous subscribers to the service that published
+	// them. They are only picked up by the worker if that
+	// failed or the process stopped before it got to them.
+	outboxSyncGrace = 30 * time.Second
+	// outboxPollInterval is how often the worker looks for due
+	// events when it is not woken up by a publish.
+	outboxPollInterval = time.Second
+	// outboxRetention is how long processed events are kept in
+	// the outbox. Events that failed for good are kept until
+	// they are looked into.
+	outboxRetention = 7 * 24 * time.Hour
+	// outboxPruneInterval is how often the worker deletes the
+	// processed events older than outboxRetention.
+	outboxPruneInterval = time.Hour
+)
+
+// Event is a change made by one of the services. Events are
+// written to the outbox in the transaction of the change, so
+// they are never lost once it commits, and are then handed to
+// the subscribers of their name.
+type Event interface {
+	EventName() string
+}
+
+// TweetCreated is published for new tweets, retweets, quotes
+// and replies, including imported ones. Imported tweets are
+// not announced, so they do not notify, stream or trigger
+// webhooks.
+type TweetCreated struct {
+	Tweet    Tweet `json:"tweet"`
+	Imported bool  `json:"imported,omitempty"`
+}
+
+func (*TweetCreated) EventName() string { return EventTweetCreated }
+
+type TweetUpdated struct {
+	Tweet Tweet `json:"tweet"`
+}
+
+func (*TweetUpdated) EventName() string { return EventTweetUpdated }
+
+type TweetDeleted struct {
+	Tweet Tweet `json:"tweet"`
+}
+
+func (*TweetDeleted) EventName() string { return EventTweetDeleted }
+
+type LikeAdded struct {
+	TweetID uint `json:"tweet_id"`
+	UserID  uint `json:"user_id"`
+}
+
+func (*LikeAdded) EventName() string { return EventLikeAdded }
+
+type LikeRemoved struct {
+	TweetID uint `json:"tweet_id"`
+	UserID  uint `json:"user_id"`
+}
+
+func (*LikeRemoved) EventName() string { return EventLikeRemoved }
+
+// FollowAdded is published when FollowerID starts following
+// UserID, either directly or once a follow request is approved.
+type FollowAdded struct {
+	UserID     uint `json:"user_id"`
+	FollowerID uint `json:"follower_id"`
+}
+
+func (*FollowAdded) EventName() string { return EventFollowAdded }
+
+type FollowRemoved struct {
+	UserID     uint `json:"user_id"`
+	FollowerID uint `json:"follower_id"`
+}
+
+func (*FollowRemoved) EventName() string { return EventFollowRemoved }
+
+// FollowRequested is published when FollowerID asks to follow
+// the protected account UserID. Approved requests are followed
+// by FollowAdded instead of an event of their own.
+type FollowRequested struct {
+	UserID     uint `json:"user_id"`
+	FollowerID uint `json:"follower_id"`
+}
+
+func (*FollowRequested) EventName() string { return EventFollowRequested }
+
+// FollowRequestCanceled is published when the follower takes
+// back the request, or it is dropped by a block.
+type FollowRequestCanceled struct {
+	UserID     uint `json:"user_id"`
+	FollowerID uint `json:"follower_id"`
+}
+
+func (*FollowRequestCanceled) EventName() string { return EventFollowRequestCanceled }
+
+type FollowRequestRejected struct {
+	UserID     uint `json:"user_id"`
+	FollowerID uint `json:"follower_id"`
+}
+
+func (*FollowRequestRejected) EventName() string { return EventFollowRequestRejected }
+
+// UserDeleted is published when a deactivated account is
+// purged.
+type UserDeleted struct {
+	UserID   uint   `json:"user_id"`
+	Username string `json:"username"`
+}
+
+func (*UserDeleted) EventName() string { return EventUserDeleted }
+
+// newEvent returns an empty event of the name for an outbox
+// payload to be decoded into.
+func newEvent(name string) (Event, error) {
+	switch name {
+	case EventTweetCreated:
+		return &TweetCreated{}, nil
+	case EventTweetUpdated:
+		return &TweetUpdated{}, nil
+	case EventTweetDeleted:
+		return &TweetDeleted{}, nil
+	case EventLikeAdded:
+		return &LikeAdded{}, nil
+	case EventLikeRemoved:
+		return &LikeRemoved{}, nil
+	case EventFollowAdded:
+		return &FollowAdded{}, nil
+	case EventFollowRemoved:
+		return &FollowRemoved{}, nil
+	case EventFollowRequested:
+		return &FollowRequested{}, nil
+	case EventFollowRequestCanceled:
+		return &FollowRequestCanceled{}, nil
+	case EventFollowRequestRejected:
+		return &FollowRequestRejected{}, nil
+	case EventUserDeleted:
+		return &UserDeleted{}, nil
+	}
+	return nil, fmt.Errorf("models: unknown event %q", name)
+}
+
+// EventHandler handles an event in the transaction that marks
+// it as processed, so the changes it makes to the database are
+// committed exactly once. Anything else it does may happen
+// again if it fails and the event is retried.
+type EventHandler func(tx *gorm.DB, event Event) error
+
+// EventListener is called in the background with the events
+// published by this process once their transaction commits.
+// Listeners are not written to the outbox: an event is lost if
+// the process stops before the listener gets to it, and a
+// failed listener is not retried. They suit pushing events to
+// the connections of this process, which no other process
+// could do for it.
+type EventListener func(event Event) error
+
+type EventBus interface {
+	// Publish writes the events to the outbox, once for each of
+	// their subscribers, in the transaction tx. The returned
+	// function runs the synchronous subscribers, hands the
+	// events to the listeners and must be called once tx is
+	// committed.
+	Publish(tx *gorm.DB, events ...Event) (func(), error)
+	// Subscribe registers the handler for the events with the
+	// names. The name of the subscriber is stored with its
+	// events in the outbox so it must not change between
+	// releases. Synchronous subscribers run before the service
+	// that published the event returns, asynchronous ones in
+	// the background. Both are retried in the background if
+	// they fail.
+	Subscribe(name string, handler EventHandler, async bool, events ...string) error
+	// Listen registers the listener for the events with the
+	// names, see EventListener.
+	Listen(name string, listener EventListener, events ...string) error
+	// Start starts the background worker. Processes that only
+	// publish events, such as one-off commands, leave it to the
+	// servers.
+	Start()
+	// Close stops the background worker.
+	Close() error
+}
+
+// outboxEvent is an event waiting to be handled by one of its
+// subscribers. NextAttemptAt is cleared once the event is
+// processed or the subscriber has failed too many times, in
+// which case the last error is kept.
+type outboxEvent struct {
+	ID            uint   `gorm:"primary_key"`
+	Name          string `gorm:"not null"`
+	Subscriber    string `gorm:"not null"`
+	Payload       string `gorm:"not null"`
+	Attempts      int    `gorm:"not null;default:0"`
+	Error         string
+	NextAttemptAt *time.Time `gorm:"index"`
+	ProcessedAt   *time.Time `gorm:"index"`
+	CreatedAt     time.Time
+}
+
+type outboxDB interface {
+	// Add inserts the events in the transaction tx.
+	Add(tx *gorm.DB, events []outboxEvent) error
+	// Due returns the IDs of up to limit events whose next
+	// attempt is due at t, oldest first.
+	Due(t time.Time, limit int) ([]uint, error)
+	// Process claims the event and calls fn in the transaction
+	// holding the claim, which marks the event as processed
+	// when fn succeeds. It returns ErrNotFound if the event was
+	// processed already or is claimed by another process.
+	Process(id uint, fn func(tx *gorm.DB, event *outboxEvent) error) error
+	// Retry records the failed attempt at the event and when
+	// to try again, or that it is not tried again if next is
+	// nil.
+	Retry(id uint, err error, next *time.Time) error
+	// Prune deletes the events processed before t.
+	Prune(t time.Time) error
+}
+
+type subscriber struct {
+	handler EventHandler
+	async   bool
+}
+
+type listener struct {
+	name     string
+	listener EventListener
+}
+
+var _ EventBus = &eventBus{}
+
+type eventBus struct {
+	db          outboxDB
+	mu          sync.RWMutex
+	subscribers map[string]subscriber
+	// names holds the subscribers of each event in the order
+	// they were registered in
+	names     map[string][]string
+	listeners map[string][]listener
+	wake      chan struct{}
+	quit      chan struct{}
+	done      chan struct{}
+	startOnce sync.Once
+	closeOnce sync.Once
+	// prunedAt is only used by the worker
+	prunedAt time.Time
+}
+
+// NewEventBus returns a bus whose worker, which handles the
+// events of the asynchronous subscribers and retries failed
+// ones, is started by Start.
+func NewEventBus(db *gorm.DB) EventBus {
+	return newEventBus(&outboxGorm{db})
+}
+
+func newEventBus(db outboxDB) *eventBus {
+	return &eventBus{
+		db:          db,
+		subscribers: make(map[string]subscriber),
+		names:       make(map[string][]string),
+		listeners:   make(map[string][]listener),
+		wake:        make(chan struct{}, 1),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+func (b *eventBus) Subscribe(name string, handler EventHandler, async bool, events ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[name]; ok {
+		return fmt.Errorf("models: subscriber %q is already registered", name)
+	}
+	for _, event := range events {
+		if _, err := newEvent(event); err != nil {
+			return err
+		}
+	}
+	b.subscribers[name] = subscriber{handler: handler, async: async}
+	for _, event := range events {
+		b.names[event] = append(b.names[event], name)
+	}
+	return nil
+}
+
+func (b *eventBus) Listen(name string, l EventListener, events ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, event := range events {
+		if _, err := newEvent(event); err != nil {
+			return err
+		}
+		for _, other := range b.listeners[event] {
+			if other.name == name {
+				return fmt.Errorf("models: listener %q is already registered", name)
+			}
+		}
+	}
+	for _, event := range events {
+		b.listeners[event] = append(b.listeners[event], listener{name: name, listener: l})
+	}
+	return nil
+}
+
+func (b *eventBus) Publish(tx *gorm.DB, events ...Event) (func(), error) {
+	b.mu.RLock()
+	var rows, heard []outboxEvent
+	now := time.Now()
+	for _, event := range events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			b.mu.RUnlock()
+			return nil, err
+		}
+		if len(b.listeners[event.EventName()]) > 0 {
+			heard = append(heard, outboxEvent{
+				Name:    event.EventName(),
+				Payload: string(payload),
+			})
+		}
+		for _, name := range b.names[event.EventName()] {
+			next := now
+			if !b.subscribers[name].async {
+				next = now.Add(outboxSyncGrace)
+			}
+			rows = append(rows, outboxEvent{
+				Name:          event.EventName(),
+				Subscriber:    name,
+				Payload:       string(payload),
+				NextAttemptAt: &next,
+			})
+		}
+	}
+	b.mu.RUnlock()
+	if len(rows) > 0 {
+		if err := b.db.Add(tx, rows); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		b.dispatch(rows)
+		if len(heard) > 0 {
+			go b.tell(heard)
+		}
+	}, nil
+}
+
+// tell hands the events to their listeners in order. Each
+// listener decodes its own copy so none of them shares the
+// publisher's values.
+func (b *eventBus) tell(events []outboxEvent) {
+	for _, e := range events {
+		b.mu.RLock()
+		listeners := b.listeners[e.Name]
+		b.mu.RUnlock()
+		for _, l := range listeners {
+			event, err := newEvent(e.Name)
+			if err == nil {
+				err = json.Unmarshal([]byte(e.Payload), event)
+			}
+			if err == nil {
+				err = l.listener(event)
+			}
+			if err != nil {
+				log.Printf("listener %s for %s: %v", l.name, e.Name, err)
+			}
+		}
+	}
+}
+
+// dispatch handles the events of the synchronous subscribers
+// and wakes the worker up for the rest.
+func (b *eventBus) dispatch(rows []outboxEvent) {
+	async := false
+	for _, row := range rows {
+		if b.subscriber(row.Subscriber).async {
+			async = true
+			continue
+		}
+		b.process(row.ID)
+	}
+	if async {
+		select {
+		case b.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *eventBus) subscriber(name string) subscriber {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.subscribers[name]
+}
+
+// process reports whether the event was handled by this call,
+// successfully or not.
+func (b *eventBus) process(id uint) bool {
+	attempts := 0
+	err := b.db.Process(id, func(tx *gorm.DB, row *outboxEvent) error {
+		attempts = row.Attempts + 1
+		return b.handle(tx, row)
+	})
+	if attempts == 0 {
+		// the event was not claimed
+		if err != nil && err != ErrNotFound {
+			log.Printf("outbox event %d: %v", id, err)
+		}
+		return false
+	}
+	if err == nil {
+		return true
+	}
+	log.Printf("outbox event %d: %v", id, err)
+	var next *time.Time
+	if attempts < outboxMaxAttempts {
+		t := time.Now().Add(outboxRetryDelay << uint(attempts-1))
+		next = &t
+	}
+	if err := b.db.Retry(id, err, next); err != nil {
+		log.Printf("outbox event %d: %v", id, err)
+	}
+	return true
+}
+
+func (b *eventBus) handle(tx *gorm.DB, row *outboxEvent) error {
+	sub := b.subscriber(row.Subscriber)
+	if sub.handler == nil {
+		return fmt.Errorf("models: no subscriber %q for %s", row.Subscriber, row.Name)
+	}
+	event, err := newEvent(row.Name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(row.Payload), event); err != nil {
+		return err
+	}
+	return sub.handler(tx, event)
+}
+
+func (b *eventBus) work() {
+	defer close(b.done)
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		b.processDue()
+		b.prune(time.Now())
+		select {
+		case <-b.quit:
+			return
+		case <-ticker.C:
+		case <-b.wake:
+		}
+	}
+}
+
+// processDue keeps going while full batches are being handled,
+// and stops once a batch is claimed by other processes.
+func (b *eventBus) processDue() {
+	for {
+		ids, err := b.db.Due(time.Now(), outboxBatchSize)
+		if err != nil {
+			log.Printf("outbox: %v", err)
+			return
+		}
+		handled := 0
+		for _, id := range ids {
+			select {
+			case <-b.quit:
+				return
+			default:
+			}
+			if b.process(id) {
+				handled++
+			}
+		}
+		if len(ids) < outboxBatchSize || handled == 0 {
+			return
+		}
+	}
+}
+
+// prune deletes the old processed events every
+// outboxPruneInterval.
+func (b *eventBus) prune(now time.Time) {
+	if now.Sub(b.prunedAt) < outboxPruneInterval {
+		return
+	}
+	if err := b.db.Prune(now.Add(-outboxRetention)); err != nil {
+		log.Printf("outbox: %v", err)
+		return
+	}
+	b.prunedAt = now
+}
+
+func (b *eventBus) Start() {
+	b.startOnce.Do(func() {
+		go b.work()
+	})
+}
+
+func (b *eventBus) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.quit)
+		// keeps a worker from starting once closed, and marks
+		// one that never started as done
+		b.startOnce.Do(func() {
+			close(b.done)
+		})
+	})
+	<-b.done
+	return nil
+}
+
+var _ outboxDB = &outboxGorm{}
+
+type outboxGorm struct {
+	db *gorm.DB
+}
+
+func (og *outboxGorm) Add(tx *gorm.DB, events []outboxEvent) error {
+	for i := range events {
+		if err := tx.Create(&events[i]).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (og *outboxGorm) Due(t time.Time, limit int) ([]uint, error) {
+	var ids []uint
+	err := og.db.Model(&outboxEvent{}).
+		Where("processed_at IS NULL AND next_attempt_at <= ?", t).
+		Order("id").
+		Limit(limit).
+		Pluck("id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Process skips events that are locked by another process so
+// several workers can share the outbox.
+func (og *outboxGorm) Process(id uint, fn func(tx *gorm.DB, event *outboxEvent) error) error {
+	var event outboxEvent
+	tx := og.db.Begin()
+	db := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").
+		Where("id = ? AND processed_at IS NULL", id)
+	if err := first(db, &event); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := fn(tx, &event); err != nil {
+		tx.Rollback()
+		return err
+	}
+	err := tx.Model(&event).Updates(map[string]interface{}{
+		"attempts":        event.Attempts + 1,
+		"error":           "",
+		"next_attempt_at": nil,
+		"processed_at":    time.Now(),
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (og *outboxGorm) Retry(id uint, err error, next *time.Time) error {
+	return og.db.Model(&outboxEvent{}).
+		Where("id = ? AND processed_at IS NULL", id).
+		Updates(map[string]interface{}{
+			"attempts":        gorm.Expr("attempts + 1"),
+			"error":           err.Error(),
+			"next_attempt_at": next,
+		}).Error
+}
+
+func (og *outboxGorm) Prune(t time.Time) error {
+	return og.db.Where("processed_at < ?", t).Delete(&outboxEvent{}).Error
+}
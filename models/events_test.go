@@ -0,0 +1,323 @@
+package models
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryOutbox keeps the outbox in memory so the event bus can
+// be tested without a database. Handlers are given a nil
+// transaction.
+type memoryOutbox struct {
+	mu      sync.Mutex
+	events  map[uint]outboxEvent
+	claimed map[uint]bool
+}
+
+func newMemoryOutbox() *memoryOutbox {
+	return &memoryOutbox{
+		events:  make(map[uint]outboxEvent),
+		claimed: make(map[uint]bool),
+	}
+}
+
+func (m *memoryOutbox) Add(tx *gorm.DB, events []outboxEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range events {
+		events[i].ID = uint(len(m.events) + 1)
+		m.events[events[i].ID] = events[i]
+	}
+	return nil
+}
+
+func (m *memoryOutbox) Due(t time.Time, limit int) ([]uint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []uint
+	for id, e := range m.events {
+		if e.ProcessedAt == nil && e.NextAttemptAt != nil && !e.NextAttemptAt.After(t) && !m.claimed[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+func (m *memoryOutbox) Process(id uint, fn func(tx *gorm.DB, event *outboxEvent) error) error {
+	m.mu.Lock()
+	event, ok := m.events[id]
+	if !ok || event.ProcessedAt != nil || m.claimed[id] {
+		m.mu.Unlock()
+		return ErrNotFound
+	}
+	m.claimed[id] = true
+	m.mu.Unlock()
+
+	err := fn(nil, &event)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.claimed, id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	event.Attempts++
+	event.Error = ""
+	event.NextAttemptAt = nil
+	event.ProcessedAt = &now
+	m.events[id] = event
+	return nil
+}
+
+func (m *memoryOutbox) Retry(id uint, err error, next *time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	event := m.events[id]
+	event.Attempts++
+	event.Error = err.Error()
+	event.NextAttemptAt = next
+	m.events[id] = event
+	return nil
+}
+
+func (m *memoryOutbox) Prune(t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, event := range m.events {
+		if event.ProcessedAt != nil && event.ProcessedAt.Before(t) {
+			delete(m.events, id)
+		}
+	}
+	return nil
+}
+
+func (m *memoryOutbox) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.events)
+}
+
+func (m *memoryOutbox) event(id uint) outboxEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.events[id]
+}
+
+// handled records the events given to a handler.
+type handled struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (h *handled) handle(tx *gorm.DB, event Event) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, event)
+	return nil
+}
+
+func (h *handled) get() []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Event(nil), h.events...)
+}
+
+func eventually(t *testing.T, msg string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEventBusSubscribe(t *testing.T) {
+	bus := newEventBus(newMemoryOutbox())
+	defer bus.Close()
+	var h handled
+	assert.NoError(t, bus.Subscribe("counts", h.handle, false, EventLikeAdded))
+	assert.Error(t, bus.Subscribe("counts", h.handle, false, EventLikeRemoved), "names are unique")
+	assert.Error(t, bus.Subscribe("edits", h.handle, false, "tweet.edited"), "events must be known")
+}
+
+func TestEventBusPublish(t *testing.T) {
+	interval := outboxPollInterval
+	outboxPollInterval = time.Millisecond
+	defer func() { outboxPollInterval = interval }()
+
+	db := newMemoryOutbox()
+	bus := newEventBus(db)
+	bus.Start()
+	defer bus.Close()
+	var inline, background handled
+	bus.Subscribe("inline", inline.handle, false, EventLikeAdded, EventTweetCreated)
+	bus.Subscribe("background", background.handle, true, EventLikeAdded)
+
+	dispatch, err := bus.Publish(nil,
+		&LikeAdded{TweetID: 1, UserID: 2},
+		&FollowAdded{UserID: 3, FollowerID: 4},
+		&TweetCreated{Tweet: Tweet{ID: 5, Username: "bobbyd", Tags: []string{"guitar"}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, db.len(), "events are written once for each subscriber")
+	assert.Empty(t, inline.get(), "nothing is handled before the transaction commits")
+
+	dispatch()
+	assert.Equal(t, []Event{
+		&LikeAdded{TweetID: 1, UserID: 2},
+		&TweetCreated{Tweet: Tweet{ID: 5, Username: "bobbyd", Tags: []string{"guitar"}}},
+	}, inline.get())
+	eventually(t, "the async subscriber did not get the event", func() bool {
+		return len(background.get()) == 1
+	})
+	assert.Equal(t, &LikeAdded{TweetID: 1, UserID: 2}, background.get()[0])
+	for id := uint(1); id <= 3; id++ {
+		event := db.event(id)
+		assert.NotNil(t, event.ProcessedAt, event.Subscriber)
+		assert.Equal(t, 1, event.Attempts, event.Subscriber)
+	}
+}
+
+func TestEventBusListen(t *testing.T) {
+	db := newMemoryOutbox()
+	bus := newEventBus(db)
+	defer bus.Close()
+	heard := make(chan Event, 2)
+	listen := func(event Event) error {
+		heard <- event
+		return nil
+	}
+	assert.NoError(t, bus.Listen("stream", listen, EventLikeAdded))
+	assert.Error(t, bus.Listen("stream", listen, EventLikeAdded), "names are unique")
+
+	like := &LikeAdded{TweetID: 1, UserID: 2}
+	dispatch, err := bus.Publish(nil, like, &LikeRemoved{TweetID: 1, UserID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, db.len(), "events are not written for listeners")
+	dispatch()
+	select {
+	case event := <-heard:
+		assert.Equal(t, like, event)
+		assert.False(t, like == event, "listeners get their own copy")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the listener did not get the event")
+	}
+	select {
+	case event := <-heard:
+		t.Errorf("unexpected event %s", event.EventName())
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestEventBusRetries(t *testing.T) {
+	interval, delay := outboxPollInterval, outboxRetryDelay
+	outboxPollInterval, outboxRetryDelay = time.Millisecond, 50*time.Millisecond
+	defer func() { outboxPollInterval, outboxRetryDelay = interval, delay }()
+
+	db := newMemoryOutbox()
+	bus := newEventBus(db)
+	bus.Start()
+	defer bus.Close()
+	var mu sync.Mutex
+	failures := 2
+	bus.Subscribe("flaky", func(tx *gorm.DB, event Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			return errors.New("flaky")
+		}
+		return nil
+	}, false, EventFollowAdded)
+
+	dispatch, err := bus.Publish(nil, &FollowAdded{UserID: 1, FollowerID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch()
+	flaky := db.event(1)
+	assert.Nil(t, flaky.ProcessedAt)
+	assert.Equal(t, "flaky", flaky.Error)
+	if assert.NotNil(t, flaky.NextAttemptAt, "failed sync events are left to the worker") {
+		assert.True(t, flaky.NextAttemptAt.Before(time.Now().Add(outboxSyncGrace)))
+	}
+
+	eventually(t, "the flaky subscriber was not retried", func() bool {
+		return db.event(1).ProcessedAt != nil
+	})
+	assert.Equal(t, 3, db.event(1).Attempts)
+	assert.Empty(t, db.event(1).Error)
+}
+
+func TestEventBusGivesUp(t *testing.T) {
+	interval, delay := outboxPollInterval, outboxRetryDelay
+	outboxPollInterval, outboxRetryDelay = time.Millisecond, time.Millisecond
+	defer func() { outboxPollInterval, outboxRetryDelay = interval, delay }()
+
+	db := newMemoryOutbox()
+	bus := newEventBus(db)
+	bus.Start()
+	defer bus.Close()
+	bus.Subscribe("broken", func(tx *gorm.DB, event Event) error {
+		return errors.New("broken")
+	}, true, EventFollowAdded)
+	dispatch, err := bus.Publish(nil, &FollowAdded{UserID: 1, FollowerID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch()
+
+	eventually(t, "the broken subscriber was not given up on", func() bool {
+		return db.event(1).Attempts == outboxMaxAttempts
+	})
+	broken := db.event(1)
+	assert.Nil(t, broken.ProcessedAt)
+	assert.Nil(t, broken.NextAttemptAt)
+	assert.Equal(t, "broken", broken.Error)
+}
+
+func TestEventBusPrunes(t *testing.T) {
+	interval, delay := outboxPollInterval, outboxRetryDelay
+	retention, pruneInterval := outboxRetention, outboxPruneInterval
+	outboxPollInterval, outboxRetryDelay = time.Millisecond, time.Millisecond
+	outboxRetention, outboxPruneInterval = time.Millisecond, time.Millisecond
+	defer func() {
+		outboxPollInterval, outboxRetryDelay = interval, delay
+		outboxRetention, outboxPruneInterval = retention, pruneInterval
+	}()
+
+	db := newMemoryOutbox()
+	bus := newEventBus(db)
+	bus.Start()
+	defer bus.Close()
+	var h handled
+	bus.Subscribe("counts", h.handle, false, EventFollowAdded)
+	bus.Subscribe("broken", func(tx *gorm.DB, event Event) error {
+		return errors.New("broken")
+	}, true, EventFollowAdded)
+	dispatch, err := bus.Publish(nil, &FollowAdded{UserID: 1, FollowerID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch()
+
+	eventually(t, "the processed event was not pruned", func() bool {
+		return db.len() == 1 && db.event(2).Attempts == outboxMaxAttempts
+	})
+	assert.Equal(t, "broken", db.event(2).Subscriber, "events that failed for good are kept")
+}
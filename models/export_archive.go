@@ -0,0 +1,110 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"time"
+)
+
+// exportData is everything that goes into an export archive.
+// Each field but GeneratedAt is written to its own JSON file.
+type exportData struct {
+	GeneratedAt time.Time
+	Profile     *User
+	Tweets      []Tweet
+	Likes       []Tweet
+	Followers   []User
+	Following   []User
+	Sessions    []Session
+}
+
+var exportIndexTmpl = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Chirp archive of @{{.Profile.Username}}</title>
+</head>
+<body>
+<h1>@{{.Profile.Username}}</h1>
+<p>{{.Profile.Name}} &middot; {{.Profile.Email}} &middot; joined {{.Profile.CreatedAt.Format "January 2, 2006"}}</p>
+<p>Generated {{.GeneratedAt.Format "January 2, 2006 15:04 MST"}}. The same data is in the JSON files next to this page.</p>
+
+<h2>Tweets ({{len .Tweets}})</h2>
+<ul>
+{{- range .Tweets}}
+<li>{{.CreatedAt.Format "2006-01-02 15:04"}}: {{if .RetweetID}}{{if .Quote}}quoted {{.RetweetID}}: {{.Post}}{{else}}retweeted {{.RetweetID}}{{end}}{{else}}{{.Post}}{{end}}{{range .Tags}} #{{.}}{{end}}</li>
+{{- end}}
+</ul>
+
+<h2>Likes ({{len .Likes}})</h2>
+<ul>
+{{- range .Likes}}
+<li>@{{.Username}}: {{.Post}}</li>
+{{- end}}
+</ul>
+
+<h2>Followers ({{len .Followers}})</h2>
+<ul>
+{{- range .Followers}}
+<li>@{{.Username}} {{.Name}}</li>
+{{- end}}
+</ul>
+
+<h2>Following ({{len .Following}})</h2>
+<ul>
+{{- range .Following}}
+<li>@{{.Username}} {{.Name}}</li>
+{{- end}}
+</ul>
+
+<h2>Sessions ({{len .Sessions}})</h2>
+<ul>
+{{- range .Sessions}}
+<li>{{.UserAgent}} from {{.IP}}, last seen {{.LastSeenAt.Format "2006-01-02 15:04"}}</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+// zip writes the JSON files and the HTML index into a zip
+// archive.
+func (d *exportData) zip() ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", d.Profile},
+		{"tweets.json", d.Tweets},
+		{"likes.json", d.Likes},
+		{"followers.json", d.Followers},
+		{"following.json", d.Following},
+		{"sessions.json", d.Sessions},
+	}
+	for _, file := range files {
+		w, err := zw.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file.data); err != nil {
+			return nil, err
+		}
+	}
+	w, err := zw.Create("index.html")
+	if err != nil {
+		return nil, err
+	}
+	if err := exportIndexTmpl.Execute(w, d); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportZip(t *testing.T) {
+	data := exportData{
+		GeneratedAt: time.Now(),
+		Profile:     &User{Username: "vincetester", Name: "Vince <Main>", Email: "vtester@gmail.com", PasswordHash: "secret"},
+		Tweets:      []Tweet{{ID: 1, Username: "vincetester", Post: "hello", Tags: []string{"go"}}},
+		Likes:       []Tweet{{ID: 2, Username: "duasings", Post: "liked"}},
+		Followers:   []User{{Username: "bobbyd"}},
+		Sessions:    []Session{{UserAgent: "curl", IP: "127.0.0.1", TokenHash: "secret"}},
+	}
+	archive, err := data.zip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(b)
+	}
+
+	for _, name := range []string{"profile.json", "tweets.json", "likes.json", "followers.json", "following.json", "sessions.json", "index.html"} {
+		assert.Contains(t, files, name)
+	}
+	var tweets []Tweet
+	assert.Nil(t, json.Unmarshal([]byte(files["tweets.json"]), &tweets))
+	assert.Equal(t, []string{"go"}, tweets[0].Tags)
+	for name, content := range files {
+		assert.NotContains(t, content, "secret", name)
+	}
+	assert.Contains(t, files["index.html"], "Vince &lt;Main&gt;")
+	assert.Contains(t, files["index.html"], "#go")
+}
@@ -0,0 +1,242 @@
+package models
+
+import (
+	"log"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Export statuses
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// exportTimeout is how long an export may stay pending before
+// it is given up on, in case the server stopped while building
+// it.
+const exportTimeout = 10 * time.Minute
+
+// Export is a zip archive of everything stored about a user.
+// It is built in the background, so it starts out pending.
+type Export struct {
+	ID          uint       `gorm:"primary_key" json:"id"`
+	UserID      uint       `gorm:"not null;index" json:"-"`
+	Status      string     `gorm:"not null" json:"status"`
+	Archive     []byte     `json:"-"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+type ExportService interface {
+	// Request starts building a new export for the user and
+	// returns it while it is still pending. Older exports of
+	// the user are deleted. If an export is already being
+	// built it is returned instead, concurrent requests
+	// included.
+	Request(user *User) (*Export, error)
+	// Build creates the archive of the export and stores it.
+	// Request runs it in the background.
+	Build(export *Export, user *User) error
+	ExportDB
+}
+
+type ExportDB interface {
+	// ByID returns the user's export without its archive,
+	// which can be large.
+	ByID(userID, id uint) (*Export, error)
+	// LoadArchive reads the archive of the export.
+	LoadArchive(export *Export) error
+	// Pending returns the user's export that is being built.
+	Pending(userID uint) (*Export, error)
+	// Create fails with a unique violation if the export is
+	// pending and the user already has a pending export.
+	Create(export *Export) error
+	// Update stores the status and archive of the export.
+	Update(export *Export) error
+	// DeleteStale removes the exports of the user except the
+	// one being built, unless it has been pending for longer
+	// than exportTimeout.
+	DeleteStale(userID uint) error
+}
+
+func NewExportService(db *gorm.DB, ts TweetDB, ls LikeDB, fs FollowDB, ss SessionDB, tagging TaggingDB, tags TagDB) ExportService {
+	return &exportService{
+		ExportDB: &exportGorm{db},
+		ts:       ts,
+		ls:       ls,
+		fs:       fs,
+		ss:       ss,
+		tagging:  tagging,
+		tags:     tags,
+	}
+}
+
+var _ ExportService = &exportService{}
+
+type exportService struct {
+	ExportDB
+	ts      TweetDB
+	ls      LikeDB
+	fs      FollowDB
+	ss      SessionDB
+	tagging TaggingDB
+	tags    TagDB
+}
+
+func (es *exportService) Request(user *User) (*Export, error) {
+	pending, err := es.Pending(user.ID)
+	if err == nil && time.Since(pending.CreatedAt) < exportTimeout {
+		return pending, nil
+	}
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	if err := es.DeleteStale(user.ID); err != nil {
+		return nil, err
+	}
+	export := Export{
+		UserID: user.ID,
+		Status: ExportPending,
+	}
+	err = es.Create(&export)
+	if isUniqueViolation(err) {
+		// another request created it in the meantime
+		return es.Pending(user.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the request's user should not be shared with the
+	// goroutine
+	u := *user
+	e := export
+	go func() {
+		if err := es.Build(&e, &u); err != nil {
+			log.Printf("export %d: %v", e.ID, err)
+		}
+	}()
+	return &export, nil
+}
+
+func (es *exportService) Build(export *Export, user *User) error {
+	archive, err := es.archive(user)
+	now := time.Now()
+	export.CompletedAt = &now
+	if err != nil {
+		export.Status = ExportFailed
+		if uerr := es.Update(export); uerr != nil {
+			log.Printf("export %d: %v", export.ID, uerr)
+		}
+		return err
+	}
+	export.Status = ExportReady
+	export.Archive = archive
+	return es.Update(export)
+}
+
+// archive gathers the user's data and zips it.
+func (es *exportService) archive(user *User) ([]byte, error) {
+	data := exportData{
+		GeneratedAt: time.Now(),
+		Profile:     user,
+	}
+	var err error
+	if data.Tweets, err = es.ts.ByUsername(user.Username); err != nil {
+		return nil, err
+	}
+	for i := range data.Tweets {
+		if data.Tweets[i].Tags, err = es.tagNames(data.Tweets[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	if data.Likes, err = es.ls.GetUserLikes(user.ID); err != nil {
+		return nil, err
+	}
+	if data.Followers, err = es.fs.GetUserFollowers(user.ID); err != nil {
+		return nil, err
+	}
+	if data.Following, err = es.fs.GetUserFollowing(user.ID); err != nil {
+		return nil, err
+	}
+	if data.Sessions, err = es.ss.ByUserID(user.ID); err != nil {
+		return nil, err
+	}
+	return data.zip()
+}
+
+func (es *exportService) tagNames(tweetID uint) ([]string, error) {
+	taggings, err := es.tagging.GetTaggings(tweetID)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(taggings))
+	for _, tagging := range taggings {
+		tag, err := es.tags.ByID(tagging.TagID)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, tag.Name)
+	}
+	return names, nil
+}
+
+var _ ExportDB = &exportGorm{}
+
+type exportGorm struct {
+	db *gorm.DB
+}
+
+// exportColumns are the columns of an export but the archive.
+const exportColumns = "id, user_id, status, created_at, completed_at"
+
+func (eg *exportGorm) ByID(userID, id uint) (*Export, error) {
+	var export Export
+	db := eg.db.Select(exportColumns).Where("id = ? AND user_id = ?", id, userID)
+	if err := first(db, &export); err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+func (eg *exportGorm) LoadArchive(export *Export) error {
+	var archived Export
+	db := eg.db.Select("archive").Where("id = ?", export.ID)
+	if err := first(db, &archived); err != nil {
+		return err
+	}
+	export.Archive = archived.Archive
+	return nil
+}
+
+func (eg *exportGorm) Pending(userID uint) (*Export, error) {
+	var export Export
+	db := eg.db.Select(exportColumns).
+		Where("user_id = ? AND status = ?", userID, ExportPending)
+	if err := first(db, &export); err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+func (eg *exportGorm) Create(export *Export) error {
+	return eg.db.Create(export).Error
+}
+
+// Update does not use Save so an export deleted while it was
+// being built is not created again.
+func (eg *exportGorm) Update(export *Export) error {
+	return eg.db.Model(export).Updates(map[string]interface{}{
+		"status":       export.Status,
+		"archive":      export.Archive,
+		"completed_at": export.CompletedAt,
+	}).Error
+}
+
+func (eg *exportGorm) DeleteStale(userID uint) error {
+	return eg.db.Where("user_id = ? AND NOT (status = ? AND created_at > ?)",
+		userID, ExportPending, time.Now().Add(-exportTimeout)).
+		Delete(&Export{}).Error
+}
@@ -0,0 +1,224 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// protectedUsernamesSQL selects the usernames of the protected
+// accounts whose tweets the user cannot see, which are all of
+// them but the user's own and the ones the user follows. It
+// takes the user's ID twice.
+const protectedUsernamesSQL = `SELECT users.username FROM users
+	WHERE users.protected AND users.id <> ? AND NOT EXISTS (
+		SELECT 1 FROM follows WHERE follows.user_id = users.id AND follows.follower_id = ?)`
+
+// FollowRequest is a pending follow of a protected account.
+// It becomes a Follow once the account approves it.
+type FollowRequest struct {
+	FollowerID uint      `gorm:"primary_key" json:"follower_id"`
+	UserID     uint      `gorm:"primary_key" json:"user_id"`
+	CreatedAt  time.Time `json:"requested_at"`
+}
+
+type FollowRequestDB interface {
+	CreateRequest(req *FollowRequest) error
+	GetRequest(userID uint, followerID uint) (*FollowRequest, error)
+	// GetRequestsPaginated returns a page of the users waiting
+	// for the user to approve their follow requests, ordered
+	// by user ID.
+	GetRequestsPaginated(userID uint, page Page) ([]User, string, error)
+	// CancelRequest is used by the follower to take back the
+	// request.
+	CancelRequest(userID uint, followerID uint) error
+	// RejectRequest is used by the protected account.
+	RejectRequest(userID uint, followerID uint) error
+	// Approve replaces the request with a follow.
+	// ErrFollowBlocked is returned if either user has blocked
+	// the other.
+	Approve(req *FollowRequest) (*Follow, error)
+	// ApproveAll approves every pending request of the user,
+	// once their account is no longer protected. Requests from
+	// users on either side of a block with them are dropped.
+	ApproveAll(userID uint) error
+}
+
+func (fv *followValidator) CreateRequest(req *FollowRequest) error {
+	if req.FollowerID <= 0 || req.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	if req.FollowerID == req.UserID {
+		return ErrFollowSelf
+	}
+	_, err := fv.GetFollow(req.UserID, req.FollowerID)
+	if err == nil {
+		return ErrFollowExists
+	}
+	if err != ErrNotFound {
+		return err
+	}
+	_, err = fv.GetRequest(req.UserID, req.FollowerID)
+	if err == nil {
+		return ErrFollowRequestExists
+	}
+	if err != ErrNotFound {
+		return err
+	}
+	return fv.FollowDB.CreateRequest(req)
+}
+
+func (fg *followGorm) CreateRequest(req *FollowRequest) error {
+	tx := fg.db.Begin()
+	if err := tx.Create(req).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	dispatch, err := fg.bus.Publish(tx, &FollowRequested{UserID: req.UserID, FollowerID: req.FollowerID})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	dispatch()
+	return nil
+}
+
+func (fg *followGorm) GetRequest(userID uint, followerID uint) (*FollowRequest, error) {
+	var req FollowRequest
+	db := fg.db.Where("user_id = ? AND follower_id = ?", userID, followerID)
+	err := first(db, &req)
+	return &req, err
+}
+
+func (fg *followGorm) GetRequestsPaginated(userID uint, page Page) ([]User, string, error) {
+	var users []User
+	db := fg.db.Table("users").
+		Select("users.*").
+		Joins("JOIN follow_requests ON follow_requests.follower_id = users.id AND follow_requests.user_id = ?", userID)
+	err := page.scope(db, "users.id").Find(&users).Error
+	if err != nil {
+		return nil, "", err
+	}
+	users, next := page.pageUsers(users)
+	return users, next, nil
+}
+
+func (fg *followGorm) CancelRequest(userID uint, followerID uint) error {
+	return fg.deleteRequest(userID, followerID, &FollowRequestCanceled{UserID: userID, FollowerID: followerID})
+}
+
+func (fg *followGorm) RejectRequest(userID uint, followerID uint) error {
+	return fg.deleteRequest(userID, followerID, &FollowRequestRejected{UserID: userID, FollowerID: followerID})
+}
+
+// deleteRequest publishes the event if there was a request to
+// delete.
+func (fg *followGorm) deleteRequest(userID uint, followerID uint, event Event) error {
+	req := FollowRequest{UserID: userID, FollowerID: followerID}
+	tx := fg.db.Begin()
+	res := tx.Delete(&req)
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	dispatch := func() {}
+	if res.RowsAffected > 0 {
+		var err error
+		dispatch, err = fg.bus.Publish(tx, event)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	dispatch()
+	return nil
+}
+
+func (fg *followGorm) Approve(req *FollowRequest) (*Follow, error) {
+	follow := Follow{UserID: req.UserID, FollowerID: req.FollowerID}
+	tx := fg.db.Begin()
+	var blocked int
+	err := tx.Model(&Block{}).
+		Where("(user_id = ? AND blocker_id = ?) OR (user_id = ? AND blocker_id = ?)",
+			req.UserID, req.FollowerID, req.FollowerID, req.UserID).
+		Count(&blocked).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if blocked > 0 {
+		tx.Rollback()
+		return nil, ErrFollowBlocked
+	}
+	if err := tx.Delete(req).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Create(&follow).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	dispatch, err := fg.bus.Publish(tx, &FollowAdded{UserID: follow.UserID, FollowerID: follow.FollowerID})
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	dispatch()
+	return &follow, nil
+}
+
+func (fg *followGorm) ApproveAll(userID uint) error {
+	tx := fg.db.Begin()
+	var followed []struct{ FollowerID uint }
+	err := tx.Raw(`INSERT INTO follows (follower_id, user_id)
+		SELECT follower_id, user_id FROM follow_requests WHERE user_id = ?
+		AND NOT EXISTS (SELECT 1 FROM blocks
+			WHERE (blocks.user_id = follow_requests.follower_id AND blocks.blocker_id = follow_requests.user_id)
+			OR (blocks.user_id = follow_requests.user_id AND blocks.blocker_id = follow_requests.follower_id))
+		ON CONFLICT DO NOTHING RETURNING follower_id`, userID).
+		Scan(&followed).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("user_id = ?", userID).Delete(&FollowRequest{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	events := make([]Event, len(followed))
+	for i, f := range followed {
+		events[i] = &FollowAdded{UserID: userID, FollowerID: f.FollowerID}
+	}
+	dispatch, err := fg.bus.Publish(tx, events...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	dispatch()
+	return nil
+}
+
+// withoutProtected leaves out of a tweets query the tweets of
+// protected accounts that viewerID does not follow, along with
+// retweets and quotes of their tweets. Signed out viewers have
+// a zero viewerID and see no protected tweets. Like
+// withoutBlocked, viewerID may be a column.
+func withoutProtected(db *gorm.DB, viewerID interface{}) *gorm.DB {
+	return db.Where("tweets.username NOT IN ("+protectedUsernamesSQL+")", viewerID, viewerID).
+		Where(`NOT EXISTS (
+			SELECT 1 FROM tweets AS originals
+			WHERE originals.id = tweets.retweet_id AND originals.username IN (`+protectedUsernamesSQL+`))`,
+			viewerID, viewerID)
+}
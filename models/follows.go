@@ -10,6 +10,8 @@ type Follow struct {
 	User       *User `json:"user"`
 }
 
+// FollowService follows public accounts directly, while
+// follows of protected accounts go through a FollowRequest.
 type FollowService interface {
 	FollowDB
 }
@@ -18,8 +20,8 @@ type followService struct {
 	FollowDB
 }
 
-func NewFollowService(db *gorm.DB) FollowService {
-	fg := &followGorm{db}
+func NewFollowService(db *gorm.DB, bus EventBus) FollowService {
+	fg := &followGorm{db, bus}
 	return &followService{
 		FollowDB: &followValidator{fg},
 	}
@@ -33,10 +35,13 @@ type FollowDB interface {
 	Create(follow *Follow) error
 	GetFollow(userID uint, followerID uint) (*Follow, error)
 	GetUserFollowers(id uint) ([]User, error)
+	GetUserFollowersPaginated(id uint, page Page) ([]User, string, error)
 	GetUserFollowing(id uint) ([]User, error)
+	GetUserFollowingPaginated(id uint, page Page) ([]User, string, error)
 	Delete(userID uint, followerID uint) error
 	GetTotalFollowers(id uint) uint
 	GetTotalFollowing(id uint) uint
+	FollowRequestDB
 }
 
 type followValFunc func(*Follow) error
@@ -74,7 +79,8 @@ func (fv *followValidator) noDuplicates(f *Follow) error {
 }
 
 type followGorm struct {
-	db *gorm.DB
+	db  *gorm.DB
+	bus EventBus
 }
 
 var _ FollowDB = &followGorm{}
@@ -97,6 +103,36 @@ func (fg *followGorm) GetUserFollowing(userID uint) ([]User, error) {
 	return users, nil
 }
 
+// GetUserFollowersPaginated returns a page of the user's
+// followers, ordered by user ID.
+func (fg *followGorm) GetUserFollowersPaginated(userID uint, page Page) ([]User, string, error) {
+	var users []User
+	db := fg.db.Table("users").
+		Select("users.*").
+		Joins("JOIN follows ON follows.follower_id = users.id AND follows.user_id = ?", userID)
+	err := page.scope(db, "users.id").Find(&users).Error
+	if err != nil {
+		return nil, "", err
+	}
+	users, next := page.pageUsers(users)
+	return users, next, nil
+}
+
+// GetUserFollowingPaginated returns a page of the users that
+// the user follows, ordered by user ID.
+func (fg *followGorm) GetUserFollowingPaginated(userID uint, page Page) ([]User, string, error) {
+	var users []User
+	db := fg.db.Table("users").
+		Select("users.*").
+		Joins("JOIN follows ON follows.user_id = users.id AND follows.follower_id = ?", userID)
+	err := page.scope(db, "users.id").Find(&users).Error
+	if err != nil {
+		return nil, "", err
+	}
+	users, next := page.pageUsers(users)
+	return users, next, nil
+}
+
 func (fg *followGorm) GetFollow(userID uint, followerID uint) (*Follow, error) {
 	var follow Follow
 	db := fg.db.Where("user_id = ? AND follower_id = ?", userID, followerID)
@@ -105,12 +141,45 @@ func (fg *followGorm) GetFollow(userID uint, followerID uint) (*Follow, error) {
 }
 
 func (fg *followGorm) Create(follow *Follow) error {
-	return fg.db.Create(follow).Error
+	tx := fg.db.Begin()
+	if err := tx.Create(follow).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	dispatch, err := fg.bus.Publish(tx, &FollowAdded{UserID: follow.UserID, FollowerID: follow.FollowerID})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	dispatch()
+	return nil
 }
 
 func (fg *followGorm) Delete(userID uint, followerID uint) error {
 	follow := Follow{UserID: userID, FollowerID: followerID}
-	return fg.db.Delete(&follow).Error
+	tx := fg.db.Begin()
+	res := tx.Delete(&follow)
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	dispatch := func() {}
+	if res.RowsAffected > 0 {
+		var err error
+		dispatch, err = fg.bus.Publish(tx, &FollowRemoved{UserID: userID, FollowerID: followerID})
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	dispatch()
+	return nil
 }
 
 func (fg *followGorm) GetTotalFollowers(id uint) uint {
@@ -0,0 +1,217 @@
+package models
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+
+	"chirp.com/internal/utils"
+	"chirp.com/pkg/unique"
+	"github.com/jinzhu/gorm"
+)
+
+// maxImportLine is the longest line accepted in an archive.
+const maxImportLine = 1 << 20
+
+// ImportRow is one line of a tweet archive. ID is the post's
+// ID in the tool it was exported from and is used to skip
+// posts that were imported already. RetweetOf refers to the ID
+// of another post in the archive; a retweet with a post of its
+// own is imported as a quote.
+type ImportRow struct {
+	ID        string    `json:"id"`
+	Post      string    `json:"post"`
+	CreatedAt time.Time `json:"created_at"`
+	Tags      []string  `json:"tags"`
+	RetweetOf string    `json:"retweet_of"`
+}
+
+// ImportResult reports what happened to each line of an
+// archive. Lines are numbered from 1.
+type ImportResult struct {
+	Imported int              `json:"imported"`
+	Skipped  int              `json:"skipped"`
+	Errors   []ImportRowError `json:"errors"`
+}
+
+type ImportRowError struct {
+	Line  int    `json:"line"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+type ImportService interface {
+	// Import creates the tweets of an archive of JSON lines for the user. Lines that cannot be imported
+	// are reported in the result and do not stop the import,
+	// only database errors do.
+	Import(user *User, r io.Reader) (*ImportResult, error)
+}
+
+// tweetImport maps a post of an imported archive to the tweet
+// created for it.
+type tweetImport struct {
+	ID         uint   `gorm:"primary_key"`
+	UserID     uint   `gorm:"not null;unique_index:uix_tweet_imports_user_id_external_id"`
+	ExternalID string `gorm:"not null;unique_index:uix_tweet_imports_user_id_external_id"`
+	TweetID    uint   `gorm:"not null"`
+	CreatedAt  time.Time
+}
+
+type tweetImportDB interface {
+	// ByExternalID returns the user's import of the post.
+	ByExternalID(userID uint, externalID string) (*tweetImport, error)
+	Create(ti *tweetImport) error
+	// inTx returns the imports written in the transaction tx.
+	inTx(tx *gorm.DB) tweetImportDB
+}
+
+func NewImportService(db *gorm.DB, ts TweetDB) ImportService {
+	return &importService{
+		tweetImportDB: &tweetImportGorm{db},
+		ts:            ts,
+	}
+}
+
+var _ ImportService = &importService{}
+
+type importService struct {
+	tweetImportDB
+	ts TweetDB
+}
+
+func (is *importService) Import(user *User, r io.Reader) (*ImportResult, error) {
+	result := ImportResult{Errors: []ImportRowError{}}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var row ImportRow
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			result.Errors = append(result.Errors, ImportRowError{Line: line, Error: "line is not valid JSON"})
+			continue
+		}
+		imported, err := is.importRow(user, &row)
+		if err != nil {
+			pErr, ok := err.(modelError)
+			if !ok {
+				return &result, err
+			}
+			result.Errors = append(result.Errors, ImportRowError{Line: line, ID: row.ID, Error: pErr.Public()})
+			continue
+		}
+		if imported {
+			result.Imported++
+		} else {
+			result.Skipped++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			result.Errors = append(result.Errors, ImportRowError{Line: line + 1, Error: "line is too long, the rest of the archive was not imported"})
+			return &result, nil
+		}
+		return &result, err
+	}
+	return &result, nil
+}
+
+// importRow reports whether the row was imported or skipped
+// because it was imported before.
+func (is *importService) importRow(user *User, row *ImportRow) (bool, error) {
+	if row.CreatedAt.IsZero() {
+		return false, ErrImportCreatedAtRequired
+	}
+	if row.CreatedAt.After(time.Now()) {
+		return false, ErrImportCreatedAtInvalid
+	}
+	externalID := row.externalID()
+	_, err := is.ByExternalID(user.ID, externalID)
+	if err == nil {
+		return false, nil
+	}
+	if err != ErrNotFound {
+		return false, err
+	}
+
+	tweet := Tweet{
+		Username:  user.Username,
+		Post:      row.Post,
+		CreatedAt: row.CreatedAt,
+	}
+	for _, name := range unique.Strings(row.Tags, utils.NormalizeText) {
+		// The tweet is kept without tags that are not valid.
+		if checkTagName(name) == nil {
+			tweet.Tags = append(tweet.Tags, name)
+		}
+	}
+	if row.RetweetOf != "" {
+		original, err := is.ByExternalID(user.ID, row.RetweetOf)
+		if err == ErrNotFound {
+			return false, ErrImportRetweetNotFound
+		}
+		if err != nil {
+			return false, err
+		}
+		tweet.RetweetID = original.TweetID
+		tweet.Quote = row.Post != ""
+	}
+	// The import is recorded along with the tweet, so a post
+	// imported concurrently by another request breaks the
+	// unique index and its tweet is not created twice.
+	err = is.ts.CreateImported(&tweet, func(tx *gorm.DB) error {
+		return is.inTx(tx).Create(&tweetImport{
+			UserID:     user.ID,
+			ExternalID: externalID,
+			TweetID:    tweet.ID,
+		})
+	})
+	if isUniqueViolation(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// externalID falls back to a hash of the row for archives
+// without IDs, so identical rows are still only imported once.
+func (row *ImportRow) externalID() string {
+	if row.ID != "" {
+		return row.ID
+	}
+	h := sha1.New()
+	io.WriteString(h, row.CreatedAt.UTC().Format(time.RFC3339Nano))
+	io.WriteString(h, "\x00"+row.Post+"\x00"+row.RetweetOf)
+	return "sha1:" + hex.EncodeToString(h.Sum(nil))
+}
+
+var _ tweetImportDB = &tweetImportGorm{}
+
+type tweetImportGorm struct {
+	db *gorm.DB
+}
+
+func (tig *tweetImportGorm) ByExternalID(userID uint, externalID string) (*tweetImport, error) {
+	var ti tweetImport
+	db := tig.db.Where("user_id = ? AND external_id = ?", userID, externalID)
+	if err := first(db, &ti); err != nil {
+		return nil, err
+	}
+	return &ti, nil
+}
+
+func (tig *tweetImportGorm) Create(ti *tweetImport) error {
+	return tig.db.Create(ti).Error
+}
+
+func (tig *tweetImportGorm) inTx(tx *gorm.DB) tweetImportDB {
+	return &tweetImportGorm{tx}
+}
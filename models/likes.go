@@ -18,8 +18,8 @@ type likeService struct {
 	LikeDB
 }
 
-func NewLikeService(db *gorm.DB) LikeService {
-	lg := &likeGorm{db}
+func NewLikeService(db *gorm.DB, bus EventBus) LikeService {
+	lg := &likeGorm{db, bus}
 	return &likeService{
 		LikeDB: &likeValidator{lg},
 	}
@@ -35,7 +35,12 @@ type LikeDB interface {
 	Delete(id, userID uint) error
 	GetTotalLikes(id uint) uint
 	GetUsers(id uint) ([]User, error)
+	GetUsersPaginated(id uint, page Page) ([]User, string, error)
 	GetUserLikes(userID uint) ([]Tweet, error)
+	// GetUserLikesPaginated leaves out the tweets viewerID
+	// cannot see, those of protected accounts they do not
+	// follow and those on either side of a block with them.
+	GetUserLikesPaginated(userID, viewerID uint, page Page) ([]Tweet, string, error)
 }
 
 type likeValFunc func(*Like) error
@@ -73,19 +78,54 @@ func (lv *likeValidator) noDuplicates(l *Like) error {
 }
 
 type likeGorm struct {
-	db *gorm.DB
+	db  *gorm.DB
+	bus EventBus
 }
 
 var _ LikeDB = &likeGorm{}
 
 func (lg *likeGorm) Create(like *Like) error {
-	return lg.db.Create(like).Error
+	tx := lg.db.Begin()
+	if err := tx.Create(like).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	dispatch, err := lg.bus.Publish(tx, &LikeAdded{TweetID: like.TweetID, UserID: like.UserID})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	dispatch()
+	return nil
 }
 
-// Delete will delete the user with the provided ID
+// Delete will delete the user's like of the tweet with the
+// provided ID
 func (lg *likeGorm) Delete(id uint, userID uint) error {
 	like := Like{TweetID: id, UserID: userID}
-	return lg.db.Delete(&like).Error
+	tx := lg.db.Begin()
+	res := tx.Delete(&like)
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	dispatch := func() {}
+	if res.RowsAffected > 0 {
+		var err error
+		dispatch, err = lg.bus.Publish(tx, &LikeRemoved{TweetID: id, UserID: userID})
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	dispatch()
+	return nil
 }
 
 func (lg *likeGorm) GetLike(id uint, userID uint) (*Like, error) {
@@ -105,6 +145,23 @@ func (lg *likeGorm) GetUserLikes(userID uint) ([]Tweet, error) {
 	return tweets, nil
 }
 
+// GetUserLikesPaginated returns a page of the tweets the user
+// liked, ordered by tweet ID.
+func (lg *likeGorm) GetUserLikesPaginated(userID, viewerID uint, page Page) ([]Tweet, string, error) {
+	var tweets []Tweet
+	db := lg.db.Table("tweets").
+		Select("tweets.*").
+		Joins("JOIN likes ON likes.tweet_id = tweets.id AND likes.user_id = ?", userID)
+	db = withoutProtected(withoutBlocked(db, viewerID), viewerID)
+	db = withoutDeactivated(db)
+	err := page.scope(db, "tweets.id").Find(&tweets).Error
+	if err != nil {
+		return nil, "", err
+	}
+	tweets, next := page.pageTweets(tweets)
+	return tweets, next, nil
+}
+
 func (lg *likeGorm) GetTotalLikes(id uint) uint {
 	var count uint
 	lg.db.Model(&Like{}).Where("tweet_id = ?", id).Count(&count)
@@ -126,3 +183,18 @@ func (lg *likeGorm) GetUsers(id uint) ([]User, error) {
 	}
 	return users, nil
 }
+
+// GetUsersPaginated returns a page of the users who liked the
+// tweet, ordered by user ID.
+func (lg *likeGorm) GetUsersPaginated(id uint, page Page) ([]User, string, error) {
+	var users []User
+	db := lg.db.Table("users").
+		Select("users.id, users.username, users.name").
+		Joins("JOIN likes ON users.id = likes.user_id AND likes.tweet_id = ?", id)
+	err := page.scope(db, "users.id").Find(&users).Error
+	if err != nil {
+		return nil, "", err
+	}
+	users, next := page.pageUsers(users)
+	return users, next, nil
+}
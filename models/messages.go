@@ -0,0 +1,505 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// maxConversationParticipants caps the size of group
+// conversations, the user who starts them included.
+const maxConversationParticipants = 10
+
+// maxMessageLength is the longest message that can be sent.
+const maxMessageLength = 10000
+
+// Conversation is a 1:1 or group conversation. Its messages
+// are read and deleted separately by each participant.
+type Conversation struct {
+	ID uint `gorm:"primary_key" json:"id"`
+	// Direct conversations are between two users and are
+	// reused whenever one messages the other.
+	Direct        bool      `gorm:"not null;default:false" json:"direct"`
+	LastMessageID uint      `gorm:"not null;index" json:"-"`
+	CreatedAt     time.Time `json:"created_at"`
+
+	// Participants holds the usernames of everyone in the
+	// conversation. It is filled in along with LastMessage and
+	// UnreadCount, which depend on who is reading.
+	Participants []string `gorm:"-" json:"participants"`
+	LastMessage  *Message `gorm:"-" json:"last_message,omitempty"`
+	UnreadCount  int      `gorm:"-" json:"unread_count"`
+}
+
+// conversationParticipant is a user's side of a conversation.
+// LastReadID is the last message they have read and ClearedID
+// the last message they deleted, along with those before it.
+type conversationParticipant struct {
+	ConversationID uint `gorm:"primary_key"`
+	UserID         uint `gorm:"primary_key"`
+	LastReadID     uint `gorm:"not null;default:0"`
+	ClearedID      uint `gorm:"not null;default:0"`
+	CreatedAt      time.Time
+}
+
+type Message struct {
+	ID             uint      `gorm:"primary_key" json:"id"`
+	ConversationID uint      `gorm:"not null;index" json:"conversation_id"`
+	SenderID       uint      `gorm:"not null" json:"-"`
+	Sender         string    `gorm:"-" json:"sender"`
+	Body           string    `gorm:"not null" json:"body"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type MessageService interface {
+	// Start sends the message to the recipients. A single
+	// recipient gets the direct conversation they already have
+	// with the sender, if any, while more recipients always
+	// start a new group conversation.
+	Start(sender *User, recipients []User, msg *Message) (*Conversation, error)
+	// Send adds the message to a conversation the sender is a
+	// participant of.
+	Send(sender *User, conversationID uint, msg *Message) error
+	// Conversation returns a conversation of the user.
+	Conversation(userID, id uint) (*Conversation, error)
+	// Conversations returns a page of the user's conversations,
+	// most recently active first. Conversations the user
+	// deleted are left out until a new message is sent.
+	Conversations(userID uint, page Page) ([]Conversation, string, error)
+	// Messages returns a page of the conversation's messages,
+	// newest first. Messages the user deleted are left out.
+	Messages(userID, conversationID uint, page Page) ([]Message, string, error)
+	// MarkRead marks every message of the conversation as read
+	// by the user.
+	MarkRead(userID, conversationID uint) error
+	// Delete removes the conversation's messages for the user
+	// only, the other participants keep them.
+	Delete(userID, conversationID uint) error
+}
+
+type messageDB interface {
+	ConversationByID(id uint) (*Conversation, error)
+	// DirectConversation returns the direct conversation
+	// between the two users.
+	DirectConversation(userID, otherID uint) (*Conversation, error)
+	// ConversationsPaginated pages through the user's
+	// conversations by their last message.
+	ConversationsPaginated(userID uint, page Page) ([]Conversation, string, error)
+	// CreateConversation creates the conversation along with
+	// its participants.
+	CreateConversation(conv *Conversation, userIDs []uint) error
+	Participant(conversationID, userID uint) (*conversationParticipant, error)
+	// Participants returns the users in the conversation.
+	Participants(conversationID uint) ([]User, error)
+	UpdateParticipant(p *conversationParticipant) error
+	MessageByID(id uint) (*Message, error)
+	// MessagesPaginated returns a page of the conversation's
+	// messages newer than afterID.
+	MessagesPaginated(conversationID, afterID uint, page Page) ([]Message, string, error)
+	// CreateMessage creates the message and makes it the last
+	// message of its conversation.
+	CreateMessage(msg *Message) error
+	// UnreadCount counts the messages newer than afterID that
+	// were not sent by the user.
+	UnreadCount(conversationID, userID, afterID uint) (int, error)
+}
+
+// NewMessageService checks blocks and the "messages from
+// followers only" setting of the recipients with the follow
+// and block services. Sent messages are streamed to every
+// participant.
+func NewMessageService(db *gorm.DB, fs FollowDB, bs BlockDB, ss StreamService) MessageService {
+	return &messageService{
+		messageDB: &messageGorm{db},
+		fs:        fs,
+		bs:        bs,
+		ss:        ss,
+	}
+}
+
+var _ MessageService = &messageService{}
+
+type messageService struct {
+	messageDB
+	fs FollowDB
+	bs BlockDB
+	ss StreamService
+}
+
+func (ms *messageService) Start(sender *User, recipients []User, msg *Message) (*Conversation, error) {
+	if err := validateMessage(msg); err != nil {
+		return nil, err
+	}
+	if len(recipients) == 0 {
+		return nil, ErrMessageRecipientsRequired
+	}
+	ids := []uint{sender.ID}
+	seen := map[uint]bool{sender.ID: true}
+	for i := range recipients {
+		recipient := &recipients[i]
+		if recipient.ID == sender.ID {
+			return nil, ErrMessageSelf
+		}
+		if seen[recipient.ID] {
+			continue
+		}
+		seen[recipient.ID] = true
+		if err := ms.canMessage(sender, recipient); err != nil {
+			return nil, err
+		}
+		ids = append(ids, recipient.ID)
+	}
+	if len(ids) > maxConversationParticipants {
+		return nil, ErrMessageTooManyRecipients
+	}
+
+	var conv *Conversation
+	if len(ids) == 2 {
+		var err error
+		conv, err = ms.DirectConversation(ids[0], ids[1])
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+	}
+	if conv == nil {
+		conv = &Conversation{Direct: len(ids) == 2}
+		if err := ms.CreateConversation(conv, ids); err != nil {
+			return nil, err
+		}
+	}
+	if err := ms.send(sender, conv.ID, msg); err != nil {
+		return nil, err
+	}
+	return ms.Conversation(sender.ID, conv.ID)
+}
+
+func (ms *messageService) Send(sender *User, conversationID uint, msg *Message) error {
+	if err := validateMessage(msg); err != nil {
+		return err
+	}
+	if _, err := ms.Participant(conversationID, sender.ID); err != nil {
+		return err
+	}
+	participants, err := ms.Participants(conversationID)
+	if err != nil {
+		return err
+	}
+	for i := range participants {
+		if participants[i].ID == sender.ID {
+			continue
+		}
+		if err := ms.canMessage(sender, &participants[i]); err != nil {
+			return err
+		}
+	}
+	return ms.send(sender, conversationID, msg)
+}
+
+// send creates the message, which the sender has read, and
+// streams it to the participants.
+func (ms *messageService) send(sender *User, conversationID uint, msg *Message) error {
+	msg.ConversationID = conversationID
+	msg.SenderID = sender.ID
+	msg.Sender = sender.Username
+	if err := ms.CreateMessage(msg); err != nil {
+		return err
+	}
+	p, err := ms.Participant(conversationID, sender.ID)
+	if err != nil {
+		return err
+	}
+	p.LastReadID = msg.ID
+	if err := ms.UpdateParticipant(p); err != nil {
+		return err
+	}
+	participants, err := ms.Participants(conversationID)
+	if err != nil {
+		return err
+	}
+	userIDs := make([]uint, len(participants))
+	for i, user := range participants {
+		userIDs[i] = user.ID
+	}
+	published := *msg
+	ms.ss.Publish(StreamMessage, &published, userIDs...)
+	return nil
+}
+
+// canMessage checks that the recipient has not blocked, nor
+// been blocked by, the sender and that the sender follows the
+// recipient if they only accept messages from their followers.
+func (ms *messageService) canMessage(sender, recipient *User) error {
+	blocked, err := ms.bs.Blocked(recipient.ID, sender.ID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrMessageBlocked
+	}
+	if !recipient.DMFollowersOnly {
+		return nil
+	}
+	_, err = ms.fs.GetFollow(recipient.ID, sender.ID)
+	if err == ErrNotFound {
+		return ErrMessageFollowersOnly
+	}
+	return err
+}
+
+func validateMessage(msg *Message) error {
+	msg.Body = strings.TrimSpace(msg.Body)
+	if msg.Body == "" {
+		return ErrMessageBodyRequired
+	}
+	if len([]rune(msg.Body)) > maxMessageLength {
+		return ErrCharMax.customCharLimitError(maxMessageLength, "message")
+	}
+	return nil
+}
+
+func (ms *messageService) Conversation(userID, id uint) (*Conversation, error) {
+	p, err := ms.Participant(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	conv, err := ms.ConversationByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := ms.fill(conv, p); err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+func (ms *messageService) Conversations(userID uint, page Page) ([]Conversation, string, error) {
+	convs, next, err := ms.ConversationsPaginated(userID, page)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range convs {
+		p, err := ms.Participant(convs[i].ID, userID)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := ms.fill(&convs[i], p); err != nil {
+			return nil, "", err
+		}
+	}
+	return convs, next, nil
+}
+
+// fill sets the participants, last message and unread count
+// of the conversation as seen by the participant.
+func (ms *messageService) fill(conv *Conversation, p *conversationParticipant) error {
+	users, err := ms.Participants(conv.ID)
+	if err != nil {
+		return err
+	}
+	conv.Participants = make([]string, len(users))
+	usernames := make(map[uint]string, len(users))
+	for i, user := range users {
+		conv.Participants[i] = user.Username
+		usernames[user.ID] = user.Username
+	}
+	if conv.LastMessageID > p.ClearedID {
+		// the last message is gone if its sender was purged
+		last, err := ms.MessageByID(conv.LastMessageID)
+		switch err {
+		case nil:
+			last.Sender = usernames[last.SenderID]
+			conv.LastMessage = last
+		case ErrNotFound:
+		default:
+			return err
+		}
+	}
+	read := p.LastReadID
+	if p.ClearedID > read {
+		read = p.ClearedID
+	}
+	conv.UnreadCount, err = ms.UnreadCount(conv.ID, p.UserID, read)
+	return err
+}
+
+func (ms *messageService) Messages(userID, conversationID uint, page Page) ([]Message, string, error) {
+	p, err := ms.Participant(conversationID, userID)
+	if err != nil {
+		return nil, "", err
+	}
+	messages, next, err := ms.MessagesPaginated(conversationID, p.ClearedID, page)
+	if err != nil {
+		return nil, "", err
+	}
+	users, err := ms.Participants(conversationID)
+	if err != nil {
+		return nil, "", err
+	}
+	usernames := make(map[uint]string, len(users))
+	for _, user := range users {
+		usernames[user.ID] = user.Username
+	}
+	for i := range messages {
+		messages[i].Sender = usernames[messages[i].SenderID]
+	}
+	return messages, next, nil
+}
+
+func (ms *messageService) MarkRead(userID, conversationID uint) error {
+	p, err := ms.Participant(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	conv, err := ms.ConversationByID(conversationID)
+	if err != nil {
+		return err
+	}
+	p.LastReadID = conv.LastMessageID
+	return ms.UpdateParticipant(p)
+}
+
+func (ms *messageService) Delete(userID, conversationID uint) error {
+	p, err := ms.Participant(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	conv, err := ms.ConversationByID(conversationID)
+	if err != nil {
+		return err
+	}
+	p.ClearedID = conv.LastMessageID
+	p.LastReadID = conv.LastMessageID
+	return ms.UpdateParticipant(p)
+}
+
+var _ messageDB = &messageGorm{}
+
+type messageGorm struct {
+	db *gorm.DB
+}
+
+func (mg *messageGorm) ConversationByID(id uint) (*Conversation, error) {
+	var conv Conversation
+	if err := first(mg.db.Where("id = ?", id), &conv); err != nil {
+		return nil, err
+	}
+	return &conv, nil
+}
+
+func (mg *messageGorm) DirectConversation(userID, otherID uint) (*Conversation, error) {
+	var conv Conversation
+	db := mg.db.Table("conversations").
+		Select("conversations.*").
+		Joins("JOIN conversation_participants a ON a.conversation_id = conversations.id AND a.user_id = ?", userID).
+		Joins("JOIN conversation_participants b ON b.conversation_id = conversations.id AND b.user_id = ?", otherID).
+		Where("conversations.direct")
+	if err := first(db, &conv); err != nil {
+		return nil, err
+	}
+	return &conv, nil
+}
+
+func (mg *messageGorm) ConversationsPaginated(userID uint, page Page) ([]Conversation, string, error) {
+	var convs []Conversation
+	db := mg.db.Table("conversations").
+		Select("conversations.*").
+		Joins("JOIN conversation_participants ON conversation_participants.conversation_id = conversations.id AND conversation_participants.user_id = ?", userID).
+		Where("conversations.last_message_id > conversation_participants.cleared_id")
+	err := page.scope(db, "conversations.last_message_id").Find(&convs).Error
+	if err != nil {
+		return nil, "", err
+	}
+	convs, next := page.pageConversations(convs)
+	return convs, next, nil
+}
+
+func (mg *messageGorm) CreateConversation(conv *Conversation, userIDs []uint) error {
+	tx := mg.db.Begin()
+	if err := tx.Create(conv).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, id := range userIDs {
+		p := conversationParticipant{ConversationID: conv.ID, UserID: id}
+		if err := tx.Create(&p).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (mg *messageGorm) Participant(conversationID, userID uint) (*conversationParticipant, error) {
+	var p conversationParticipant
+	db := mg.db.Where("conversation_id = ? AND user_id = ?", conversationID, userID)
+	if err := first(db, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (mg *messageGorm) Participants(conversationID uint) ([]User, error) {
+	var users []User
+	err := mg.db.Table("users").
+		Select("users.*").
+		Joins("JOIN conversation_participants ON conversation_participants.user_id = users.id AND conversation_participants.conversation_id = ?", conversationID).
+		Order("users.username").
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (mg *messageGorm) UpdateParticipant(p *conversationParticipant) error {
+	return mg.db.Model(&conversationParticipant{}).
+		Where("conversation_id = ? AND user_id = ?", p.ConversationID, p.UserID).
+		Updates(map[string]interface{}{
+			"last_read_id": p.LastReadID,
+			"cleared_id":   p.ClearedID,
+		}).Error
+}
+
+func (mg *messageGorm) MessageByID(id uint) (*Message, error) {
+	var msg Message
+	if err := first(mg.db.Where("id = ?", id), &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (mg *messageGorm) MessagesPaginated(conversationID, afterID uint, page Page) ([]Message, string, error) {
+	var messages []Message
+	db := mg.db.Where("conversation_id = ? AND id > ?", conversationID, afterID)
+	err := page.scope(db, "id").Find(&messages).Error
+	if err != nil {
+		return nil, "", err
+	}
+	messages, next := page.pageMessages(messages)
+	return messages, next, nil
+}
+
+func (mg *messageGorm) CreateMessage(msg *Message) error {
+	tx := mg.db.Begin()
+	if err := tx.Create(msg).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	err := tx.Model(&Conversation{}).
+		Where("id = ?", msg.ConversationID).
+		UpdateColumn("last_message_id", msg.ID).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (mg *messageGorm) UnreadCount(conversationID, userID, afterID uint) (int, error) {
+	var count int
+	err := mg.db.Model(&Message{}).
+		Where("conversation_id = ? AND id > ? AND sender_id <> ?", conversationID, afterID, userID).
+		Count(&count).Error
+	return count, err
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// schemaMigration records a migration that has been applied so
+// it is not run again.
+type schemaMigration struct {
+	Name      string `gorm:"primary_key"`
+	AppliedAt time.Time
+}
+
+// migrations are the schema changes AutoMigrate cannot make
+// itself, such as dropping columns. They are run in order and
+// each one only ever runs once. New migrations are appended to
+// the end and existing ones are never renamed.
+var migrations = []struct {
+	name      string
+	statement string
+}{
+	// sessions replaced the single remember token of each user
+	{"drop_users_remember_hash", "ALTER TABLE users DROP COLUMN IF EXISTS remember_hash"},
+	// only one export of a user can be pending, older
+	// duplicates are given up on first
+	{"fail_duplicate_pending_exports", `UPDATE exports SET status = 'failed', completed_at = now()
+		WHERE status = 'pending' AND id NOT IN (
+			SELECT MAX(id) FROM exports WHERE status = 'pending' GROUP BY user_id)`},
+	{"create_exports_pending_index", `CREATE UNIQUE INDEX IF NOT EXISTS uix_exports_user_id_pending
+		ON exports (user_id) WHERE status = 'pending'`},
+}
+
+// runMigrations applies the migrations that have not been
+// applied yet. Each one is recorded in the same transaction it
+// runs in, so a migration that fails will be tried again.
+func runMigrations(db *gorm.DB) error {
+	for _, m := range migrations {
+		tx := db.Begin()
+		res := tx.Exec(`INSERT INTO schema_migrations (name, applied_at) VALUES (?, ?)
+			ON CONFLICT DO NOTHING`, m.name, time.Now())
+		if res.Error != nil {
+			tx.Rollback()
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			tx.Rollback()
+			continue
+		}
+		if err := tx.Exec(m.statement).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// mutedUsernamesSQL selects the usernames of the users muted
+// by the user whose ID it takes.
+const mutedUsernamesSQL = `SELECT users.username FROM users JOIN mutes ON
+	mutes.muter_id = ? AND mutes.user_id = users.id`
+
+// Mute hides UserID from the timelines and notifications of
+// MuterID. Unlike a block, the muted user is not told and can
+// still follow and interact with the muter.
+type Mute struct {
+	MuterID   uint      `gorm:"primary_key" json:"muter_id"`
+	UserID    uint      `gorm:"primary_key" json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type MuteService interface {
+	MuteDB
+}
+
+type muteService struct {
+	MuteDB
+}
+
+func NewMuteService(db *gorm.DB) MuteService {
+	mg := &muteGorm{db}
+	return &muteService{
+		MuteDB: &muteValidator{mg},
+	}
+}
+
+type MuteDB interface {
+	Create(mute *Mute) error
+	GetMute(userID uint, muterID uint) (*Mute, error)
+	// GetUserMutingPaginated returns a page of the users that
+	// the user muted, ordered by user ID.
+	GetUserMutingPaginated(muterID uint, page Page) ([]User, string, error)
+	Delete(userID uint, muterID uint) error
+}
+
+type muteValidator struct {
+	MuteDB
+}
+
+type muteValFunc func(*Mute) error
+
+func runMuteValFuncs(mute *Mute, fns ...muteValFunc) error {
+	for _, fn := range fns {
+		if err := fn(mute); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mv *muteValidator) Create(mute *Mute) error {
+	err := runMuteValFuncs(mute, mv.idsRequired, mv.notSelf, mv.noDuplicates)
+	if err != nil {
+		return err
+	}
+	return mv.MuteDB.Create(mute)
+}
+
+func (mv *muteValidator) idsRequired(m *Mute) error {
+	if m.MuterID <= 0 || m.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (mv *muteValidator) notSelf(m *Mute) error {
+	if m.MuterID == m.UserID {
+		return ErrMuteSelf
+	}
+	return nil
+}
+
+func (mv *muteValidator) noDuplicates(m *Mute) error {
+	_, err := mv.GetMute(m.UserID, m.MuterID)
+	switch err {
+	case nil:
+		return ErrMuteExists
+	case ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+}
+
+type muteGorm struct {
+	db *gorm.DB
+}
+
+var _ MuteDB = &muteGorm{}
+
+func (mg *muteGorm) Create(mute *Mute) error {
+	return mg.db.Create(mute).Error
+}
+
+func (mg *muteGorm) GetMute(userID uint, muterID uint) (*Mute, error) {
+	var mute Mute
+	db := mg.db.Where("user_id = ? AND muter_id = ?", userID, muterID)
+	err := first(db, &mute)
+	return &mute, err
+}
+
+func (mg *muteGorm) GetUserMutingPaginated(muterID uint, page Page) ([]User, string, error) {
+	var users []User
+	db := mg.db.Table("users").
+		Select("users.*").
+		Joins("JOIN mutes ON mutes.user_id = users.id AND mutes.muter_id = ?", muterID)
+	err := page.scope(db, "users.id").Find(&users).Error
+	if err != nil {
+		return nil, "", err
+	}
+	users, next := page.pageUsers(users)
+	return users, next, nil
+}
+
+func (mg *muteGorm) Delete(userID uint, muterID uint) error {
+	mute := Mute{UserID: userID, MuterID: muterID}
+	return mg.db.Delete(&mute).Error
+}
+
+// withoutMuted leaves out of a tweets query the tweets of the
+// users muted by muterID, along with retweets and quotes of
+// their tweets. Like withoutBlocked, muterID may be a column.
+func withoutMuted(db *gorm.DB, muterID interface{}) *gorm.DB {
+	return db.Where("tweets.username NOT IN ("+mutedUsernamesSQL+")", muterID).
+		Where(`NOT EXISTS (
+			SELECT 1 FROM tweets AS originals
+			WHERE originals.id = tweets.retweet_id AND originals.username IN (`+mutedUsernamesSQL+`))`,
+			muterID)
+}
@@ -0,0 +1,371 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Types of notifications
+const (
+	NotificationLike    = "like"
+	NotificationFollow  = "follow"
+	NotificationRetweet = "retweet"
+	NotificationMention = "mention"
+	// NotificationFollowRequest is sent to protected accounts
+	// and removed once the request is approved or rejected.
+	NotificationFollowRequest = "follow_request"
+)
+
+// maxGroupActors is the number of actor usernames returned
+// with each notification group.
+const maxGroupActors = 3
+
+// hiddenActorsSQL selects the IDs of the actors whose
+// notifications are not shown to the user: the users they
+// muted and the users on either side of a block with them.
+// It is bound with the user's ID three times, see hiddenActors.
+const hiddenActorsSQL = `SELECT user_id FROM mutes WHERE muter_id = ?
+	UNION SELECT user_id FROM blocks WHERE blocker_id = ?
+	UNION SELECT blocker_id FROM blocks WHERE user_id = ?`
+
+// hiddenActors returns the args hiddenActorsSQL is bound with.
+func hiddenActors(userID uint) []interface{} {
+	return []interface{}{userID, userID, userID}
+}
+
+// Notification tells a user that another user acted on them
+// or their tweets. TweetID is the liked, retweeted or
+// mentioning tweet and is zero for follows.
+type Notification struct {
+	ID        uint       `gorm:"primary_key" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"-"`
+	ActorID   uint       `gorm:"not null" json:"-"`
+	Type      string     `gorm:"not null" json:"type"`
+	TweetID   uint       `json:"tweet_id,omitempty"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// NotificationGroup is every notification of the same type
+// about the same tweet, such as all of the likes on a tweet.
+// Actors holds the usernames of the most recent actors.
+type NotificationGroup struct {
+	Type        string    `json:"type"`
+	TweetID     uint      `json:"tweet_id,omitempty"`
+	Actors      []string  `gorm:"-" json:"actors"`
+	ActorsCount int       `json:"actors_count"`
+	Message     string    `gorm:"-" json:"message"`
+	Unread      bool      `json:"unread"`
+	LatestID    uint      `json:"-"`
+	LatestAt    time.Time `json:"created_at"`
+}
+
+type NotificationService interface {
+	// Notify creates the notification unless the actor and
+	// the recipient are the same user, and streams it to the
+	// recipient.
+	Notify(n *Notification) error
+	// Undo removes the notification created for an action
+	// that has been reversed, such as an unfollow.
+	Undo(n *Notification) error
+	// Groups returns a page of the user's notification groups,
+	// most recently active first, with their actors and
+	// messages filled in. Notifications from muted and blocked
+	// users are left out.
+	Groups(userID uint, page Page) ([]NotificationGroup, string, error)
+	// inTx returns the service writing in the transaction tx,
+	// for event subscribers.
+	inTx(tx *gorm.DB) NotificationService
+	NotificationDB
+}
+
+type NotificationDB interface {
+	Create(n *Notification) error
+	// Delete removes the notifications matching the user,
+	// actor, type and tweet of n.
+	Delete(n *Notification) error
+	// DeleteByTweet removes every notification about the tweet.
+	DeleteByTweet(tweetID uint) error
+	GroupsPaginated(userID uint, page Page) ([]NotificationGroup, string, error)
+	// GroupActors returns the usernames of the latest actors of
+	// the group.
+	GroupActors(userID uint, group *NotificationGroup, limit int) ([]string, error)
+	// MarkRead marks the user's notifications as read. If the
+	// type is empty all notifications are marked, otherwise only
+	// the group matching the type and tweet.
+	MarkRead(userID uint, notificationType string, tweetID uint) error
+	// VisibleActor returns the username of the notification's
+	// actor, or ErrNotFound if the user hides notifications
+	// from them.
+	VisibleActor(n *Notification) (string, error)
+}
+
+// NotificationEvent is the data of notification stream events.
+type NotificationEvent struct {
+	Type      string    `json:"type"`
+	TweetID   uint      `json:"tweet_id,omitempty"`
+	Actor     string    `json:"actor"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewNotificationService(db *gorm.DB, ss StreamService) NotificationService {
+	return &notificationService{
+		NotificationDB: &notificationValidator{&notificationGorm{db}},
+		ss:             ss,
+	}
+}
+
+type notificationService struct {
+	NotificationDB
+	ss StreamService
+}
+
+func (ns *notificationService) Notify(n *Notification) error {
+	if n.UserID == n.ActorID {
+		return nil
+	}
+	if err := ns.Create(n); err != nil {
+		return err
+	}
+	actor, err := ns.VisibleActor(n)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		return nil
+	default:
+		return err
+	}
+	ns.ss.Publish(StreamNotification, &NotificationEvent{
+		Type:      n.Type,
+		TweetID:   n.TweetID,
+		Actor:     actor,
+		Message:   groupMessage(n.Type, []string{actor}, 1),
+		CreatedAt: n.CreatedAt,
+	}, n.UserID)
+	return nil
+}
+
+func (ns *notificationService) inTx(tx *gorm.DB) NotificationService {
+	return &notificationService{
+		NotificationDB: &notificationValidator{&notificationGorm{tx}},
+		ss:             ns.ss,
+	}
+}
+
+func (ns *notificationService) Undo(n *Notification) error {
+	if n.UserID == n.ActorID {
+		return nil
+	}
+	return ns.Delete(n)
+}
+
+func (ns *notificationService) Groups(userID uint, page Page) ([]NotificationGroup, string, error) {
+	groups, next, err := ns.GroupsPaginated(userID, page)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range groups {
+		group := &groups[i]
+		group.Actors, err = ns.GroupActors(userID, group, maxGroupActors)
+		if err != nil {
+			return nil, "", err
+		}
+		group.Message = groupMessage(group.Type, group.Actors, group.ActorsCount)
+	}
+	return groups, next, nil
+}
+
+// groupMessage builds messages such as
+// "alice and 3 others liked your tweet".
+func groupMessage(notificationType string, actors []string, count int) string {
+	var who string
+	switch {
+	case len(actors) == 0:
+		who = "Someone"
+	case count == 2 && len(actors) == 2:
+		who = actors[0] + " and " + actors[1]
+	case count > 1:
+		others := "others"
+		if count == 2 {
+			others = "other"
+		}
+		who = fmt.Sprintf("%s and %d %s", actors[0], count-1, others)
+	default:
+		who = actors[0]
+	}
+	switch notificationType {
+	case NotificationLike:
+		return who + " liked your tweet"
+	case NotificationRetweet:
+		return who + " retweeted your tweet"
+	case NotificationFollow:
+		return who + " followed you"
+	case NotificationMention:
+		return who + " mentioned you"
+	case NotificationFollowRequest:
+		return who + " requested to follow you"
+	}
+	return who
+}
+
+type notificationValidator struct {
+	NotificationDB
+}
+
+func (nv *notificationValidator) Create(n *Notification) error {
+	err := runNotificationValFuncs(n,
+		nv.userIDRequired,
+		nv.actorIDRequired,
+		nv.typeValid,
+	)
+	if err != nil {
+		return err
+	}
+	return nv.NotificationDB.Create(n)
+}
+
+func (nv *notificationValidator) Delete(n *Notification) error {
+	err := runNotificationValFuncs(n,
+		nv.userIDRequired,
+		nv.actorIDRequired,
+		nv.typeValid,
+	)
+	if err != nil {
+		return err
+	}
+	return nv.NotificationDB.Delete(n)
+}
+
+func (nv *notificationValidator) MarkRead(userID uint, notificationType string, tweetID uint) error {
+	n := Notification{UserID: userID, Type: notificationType}
+	fns := []notificationValFunc{nv.userIDRequired}
+	if notificationType != "" {
+		fns = append(fns, nv.typeValid)
+	}
+	if err := runNotificationValFuncs(&n, fns...); err != nil {
+		return err
+	}
+	return nv.NotificationDB.MarkRead(userID, notificationType, tweetID)
+}
+
+type notificationValFunc func(*Notification) error
+
+func runNotificationValFuncs(n *Notification, fns ...notificationValFunc) error {
+	for _, fn := range fns {
+		if err := fn(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (nv *notificationValidator) userIDRequired(n *Notification) error {
+	if n.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (nv *notificationValidator) actorIDRequired(n *Notification) error {
+	if n.ActorID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (nv *notificationValidator) typeValid(n *Notification) error {
+	switch n.Type {
+	case NotificationLike, NotificationFollow, NotificationRetweet, NotificationMention, NotificationFollowRequest:
+		return nil
+	}
+	return ErrNotificationTypeInvalid
+}
+
+var _ NotificationDB = &notificationGorm{}
+
+type notificationGorm struct {
+	db *gorm.DB
+}
+
+func (ng *notificationGorm) Create(n *Notification) error {
+	return ng.db.Create(n).Error
+}
+
+func (ng *notificationGorm) Delete(n *Notification) error {
+	return ng.db.
+		Where("user_id = ? AND actor_id = ? AND type = ? AND tweet_id = ?", n.UserID, n.ActorID, n.Type, n.TweetID).
+		Delete(&Notification{}).Error
+}
+
+func (ng *notificationGorm) DeleteByTweet(tweetID uint) error {
+	return ng.db.Where("tweet_id = ?", tweetID).Delete(&Notification{}).Error
+}
+
+// GroupsPaginated groups the notifications by type and tweet
+// and pages through the groups by their latest notification.
+func (ng *notificationGorm) GroupsPaginated(userID uint, page Page) ([]NotificationGroup, string, error) {
+	var groups []NotificationGroup
+	db := ng.db.Table("notifications").
+		Select(`type, tweet_id, COUNT(*) AS actors_count, MAX(id) AS latest_id,
+			MAX(created_at) AS latest_at, BOOL_OR(read_at IS NULL) AS unread`).
+		Where("user_id = ?", userID).
+		Where("actor_id NOT IN ("+hiddenActorsSQL+")", hiddenActors(userID)...).
+		Group("type, tweet_id")
+	err := page.scopeGroups(db, "MAX(id)").Scan(&groups).Error
+	if err != nil {
+		return nil, "", err
+	}
+	more, n := page.more(len(groups))
+	groups = groups[:n]
+	var next string
+	if more {
+		next = EncodeCursor(groups[n-1].LatestID)
+	}
+	if page.After > 0 {
+		for i, j := 0, len(groups)-1; i < j; i, j = i+1, j-1 {
+			groups[i], groups[j] = groups[j], groups[i]
+		}
+	}
+	return groups, next, nil
+}
+
+func (ng *notificationGorm) GroupActors(userID uint, group *NotificationGroup, limit int) ([]string, error) {
+	var usernames []string
+	err := ng.db.Table("notifications").
+		Joins("JOIN users ON users.id = notifications.actor_id").
+		Where("notifications.user_id = ? AND notifications.type = ? AND notifications.tweet_id = ?", userID, group.Type, group.TweetID).
+		Where("notifications.actor_id NOT IN ("+hiddenActorsSQL+")", hiddenActors(userID)...).
+		Order("notifications.id desc").
+		Limit(limit).
+		Pluck("users.username", &usernames).Error
+	if err != nil {
+		return nil, err
+	}
+	return usernames, nil
+}
+
+func (ng *notificationGorm) MarkRead(userID uint, notificationType string, tweetID uint) error {
+	db := ng.db.Model(&Notification{}).Where("user_id = ? AND read_at IS NULL", userID)
+	if notificationType != "" {
+		db = db.Where("type = ? AND tweet_id = ?", notificationType, tweetID)
+	}
+	return db.UpdateColumn("read_at", time.Now()).Error
+}
+
+func (ng *notificationGorm) VisibleActor(n *Notification) (string, error) {
+	var usernames []string
+	err := ng.db.Model(&User{}).
+		Where("id = ?", n.ActorID).
+		Where("id NOT IN ("+hiddenActorsSQL+")", hiddenActors(n.UserID)...).
+		Pluck("username", &usernames).Error
+	if err != nil {
+		return "", err
+	}
+	if len(usernames) == 0 {
+		return "", ErrNotFound
+	}
+	return usernames[0], nil
+}
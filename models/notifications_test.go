@@ -0,0 +1,26 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupMessage(t *testing.T) {
+	tests := []struct {
+		notificationType string
+		actors           []string
+		count            int
+		want             string
+	}{
+		{NotificationFollow, []string{"alice"}, 1, "alice followed you"},
+		{NotificationLike, []string{"alice", "bob"}, 2, "alice and bob liked your tweet"},
+		{NotificationRetweet, []string{"alice"}, 2, "alice and 1 other retweeted your tweet"},
+		{NotificationLike, []string{"alice", "bob", "carol"}, 4, "alice and 3 others liked your tweet"},
+		{NotificationMention, nil, 0, "Someone mentioned you"},
+	}
+	for _, test := range tests {
+		got := groupMessage(test.notificationType, test.actors, test.count)
+		assert.Equal(t, test.want, got)
+	}
+}
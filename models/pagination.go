@@ -0,0 +1,206 @@
+package models
+
+import (
+	"encoding/base64"
+	"strconv"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// DefaultPageLimit is used when a page is requested
+	// without a limit.
+	DefaultPageLimit = 20
+	// MaxPageLimit is the largest page that will be returned.
+	MaxPageLimit = 100
+)
+
+// Page describes which slice of a list should be returned.
+// Lists are ordered newest first. Before returns the rows
+// older than the cursor and After returns the rows newer than
+// the cursor. If both are empty the newest rows are returned.
+type Page struct {
+	Limit  int
+	Before uint
+	After  uint
+}
+
+// NewPage builds a Page from the raw limit and the opaque
+// before and after cursors. An invalid cursor will return
+// ErrCursorInvalid.
+func NewPage(limit int, before, after string) (Page, error) {
+	page := Page{Limit: limit}
+	var err error
+	if before != "" {
+		if page.Before, err = DecodeCursor(before); err != nil {
+			return page, err
+		}
+	}
+	if after != "" {
+		if page.After, err = DecodeCursor(after); err != nil {
+			return page, err
+		}
+	}
+	if page.Before > 0 && page.After > 0 {
+		return page, ErrCursorInvalid
+	}
+	return page, nil
+}
+
+// EncodeCursor turns a row key into an opaque cursor.
+func EncodeCursor(key uint) string {
+	s := strconv.FormatUint(uint64(key), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// DecodeCursor turns an opaque cursor back into a row key.
+func DecodeCursor(cursor string) (uint, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrCursorInvalid
+	}
+	key, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil || key == 0 {
+		return 0, ErrCursorInvalid
+	}
+	return uint(key), nil
+}
+
+// size returns the page limit clamped between 1 and
+// MaxPageLimit.
+func (p Page) size() int {
+	switch {
+	case p.Limit <= 0:
+		return DefaultPageLimit
+	case p.Limit > MaxPageLimit:
+		return MaxPageLimit
+	}
+	return p.Limit
+}
+
+// scope filters and orders the query by the provided key
+// column. One more row than the page size is requested so
+// nextCursor can tell if there is another page.
+//
+// After pages are read oldest first so the rows closest to
+// the cursor are returned. The caller is expected to reverse
+// them once the page has been trimmed.
+func (p Page) scope(db *gorm.DB, column string) *gorm.DB {
+	switch {
+	case p.After > 0:
+		db = db.Where(column+" > ?", p.After).Order(column + " asc")
+	case p.Before > 0:
+		db = db.Where(column+" < ?", p.Before).Order(column + " desc")
+	default:
+		db = db.Order(column + " desc")
+	}
+	return db.Limit(p.size() + 1)
+}
+
+// scopeGroups is scope for grouped queries, where the key is
+// an aggregate such as MAX(id) and has to be filtered with
+// HAVING.
+func (p Page) scopeGroups(db *gorm.DB, aggregate string) *gorm.DB {
+	switch {
+	case p.After > 0:
+		db = db.Having(aggregate+" > ?", p.After).Order(aggregate + " asc")
+	case p.Before > 0:
+		db = db.Having(aggregate+" < ?", p.Before).Order(aggregate + " desc")
+	default:
+		db = db.Order(aggregate + " desc")
+	}
+	return db.Limit(p.size() + 1)
+}
+
+// more reports whether the query returned more rows than fit
+// in the page, along with the number of rows to keep.
+func (p Page) more(fetched int) (bool, int) {
+	if fetched > p.size() {
+		return true, p.size()
+	}
+	return false, fetched
+}
+
+// pageTweets trims the tweets fetched with scope down to the
+// page size and returns them newest first along with the
+// cursor of the next page.
+func (p Page) pageTweets(tweets []Tweet) ([]Tweet, string) {
+	more, n := p.more(len(tweets))
+	tweets = tweets[:n]
+	var next string
+	if more {
+		next = EncodeCursor(tweets[n-1].ID)
+	}
+	if p.After > 0 {
+		for i, j := 0, len(tweets)-1; i < j; i, j = i+1, j-1 {
+			tweets[i], tweets[j] = tweets[j], tweets[i]
+		}
+	}
+	return tweets, next
+}
+
+// pageUsers is the same as pageTweets but for users.
+func (p Page) pageUsers(users []User) ([]User, string) {
+	more, n := p.more(len(users))
+	users = users[:n]
+	var next string
+	if more {
+		next = EncodeCursor(users[n-1].ID)
+	}
+	if p.After > 0 {
+		for i, j := 0, len(users)-1; i < j; i, j = i+1, j-1 {
+			users[i], users[j] = users[j], users[i]
+		}
+	}
+	return users, next
+}
+
+// pageMessages is the same as pageTweets but for messages.
+func (p Page) pageMessages(messages []Message) ([]Message, string) {
+	more, n := p.more(len(messages))
+	messages = messages[:n]
+	var next string
+	if more {
+		next = EncodeCursor(messages[n-1].ID)
+	}
+	if p.After > 0 {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	return messages, next
+}
+
+// pageConversations is the same as pageTweets but for
+// conversations, which are keyed by their last message.
+func (p Page) pageConversations(convs []Conversation) ([]Conversation, string) {
+	more, n := p.more(len(convs))
+	convs = convs[:n]
+	var next string
+	if more {
+		next = EncodeCursor(convs[n-1].LastMessageID)
+	}
+	if p.After > 0 {
+		for i, j := 0, len(convs)-1; i < j; i, j = i+1, j-1 {
+			convs[i], convs[j] = convs[j], convs[i]
+		}
+	}
+	return convs, next
+}
+
+// pageDeliveries is the same as pageTweets but for webhook
+// deliveries.
+func (p Page) pageDeliveries(deliveries []WebhookDelivery) ([]WebhookDelivery, string) {
+	more, n := p.more(len(deliveries))
+	deliveries = deliveries[:n]
+	var next string
+	if more {
+		next = EncodeCursor(deliveries[n-1].ID)
+	}
+	if p.After > 0 {
+		for i, j := 0, len(deliveries)-1; i < j; i, j = i+1, j-1 {
+			deliveries[i], deliveries[j] = deliveries[j], deliveries[i]
+		}
+	}
+	return deliveries, next
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursor(t *testing.T) {
+	cursor := EncodeCursor(1006)
+	key, err := DecodeCursor(cursor)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1006), key)
+
+	for _, bad := range []string{"not-a-cursor", "", EncodeCursor(0)} {
+		_, err := DecodeCursor(bad)
+		assert.Equal(t, ErrCursorInvalid, err, bad)
+	}
+}
+
+func TestNewPage(t *testing.T) {
+	page, err := NewPage(0, EncodeCursor(10), "")
+	assert.Nil(t, err)
+	assert.Equal(t, uint(10), page.Before)
+	assert.Equal(t, DefaultPageLimit, page.size())
+
+	page, err = NewPage(1000, "", EncodeCursor(5))
+	assert.Nil(t, err)
+	assert.Equal(t, uint(5), page.After)
+	assert.Equal(t, MaxPageLimit, page.size())
+
+	_, err = NewPage(10, EncodeCursor(10), EncodeCursor(5))
+	assert.Equal(t, ErrCursorInvalid, err)
+}
+
+func TestPageTweets(t *testing.T) {
+	// before pages are fetched newest first
+	tweets := []Tweet{{ID: 4}, {ID: 3}, {ID: 2}, {ID: 1}}
+	page := Page{Limit: 3}
+	got, next := page.pageTweets(tweets)
+	assert.Len(t, got, 3)
+	assert.Equal(t, EncodeCursor(2), next)
+
+	// after pages are fetched oldest first and returned newest first
+	tweets = []Tweet{{ID: 2}, {ID: 3}, {ID: 4}}
+	page = Page{Limit: 5, After: 1}
+	got, next = page.pageTweets(tweets)
+	assert.Equal(t, "", next)
+	assert.Equal(t, uint(4), got[0].ID)
+	assert.Equal(t, uint(2), got[2].ID)
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"chirp.com/pkg/hash"
 	"chirp.com/pkg/rand"
 	"github.com/jinzhu/gorm"
@@ -15,6 +17,9 @@ type pwReset struct {
 
 type pwResetDB interface {
 	ByToken(token string) (*pwReset, error)
+	// CountSince returns the number of reset tokens created for
+	// the user after the given time, including used tokens.
+	CountSince(userID uint, since time.Time) (int, error)
 	Create(pwr *pwReset) error
 	Delete(id uint) error
 }
@@ -72,6 +77,16 @@ func (pwrg *pwResetGorm) ByToken(tokenHash string) (*pwReset, error) {
 	return &pwr, nil
 }
 
+// CountSince looks at soft deleted tokens as well so a user
+// cannot get around the rate limit by using their tokens.
+func (pwrg *pwResetGorm) CountSince(userID uint, since time.Time) (int, error) {
+	var count int
+	err := pwrg.db.Unscoped().Model(&pwReset{}).
+		Where("user_id = ? AND created_at > ?", userID, since).
+		Count(&count).Error
+	return count, err
+}
+
 func (pwrg *pwResetGorm) Create(pwr *pwReset) error {
 	return pwrg.db.Create(pwr).Error
 }
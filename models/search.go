@@ -0,0 +1,320 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"chirp.com/internal/utils"
+	"github.com/jinzhu/gorm"
+)
+
+// searchDateLayout is the layout of the since: and until:
+// operators.
+const searchDateLayout = "2006-01-02"
+
+// userSearchLimit is the number of users returned by a user
+// search when no limit is given.
+const userSearchLimit = 10
+
+// rebuildBatchSize is the number of tweets indexed per update
+// when the search index is rebuilt.
+const rebuildBatchSize = 1000
+
+// SearchQuery is a parsed search string. Terms are matched
+// anywhere in the post and each phrase must appear as is.
+type SearchQuery struct {
+	Terms   []string
+	Phrases []string
+	From    string
+	Tags    []string
+	Since   *time.Time
+	Until   *time.Time
+}
+
+// ParseSearchQuery parses a search string made up of words,
+// "quoted phrases" and the from:username, #tag,
+// since:2006-01-02 and until:2006-01-02 operators.
+func ParseSearchQuery(q string) (*SearchQuery, error) {
+	var query SearchQuery
+	for len(q) > 0 {
+		q = strings.TrimLeft(q, " \t\n")
+		if q == "" {
+			break
+		}
+		if q[0] == '"' {
+			// an unterminated phrase runs to the end of the query
+			phrase, rest := q[1:], ""
+			if end := strings.IndexByte(phrase, '"'); end >= 0 {
+				phrase, rest = phrase[:end], phrase[end+1:]
+			}
+			if phrase = strings.TrimSpace(phrase); phrase != "" {
+				query.Phrases = append(query.Phrases, phrase)
+			}
+			q = rest
+			continue
+		}
+		token := q
+		if end := strings.IndexAny(q, " \t\n"); end >= 0 {
+			token = q[:end]
+		}
+		q = q[len(token):]
+		if err := query.addToken(token); err != nil {
+			return nil, err
+		}
+	}
+	if query.empty() {
+		return nil, ErrSearchQueryRequired
+	}
+	return &query, nil
+}
+
+func (sq *SearchQuery) addToken(token string) error {
+	lower := strings.ToLower(token)
+	switch {
+	case strings.HasPrefix(lower, "from:"):
+		sq.From = utils.NormalizeText(strings.TrimPrefix(lower[len("from:"):], "@"))
+	case strings.HasPrefix(lower, "since:"):
+		t, err := time.Parse(searchDateLayout, lower[len("since:"):])
+		if err != nil {
+			return ErrSearchDateInvalid
+		}
+		sq.Since = &t
+	case strings.HasPrefix(lower, "until:"):
+		t, err := time.Parse(searchDateLayout, lower[len("until:"):])
+		if err != nil {
+			return ErrSearchDateInvalid
+		}
+		// until is inclusive of the whole day
+		t = t.AddDate(0, 0, 1)
+		sq.Until = &t
+	case strings.HasPrefix(token, "#"):
+		if tag := utils.NormalizeText(token[1:]); tag != "" {
+			sq.Tags = append(sq.Tags, tag)
+		}
+	default:
+		sq.Terms = append(sq.Terms, token)
+	}
+	return nil
+}
+
+// hasText reports whether the query needs the full-text index.
+func (sq *SearchQuery) hasText() bool {
+	return len(sq.Terms) > 0 || len(sq.Phrases) > 0
+}
+
+func (sq *SearchQuery) empty() bool {
+	return !sq.hasText() && sq.From == "" && len(sq.Tags) == 0 &&
+		sq.Since == nil && sq.Until == nil
+}
+
+// SearchService is used to search through tweets and users.
+type SearchService interface {
+	// Tweets returns a page of the tweets matching the search
+	// string, best matches first. Search results are ranked so
+	// they can only be paged forward with the before cursor.
+	// Tweets on either side of a block with the caller and
+	// tweets of protected accounts the caller does not follow
+	// are left out, callerID may be zero for signed out users.
+	Tweets(q string, callerID uint, page Page) ([]Tweet, string, error)
+	// Users returns the users whose username or name starts with
+	// or closely resembles q. Accounts followed by the caller are
+	// ranked first, callerID may be zero for signed out users.
+	Users(q string, callerID uint, limit int) ([]User, error)
+	// Rebuild backfills the search index for every tweet and
+	// returns the number of tweets indexed.
+	Rebuild() (int, error)
+	SearchDB
+}
+
+type SearchDB interface {
+	SearchTweets(query *SearchQuery, callerID uint, page Page) ([]Tweet, string, error)
+	SearchUsers(q string, callerID uint, limit int) ([]User, error)
+	// IndexTweets indexes up to limit tweets with an ID greater
+	// than afterID and returns the last ID indexed along with
+	// the number of tweets indexed.
+	IndexTweets(afterID uint, limit int) (uint, int, error)
+}
+
+func NewSearchService(db *gorm.DB) SearchService {
+	return &searchService{
+		SearchDB: &searchGorm{db},
+	}
+}
+
+type searchService struct {
+	SearchDB
+}
+
+func (ss *searchService) Tweets(q string, callerID uint, page Page) ([]Tweet, string, error) {
+	query, err := ParseSearchQuery(q)
+	if err != nil {
+		return nil, "", err
+	}
+	if page.After > 0 {
+		return nil, "", ErrCursorInvalid
+	}
+	return ss.SearchTweets(query, callerID, page)
+}
+
+func (ss *searchService) Users(q string, callerID uint, limit int) ([]User, error) {
+	q = utils.NormalizeText(strings.TrimPrefix(strings.TrimSpace(q), "@"))
+	if q == "" {
+		return nil, ErrSearchQueryRequired
+	}
+	switch {
+	case limit <= 0:
+		limit = userSearchLimit
+	case limit > MaxPageLimit:
+		limit = MaxPageLimit
+	}
+	return ss.SearchUsers(q, callerID, limit)
+}
+
+func (ss *searchService) Rebuild() (int, error) {
+	var total int
+	var lastID uint
+	for {
+		id, n, err := ss.IndexTweets(lastID, rebuildBatchSize)
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < rebuildBatchSize {
+			return total, nil
+		}
+		lastID = id
+	}
+}
+
+var _ SearchDB = &searchGorm{}
+
+type searchGorm struct {
+	db *gorm.DB
+}
+
+// SearchTweets pages through the results with a (rank, id)
+// keyset. The before cursor is the ID of the last tweet of the
+// previous page and its rank is worked out again from the
+// index, so the cursor does not need to hold the rank.
+func (sg *searchGorm) SearchTweets(query *SearchQuery, callerID uint, page Page) ([]Tweet, string, error) {
+	var tweets []Tweet
+	db := withoutBlocked(sg.db.Preload("Retweet").Model(&Tweet{}), callerID)
+	db = withoutDeactivated(withoutProtected(db, callerID))
+	if query.hasText() {
+		var parts []string
+		var args []interface{}
+		if len(query.Terms) > 0 {
+			parts = append(parts, "plainto_tsquery('english', ?)")
+			args = append(args, strings.Join(query.Terms, " "))
+		}
+		for _, phrase := range query.Phrases {
+			parts = append(parts, "phraseto_tsquery('english', ?)")
+			args = append(args, phrase)
+		}
+		tsquery := "(" + strings.Join(parts, " && ") + ")"
+		db = db.Select("tweets.*, ts_rank(tweets.search_vector, "+tsquery+") AS rank", args...).
+			Where("tweets.search_vector @@ "+tsquery, args...).
+			Order("rank desc")
+		if page.Before > 0 {
+			keyset := append(append([]interface{}{}, args...), args...)
+			keyset = append(keyset, page.Before, page.Before)
+			db = db.Where(`(ts_rank(tweets.search_vector, `+tsquery+`), tweets.id) <
+				((SELECT ts_rank(c.search_vector, `+tsquery+`) FROM tweets c WHERE c.id = ?), ?)`,
+				keyset...)
+		}
+	} else if page.Before > 0 {
+		db = db.Where("tweets.id < ?", page.Before)
+	}
+	if query.From != "" {
+		db = db.Where("tweets.username = ?", query.From)
+	}
+	for _, tag := range query.Tags {
+		db = db.Where(`EXISTS (
+			SELECT 1 FROM taggings JOIN tags ON tags.id = taggings.tag_id
+			WHERE taggings.tweet_id = tweets.id AND tags.name = ?)`, tag)
+	}
+	if query.Since != nil {
+		db = db.Where("tweets.created_at >= ?", *query.Since)
+	}
+	if query.Until != nil {
+		db = db.Where("tweets.created_at < ?", *query.Until)
+	}
+	err := db.Order("tweets.id desc").
+		Limit(page.size() + 1).
+		Find(&tweets).Error
+	if err != nil {
+		return nil, "", err
+	}
+	tweets, next := page.pageTweets(tweets)
+	return tweets, next, nil
+}
+
+// SearchUsers matches prefixes of the username and of each
+// word of the name, along with trigram matches for typos.
+// Only public fields of the users are returned.
+func (sg *searchGorm) SearchUsers(q string, callerID uint, limit int) ([]User, error) {
+	var users []User
+	prefix := likeEscaper.Replace(q) + "%"
+	err := sg.db.Table("users").
+		Select("users.id, users.username, users.name, users.created_at").
+		Joins("LEFT JOIN follows ON follows.user_id = users.id AND follows.follower_id = ?", callerID).
+		Where("users.deleted_at IS NULL").
+		Where(`users.username LIKE ? OR lower(users.name) LIKE ? OR lower(users.name) LIKE ?
+			OR users.username % ? OR lower(users.name) % ?`,
+			prefix, prefix, "% "+prefix, q, q).
+		Order("follows.user_id IS NOT NULL desc").
+		Order(gorm.Expr("users.username LIKE ? desc", prefix)).
+		Order(gorm.Expr("GREATEST(similarity(users.username, ?), similarity(lower(users.name), ?)) desc", q, q)).
+		Order("users.username").
+		Limit(limit).
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// likeEscaper escapes the LIKE wildcards so they are matched
+// literally, underscores being common in usernames.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (sg *searchGorm) IndexTweets(afterID uint, limit int) (uint, int, error) {
+	var ids []uint
+	err := sg.db.Unscoped().Model(&Tweet{}).
+		Where("id > ?", afterID).
+		Order("id").
+		Limit(limit).
+		Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return afterID, 0, err
+	}
+	err = sg.db.Exec(`UPDATE tweets SET search_vector = to_tsvector('english', coalesce(post, ''))
+		WHERE id IN (?)`, ids).Error
+	if err != nil {
+		return afterID, 0, err
+	}
+	return ids[len(ids)-1], len(ids), nil
+}
+
+// migrateSearch adds the search column and GIN index to the
+// tweets table along with a trigger that keeps the column up
+// to date as tweets are created and edited. The users table
+// gets trigram indexes for user search.
+func migrateSearch(db *gorm.DB) error {
+	statements := []string{
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+		`CREATE INDEX IF NOT EXISTS idx_users_username_trgm ON users USING GIN (username gin_trgm_ops)`,
+		`CREATE INDEX IF NOT EXISTS idx_users_name_trgm ON users USING GIN (lower(name) gin_trgm_ops)`,
+		`ALTER TABLE tweets ADD COLUMN IF NOT EXISTS search_vector tsvector`,
+		`CREATE INDEX IF NOT EXISTS idx_tweets_search_vector ON tweets USING GIN (search_vector)`,
+		`DROP TRIGGER IF EXISTS tweets_search_vector_update ON tweets`,
+		`CREATE TRIGGER tweets_search_vector_update BEFORE INSERT OR UPDATE OF post ON tweets
+			FOR EACH ROW EXECUTE PROCEDURE tsvector_update_trigger(search_vector, 'pg_catalog.english', post)`,
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
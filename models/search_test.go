@@ -0,0 +1,31 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	since := time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2018, 6, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		q    string
+		want *SearchQuery
+		err  error
+	}{
+		{"game seven", &SearchQuery{Terms: []string{"game", "seven"}}, nil},
+		{`"game 7" lakers`, &SearchQuery{Phrases: []string{"game 7"}, Terms: []string{"lakers"}}, nil},
+		{`from:@BobbyD "unterminated phrase`, &SearchQuery{From: "bobbyd", Phrases: []string{"unterminated phrase"}}, nil},
+		{"#Lakers #okc", &SearchQuery{Tags: []string{"lakers", "okc"}}, nil},
+		{"since:2018-05-01 until:2018-06-01", &SearchQuery{Since: &since, Until: &until}, nil},
+		{"since:May", nil, ErrSearchDateInvalid},
+		{`  "" `, nil, ErrSearchQueryRequired},
+	}
+	for _, test := range tests {
+		got, err := ParseSearchQuery(test.q)
+		assert.Equal(t, test.err, err, test.q)
+		assert.Equal(t, test.want, got, test.q)
+	}
+}
@@ -25,16 +25,84 @@ func WithLogMode(mode bool) ServicesConfig {
 	}
 }
 
+// WithEventBus has to come before the user, tweet, like,
+// follow and block services, which publish events to it.
+func WithEventBus() ServicesConfig {
+	return func(s *Services) error {
+		s.Events = NewEventBus(s.db)
+		return nil
+	}
+}
+
+// WithSubscriber registers a synchronous subscriber to the
+// events with the names. It has to come after WithEventBus and
+// the services the handler uses.
+func WithSubscriber(name string, handler EventHandler, events ...string) ServicesConfig {
+	return func(s *Services) error {
+		return s.Events.Subscribe(name, handler, false, events...)
+	}
+}
+
+// WithAsyncSubscriber registers a subscriber to the events
+// with the names that runs in the background. It has to come
+// after WithEventBus and the services the handler uses.
+func WithAsyncSubscriber(name string, handler EventHandler, events ...string) ServicesConfig {
+	return func(s *Services) error {
+		return s.Events.Subscribe(name, handler, true, events...)
+	}
+}
+
+// WithNotificationSubscriber sends the notifications about
+// likes, follows, follow requests, retweets and mentions as
+// they happen. It has to come after the notification service.
+func WithNotificationSubscriber() ServicesConfig {
+	return func(s *Services) error {
+		n := notifier{ns: s.Notification}
+		return WithSubscriber("notifications", n.handle,
+			EventTweetCreated, EventTweetDeleted,
+			EventLikeAdded, EventLikeRemoved,
+			EventFollowAdded, EventFollowRemoved,
+			EventFollowRequested, EventFollowRequestCanceled, EventFollowRequestRejected,
+		)(s)
+	}
+}
+
+// WithWebhookSubscriber logs the webhook deliveries of the
+// events in the background. It has to come after the webhook
+// service.
+func WithWebhookSubscriber() ServicesConfig {
+	return func(s *Services) error {
+		wt := webhookTrigger{ws: s.Webhook}
+		return WithAsyncSubscriber("webhooks", wt.handle,
+			EventTweetCreated, EventTweetDeleted,
+			EventLikeAdded, EventFollowAdded,
+		)(s)
+	}
+}
+
+// WithStreamListener streams new tweets and changed counts to
+// the connections of this process. It has to come after the
+// stream service.
+func WithStreamListener() ServicesConfig {
+	return func(s *Services) error {
+		st := streamer{db: s.db, ss: s.Stream}
+		return s.Events.Listen("stream", st.handle,
+			EventTweetCreated, EventTweetDeleted,
+			EventLikeAdded, EventLikeRemoved,
+		)
+	}
+}
+
 func WithUser(pepper, hmacKey string) ServicesConfig {
 	return func(s *Services) error {
-		s.User = NewUserService(s.db, pepper, hmacKey)
+		s.User = NewUserService(s.db, pepper, hmacKey, s.Events)
 		return nil
 	}
 }
 
 func WithTweet() ServicesConfig {
 	return func(s *Services) error {
-		s.Tweet = NewTweetService(s.db)
+		s.Tweet = NewTweetService(s.db, s.Events)
 		return nil
 	}
 }
@@ -55,14 +123,107 @@ func WithTagging() ServicesConfig {
 
 func WithLike() ServicesConfig {
 	return func(s *Services) error {
-		s.Like = NewLikeService(s.db)
+		s.Like = NewLikeService(s.db, s.Events)
 		return nil
 	}
 }
 
 func WithFollow() ServicesConfig {
 	return func(s *Services) error {
-		s.Follow = NewFollowService(s.db)
+		s.Follow = NewFollowService(s.db, s.Events)
+		return nil
+	}
+}
+
+func WithBlock() ServicesConfig {
+	return func(s *Services) error {
+		s.Block = NewBlockService(s.db, s.Events)
+		return nil
+	}
+}
+
+func WithMute() ServicesConfig {
+	return func(s *Services) error {
+		s.Mute = NewMuteService(s.db)
+		return nil
+	}
+}
+
+func WithTimeline() ServicesConfig {
+	return func(s *Services) error {
+		s.Timeline = NewTimelineService(s.db)
+		return nil
+	}
+}
+
+// WithStream has to come after the timeline service.
+func WithStream() ServicesConfig {
+	return func(s *Services) error {
+		s.Stream = NewStreamService(s.db, s.Timeline)
+		return nil
+	}
+}
+
+// WithNotification has to come after the stream service.
+func WithNotification() ServicesConfig {
+	return func(s *Services) error {
+		s.Notification = NewNotificationService(s.db, s.Stream)
+		return nil
+	}
+}
+
+func WithAPIToken(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.APIToken = NewAPITokenService(s.db, hmacKey)
+		return nil
+	}
+}
+
+func WithSession(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.Session = NewSessionService(s.db, hmacKey)
+		return nil
+	}
+}
+
+func WithSearch() ServicesConfig {
+	return func(s *Services) error {
+		s.Search = NewSearchService(s.db)
+		return nil
+	}
+}
+
+// WithMessage has to come after the follow, block and stream
+// services.
+func WithMessage() ServicesConfig {
+	return func(s *Services) error {
+		s.Message = NewMessageService(s.db, s.Follow, s.Block, s.Stream)
+		return nil
+	}
+}
+
+// WithExport has to come after the tweet, like, follow,
+// session, tagging and tag services it reads from.
+func WithExport() ServicesConfig {
+	return func(s *Services) error {
+		s.Export = NewExportService(s.db, s.Tweet, s.Like, s.Follow, s.Session, s.Tagging, s.Tag)
+		return nil
+	}
+}
+
+// WithImport has to come after the tweet service.
+func WithImport() ServicesConfig {
+	return func(s *Services) error {
+		s.Import = NewImportService(s.db, s.Tweet)
+		return nil
+	}
+}
+
+// WithWebhook lets webhooks be sent to private addresses when
+// allowPrivate is set, see NewWebhookService.
+func WithWebhook(allowPrivate bool) ServicesConfig {
+	return func(s *Services) error {
+		s.Webhook = NewWebhookService(s.db, allowPrivate)
 		return nil
 	}
 }
@@ -85,23 +246,55 @@ func NewServices(cfgs ...ServicesConfig) (*Services, error) {
 }
 
 type Services struct {
-	Tweet   TweetService
-	User    UserService
-	Like    LikeService
-	Follow  FollowService
-	Tag     TagService
-	Tagging TaggingService
-	db      *gorm.DB
+	Tweet        TweetService
+	User         UserService
+	Like         LikeService
+	Follow       FollowService
+	Block        BlockService
+	Mute         MuteService
+	Message      MessageService
+	Tag          TagService
+	Tagging      TaggingService
+	Timeline     TimelineService
+	Notification NotificationService
+	Stream       StreamService
+	Search       SearchService
+	APIToken     APITokenService
+	Session      SessionService
+	Export       ExportService
+	Import       ImportService
+	Webhook      WebhookService
+	Events       EventBus
+	db           *gorm.DB
+}
+
+// Start starts the workers of the event bus and the webhook
+// service. Only servers start them; one-off commands leave
+// the events they publish to the servers.
+func (s *Services) Start() {
+	if s.Events != nil {
+		s.Events.Start()
+	}
+	if s.Webhook != nil {
+		s.Webhook.Start()
+	}
 }
 
-// Closes the database connection
+// Closes the database connection once the event bus has
+// stopped
 func (s *Services) Close() error {
+	if s.Events != nil {
+		s.Events.Close()
+	}
+	if s.Webhook != nil {
+		s.Webhook.Close()
+	}
 	return s.db.Close()
 }
 
 // DestructiveReset drops all tables and rebuilds them
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Tweet{}, &Like{}, &Follow{}, &Tag{}, &Tagging{}).Error
+	err := s.db.DropTableIfExists(&User{}, &Tweet{}, &Like{}, &Follow{}, &Tag{}, &Tagging{}, &pwReset{}, &Notification{}, &APIToken{}, &Session{}, &recoveryCode{}, &loginChallenge{}, &emailVerification{}, &usernameChange{}, &Export{}, &tweetImport{}, &Block{}, &Mute{}, &FollowRequest{}, &Conversation{}, &conversationParticipant{}, &Message{}, &Webhook{}, &WebhookDelivery{}, &outboxEvent{}, &schemaMigration{}).Error
 	if err != nil {
 		return err
 	}
@@ -110,5 +303,12 @@ func (s *Services) DestructiveReset() error {
 
 // AutoMigrate will attempt to automatically migrate all tables
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Tweet{}, &Like{}, &Follow{}, &Tag{}, &Tagging{}).Error
+	err := s.db.AutoMigrate(&User{}, &Tweet{}, &Like{}, &Follow{}, &Tag{}, &Tagging{}, &pwReset{}, &Notification{}, &APIToken{}, &Session{}, &recoveryCode{}, &loginChallenge{}, &emailVerification{}, &usernameChange{}, &Export{}, &tweetImport{}, &Block{}, &Mute{}, &FollowRequest{}, &Conversation{}, &conversationParticipant{}, &Message{}, &Webhook{}, &WebhookDelivery{}, &outboxEvent{}, &schemaMigration{}).Error
+	if err != nil {
+		return err
+	}
+	if err := migrateSearch(s.db); err != nil {
+		return err
+	}
+	return runMigrations(s.db)
 }
@@ -0,0 +1,223 @@
+package models
+
+import (
+	"time"
+
+	"chirp.com/pkg/hash"
+	"chirp.com/pkg/rand"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// SessionTTL is how long a session lasts after signing in.
+	SessionTTL = 30 * 24 * time.Hour
+	// sessionSeenInterval limits how often LastSeenAt is
+	// written so every request does not update the session.
+	sessionSeenInterval = time.Minute
+)
+
+// Session is created every time a user signs in, so a user
+// signed in on several devices has a session for each of them.
+// Token is only set when the session is created and is what
+// the remember_token cookie holds.
+type Session struct {
+	ID         uint      `gorm:"primary_key" json:"id"`
+	UserID     uint      `gorm:"not null;index" json:"-"`
+	Token      string    `gorm:"-" json:"-"`
+	TokenHash  string    `gorm:"not null;unique_index" json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Current    bool      `gorm:"-" json:"current"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `gorm:"not null" json:"expires_at"`
+}
+
+type SessionService interface {
+	// Seen records that the session was just used.
+	Seen(s *Session) error
+	SessionDB
+}
+
+type SessionDB interface {
+	// ByToken returns the unexpired session with the token.
+	ByToken(token string) (*Session, error)
+	// ByUserID returns the user's unexpired sessions, most
+	// recently used first.
+	ByUserID(userID uint) ([]Session, error)
+	// Create generates the session token, which is returned in
+	// the Token field, and stores its hash.
+	Create(s *Session) error
+	Touch(id uint, seenAt time.Time) error
+	// Delete revokes one of the user's sessions.
+	Delete(userID, id uint) error
+	// DeleteOthers revokes every session of the user except
+	// the one with keepID.
+	DeleteOthers(userID, keepID uint) error
+	// DeleteByUser revokes every session of the user.
+	DeleteByUser(userID uint) error
+}
+
+func NewSessionService(db *gorm.DB, hmacKey string) SessionService {
+	return &sessionService{
+		SessionDB: newSessionValidator(&sessionGorm{db}, hash.NewHMAC(hmacKey)),
+	}
+}
+
+type sessionService struct {
+	SessionDB
+}
+
+func (ss *sessionService) Seen(s *Session) error {
+	now := time.Now()
+	if now.Sub(s.LastSeenAt) < sessionSeenInterval {
+		return nil
+	}
+	s.LastSeenAt = now
+	return ss.Touch(s.ID, now)
+}
+
+func newSessionValidator(db SessionDB, hmac hash.HMAC) *sessionValidator {
+	return &sessionValidator{
+		SessionDB: db,
+		hmac:      hmac,
+	}
+}
+
+type sessionValidator struct {
+	SessionDB
+	hmac hash.HMAC
+}
+
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+	s := Session{Token: token}
+	if err := runSessionValFuncs(&s, sv.tokenRequired, sv.hmacToken); err != nil {
+		return nil, err
+	}
+	return sv.SessionDB.ByToken(s.TokenHash)
+}
+
+func (sv *sessionValidator) Create(s *Session) error {
+	err := runSessionValFuncs(s,
+		sv.userIDRequired,
+		sv.setToken,
+		sv.hmacToken,
+		sv.setTimes,
+	)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Create(s)
+}
+
+func (sv *sessionValidator) Delete(userID, id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.Delete(userID, id)
+}
+
+type sessionValFunc func(*Session) error
+
+func runSessionValFuncs(s *Session, fns ...sessionValFunc) error {
+	for _, fn := range fns {
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sv *sessionValidator) userIDRequired(s *Session) error {
+	if s.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setToken(s *Session) error {
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	s.Token = token
+	return nil
+}
+
+func (sv *sessionValidator) tokenRequired(s *Session) error {
+	if s.Token == "" {
+		return ErrTokenInvalid
+	}
+	return nil
+}
+
+func (sv *sessionValidator) hmacToken(s *Session) error {
+	s.TokenHash = sv.hmac.Hash(s.Token)
+	return nil
+}
+
+func (sv *sessionValidator) setTimes(s *Session) error {
+	now := time.Now()
+	if s.LastSeenAt.IsZero() {
+		s.LastSeenAt = now
+	}
+	if s.ExpiresAt.IsZero() {
+		s.ExpiresAt = now.Add(SessionTTL)
+	}
+	return nil
+}
+
+var _ SessionDB = &sessionGorm{}
+
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+func (sg *sessionGorm) ByToken(tokenHash string) (*Session, error) {
+	var s Session
+	db := sg.db.Where("token_hash = ? AND expires_at > ?", tokenHash, time.Now())
+	if err := first(db, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (sg *sessionGorm) ByUserID(userID uint) ([]Session, error) {
+	sessions := []Session{}
+	err := sg.db.Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at desc").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (sg *sessionGorm) Create(s *Session) error {
+	return sg.db.Create(s).Error
+}
+
+func (sg *sessionGorm) Touch(id uint, seenAt time.Time) error {
+	return sg.db.Model(&Session{ID: id}).UpdateColumn("last_seen_at", seenAt).Error
+}
+
+// Delete returns ErrNotFound if the user has no such session
+// so users cannot revoke each other's sessions.
+func (sg *sessionGorm) Delete(userID, id uint) error {
+	db := sg.db.Where("id = ? AND user_id = ?", id, userID).Delete(&Session{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (sg *sessionGorm) DeleteOthers(userID, keepID uint) error {
+	return sg.db.Where("user_id = ? AND id <> ?", userID, keepID).Delete(&Session{}).Error
+}
+
+func (sg *sessionGorm) DeleteByUser(userID uint) error {
+	return sg.db.Where("user_id = ?", userID).Delete(&Session{}).Error
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"testing"
+
+	"chirp.com/config"
+	"chirp.com/pkg/hash"
+	"github.com/stretchr/testify/assert"
+)
+
+// sessionDBMock records the token hash it is asked for.
+type sessionDBMock struct {
+	SessionDB
+	tokenHash string
+}
+
+func (s *sessionDBMock) ByToken(tokenHash string) (*Session, error) {
+	s.tokenHash = tokenHash
+	return &Session{TokenHash: tokenHash}, nil
+}
+
+func TestSessionByTokenValidator(t *testing.T) {
+	cfg := config.TestConfig()
+	hmac := hash.NewHMAC(cfg.HMACKey)
+	mockDB := &sessionDBMock{}
+	sv := newSessionValidator(mockDB, hmac)
+
+	_, err := sv.ByToken("fakeInputToken_123")
+	assert.Nil(t, err)
+	assert.Equal(t, hmac.Hash("fakeInputToken_123"), mockDB.tokenHash)
+	assert.NotEqual(t, "fakeInputToken_123", mockDB.tokenHash)
+
+	_, err = sv.ByToken("")
+	assert.Equal(t, ErrTokenInvalid, err)
+}
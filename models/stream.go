@@ -0,0 +1,399 @@
+package models
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Types of stream events
+const (
+	StreamTweet        = "tweet"
+	StreamCounts       = "counts"
+	StreamNotification = "notification"
+	StreamMessage      = "message"
+	// StreamReset is sent instead of the missed events when a
+	// client resumes from an event that is no longer kept. The
+	// client should reload what it shows.
+	StreamReset = "reset"
+)
+
+// streamReplaySize is the number of recent events kept for
+// each user so that clients can resume after reconnecting.
+// Events are only kept for users who are subscribed, or whose
+// last subscription closed less than streamReplayTTL ago.
+const streamReplaySize = 100
+
+// streamReplayTTL is how long the events of a user are kept
+// after their last subscription closes, long enough for a
+// client to reconnect.
+var streamReplayTTL = 5 * time.Minute
+
+// streamSweepInterval is how often the replays that expired
+// are removed.
+const streamSweepInterval = time.Minute
+
+// streamBufferSize is the number of events a connection can
+// fall behind by before it is closed. It has to hold the
+// replayed events too.
+const streamBufferSize = streamReplaySize + 28
+
+// StreamEvent is pushed to the connections of a user. IDs
+// increase with every event, across users and restarts.
+type StreamEvent struct {
+	ID   uint64
+	Type string
+	Data interface{}
+}
+
+// TweetCounts is the data of counts events.
+type TweetCounts struct {
+	ID            uint `json:"id"`
+	LikesCount    uint `json:"likesCount"`
+	RetweetsCount uint `json:"retweetsCount"`
+	RepliesCount  uint `json:"repliesCount"`
+}
+
+// StreamService is an in-process hub that pushes events to
+// the users connected to this server.
+type StreamService interface {
+	// Subscribe starts delivering the user's events. If
+	// lastEventID is set, the kept events published after it
+	// are delivered first.
+	Subscribe(userID uint, lastEventID uint64) *Subscription
+	// Publish delivers the event to each of the users.
+	Publish(eventType string, data interface{}, userIDs ...uint)
+	// PublishTweet delivers a new tweet to the users whose home
+	// timeline it shows up in and to the subscriptions watching
+	// its author or tags.
+	PublishTweet(tweet *Tweet) error
+	// PublishCounts delivers the counts of the tweet to its
+	// author and to the users whose home timeline it shows up
+	// in.
+	PublishCounts(tweet *Tweet) error
+}
+
+// UserTopic is watched for the tweets of the user.
+func UserTopic(username string) string {
+	return "@" + username
+}
+
+// TagTopic is watched for the tweets with the tag.
+func TagTopic(tag string) string {
+	return "#" + tag
+}
+
+// Subscription is a user's connection to the stream.
+type Subscription struct {
+	// Events is closed once the subscription is closed, which
+	// also happens when the connection falls too far behind.
+	Events <-chan StreamEvent
+	events chan StreamEvent
+	userID uint
+	topics map[string]bool
+	ss     *streamService
+}
+
+// Watch adds the tweets published on the topic, see UserTopic
+// and TagTopic, to the subscription. They are left out if the
+// user's home timeline would leave them out and they are not
+// kept for resuming.
+func (s *Subscription) Watch(topic string) {
+	s.ss.mu.Lock()
+	defer s.ss.mu.Unlock()
+	if !s.ss.subs[s.userID][s] {
+		return
+	}
+	s.topics[topic] = true
+	if s.ss.watchers[topic] == nil {
+		s.ss.watchers[topic] = make(map[*Subscription]bool)
+	}
+	s.ss.watchers[topic][s] = true
+}
+
+// Unwatch stops the tweets of a watched topic.
+func (s *Subscription) Unwatch(topic string) {
+	s.ss.mu.Lock()
+	defer s.ss.mu.Unlock()
+	s.ss.unwatch(s, topic)
+}
+
+// Topics returns the number of topics watched.
+func (s *Subscription) Topics() int {
+	s.ss.mu.Lock()
+	defer s.ss.mu.Unlock()
+	return len(s.topics)
+}
+
+// Close stops the subscription. It is safe to call more than
+// once.
+func (s *Subscription) Close() {
+	s.ss.mu.Lock()
+	defer s.ss.mu.Unlock()
+	s.ss.drop(s)
+}
+
+func NewStreamService(db *gorm.DB, tl TimelineDB) StreamService {
+	// starting from the clock keeps IDs increasing across
+	// restarts, so old Last-Event-IDs are told apart
+	start := uint64(time.Now().UnixNano())
+	return &streamService{
+		db:       db,
+		tl:       tl,
+		startID:  start,
+		lastID:   start,
+		subs:     make(map[uint]map[*Subscription]bool),
+		watchers: make(map[string]map[*Subscription]bool),
+		replays:  make(map[uint]*streamReplay),
+	}
+}
+
+var _ StreamService = &streamService{}
+
+type streamService struct {
+	db *gorm.DB
+	tl TimelineDB
+
+	mu      sync.Mutex
+	startID uint64
+	lastID  uint64
+	subs    map[uint]map[*Subscription]bool
+	// watchers holds the subscriptions watching each topic
+	watchers map[string]map[*Subscription]bool
+	replays  map[uint]*streamReplay
+	sweptAt  time.Time
+}
+
+// streamReplay holds the recent events of a user. DroppedID is
+// the newest event that is no longer kept. IdleSince is when
+// the user's last subscription closed and is zero while they
+// are subscribed.
+type streamReplay struct {
+	events    []StreamEvent
+	droppedID uint64
+	idleSince time.Time
+}
+
+func (r *streamReplay) expired(now time.Time) bool {
+	return !r.idleSince.IsZero() && now.Sub(r.idleSince) > streamReplayTTL
+}
+
+func (ss *streamService) Subscribe(userID uint, lastEventID uint64) *Subscription {
+	events := make(chan StreamEvent, streamBufferSize)
+	sub := &Subscription{
+		Events: events,
+		events: events,
+		userID: userID,
+		topics: make(map[string]bool),
+		ss:     ss,
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	replay := ss.replays[userID]
+	if replay != nil && replay.expired(time.Now()) {
+		delete(ss.replays, userID)
+		replay = nil
+	}
+	if lastEventID > 0 {
+		switch {
+		case lastEventID < ss.startID,
+			// nothing was kept while the user was away
+			replay == nil && lastEventID < ss.lastID,
+			replay != nil && lastEventID < replay.droppedID:
+			sub.events <- StreamEvent{ID: ss.lastID, Type: StreamReset}
+		case replay != nil:
+			for _, e := range replay.events {
+				if e.ID > lastEventID {
+					sub.events <- e
+				}
+			}
+		}
+	}
+	if replay == nil {
+		replay = &streamReplay{}
+		ss.replays[userID] = replay
+	}
+	replay.idleSince = time.Time{}
+	if ss.subs[userID] == nil {
+		ss.subs[userID] = make(map[*Subscription]bool)
+	}
+	ss.subs[userID][sub] = true
+	return sub
+}
+
+func (ss *streamService) Publish(eventType string, data interface{}, userIDs ...uint) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	now := time.Now()
+	if now.Sub(ss.sweptAt) > streamSweepInterval {
+		ss.sweep(now)
+	}
+	seen := make(map[uint]bool, len(userIDs))
+	for _, id := range userIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ss.lastID++
+		e := StreamEvent{ID: ss.lastID, Type: eventType, Data: data}
+
+		replay := ss.replays[id]
+		switch {
+		case replay == nil:
+		case replay.expired(now):
+			delete(ss.replays, id)
+		default:
+			replay.events = append(replay.events, e)
+			if len(replay.events) > streamReplaySize {
+				replay.droppedID = replay.events[0].ID
+				replay.events = append(replay.events[:0], replay.events[1:]...)
+			}
+		}
+
+		for sub := range ss.subs[id] {
+			select {
+			case sub.events <- e:
+			default:
+				// the client resumes from its Last-Event-ID
+				// once it reconnects
+				ss.drop(sub)
+			}
+		}
+	}
+}
+
+// drop closes the subscription. The caller has to hold the
+// lock.
+func (ss *streamService) drop(sub *Subscription) {
+	subs := ss.subs[sub.userID]
+	if !subs[sub] {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(ss.subs, sub.userID)
+		if replay := ss.replays[sub.userID]; replay != nil {
+			replay.idleSince = time.Now()
+		}
+	}
+	for topic := range sub.topics {
+		ss.unwatch(sub, topic)
+	}
+	close(sub.events)
+}
+
+// sweep removes the replays that expired. The caller has to
+// hold the lock.
+func (ss *streamService) sweep(now time.Time) {
+	for id, replay := range ss.replays {
+		if replay.expired(now) {
+			delete(ss.replays, id)
+		}
+	}
+	ss.sweptAt = now
+}
+
+// unwatch removes the subscription from the watchers of the
+// topic. The caller has to hold the lock.
+func (ss *streamService) unwatch(sub *Subscription, topic string) {
+	delete(sub.topics, topic)
+	watchers := ss.watchers[topic]
+	delete(watchers, sub)
+	if len(watchers) == 0 {
+		delete(ss.watchers, topic)
+	}
+}
+
+// watchingUsers returns the IDs of the users watching any of
+// the topics, leaving out the skipped ones.
+func (ss *streamService) watchingUsers(topics []string, skip []uint) []uint {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	skipped := make(map[uint]bool, len(skip))
+	for _, id := range skip {
+		skipped[id] = true
+	}
+	var userIDs []uint
+	for _, topic := range topics {
+		for sub := range ss.watchers[topic] {
+			if !skipped[sub.userID] {
+				skipped[sub.userID] = true
+				userIDs = append(userIDs, sub.userID)
+			}
+		}
+	}
+	return userIDs
+}
+
+// publishTopics delivers the event once to each subscription
+// of the users that watches any of the topics.
+func (ss *streamService) publishTopics(topics []string, eventType string, data interface{}, userIDs []uint) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	allowed := make(map[uint]bool, len(userIDs))
+	for _, id := range userIDs {
+		allowed[id] = true
+	}
+	ss.lastID++
+	e := StreamEvent{ID: ss.lastID, Type: eventType, Data: data}
+	sent := make(map[*Subscription]bool)
+	for _, topic := range topics {
+		for sub := range ss.watchers[topic] {
+			if !allowed[sub.userID] || sent[sub] {
+				continue
+			}
+			sent[sub] = true
+			select {
+			case sub.events <- e:
+			default:
+				ss.drop(sub)
+			}
+		}
+	}
+}
+
+// PublishTweet skips the watchers that already got the tweet
+// for their home timeline.
+func (ss *streamService) PublishTweet(tweet *Tweet) error {
+	userIDs, err := ss.tl.HomeUserIDs(tweet)
+	if err != nil {
+		return err
+	}
+	published := *tweet
+	ss.Publish(StreamTweet, &published, userIDs...)
+
+	topics := []string{UserTopic(tweet.Username)}
+	for _, tag := range tweet.Tags {
+		topics = append(topics, TagTopic(tag))
+	}
+	watching := ss.watchingUsers(topics, userIDs)
+	if len(watching) == 0 {
+		return nil
+	}
+	visible, err := ss.tl.VisibleTo(tweet, watching)
+	if err != nil {
+		return err
+	}
+	ss.publishTopics(topics, StreamTweet, &published, visible)
+	return nil
+}
+
+func (ss *streamService) PublishCounts(tweet *Tweet) error {
+	userIDs, err := ss.tl.HomeUserIDs(tweet)
+	if err != nil {
+		return err
+	}
+	var authorIDs []uint
+	err = ss.db.Model(&User{}).Where("username = ?", tweet.Username).Pluck("id", &authorIDs).Error
+	if err != nil {
+		return err
+	}
+	ss.Publish(StreamCounts, &TweetCounts{
+		ID:            tweet.ID,
+		LikesCount:    tweet.LikesCount,
+		RetweetsCount: tweet.RetweetsCount,
+		RepliesCount:  tweet.RepliesCount,
+	}, append(userIDs, authorIDs...)...)
+	return nil
+}
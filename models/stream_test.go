@@ -0,0 +1,165 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// received drains the events that are ready on the
+// subscription.
+func received(sub *Subscription) []StreamEvent {
+	var events []StreamEvent
+	for {
+		select {
+		case e, ok := <-sub.Events:
+			if !ok {
+				return events
+			}
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestStreamPublish(t *testing.T) {
+	ss := NewStreamService(nil, nil)
+	first := ss.Subscribe(1, 0)
+	second := ss.Subscribe(1, 0)
+	other := ss.Subscribe(2, 0)
+
+	ss.Publish(StreamMessage, "hi", 1, 1)
+	for _, sub := range []*Subscription{first, second} {
+		events := received(sub)
+		if assert.Len(t, events, 1, "each user gets an event once") {
+			assert.Equal(t, StreamMessage, events[0].Type)
+			assert.Equal(t, "hi", events[0].Data)
+		}
+	}
+	assert.Empty(t, received(other))
+
+	ss.Publish(StreamMessage, "hi all", 1, 2)
+	a, b := received(first), received(other)
+	received(second)
+	if assert.Len(t, a, 1) && assert.Len(t, b, 1) {
+		assert.True(t, b[0].ID > a[0].ID, "event IDs increase")
+	}
+
+	first.Close()
+	first.Close()
+	_, open := <-first.Events
+	assert.False(t, open, "closing twice is fine")
+	ss.Publish(StreamMessage, "still there?", 1)
+	assert.Len(t, received(second), 1)
+}
+
+func TestStreamResume(t *testing.T) {
+	ss := NewStreamService(nil, nil)
+	for _, data := range []string{"one", "two", "three"} {
+		ss.Publish(StreamMessage, data, 1)
+	}
+	events := received(ss.Subscribe(1, 0))
+	assert.Empty(t, events, "new subscriptions start from now")
+
+	sub := ss.Subscribe(1, 1)
+	events = received(sub)
+	sub.Close()
+	if assert.Len(t, events, 1, "IDs from before a restart get a reset") {
+		assert.Equal(t, StreamReset, events[0].Type)
+	}
+
+	ss.Publish(StreamMessage, "four", 1)
+	sub = ss.Subscribe(1, 0)
+	ss.Publish(StreamMessage, "five", 1)
+	last := received(sub)[0]
+	sub.Close()
+	ss.Publish(StreamMessage, "six", 1)
+	ss.Publish(StreamMessage, "seven", 1)
+	events = received(ss.Subscribe(1, last.ID))
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "six", events[0].Data)
+		assert.Equal(t, "seven", events[1].Data)
+	}
+}
+
+func TestStreamResumeDropped(t *testing.T) {
+	ss := NewStreamService(nil, nil)
+	ss.Publish(StreamMessage, "first", 1)
+	sub := ss.Subscribe(1, 0)
+	ss.Publish(StreamMessage, "second", 1)
+	seen := received(sub)[0]
+	sub.Close()
+	for i := 0; i < streamReplaySize; i++ {
+		ss.Publish(StreamMessage, i, 1)
+	}
+	events := received(ss.Subscribe(1, seen.ID))
+	assert.Len(t, events, streamReplaySize, "every event after the last one seen is kept")
+	ss.Publish(StreamMessage, "one too many", 1)
+	events = received(ss.Subscribe(1, seen.ID))
+	if assert.Len(t, events, 1, "missed events are replaced by a reset") {
+		assert.Equal(t, StreamReset, events[0].Type)
+	}
+}
+
+func TestStreamReplayExpires(t *testing.T) {
+	defer func(ttl time.Duration) { streamReplayTTL = ttl }(streamReplayTTL)
+	streamReplayTTL = time.Millisecond
+	ss := NewStreamService(nil, nil).(*streamService)
+	ss.Publish(StreamMessage, "nobody listens", 2)
+	assert.Nil(t, ss.replays[2], "events are only kept for subscribed users")
+
+	sub := ss.Subscribe(1, 0)
+	ss.Publish(StreamMessage, "first", 1)
+	seen := received(sub)[0]
+	sub.Close()
+	time.Sleep(2 * streamReplayTTL)
+	ss.Publish(StreamMessage, "second", 1)
+	assert.Nil(t, ss.replays[1], "replays expire once the user is gone")
+
+	events := received(ss.Subscribe(1, seen.ID))
+	if assert.Len(t, events, 1, "resuming after the replay expired gets a reset") {
+		assert.Equal(t, StreamReset, events[0].Type)
+	}
+}
+
+func TestStreamSlowSubscriber(t *testing.T) {
+	ss := NewStreamService(nil, nil)
+	slow := ss.Subscribe(1, 0)
+	for i := 0; i <= streamBufferSize; i++ {
+		ss.Publish(StreamMessage, i, 1)
+	}
+	events := received(slow)
+	assert.Len(t, events, streamBufferSize)
+	_, open := <-slow.Events
+	assert.False(t, open, "subscriptions that fall behind are closed")
+	slow.Close()
+}
+
+func TestStreamWatch(t *testing.T) {
+	ss := NewStreamService(nil, nil).(*streamService)
+	jazz := ss.Subscribe(1, 0)
+	jazz.Watch(TagTopic("jazz"))
+	jazz.Watch(UserTopic("bobbyd"))
+	other := ss.Subscribe(2, 0)
+	other.Watch(TagTopic("rock"))
+	assert.Equal(t, 2, jazz.Topics())
+
+	topics := []string{UserTopic("bobbyd"), TagTopic("jazz")}
+	assert.Equal(t, []uint{1}, ss.watchingUsers(topics, nil))
+	assert.Empty(t, ss.watchingUsers(topics, []uint{1}), "users that got the tweet are skipped")
+
+	ss.publishTopics(topics, StreamTweet, "tweet", []uint{1, 2})
+	assert.Len(t, received(jazz), 1, "watching two of the topics gets the event once")
+	assert.Empty(t, received(other))
+	ss.publishTopics(topics, StreamTweet, "hidden", nil)
+	assert.Empty(t, received(jazz), "only the allowed users get the event")
+
+	jazz.Unwatch(TagTopic("jazz"))
+	assert.Equal(t, 1, jazz.Topics())
+	jazz.Close()
+	assert.Empty(t, ss.watchers[UserTopic("bobbyd")], "closing unwatches every topic")
+	jazz.Watch(TagTopic("jazz"))
+	assert.Empty(t, ss.watchers[TagTopic("jazz")], "closed subscriptions cannot watch")
+}
@@ -0,0 +1,414 @@
+package models
+
+import (
+	"database/sql"
+
+	"chirp.com/internal/utils"
+	"chirp.com/pkg/unique"
+	"github.com/jinzhu/gorm"
+)
+
+// CountLikes keeps the LikesCount of liked and unliked tweets.
+func CountLikes(tx *gorm.DB, event Event) error {
+	var tweetID uint
+	switch e := event.(type) {
+	case *LikeAdded:
+		tweetID = e.TweetID
+	case *LikeRemoved:
+		tweetID = e.TweetID
+	default:
+		return nil
+	}
+	return tx.Exec(`UPDATE tweets SET likes_count =
+		(SELECT COUNT(*) FROM likes WHERE likes.tweet_id = tweets.id)
+		WHERE id = ?`, tweetID).Error
+}
+
+// CountReplies keeps the RepliesCount of the tweets that
+// replies are created or deleted under.
+func CountReplies(tx *gorm.DB, event Event) error {
+	var tweet *Tweet
+	switch e := event.(type) {
+	case *TweetCreated:
+		tweet = &e.Tweet
+	case *TweetDeleted:
+		tweet = &e.Tweet
+	default:
+		return nil
+	}
+	if tweet.InReplyToID == 0 {
+		return nil
+	}
+	return tx.Exec(`UPDATE tweets SET replies_count =
+		(SELECT COUNT(*) FROM tweets r WHERE r.in_reply_to_id = tweets.id AND r.deleted_at IS NULL)
+		WHERE id = ?`, tweet.InReplyToID).Error
+}
+
+// TagTweet creates the tags of new and updated tweets, or
+// restores deleted ones, and tags them with exactly those. The
+// tweet validator makes sure the names are valid.
+func TagTweet(tx *gorm.DB, event Event) error {
+	var tweet *Tweet
+	switch e := event.(type) {
+	case *TweetCreated:
+		tweet = &e.Tweet
+	case *TweetUpdated:
+		tweet = &e.Tweet
+	default:
+		return nil
+	}
+	var tagIDs []uint
+	for _, name := range tweet.Tags {
+		var tag Tag
+		err := tx.Raw(`INSERT INTO tags (name, created_at, updated_at) VALUES (?, NOW(), NOW())
+			ON CONFLICT (name) DO UPDATE SET deleted_at = NULL
+			RETURNING id`, name).Scan(&tag).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Exec(`INSERT INTO taggings (tag_id, tweet_id) VALUES (?, ?)
+			ON CONFLICT DO NOTHING`, tag.ID, tweet.ID).Error
+		if err != nil {
+			return err
+		}
+		tagIDs = append(tagIDs, tag.ID)
+	}
+	// tags removed from an updated tweet
+	db := tx.Where("tweet_id = ?", tweet.ID)
+	if len(tagIDs) > 0 {
+		db = db.Where("tag_id NOT IN (?)", tagIDs)
+	}
+	return db.Delete(&Tagging{}).Error
+}
+
+// DeleteWebhooks removes the webhooks of purged users along
+// with their delivery logs.
+func DeleteWebhooks(tx *gorm.DB, event Event) error {
+	e, ok := event.(*UserDeleted)
+	if !ok {
+		return nil
+	}
+	err := tx.Where("webhook_id IN (SELECT id FROM webhooks WHERE user_id = ?)", e.UserID).
+		Delete(&WebhookDelivery{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where("user_id = ?", e.UserID).Delete(&Webhook{}).Error
+}
+
+// notifier sends the notifications about likes, follows,
+// follow requests, retweets and mentions, and removes them
+// once the action is undone, the request is answered or the
+// tweet is deleted. Imported tweets do not
+// notify anyone.
+type notifier struct {
+	ns NotificationService
+}
+
+// handle writes the notifications in tx, so they are committed
+// along with the event being marked as processed and a retried
+// event does not notify twice. Only the stream events may be
+// sent again.
+func (n *notifier) handle(tx *gorm.DB, event Event) error {
+	inTx := &notifier{ns: n.ns.inTx(tx)}
+	return inTx.notify(tx, event)
+}
+
+func (n *notifier) notify(tx *gorm.DB, event Event) error {
+	switch e := event.(type) {
+	case *LikeAdded:
+		return n.notifyOwner(tx, NotificationLike, e.TweetID, e.UserID, false)
+	case *LikeRemoved:
+		return n.notifyOwner(tx, NotificationLike, e.TweetID, e.UserID, true)
+	case *FollowAdded:
+		// the follow may be an approved request
+		err := n.ns.Undo(&Notification{UserID: e.UserID, ActorID: e.FollowerID, Type: NotificationFollowRequest})
+		if err != nil {
+			return err
+		}
+		return n.ns.Notify(&Notification{UserID: e.UserID, ActorID: e.FollowerID, Type: NotificationFollow})
+	case *FollowRemoved:
+		return n.ns.Undo(&Notification{UserID: e.UserID, ActorID: e.FollowerID, Type: NotificationFollow})
+	case *FollowRequested:
+		return n.ns.Notify(&Notification{UserID: e.UserID, ActorID: e.FollowerID, Type: NotificationFollowRequest})
+	case *FollowRequestCanceled:
+		return n.ns.Undo(&Notification{UserID: e.UserID, ActorID: e.FollowerID, Type: NotificationFollowRequest})
+	case *FollowRequestRejected:
+		return n.ns.Undo(&Notification{UserID: e.UserID, ActorID: e.FollowerID, Type: NotificationFollowRequest})
+	case *TweetCreated:
+		if e.Imported {
+			return nil
+		}
+		if err := n.notifyMentions(tx, &e.Tweet); err != nil {
+			return err
+		}
+		return n.notifyRetweet(tx, &e.Tweet, false)
+	case *TweetDeleted:
+		if err := n.ns.DeleteByTweet(e.Tweet.ID); err != nil {
+			return err
+		}
+		return n.notifyRetweet(tx, &e.Tweet, true)
+	}
+	return nil
+}
+
+// notifyMentions tells the users mentioned in the post.
+func (n *notifier) notifyMentions(tx *gorm.DB, tweet *Tweet) error {
+	mentioned, err := mentionedUsers(tx, tweet)
+	if err != nil || len(mentioned) == 0 {
+		return err
+	}
+	actorID, err := userIDByUsername(tx, tweet.Username)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, user := range mentioned {
+		err := n.ns.Notify(&Notification{
+			UserID:  user.ID,
+			ActorID: actorID,
+			Type:    NotificationMention,
+			TweetID: tweet.ID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyRetweet tells the owner of the original about plain
+// retweets.
+func (n *notifier) notifyRetweet(tx *gorm.DB, tweet *Tweet, undo bool) error {
+	if tweet.RetweetID == 0 || tweet.Quote {
+		return nil
+	}
+	actorID, err := userIDByUsername(tx, tweet.Username)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return n.notifyOwner(tx, NotificationRetweet, tweet.RetweetID, actorID, undo)
+}
+
+func (n *notifier) notifyOwner(tx *gorm.DB, notificationType string, tweetID, actorID uint, undo bool) error {
+	var ownerID uint
+	err := tx.Raw(`SELECT users.id FROM users JOIN tweets ON tweets.username = users.username
+		WHERE tweets.id = ?`, tweetID).Row().Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	notification := Notification{
+		UserID:  ownerID,
+		ActorID: actorID,
+		Type:    notificationType,
+		TweetID: tweetID,
+	}
+	if undo {
+		return n.ns.Undo(&notification)
+	}
+	return n.ns.Notify(&notification)
+}
+
+func userIDByUsername(tx *gorm.DB, username string) (uint, error) {
+	var user User
+	err := first(tx.Unscoped().Select("id").Where("username = ?", username), &user)
+	return user.ID, err
+}
+
+// mentionedUsers returns the users mentioned in the post that
+// exist.
+func mentionedUsers(tx *gorm.DB, tweet *Tweet) ([]User, error) {
+	usernames := unique.Strings(tweet.Entities.Mentions(), utils.NormalizeText)
+	if len(usernames) == 0 {
+		return nil, nil
+	}
+	var users []User
+	err := tx.Select("id, username").Where("username IN (?)", usernames).Find(&users).Error
+	return users, err
+}
+
+func userByID(tx *gorm.DB, id uint) (*User, error) {
+	var user User
+	err := first(tx.Select("id, username").Where("id = ?", id), &user)
+	return &user, err
+}
+
+// webhookTrigger logs the webhook deliveries of the events in
+// the transaction that marks them as processed, so each is
+// logged exactly once, and leaves sending them to the webhook
+// worker. Imported tweets trigger nothing.
+type webhookTrigger struct {
+	ws WebhookService
+}
+
+func (wt *webhookTrigger) handle(tx *gorm.DB, event Event) error {
+	switch e := event.(type) {
+	case *TweetCreated:
+		if e.Imported {
+			return nil
+		}
+		return wt.tweetCreated(tx, &e.Tweet)
+	case *TweetDeleted:
+		authorID, err := userIDByUsername(tx, e.Tweet.Username)
+		if err == ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return wt.ws.queue(tx, WebhookTweetDeleted, authorID, &WebhookEvent{
+			User:  e.Tweet.Username,
+			Tweet: &e.Tweet,
+		})
+	case *LikeAdded:
+		return wt.liked(tx, e)
+	case *FollowAdded:
+		return wt.followed(tx, e)
+	}
+	return nil
+}
+
+// tweetCreated triggers the author's webhooks and those of the
+// users mentioned in the post.
+func (wt *webhookTrigger) tweetCreated(tx *gorm.DB, tweet *Tweet) error {
+	authorID, err := userIDByUsername(tx, tweet.Username)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = wt.ws.queue(tx, WebhookTweetCreated, authorID, &WebhookEvent{
+		User:  tweet.Username,
+		Tweet: tweet,
+	})
+	if err != nil {
+		return err
+	}
+	mentioned, err := mentionedUsers(tx, tweet)
+	if err != nil {
+		return err
+	}
+	for _, user := range mentioned {
+		if user.ID == authorID {
+			continue
+		}
+		err := wt.ws.queue(tx, WebhookMentioned, user.ID, &WebhookEvent{
+			User:  user.Username,
+			Actor: tweet.Username,
+			Tweet: tweet,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// liked triggers the webhooks of the owner of the liked tweet,
+// unless they liked it themselves.
+func (wt *webhookTrigger) liked(tx *gorm.DB, e *LikeAdded) error {
+	var tweet Tweet
+	err := first(tx.Where("id = ?", e.TweetID), &tweet)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ownerID, err := userIDByUsername(tx, tweet.Username)
+	if err == ErrNotFound || (err == nil && ownerID == e.UserID) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	actor, err := userByID(tx, e.UserID)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return wt.ws.queue(tx, WebhookTweetLiked, ownerID, &WebhookEvent{
+		User:  tweet.Username,
+		Actor: actor.Username,
+		Tweet: &tweet,
+	})
+}
+
+func (wt *webhookTrigger) followed(tx *gorm.DB, e *FollowAdded) error {
+	followee, err := userByID(tx, e.UserID)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	follower, err := userByID(tx, e.FollowerID)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	return wt.ws.queue(tx, WebhookFollowed, followee.ID, &WebhookEvent{
+		User:  followee.Username,
+		Actor: follower.Username,
+	})
+}
+
+// streamer streams new tweets and the changed counts of tweets
+// to the users connected to this process, after the requests
+// that made the changes. It listens to the events of this
+// process only since no other process can reach its
+// connections. Imported tweets are not streamed.
+type streamer struct {
+	db *gorm.DB
+	ss StreamService
+}
+
+func (s *streamer) handle(event Event) error {
+	switch e := event.(type) {
+	case *TweetCreated:
+		if e.Imported {
+			return nil
+		}
+		if err := s.ss.PublishTweet(&e.Tweet); err != nil {
+			return err
+		}
+		if e.Tweet.RetweetID > 0 && !e.Tweet.Quote {
+			return s.publishCounts(e.Tweet.RetweetID)
+		}
+	case *TweetDeleted:
+		if e.Tweet.RetweetID > 0 && !e.Tweet.Quote {
+			return s.publishCounts(e.Tweet.RetweetID)
+		}
+	case *LikeAdded:
+		return s.publishCounts(e.TweetID)
+	case *LikeRemoved:
+		return s.publishCounts(e.TweetID)
+	}
+	return nil
+}
+
+// publishCounts loads the counts the synchronous subscribers
+// have updated, since listeners are called after them.
+func (s *streamer) publishCounts(tweetID uint) error {
+	var tweet Tweet
+	if err := first(s.db.Where("id = ?", tweetID), &tweet); err != nil {
+		return ignoreNotFound(err)
+	}
+	return s.ss.PublishCounts(&tweet)
+}
+
+// ignoreNotFound is used by subscribers for events about rows
+// that have been deleted since.
+func ignoreNotFound(err error) error {
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
@@ -34,6 +34,10 @@ type TaggingDB interface {
 	GetTagging(tagID uint, tweetID uint) (*Tagging, error)
 	GetTaggings(tweetID uint) ([]Tagging, error)
 	GetTweets(id uint) ([]Tweet, error)
+	// GetTweetsPaginated leaves out the tweets viewerID cannot
+	// see, those of protected accounts they do not follow and
+	// those on either side of a block with them.
+	GetTweetsPaginated(id, viewerID uint, page Page) ([]Tweet, string, error)
 	Delete(tagID, tweetID uint) error
 }
 
@@ -111,3 +115,21 @@ func (tg *taggingGorm) GetTweets(id uint) ([]Tweet, error) {
 	}
 	return tweets, nil
 }
+
+// GetTweetsPaginated returns a page of the tweets tagged with
+// the tag, newest first.
+func (tg *taggingGorm) GetTweetsPaginated(id, viewerID uint, page Page) ([]Tweet, string, error) {
+	var tweets []Tweet
+	db := tg.db.Table("tweets").
+		Select("tweets.*").
+		Joins("JOIN taggings ON taggings.tweet_id = tweets.id").
+		Where("taggings.tag_id = ?", id)
+	db = withoutProtected(withoutBlocked(db, viewerID), viewerID)
+	db = withoutDeactivated(db)
+	err := page.scope(db, "tweets.id").Find(&tweets).Error
+	if err != nil {
+		return nil, "", err
+	}
+	tweets, next := page.pageTweets(tweets)
+	return tweets, next, nil
+}
@@ -67,6 +67,17 @@ func (tv *tagValidator) ByName(name string) (*Tag, error) {
 	return tv.TagDB.ByName(tag.Name)
 }
 
+// checkTagName returns the error a tag with the name fails
+// validation with, not counting ErrTagExists.
+func checkTagName(name string) error {
+	var tv tagValidator
+	return runTagValFuncs(&Tag{Name: name},
+		tv.normalizeName,
+		tv.nameRequired,
+		tv.noSpecialCharacters,
+	)
+}
+
 type tagValFunc func(*Tag) error
 
 func runTagValFuncs(tag *Tag, fns ...tagValFunc) error {
@@ -110,7 +121,7 @@ func (tv *tagValidator) noDuplicates(t *Tag) error {
 }
 
 func (tv *tagValidator) noSpecialCharacters(t *Tag) error {
-	reg, err := regexp.Compile("[^a-zA-Z0-9]+")
+	reg, err := regexp.Compile(`[^\p{L}\p{N}_]+`)
 	if err != nil {
 		log.Fatal(err)
 	}
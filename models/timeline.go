@@ -0,0 +1,109 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// TimelineService builds the feeds that are made up of tweets
+// from more than one user.
+type TimelineService interface {
+	TimelineDB
+}
+
+type timelineService struct {
+	TimelineDB
+}
+
+// TimelineDB is used to query the tweets that make up a feed.
+type TimelineDB interface {
+	// Home returns the tweets and retweets posted by the users
+	// that userID follows, newest first, along with the cursor
+	// of the next page. Retweets have their Retweet field set.
+	// Tweets of blocked and muted users are left out, as are
+	// retweets of their tweets and of tweets from protected
+	// accounts userID does not follow.
+	Home(userID uint, page Page) ([]Tweet, string, error)
+	// HomeUserIDs returns the IDs of the users whose home
+	// timeline the tweet shows up in.
+	HomeUserIDs(tweet *Tweet) ([]uint, error)
+	// VisibleTo returns the IDs of the users, among userIDs,
+	// that Home would show the tweet to if they followed its
+	// author.
+	VisibleTo(tweet *Tweet, userIDs []uint) ([]uint, error)
+}
+
+func NewTimelineService(db *gorm.DB) TimelineService {
+	return &timelineService{
+		TimelineDB: &timelineValidator{&timelineGorm{db}},
+	}
+}
+
+type timelineValidator struct {
+	TimelineDB
+}
+
+func (tv *timelineValidator) Home(userID uint, page Page) ([]Tweet, string, error) {
+	if userID <= 0 {
+		return nil, "", ErrUserIDRequired
+	}
+	return tv.TimelineDB.Home(userID, page)
+}
+
+var _ TimelineDB = &timelineGorm{}
+
+type timelineGorm struct {
+	db *gorm.DB
+}
+
+func (tg *timelineGorm) Home(userID uint, page Page) ([]Tweet, string, error) {
+	var tweets []Tweet
+	db := tg.db.Preload("Retweet").
+		Select("tweets.*").
+		Joins("JOIN users ON users.username = tweets.username AND users.deleted_at IS NULL").
+		Joins("JOIN follows ON follows.user_id = users.id AND follows.follower_id = ?", userID)
+	db = withoutMuted(withoutBlocked(db, userID), userID)
+	db = withoutDeactivated(withoutProtected(db, userID))
+	err := page.scope(db, "tweets.id").Find(&tweets).Error
+	if err != nil {
+		return nil, "", err
+	}
+	tweets, next := page.pageTweets(tweets)
+	return tweets, next, nil
+}
+
+func (tg *timelineGorm) HomeUserIDs(tweet *Tweet) ([]uint, error) {
+	var userIDs []uint
+	db := tg.db.Table("users AS viewers").
+		Joins("JOIN follows AS followed ON followed.follower_id = viewers.id").
+		Joins("JOIN users AS authors ON authors.id = followed.user_id AND authors.deleted_at IS NULL").
+		Where("authors.username = ?", tweet.Username)
+	err := visibleTo(db, tweet).Pluck("viewers.id", &userIDs).Error
+	if err != nil {
+		return nil, err
+	}
+	return userIDs, nil
+}
+
+func (tg *timelineGorm) VisibleTo(tweet *Tweet, userIDs []uint) ([]uint, error) {
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+	var visible []uint
+	db := tg.db.Table("users AS viewers").Where("viewers.id IN (?)", userIDs)
+	err := visibleTo(db, tweet).Pluck("viewers.id", &visible).Error
+	if err != nil {
+		return nil, err
+	}
+	return visible, nil
+}
+
+// visibleTo narrows a query of users, aliased as viewers, down
+// to the ones Home would show the tweet to, using the same
+// filters in a single query. The aliases keep the viewers
+// apart from the users and follows tables the filters query.
+func visibleTo(db *gorm.DB, tweet *Tweet) *gorm.DB {
+	viewerID := gorm.Expr("viewers.id")
+	db = db.Joins("JOIN tweets ON tweets.id = ?", tweet.ID)
+	db = withoutMuted(withoutBlocked(db, viewerID), viewerID)
+	return withoutProtected(db, viewerID)
+}
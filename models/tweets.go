@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"chirp.com/internal/utils"
+	"chirp.com/pkg/unique"
 	"github.com/jinzhu/gorm"
 )
 
@@ -16,9 +17,21 @@ type Tweet struct {
 	LikesCount    uint      `json:"likesCount"`
 	RetweetsCount uint      `json:"retweetsCount"`
 
+	// Entities are the hashtags, mentions and URLs in the post
+	Entities Entities `gorm:"type:jsonb" json:"entities,omitempty"`
+
 	// IsRetweet bool
 	Retweet   *Tweet `json:"retweet,omitempty"`
 	RetweetID uint   `json:"retweetID,omitempty"`
+	// Quote is set on retweets that carry their own post
+	Quote bool `gorm:"not null;default:false" json:"quote,omitempty"`
+
+	// InReplyToID is the tweet this tweet replies to and
+	// ConversationID is the tweet that started the thread.
+	// Both are zero when the tweet is not a reply.
+	InReplyToID    uint `gorm:"index" json:"inReplyToID,omitempty"`
+	ConversationID uint `gorm:"index" json:"conversationID,omitempty"`
+	RepliesCount   uint `json:"repliesCount"`
 
 	//tags
 	tags []Tag `json:"tags"`
@@ -30,48 +43,167 @@ type Tweet struct {
 }
 
 type TweetService interface {
+	// Thread returns the ancestors of the tweet along with a
+	// page of its direct replies. Each reply holds the replies
+	// made to it, up to maxThreadDescendants in total. Tweets
+	// on either side of a block with viewerID are left out,
+	// along with the replies below them.
+	Thread(tweet *Tweet, viewerID uint, page Page) (*Thread, error)
 	TweetDB
 }
 
+// Thread is a tweet along with the conversation around it.
+// Ancestors are ordered from the start of the conversation
+// down to the tweet's parent.
+type Thread struct {
+	Ancestors  []Tweet       `json:"ancestors"`
+	Tweet      *Tweet        `json:"tweet"`
+	Replies    []ThreadReply `json:"replies"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// ThreadReply is a reply in a Thread and the replies made to
+// it, oldest first.
+type ThreadReply struct {
+	Tweet
+	Replies []ThreadReply `json:"replies,omitempty"`
+}
+
+// maxThreadDescendants caps the number of nested replies that
+// are loaded for a single page of a thread.
+const maxThreadDescendants = 200
+
 type tweetService struct {
 	TweetDB
 }
 
 type TweetDB interface {
 	ByID(id uint) (*Tweet, error)
+	// ByIDVisibleTo returns ErrNotFound for the tweets of
+	// protected accounts that viewerID does not follow and of
+	// deactivated accounts, and for retweets of them.
+	ByIDVisibleTo(id, viewerID uint) (*Tweet, error)
 	ByUsername(username string) ([]Tweet, error)
+	ByUsernamePaginated(username string, page Page) ([]Tweet, string, error)
+	// ByUsernameAndRetweetID looks up the user's plain retweet
+	// of the tweet. Quote tweets are not returned.
 	ByUsernameAndRetweetID(username string, retweetID uint) (*Tweet, error)
+	// QuotesPaginated returns a page of the quote tweets of the
+	// tweet, newest first. Quotes on either side of a block
+	// with viewerID, those of protected accounts viewerID does
+	// not follow and those of deactivated accounts are left
+	// out.
+	QuotesPaginated(id, viewerID uint, page Page) ([]Tweet, string, error)
+	// RepliesPaginated returns a page of the direct replies to
+	// the tweet, newest first. Replies are left out like
+	// quotes are by QuotesPaginated.
+	RepliesPaginated(id, viewerID uint, page Page) ([]Tweet, string, error)
+	// Ancestors returns the tweets above the tweet in its
+	// thread, starting with the root of the conversation.
+	// Tweets are left out like quotes are by QuotesPaginated.
+	Ancestors(id, viewerID uint) ([]Tweet, error)
+	// Descendants returns up to limit replies made below the
+	// provided tweets, at any depth, oldest first. Replies are
+	// left out like quotes are by QuotesPaginated, along with
+	// the replies below them.
+	Descendants(ids []uint, viewerID uint, limit int) ([]Tweet, error)
+	GetTotalReplies(id uint) uint
 	Create(tweet *Tweet) error
+	// CreateImported creates a tweet of an imported archive,
+	// see TweetCreated. record is called in the transaction
+	// creating the tweet, once it has its ID, and the tweet is
+	// not created if it fails.
+	CreateImported(tweet *Tweet, record func(tx *gorm.DB) error) error
 	Update(tweet *Tweet) error
 	Delete(id uint) (*Tweet, error)
 }
 
-func NewTweetService(db *gorm.DB) TweetService {
+func NewTweetService(db *gorm.DB, bus EventBus) TweetService {
 	return &tweetService{
-		TweetDB: &tweetValidator{&tweetGorm{db}},
+		TweetDB: &tweetValidator{
+			TweetDB: &tweetGorm{db, bus},
+			userDB:  &userGorm{db},
+		},
+	}
+}
+
+func (ts *tweetService) Thread(tweet *Tweet, viewerID uint, page Page) (*Thread, error) {
+	ancestors, err := ts.Ancestors(tweet.ID, viewerID)
+	if err != nil {
+		return nil, err
+	}
+	replies, next, err := ts.RepliesPaginated(tweet.ID, viewerID, page)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint, len(replies))
+	for i, reply := range replies {
+		ids[i] = reply.ID
+	}
+	descendants, err := ts.Descendants(ids, viewerID, maxThreadDescendants)
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[uint][]Tweet)
+	for _, d := range descendants {
+		children[d.InReplyToID] = append(children[d.InReplyToID], d)
+	}
+	thread := Thread{
+		Ancestors:  ancestors,
+		Tweet:      tweet,
+		Replies:    make([]ThreadReply, len(replies)),
+		NextCursor: next,
 	}
+	for i, reply := range replies {
+		thread.Replies[i] = buildThreadReply(reply, children)
+	}
+	return &thread, nil
+}
+
+func buildThreadReply(tweet Tweet, children map[uint][]Tweet) ThreadReply {
+	reply := ThreadReply{Tweet: tweet}
+	for _, child := range children[tweet.ID] {
+		reply.Replies = append(reply.Replies, buildThreadReply(child, children))
+	}
+	return reply
 }
 
 type tweetValidator struct {
 	TweetDB
+	userDB UserDB
 }
 
 func (tv *tweetValidator) Create(tweet *Tweet) error {
-	err := runTweetValFuncs(tweet,
-		// tv.userIDRequired,
-		tv.usernameRequired,
-		tv.postRequired,
-		tv.retweetOnlyOnce)
-	if err != nil {
+	if err := tv.validateCreate(tweet); err != nil {
 		return err
 	}
 	return tv.TweetDB.Create(tweet)
 }
 
+func (tv *tweetValidator) CreateImported(tweet *Tweet, record func(tx *gorm.DB) error) error {
+	if err := tv.validateCreate(tweet); err != nil {
+		return err
+	}
+	return tv.TweetDB.CreateImported(tweet, record)
+}
+
+func (tv *tweetValidator) validateCreate(tweet *Tweet) error {
+	return runTweetValFuncs(tweet,
+		// tv.userIDRequired,
+		tv.usernameRequired,
+		tv.postRequired,
+		tv.retweetOnlyOnce,
+		tv.replyParentExists,
+		tv.setEntities,
+		tv.tagsValid)
+}
+
 func (tv *tweetValidator) Update(tweet *Tweet) error {
 	err := runTweetValFuncs(tweet,
 		tv.usernameRequired,
-		tv.postRequired)
+		tv.postRequired,
+		tv.setEntities,
+		tv.tagsValid)
 	if err != nil {
 		return err
 	}
@@ -96,7 +228,7 @@ func (tv *tweetValidator) usernameRequired(t *Tweet) error {
 }
 
 func (tv *tweetValidator) postRequired(t *Tweet) error {
-	if t.RetweetID > 0 {
+	if t.RetweetID > 0 && !t.Quote {
 		return nil
 	}
 	if t.Post == "" {
@@ -106,8 +238,8 @@ func (tv *tweetValidator) postRequired(t *Tweet) error {
 }
 
 func (tv *tweetValidator) retweetOnlyOnce(t *Tweet) error {
-	//check if this tweet is a retweet
-	if t.RetweetID <= 0 {
+	//check if this tweet is a plain retweet, quotes can be made any number of times
+	if t.RetweetID <= 0 || t.Quote {
 		return nil
 	}
 	existing, err := tv.ByUsernameAndRetweetID(t.Username, t.RetweetID)
@@ -124,10 +256,69 @@ func (tv *tweetValidator) retweetOnlyOnce(t *Tweet) error {
 	return nil
 }
 
+// replyParentExists makes sure the tweet being replied to
+// exists and sets the conversation the reply belongs to.
+func (tv *tweetValidator) replyParentExists(t *Tweet) error {
+	if t.InReplyToID <= 0 {
+		return nil
+	}
+	parent, err := tv.ByID(t.InReplyToID)
+	if err == ErrNotFound {
+		return ErrReplyParentNotFound
+	}
+	if err != nil {
+		return err
+	}
+	t.ConversationID = parent.ConversationID
+	if t.ConversationID == 0 {
+		t.ConversationID = parent.ID
+	}
+	return nil
+}
+
+// setEntities extracts the entities from the post and merges
+// the hashtags into the tweet's tags. Mentions of users that
+// do not exist are dropped.
+func (tv *tweetValidator) setEntities(t *Tweet) error {
+	entities := ExtractEntities(t.Post)
+	t.Tags = unique.Strings(append(t.Tags, entities.Hashtags()...), utils.NormalizeText)
+	exists := make(map[string]bool)
+	for _, username := range unique.Strings(entities.Mentions()) {
+		_, err := tv.userDB.ByUsername(username)
+		switch err {
+		case nil:
+			exists[username] = true
+		case ErrNotFound:
+		default:
+			return err
+		}
+	}
+	t.Entities = nil
+	for _, e := range entities {
+		if e.Type == EntityMention && !exists[e.Text] {
+			continue
+		}
+		t.Entities = append(t.Entities, e)
+	}
+	return nil
+}
+
+// tagsValid checks the names of the tags before the tweet is
+// saved, since the tags are created once it is.
+func (tv *tweetValidator) tagsValid(t *Tweet) error {
+	for _, name := range t.Tags {
+		if err := checkTagName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 var _ TweetDB = &tweetGorm{}
 
 type tweetGorm struct {
-	db *gorm.DB
+	db  *gorm.DB
+	bus EventBus
 }
 
 func (tg *tweetGorm) ByID(id uint) (*Tweet, error) {
@@ -137,6 +328,13 @@ func (tg *tweetGorm) ByID(id uint) (*Tweet, error) {
 	return &tweet, err
 }
 
+func (tg *tweetGorm) ByIDVisibleTo(id, viewerID uint) (*Tweet, error) {
+	var tweet Tweet
+	db := withoutProtected(tg.db.Where("tweets.id = ?", id), viewerID)
+	err := first(withoutDeactivated(db), &tweet)
+	return &tweet, err
+}
+
 func (tg *tweetGorm) ByUsername(username string) ([]Tweet, error) {
 	var tweets []Tweet
 	username = utils.NormalizeText(username)
@@ -147,26 +345,221 @@ func (tg *tweetGorm) ByUsername(username string) ([]Tweet, error) {
 	return tweets, nil
 }
 
+// ByUsernamePaginated returns a page of the user's tweets,
+// newest first, along with the cursor of the next page.
+func (tg *tweetGorm) ByUsernamePaginated(username string, page Page) ([]Tweet, string, error) {
+	var tweets []Tweet
+	username = utils.NormalizeText(username)
+	db := tg.db.Where("username = ?", username)
+	err := page.scope(db, "id").Find(&tweets).Error
+	if err != nil {
+		return nil, "", err
+	}
+	tweets, next := page.pageTweets(tweets)
+	return tweets, next, nil
+}
+
 func (tg *tweetGorm) ByUsernameAndRetweetID(username string, retweetID uint) (*Tweet, error) {
 	var tweet Tweet
-	db := tg.db.Where("username = ? AND retweet_id = ?", username, retweetID)
+	db := tg.db.Where("username = ? AND retweet_id = ? AND quote = ?", username, retweetID, false)
 	err := first(db, &tweet)
 	return &tweet, err
 
 }
 
+func (tg *tweetGorm) QuotesPaginated(id, viewerID uint, page Page) ([]Tweet, string, error) {
+	var tweets []Tweet
+	db := withoutBlocked(tg.db.Where("retweet_id = ? AND quote = ?", id, true), viewerID)
+	db = withoutDeactivated(withoutProtected(db, viewerID))
+	err := page.scope(db, "id").Find(&tweets).Error
+	if err != nil {
+		return nil, "", err
+	}
+	tweets, next := page.pageTweets(tweets)
+	return tweets, next, nil
+}
+
+func (tg *tweetGorm) RepliesPaginated(id, viewerID uint, page Page) ([]Tweet, string, error) {
+	var tweets []Tweet
+	db := withoutBlocked(tg.db.Where("in_reply_to_id = ?", id), viewerID)
+	db = withoutDeactivated(withoutProtected(db, viewerID))
+	err := page.scope(db, "id").Find(&tweets).Error
+	if err != nil {
+		return nil, "", err
+	}
+	tweets, next := page.pageTweets(tweets)
+	return tweets, next, nil
+}
+
+// Ancestors walks up the in_reply_to_id chain. Deleted tweets
+// are followed but left out of the result so the rest of the
+// thread can still be shown.
+func (tg *tweetGorm) Ancestors(id, viewerID uint) ([]Tweet, error) {
+	tweets := []Tweet{}
+	err := tg.db.Raw(`
+		WITH RECURSIVE ancestors AS (
+			SELECT * FROM tweets WHERE id = (SELECT in_reply_to_id FROM tweets WHERE id = ?)
+			UNION ALL
+			SELECT t.* FROM tweets t JOIN ancestors a ON t.id = a.in_reply_to_id
+		)
+		SELECT * FROM ancestors WHERE deleted_at IS NULL
+		AND username NOT IN (`+blockedUsernamesSQL+`)
+		AND username NOT IN (`+protectedUsernamesSQL+`)
+		AND username NOT IN (`+deactivatedUsernamesSQL+`) ORDER BY id`,
+		id, viewerID, viewerID, viewerID, viewerID).
+		Scan(&tweets).Error
+	if err != nil {
+		return nil, err
+	}
+	return tweets, nil
+}
+
+// Descendants only follows replies that have not been
+// deleted, since their own replies would have no parent to
+// be shown under.
+func (tg *tweetGorm) Descendants(ids []uint, viewerID uint, limit int) ([]Tweet, error) {
+	tweets := []Tweet{}
+	if len(ids) == 0 {
+		return tweets, nil
+	}
+	err := tg.db.Raw(`
+		WITH RECURSIVE descendants AS (
+			SELECT * FROM tweets WHERE in_reply_to_id IN (?) AND deleted_at IS NULL
+			AND username NOT IN (`+blockedUsernamesSQL+`)
+			AND username NOT IN (`+protectedUsernamesSQL+`)
+			AND username NOT IN (`+deactivatedUsernamesSQL+`)
+			UNION ALL
+			SELECT t.* FROM tweets t JOIN descendants d ON t.in_reply_to_id = d.id
+			WHERE t.deleted_at IS NULL AND t.username NOT IN (`+blockedUsernamesSQL+`)
+			AND t.username NOT IN (`+protectedUsernamesSQL+`)
+			AND t.username NOT IN (`+deactivatedUsernamesSQL+`)
+		)
+		SELECT * FROM descendants ORDER BY id LIMIT ?`,
+		ids, viewerID, viewerID, viewerID, viewerID,
+		viewerID, viewerID, viewerID, viewerID, limit).
+		Scan(&tweets).Error
+	if err != nil {
+		return nil, err
+	}
+	return tweets, nil
+}
+
+func (tg *tweetGorm) GetTotalReplies(id uint) uint {
+	var count uint
+	tg.db.Model(&Tweet{}).Where("in_reply_to_id = ?", id).Count(&count)
+	return count
+}
+
+// Create will also increment the RetweetsCount of the original
+// tweet when a plain retweet is created. The embedded Retweet
+// is not saved so its count cannot be overwritten.
 func (tg *tweetGorm) Create(tweet *Tweet) error {
-	return tg.db.Create(tweet).Error
+	return tg.create(tweet, false, nil)
+}
+
+func (tg *tweetGorm) CreateImported(tweet *Tweet, record func(tx *gorm.DB) error) error {
+	return tg.create(tweet, true, record)
+}
+
+func (tg *tweetGorm) create(tweet *Tweet, imported bool, record func(tx *gorm.DB) error) error {
+	tx := tg.db.Begin()
+	err := tx.Set("gorm:save_associations", false).Create(tweet).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if tweet.RetweetID > 0 && !tweet.Quote {
+		if err := addRetweets(tx, tweet.RetweetID, 1); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if record != nil {
+		if err := record(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	dispatch, err := tg.bus.Publish(tx, &TweetCreated{Tweet: *tweet, Imported: imported})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	dispatch()
+	return nil
 }
 
+// Update only writes the post and its entities. The counts are
+// left alone since they are kept by their own queries and the
+// tweet may have been read before they last changed.
 func (tg *tweetGorm) Update(tweet *Tweet) error {
-	return tg.db.Save(tweet).Error
+	tx := tg.db.Begin()
+	err := tx.Model(tweet).Updates(map[string]interface{}{
+		"post":     tweet.Post,
+		"entities": tweet.Entities,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	dispatch, err := tg.bus.Publish(tx, &TweetUpdated{Tweet: *tweet})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	dispatch()
+	return nil
 }
 
+// Delete will also decrement the RetweetsCount of the original
+// tweet when a plain retweet is deleted.
 func (tg *tweetGorm) Delete(id uint) (*Tweet, error) {
+	var existing Tweet
+	tx := tg.db.Begin()
+	err := first(tx.Where("id = ?", id), &existing)
+	if err != nil && err != ErrNotFound {
+		tx.Rollback()
+		return nil, err
+	}
 	tweet := Tweet{ID: id}
-	err := tg.db.Delete(&tweet).Error
-	return &tweet, err
+	if err := tx.Delete(&tweet).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if existing.RetweetID > 0 && !existing.Quote {
+		if err := addRetweets(tx, existing.RetweetID, -1); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	dispatch := func() {}
+	if existing.ID > 0 {
+		dispatch, err = tg.bus.Publish(tx, &TweetDeleted{Tweet: existing})
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	dispatch()
+	return &tweet, nil
+}
+
+// addRetweets atomically adds delta to the RetweetsCount of
+// the tweet, never letting it drop below zero.
+func addRetweets(db *gorm.DB, id uint, delta int) error {
+	return db.Model(&Tweet{}).
+		Where("id = ?", id).
+		UpdateColumn("retweets_count", gorm.Expr("GREATEST(COALESCE(retweets_count, 0) + ?, 0)", delta)).
+		Error
 }
 
 type tweetValFunc func(*Tweet) error
@@ -0,0 +1,326 @@
+package models
+
+import (
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"chirp.com/pkg/hash"
+	"chirp.com/pkg/rand"
+	"chirp.com/pkg/totp"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// totpIssuer is shown next to the account in authenticator
+	// apps.
+	totpIssuer = "Chirp"
+	// recoveryCodeCount is the number of recovery codes handed
+	// out when two-factor authentication is enabled.
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 10
+	// loginChallengeTTL is how long a user has to enter their
+	// code after entering their password.
+	loginChallengeTTL = 5 * time.Minute
+	// loginChallengeAttempts is the number of wrong codes
+	// allowed before the challenge is thrown away.
+	loginChallengeAttempts = 5
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment is the secret a user adds to their
+// authenticator app, either directly or through the URI.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// recoveryCode can be used once in place of a TOTP code when
+// the user has lost their device.
+type recoveryCode struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"not null;unique_index"`
+	CreatedAt time.Time
+}
+
+// loginChallenge is created when a user with two-factor
+// authentication enabled enters the right password. Its token
+// is exchanged for a session along with a valid code.
+type loginChallenge struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	Attempts  int    `gorm:"not null;default:0"`
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+type twoFactorDB interface {
+	// CreateRecoveryCodes replaces the user's recovery codes.
+	CreateRecoveryCodes(userID uint, codes []string) error
+	// UseRecoveryCode deletes the recovery code and reports
+	// whether the user had it.
+	UseRecoveryCode(userID uint, code string) (bool, error)
+	DeleteRecoveryCodes(userID uint) error
+	CreateChallenge(c *loginChallenge) error
+	// ChallengeByToken returns the unexpired challenge.
+	ChallengeByToken(token string) (*loginChallenge, error)
+	AddChallengeAttempt(id uint) error
+	DeleteChallenge(id uint) error
+}
+
+// TwoFactorEnabled reports whether the user has to enter a
+// code when signing in.
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+func (us *userService) EnrollTOTP(user *User) (*TOTPEnrollment, error) {
+	if user.TwoFactorEnabled() {
+		return nil, ErrTwoFactorEnabled
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPSecret = secret
+	user.TOTPLastStep = 0
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	return &TOTPEnrollment{
+		Secret: secret,
+		URI:    totp.URI(totpIssuer, user.Username, secret),
+	}, nil
+}
+
+func (us *userService) EnableTOTP(user *User, code string) ([]string, error) {
+	if user.TwoFactorEnabled() {
+		return nil, ErrTwoFactorEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return nil, ErrTwoFactorCodeInvalid
+	}
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := us.twoFactorDB.CreateRecoveryCodes(user.ID, codes); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	user.TOTPEnabledAt = &now
+	user.TOTPLastStep = step
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (us *userService) DisableTOTP(user *User, code string) error {
+	if !user.TwoFactorEnabled() {
+		return ErrTwoFactorNotEnabled
+	}
+	if err := us.verifyCode(user, code); err != nil {
+		return err
+	}
+	if err := us.twoFactorDB.DeleteRecoveryCodes(user.ID); err != nil {
+		return err
+	}
+	user.TOTPSecret = ""
+	user.TOTPEnabledAt = nil
+	user.TOTPLastStep = 0
+	return us.Update(user)
+}
+
+func (us *userService) CreateLoginChallenge(user *User) (string, error) {
+	c := loginChallenge{
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(loginChallengeTTL),
+	}
+	if err := us.twoFactorDB.CreateChallenge(&c); err != nil {
+		return "", err
+	}
+	return c.Token, nil
+}
+
+func (us *userService) CompleteLogin(token, code string) (*User, error) {
+	c, err := us.twoFactorDB.ChallengeByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if c.Attempts >= loginChallengeAttempts {
+		us.twoFactorDB.DeleteChallenge(c.ID)
+		return nil, ErrTokenInvalid
+	}
+	user, err := us.ByID(c.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if err := us.verifyCode(user, code); err != nil {
+		if err == ErrTwoFactorCodeInvalid {
+			us.twoFactorDB.AddChallengeAttempt(c.ID)
+		}
+		return nil, err
+	}
+	// Challenges are single use
+	if err := us.twoFactorDB.DeleteChallenge(c.ID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// verifyCode accepts either a TOTP code, which cannot be used
+// again afterwards, or one of the user's recovery codes.
+func (us *userService) verifyCode(user *User, code string) error {
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if ok {
+		user.TOTPLastStep = step
+		return us.Update(user)
+	}
+	used, err := us.twoFactorDB.UseRecoveryCode(user.ID, code)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrTwoFactorCodeInvalid
+	}
+	return nil
+}
+
+// newRecoveryCodes returns codes formatted like
+// abcd-efgh-ijkl-mnop.
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b, err := rand.Bytes(recoveryCodeBytes)
+		if err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		codes[i] = s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16]
+	}
+	return codes, nil
+}
+
+func newTwoFactorValidator(db twoFactorDB, hmac hash.HMAC) *twoFactorValidator {
+	return &twoFactorValidator{
+		twoFactorDB: db,
+		hmac:        hmac,
+	}
+}
+
+// twoFactorValidator hashes recovery codes and challenge
+// tokens so only their hashes are stored.
+type twoFactorValidator struct {
+	twoFactorDB
+	hmac hash.HMAC
+}
+
+func (tfv *twoFactorValidator) CreateRecoveryCodes(userID uint, codes []string) error {
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = tfv.hashRecoveryCode(code)
+	}
+	return tfv.twoFactorDB.CreateRecoveryCodes(userID, hashes)
+}
+
+func (tfv *twoFactorValidator) UseRecoveryCode(userID uint, code string) (bool, error) {
+	if code == "" {
+		return false, nil
+	}
+	return tfv.twoFactorDB.UseRecoveryCode(userID, tfv.hashRecoveryCode(code))
+}
+
+func (tfv *twoFactorValidator) CreateChallenge(c *loginChallenge) error {
+	if c.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	c.Token = token
+	c.TokenHash = tfv.hmac.Hash(token)
+	return tfv.twoFactorDB.CreateChallenge(c)
+}
+
+func (tfv *twoFactorValidator) ChallengeByToken(token string) (*loginChallenge, error) {
+	if token == "" {
+		return nil, ErrTokenInvalid
+	}
+	return tfv.twoFactorDB.ChallengeByToken(tfv.hmac.Hash(token))
+}
+
+// hashRecoveryCode ignores case, spaces and dashes so codes
+// can be typed back however they were written down.
+func (tfv *twoFactorValidator) hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return tfv.hmac.Hash(code)
+}
+
+var _ twoFactorDB = &twoFactorGorm{}
+
+type twoFactorGorm struct {
+	db *gorm.DB
+}
+
+func (tfg *twoFactorGorm) CreateRecoveryCodes(userID uint, hashes []string) error {
+	tx := tfg.db.Begin()
+	if err := tx.Where("user_id = ?", userID).Delete(&recoveryCode{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, h := range hashes {
+		if err := tx.Create(&recoveryCode{UserID: userID, CodeHash: h}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (tfg *twoFactorGorm) UseRecoveryCode(userID uint, codeHash string) (bool, error) {
+	db := tfg.db.Where("user_id = ? AND code_hash = ?", userID, codeHash).Delete(&recoveryCode{})
+	if db.Error != nil {
+		return false, db.Error
+	}
+	return db.RowsAffected > 0, nil
+}
+
+func (tfg *twoFactorGorm) DeleteRecoveryCodes(userID uint) error {
+	return tfg.db.Where("user_id = ?", userID).Delete(&recoveryCode{}).Error
+}
+
+func (tfg *twoFactorGorm) CreateChallenge(c *loginChallenge) error {
+	return tfg.db.Create(c).Error
+}
+
+func (tfg *twoFactorGorm) ChallengeByToken(tokenHash string) (*loginChallenge, error) {
+	var c loginChallenge
+	db := tfg.db.Where("token_hash = ? AND expires_at > ?", tokenHash, time.Now())
+	if err := first(db, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (tfg *twoFactorGorm) AddChallengeAttempt(id uint) error {
+	return tfg.db.Model(&loginChallenge{ID: id}).
+		UpdateColumn("attempts", gorm.Expr("attempts + 1")).Error
+}
+
+func (tfg *twoFactorGorm) DeleteChallenge(id uint) error {
+	return tfg.db.Delete(&loginChallenge{ID: id}).Error
+}
@@ -2,7 +2,6 @@ package models
 
 import (
 	"chirp.com/config"
-	"chirp.com/pkg/hash"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -13,7 +12,6 @@ const (
 	ByID       = "ByID"
 	ByEmail    = "ByEmail"
 	ByUsername = "ByUsername"
-	ByRemember = "ByRemember"
 	Create     = "Create"
 	Update     = "Update"
 	Delete     = "Delete"
@@ -40,11 +38,6 @@ func (u *userDBMock) ByUsername(username string) (*User, error) {
 	u.Called()
 	return u.user, nil
 }
-func (u *userDBMock) ByRemember(token string) (*User, error) {
-	u.user.RememberHash = token
-	u.Called()
-	return u.user, nil
-}
 func (u *userDBMock) Create(user *User) error {
 	u.user = user
 	u.Called()
@@ -53,6 +46,12 @@ func (u *userDBMock) Create(user *User) error {
 func (u *userDBMock) Update(user *User) error {
 	return nil
 }
+func (u *userDBMock) Rename(user *User, oldUsername string) error {
+	return nil
+}
+func (u *userDBMock) ResetPassword(user *User, resetID uint) error {
+	return nil
+}
 func (u *userDBMock) Delete(id uint) error {
 	return nil
 }
@@ -71,8 +70,7 @@ func newUserDBMock(u *User) *userDBMock {
 
 func newUserValidatorWithMock(mockDB *userDBMock) *userValidator {
 	cfg := config.TestConfig()
-	hmac := hash.NewHMAC(cfg.HMACKey)
-	return newUserValidator(mockDB, hmac, cfg.Pepper)
+	return newUserValidator(mockDB, cfg.Pepper)
 }
 
 type testCase struct {
@@ -157,38 +155,12 @@ func TestByUsernameValidator(t *testing.T) {
 	mockDB.AssertNumberOfCalls(t, ByUsername, dbCalls)
 }
 
-func TestByRememberValidator(t *testing.T) {
-	tests := []stringTestCase{
-		{tc: testCase{tag: "remember token gets hashed"},
-			input: "fakeInputToken_123", want: "BHQIyJPodP2exJnuAIukgXRkqENICrNJr7bQc1JBO9I="},
-	}
-	mockDB, uv := setupUserValTests(nil)
-	dbCalls := 0
-	for _, test := range tests {
-		t.Run(test.tc.tag, func(t *testing.T) {
-			mockDB.On(ByRemember)
-			user, err := uv.ByRemember(test.input)
-			if err != nil {
-				test.tc.gotErr = err
-				assert.Equal(t, test.tc.wantErr, test.tc.gotErr)
-			} else {
-				test.got = user.RememberHash
-				dbCalls++
-				assert.Equal(t, test.want, test.got)
-			}
-		})
-	}
-	mockDB.AssertNumberOfCalls(t, ByRemember, dbCalls)
-}
-
 func newDefaultTestUser() *User {
 	return &User{
-		Name:         "George Hill",
-		Username:     "hill_9000",
-		Email:        "george@hill.com",
-		Password:     "12345678",
-		Remember:     "mockmockfakerememberhash12345678fakefakefakefake",
-		RememberHash: "A5VkvtUNRxYLNWDQIr_L1IzEA6S7k2Xrf3kVjkRJcxU=",
+		Name:     "George Hill",
+		Username: "hill_9000",
+		Email:    "george@hill.com",
+		Password: "12345678",
 	}
 }
 
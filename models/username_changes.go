@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// usernameRedirectPeriod is how long links under a user's old
+// username keep redirecting to their new one.
+const usernameRedirectPeriod = 30 * 24 * time.Hour
+
+// usernameChange records a username the user gave up. They are
+// created by UserDB.Rename.
+type usernameChange struct {
+	ID          uint   `gorm:"primary_key"`
+	UserID      uint   `gorm:"not null;index"`
+	OldUsername string `gorm:"not null;index"`
+	CreatedAt   time.Time
+}
+
+type usernameChangeDB interface {
+	// ByOldUsername returns the latest change away from the
+	// username made after since.
+	ByOldUsername(username string, since time.Time) (*usernameChange, error)
+}
+
+var _ usernameChangeDB = &usernameChangeGorm{}
+
+type usernameChangeGorm struct {
+	db *gorm.DB
+}
+
+func (ucg *usernameChangeGorm) ByOldUsername(username string, since time.Time) (*usernameChange, error) {
+	var uc usernameChange
+	db := ucg.db.Where("old_username = ? AND created_at > ?", username, since).
+		Order("created_at desc")
+	if err := first(db, &uc); err != nil {
+		return nil, err
+	}
+	return &uc, nil
+}
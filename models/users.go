@@ -2,12 +2,12 @@ package models
 
 import (
 	"regexp"
+	"strings"
 	"time"
 	"unicode"
 
 	"chirp.com/internal/utils"
 	"chirp.com/pkg/hash"
-	"chirp.com/pkg/rand"
 	"github.com/jinzhu/gorm"
 
 	"golang.org/x/crypto/bcrypt"
@@ -32,8 +32,27 @@ type User struct {
 
 	Password     string `gorm:"-" json:"-"`
 	PasswordHash string `gorm:"not null"  json:"-"`
-	Remember     string `gorm:"-" json:"-"`
-	RememberHash string `gorm:"not null;unique_index" json:"-"`
+
+	// EmailVerifiedAt is set once the user follows the link
+	// sent to their email address.
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	// DeactivatedAt is set when the user deletes their account.
+	// The account is purged DeactivationPeriod later unless the
+	// user signs in again.
+	DeactivatedAt *time.Time `gorm:"index" json:"-"`
+	// Protected accounts approve their followers, and only
+	// show their tweets to them.
+	Protected bool `gorm:"not null;default:false" json:"protected,omitempty"`
+	// DMFollowersOnly users only receive direct messages from
+	// their followers.
+	DMFollowersOnly bool `gorm:"not null;default:false" json:"dm_followers_only,omitempty"`
+
+	// TOTPSecret is set on enrollment but only has to be used
+	// to sign in once TOTPEnabledAt is set. TOTPLastStep is the
+	// time step of the last code used so it cannot be replayed.
+	TOTPSecret    string     `json:"-"`
+	TOTPEnabledAt *time.Time `json:"-"`
+	TOTPLastStep  int64      `gorm:"not null;default:0" json:"-"`
 }
 
 // UserDB is used to interact with the users database.
@@ -52,9 +71,17 @@ type UserDB interface {
 	ByID(id uint) (*User, error)
 	ByEmail(email string) (*User, error)
 	ByUsername(username string) (*User, error)
-	ByRemember(token string) (*User, error)
 	Create(user *User) error
 	Update(user *User) error
+	// Rename updates the user the same way Update does. In the
+	// same transaction it moves the user's tweets over to the
+	// new username and records the old one so links to it can
+	// be redirected.
+	Rename(user *User, oldUsername string) error
+	// ResetPassword updates the user the same way Update does,
+	// but a new password is required. In the same transaction
+	// it revokes the user's sessions and deletes the reset.
+	ResetPassword(user *User, resetID uint) error
 	Delete(id uint) error
 }
 
@@ -72,18 +99,90 @@ type UserService interface {
 	// by creating a reset token for the user found with the
 	// provided email address.
 	InitiateReset(email string) (string, error)
+	// CompleteReset will update the password of the user that
+	// owns the reset token and sign them out of every session.
+	// ErrTokenInvalid is returned if the token is unknown,
+	// has already been used, or has expired.
 	CompleteReset(token, newPw string) (*User, error)
+	// EnrollTOTP generates a new TOTP secret for the user. It
+	// is not required to sign in until it is confirmed with
+	// EnableTOTP.
+	EnrollTOTP(user *User) (*TOTPEnrollment, error)
+	// EnableTOTP turns on two-factor authentication if the code
+	// is valid for the enrolled secret and returns the user's
+	// recovery codes. The codes are only stored hashed so this
+	// is the only time they are available.
+	EnableTOTP(user *User, code string) ([]string, error)
+	// DisableTOTP turns off two-factor authentication given a
+	// valid TOTP or recovery code.
+	DisableTOTP(user *User, code string) error
+	// CreateLoginChallenge is used in place of signing in a
+	// user with two-factor authentication enabled. The returned
+	// token is exchanged through CompleteLogin.
+	CreateLoginChallenge(user *User) (string, error)
+	// CompleteLogin returns the user of the challenge if the
+	// TOTP or recovery code is valid. ErrTokenInvalid is
+	// returned for unknown or expired challenges and for
+	// challenges with too many wrong codes.
+	CompleteLogin(token, code string) (*User, error)
+	// InitiateVerification creates the token emailed to the
+	// user to verify their email address.
+	// ErrVerificationRateLimited is returned if the user has
+	// requested too many of them recently.
+	InitiateVerification(user *User) (string, error)
+	// CompleteVerification marks the email address of the user
+	// who owns the token as verified. ErrTokenInvalid is
+	// returned if the token is unknown or has expired.
+	CompleteVerification(token string) (*User, error)
+	// UpdateProfile applies the fields set in the update to the
+	// user. Changing the email address or password requires the
+	// current password, and a new email address has to be
+	// verified again. The user is left untouched on error.
+	UpdateProfile(user *User, update ProfileUpdate) error
+	// ByPreviousUsername returns the user who changed away from
+	// the username within the redirect period. ErrNotFound is
+	// returned otherwise.
+	ByPreviousUsername(username string) (*User, error)
+	// Deactivate starts the deletion of the user's account
+	// given their password and signs them out everywhere.
+	Deactivate(user *User, password string) error
+	// Restore cancels the deletion of a deactivated account.
+	// ErrNotFound is returned once DeactivationPeriod is over.
+	Restore(user *User) error
+	// PurgeDeactivated deletes every account deactivated more
+	// than DeactivationPeriod ago along with everything the
+	// users made, and returns the number of accounts deleted.
+	PurgeDeactivated() (int, error)
 	UserDB
 }
 
-func NewUserService(db *gorm.DB, pepper, hmacKey string) UserService {
+// ProfileUpdate holds the profile fields to change. Fields
+// left nil keep their current value.
+type ProfileUpdate struct {
+	Name            *string
+	Username        *string
+	Email           *string
+	Password        *string
+	Protected       *bool
+	DMFollowersOnly *bool
+	// CurrentPassword is only checked when the email address
+	// or password is changed.
+	CurrentPassword string
+}
+
+func NewUserService(db *gorm.DB, pepper, hmacKey string, bus EventBus) UserService {
 	ug := &userGorm{db}
 	hmac := hash.NewHMAC(hmacKey)
-	uv := newUserValidator(ug, hmac, pepper)
+	uv := newUserValidator(ug, pepper)
 	return &userService{
-		UserDB:    uv,
-		pepper:    pepper,
-		pwResetDB: newPwResetValidator(&pwResetGorm{db}, hmac),
+		UserDB:              uv,
+		pepper:              pepper,
+		pwResetDB:           newPwResetValidator(&pwResetGorm{db}, hmac),
+		sessionDB:           newSessionValidator(&sessionGorm{db}, hmac),
+		twoFactorDB:         newTwoFactorValidator(&twoFactorGorm{db}, hmac),
+		emailVerificationDB: newEmailVerificationValidator(&emailVerificationGorm{db}, hmac),
+		usernameChangeDB:    &usernameChangeGorm{db},
+		purgeDB:             &purgeGorm{db, bus},
 	}
 }
 
@@ -91,8 +190,13 @@ var _ UserService = &userService{}
 
 type userService struct {
 	UserDB
-	pepper    string
-	pwResetDB pwResetDB
+	pepper              string
+	pwResetDB           pwResetDB
+	sessionDB           SessionDB
+	twoFactorDB         twoFactorDB
+	emailVerificationDB emailVerificationDB
+	usernameChangeDB    usernameChangeDB
+	purgeDB             purgeDB
 }
 
 // Authenticate can be used to authenticate a user with the
@@ -111,24 +215,56 @@ func (us *userService) Authenticate(email, password string) (*User, error) {
 		return nil, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(foundUser.PasswordHash), []byte(password+us.pepper))
+	err = us.comparePassword(foundUser, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return foundUser, nil
+}
+
+func (us *userService) comparePassword(user *User, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password+us.pepper))
 	if err != nil {
 		switch err {
 		case bcrypt.ErrMismatchedHashAndPassword:
-			return nil, ErrPasswordIncorrect
+			return ErrPasswordIncorrect
 		default:
-			return nil, err
+			return err
 		}
 	}
-
-	return foundUser, nil
+	return nil
 }
 
+const (
+	// pwResetLimit is the number of reset tokens a user may
+	// request within pwResetWindow.
+	pwResetLimit  = 3
+	pwResetWindow = time.Hour
+	// pwResetTTL is how long a reset token stays valid.
+	pwResetTTL = 12 * time.Hour
+	// emailVerificationTTL is how long a verification link
+	// stays valid.
+	emailVerificationTTL = 48 * time.Hour
+	// emailVerificationLimit is the number of verification
+	// emails a user may request within emailVerificationWindow,
+	// including the one sent when they signed up.
+	emailVerificationLimit  = 3
+	emailVerificationWindow = time.Hour
+)
+
 func (us *userService) InitiateReset(email string) (string, error) {
 	user, err := us.ByEmail(email)
 	if err != nil {
 		return "", err
 	}
+	count, err := us.pwResetDB.CountSince(user.ID, time.Now().Add(-pwResetWindow))
+	if err != nil {
+		return "", err
+	}
+	if count >= pwResetLimit {
+		return "", ErrResetRateLimited
+	}
 	pwr := pwReset{
 		UserID: user.ID,
 	}
@@ -146,7 +282,7 @@ func (us *userService) CompleteReset(token, newPw string) (*User, error) {
 		}
 		return nil, err
 	}
-	if time.Now().Sub(pwr.CreatedAt) > (12 * time.Hour) {
+	if time.Now().Sub(pwr.CreatedAt) > pwResetTTL {
 		return nil, ErrTokenInvalid
 	}
 	user, err := us.ByID(pwr.UserID)
@@ -154,14 +290,125 @@ func (us *userService) CompleteReset(token, newPw string) (*User, error) {
 		return nil, err
 	}
 	user.Password = newPw
-	err = us.Update(user)
+	// Whoever knew the old password may still be signed in, and
+	// tokens are single use.
+	if err := us.ResetPassword(user, pwr.ID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (us *userService) InitiateVerification(user *User) (string, error) {
+	if user.EmailVerifiedAt != nil {
+		return "", ErrEmailVerified
+	}
+	count, err := us.emailVerificationDB.CountSince(user.ID, time.Now().Add(-emailVerificationWindow))
+	if err != nil {
+		return "", err
+	}
+	if count >= emailVerificationLimit {
+		return "", ErrVerificationRateLimited
+	}
+	ev := emailVerification{
+		UserID: user.ID,
+	}
+	if err := us.emailVerificationDB.Create(&ev); err != nil {
+		return "", err
+	}
+	return ev.Token, nil
+}
+
+func (us *userService) CompleteVerification(token string) (*User, error) {
+	ev, err := us.emailVerificationDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if time.Now().Sub(ev.CreatedAt) > emailVerificationTTL {
+		return nil, ErrTokenInvalid
+	}
+	user, err := us.ByID(ev.UserID)
 	if err != nil {
 		return nil, err
 	}
-	us.pwResetDB.Delete(pwr.ID)
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	if err := us.emailVerificationDB.DeleteByUser(user.ID); err != nil {
+		return nil, err
+	}
 	return user, nil
 }
 
+func (us *userService) UpdateProfile(user *User, update ProfileUpdate) error {
+	updated := *user
+	if update.Name != nil {
+		updated.Name = strings.TrimSpace(*update.Name)
+	}
+	if update.Username != nil {
+		updated.Username = *update.Username
+	}
+	emailChanged := false
+	if update.Email != nil {
+		updated.Email = *update.Email
+		emailChanged = utils.NormalizeText(updated.Email) != user.Email
+	}
+	if update.Protected != nil {
+		updated.Protected = *update.Protected
+	}
+	if update.DMFollowersOnly != nil {
+		updated.DMFollowersOnly = *update.DMFollowersOnly
+	}
+	if update.Password != nil {
+		if *update.Password == "" {
+			return ErrPasswordRequired
+		}
+		updated.Password = *update.Password
+	}
+	if emailChanged || update.Password != nil {
+		if update.CurrentPassword == "" {
+			return ErrCurrentPasswordRequired
+		}
+		if err := us.comparePassword(user, update.CurrentPassword); err != nil {
+			return err
+		}
+	}
+	if emailChanged {
+		updated.EmailVerifiedAt = nil
+	}
+	var err error
+	if updated.Username != user.Username {
+		err = us.Rename(&updated, user.Username)
+	} else {
+		err = us.Update(&updated)
+	}
+	if err != nil {
+		return err
+	}
+	if emailChanged {
+		// Links sent to the old address must not verify the
+		// new one.
+		if err := us.emailVerificationDB.DeleteByUser(user.ID); err != nil {
+			return err
+		}
+	}
+	*user = updated
+	return nil
+}
+
+func (us *userService) ByPreviousUsername(username string) (*User, error) {
+	username = utils.NormalizeText(username)
+	uc, err := us.usernameChangeDB.ByOldUsername(username, time.Now().Add(-usernameRedirectPeriod))
+	if err != nil {
+		return nil, err
+	}
+	return us.ByID(uc.UserID)
+}
+
 type userValFunc func(*User) error
 
 func runUserValFuncs(user *User, fns ...userValFunc) error {
@@ -175,10 +422,9 @@ func runUserValFuncs(user *User, fns ...userValFunc) error {
 
 var _ UserDB = &userValidator{}
 
-func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator {
+func newUserValidator(udb UserDB, pepper string) *userValidator {
 	return &userValidator{
 		UserDB:     udb,
-		hmac:       hmac,
 		emailRegex: regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
 		pepper:     pepper,
 	}
@@ -186,7 +432,6 @@ func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator
 
 type userValidator struct {
 	UserDB
-	hmac       hash.HMAC
 	emailRegex *regexp.Regexp
 	pepper     string
 }
@@ -221,18 +466,6 @@ func (uv *userValidator) ByEmail(email string) (*User, error) {
 	return uv.UserDB.ByEmail(user.Email)
 }
 
-// ByRemember will hash the remember token and then call
-// ByRemember on the subsequent UserDB layer.
-func (uv *userValidator) ByRemember(token string) (*User, error) {
-	user := User{
-		Remember: token,
-	}
-	if err := runUserValFuncs(&user, uv.hmacRemember); err != nil {
-		return nil, err
-	}
-	return uv.UserDB.ByRemember(user.RememberHash)
-}
-
 // Create will create the provided user and backfill data
 // like the ID, CreatedAt, and UpdatedAt fields.
 func (uv *userValidator) Create(user *User) error {
@@ -241,10 +474,6 @@ func (uv *userValidator) Create(user *User) error {
 		uv.passwordMinLength,
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
-		uv.setRememberIfUnset,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
@@ -261,25 +490,47 @@ func (uv *userValidator) Create(user *User) error {
 	return uv.UserDB.Create(user)
 }
 
-// Update will hash a remember token if it is provided.
+// Update will hash the password if a new one is provided.
 func (uv *userValidator) Update(user *User) error {
-	err := runUserValFuncs(user,
+	if err := uv.validateUpdate(user); err != nil {
+		return err
+	}
+	return uv.UserDB.Update(user)
+}
+
+func (uv *userValidator) Rename(user *User, oldUsername string) error {
+	if err := uv.validateUpdate(user); err != nil {
+		return err
+	}
+	return uv.UserDB.Rename(user, oldUsername)
+}
+
+func (uv *userValidator) ResetPassword(user *User, resetID uint) error {
+	if err := runUserValFuncs(user, uv.passwordRequired); err != nil {
+		return err
+	}
+	if err := uv.validateUpdate(user); err != nil {
+		return err
+	}
+	return uv.UserDB.ResetPassword(user, resetID)
+}
+
+func (uv *userValidator) validateUpdate(user *User) error {
+	return runUserValFuncs(user,
 		uv.passwordMinLength,
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
 		uv.normalizeEmail,
 		uv.requireEmail,
 		uv.emailFormat,
 		uv.emailIsAvail,
+		uv.normalizeUsername,
 		uv.requireUsername,
+		uv.usernameBeginsWithLetter,
+		uv.charLimit("username", user.Username, 3, 25),
+		uv.usernameIsAvail,
+		uv.nameMaxLength,
 	)
-	if err != nil {
-		return err
-	}
-	return uv.UserDB.Update(user)
 }
 
 // Delete will delete the user with the provided ID
@@ -310,48 +561,6 @@ func (uv *userValidator) bcryptPassword(user *User) error {
 	return nil
 }
 
-func (uv *userValidator) hmacRemember(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-
-	user.RememberHash = uv.hmac.Hash(user.Remember)
-	return nil
-}
-
-func (uv *userValidator) setRememberIfUnset(user *User) error {
-	if user.Remember != "" {
-		return nil
-	}
-	token, err := rand.RememberToken()
-	if err != nil {
-		return err
-	}
-	user.Remember = token
-	return nil
-}
-
-func (uv *userValidator) rememberMinBytes(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	n, err := rand.NBytes(user.Remember)
-	if err != nil {
-		return err
-	}
-	if n < 32 {
-		return ErrRememberTooShort
-	}
-	return nil
-}
-
-func (uv *userValidator) rememberHashRequired(user *User) error {
-	if user.RememberHash == "" {
-		return ErrRememberRequired
-	}
-	return nil
-}
-
 func (uv *userValidator) idGreaterThan(n uint) userValFunc {
 	return userValFunc(func(user *User) error {
 		if user.ID <= n {
@@ -392,20 +601,26 @@ func (uv *userValidator) requireUsername(user *User) error {
 }
 
 func (uv *userValidator) usernameIsAvail(user *User) error {
-	existing, err := uv.ByEmail(user.Email)
+	existing, err := uv.UserDB.ByUsername(user.Username)
 	if err == ErrNotFound {
-		// Email address is not taken
+		// Username is not taken
 		return nil
 	}
 	if err != nil {
 		return err
 	}
 
-	// We found a user w/ this email address...
 	// If the found user has the same ID as this user, it is
 	// an update and this is the same user.
 	if user.ID != existing.ID {
-		return ErrEmailTaken
+		return ErrUsernameTaken
+	}
+	return nil
+}
+
+func (uv *userValidator) nameMaxLength(user *User) error {
+	if len(user.Name) > 50 {
+		return ErrCharMax.customCharLimitError(50, "name")
 	}
 	return nil
 }
@@ -527,19 +742,6 @@ func (ug *userGorm) ByEmail(email string) (*User, error) {
 	return &user, err
 }
 
-// ByRemember looks up a user with the given remember token
-// and returns that user. This method expects the remember
-// token to already be hashed.
-// Errors are the same as ByEmail.
-func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
-	var user User
-	err := first(ug.db.Where("remember_hash = ?", rememberHash), &user)
-	if err != nil {
-		return nil, err
-	}
-	return &user, nil
-}
-
 // Create will create the provided user and backfill data
 // like the ID, CreatedAt, and UpdatedAt fields.
 func (ug *userGorm) Create(user *User) error {
@@ -552,6 +754,50 @@ func (ug *userGorm) Update(user *User) error {
 	return ug.db.Save(user).Error
 }
 
+func (ug *userGorm) Rename(user *User, oldUsername string) error {
+	tx := ug.db.Begin()
+	if err := tx.Save(user).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	// Tweets are looked up by username so they have to follow
+	// the user. Soft deleted tweets are moved as well.
+	err := tx.Unscoped().Model(&Tweet{}).
+		Where("username = ?", oldUsername).
+		UpdateColumn("username", user.Username).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	uc := usernameChange{
+		UserID:      user.ID,
+		OldUsername: oldUsername,
+	}
+	if err := tx.Create(&uc).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (ug *userGorm) ResetPassword(user *User, resetID uint) error {
+	tx := ug.db.Begin()
+	if err := tx.Save(user).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("user_id = ?", user.ID).Delete(&Session{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	pwr := pwReset{Model: gorm.Model{ID: resetID}}
+	if err := tx.Delete(&pwr).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
 // Delete will delete the user with the provided ID
 func (ug *userGorm) Delete(id uint) error {
 	user := User{ID: id}
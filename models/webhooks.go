@@ -0,0 +1,715 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"chirp.com/pkg/hash"
+	"chirp.com/pkg/rand"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// Webhook events
+const (
+	WebhookTweetCreated = "tweet.created"
+	WebhookTweetDeleted = "tweet.deleted"
+	WebhookTweetLiked   = "tweet.liked"
+	WebhookFollowed     = "user.followed"
+	WebhookMentioned    = "user.mentioned"
+)
+
+// WebhookEvents lists every event webhooks can subscribe to.
+var WebhookEvents = []string{
+	WebhookTweetCreated,
+	WebhookTweetDeleted,
+	WebhookTweetLiked,
+	WebhookFollowed,
+	WebhookMentioned,
+}
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Headers sent along with every delivery. The signature is the
+// HMAC-SHA256 of the body keyed with the webhook's secret,
+// base64 URL encoded.
+const (
+	WebhookEventHeader     = "X-Chirp-Event"
+	WebhookDeliveryHeader  = "X-Chirp-Delivery"
+	WebhookSignatureHeader = "X-Chirp-Signature"
+)
+
+const (
+	// maxWebhooks is the number of webhooks each user can
+	// register.
+	maxWebhooks = 10
+	// webhookMaxAttempts is the number of times a delivery is
+	// sent before it is marked as failed.
+	webhookMaxAttempts = 5
+	// webhookTimeout is how long receivers have to respond.
+	webhookTimeout = 10 * time.Second
+	// webhookBatchSize is the number of due deliveries the
+	// worker claims and sends at a time.
+	webhookBatchSize = 20
+)
+
+var (
+	// webhookRetryDelay is the wait before the first retry. It
+	// doubles with every attempt after that.
+	webhookRetryDelay = 10 * time.Second
+	// webhookLease is how long a delivery that is being sent is
+	// left to the process sending it. It is only tried again
+	// after that if the process stopped before logging the
+	// attempt.
+	webhookLease = time.Minute
+	// webhookPollInterval is how often the worker looks for
+	// due deliveries.
+	webhookPollInterval = time.Second
+)
+
+// Webhook sends the events it is subscribed to to its URL. The
+// webhooks of a user get the events about their account and
+// content, while global webhooks, which only admins can
+// register, get the events of every user.
+type Webhook struct {
+	ID     uint           `gorm:"primary_key" json:"id"`
+	UserID uint           `gorm:"not null;index" json:"-"`
+	URL    string         `gorm:"not null" json:"url"`
+	Events pq.StringArray `gorm:"type:text[];not null" json:"events"`
+	// Secret is generated when the webhook is created and
+	// signs its deliveries.
+	Secret    string    `gorm:"not null" json:"secret"`
+	Global    bool      `gorm:"not null;default:false" json:"global"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is the log of an event sent to a webhook.
+// Payload is the exact body that was sent, so redeliveries
+// carry the same signature. NextAttemptAt is when a pending
+// delivery is sent next and is cleared once it succeeds or
+// fails for good.
+type WebhookDelivery struct {
+	ID            uint       `gorm:"primary_key" json:"id"`
+	WebhookID     uint       `gorm:"not null;index" json:"webhook_id"`
+	Event         string     `gorm:"not null" json:"event"`
+	Payload       string     `gorm:"not null" json:"payload"`
+	Status        string     `gorm:"not null" json:"status"`
+	Attempts      int        `gorm:"not null" json:"attempts"`
+	ResponseCode  int        `json:"response_code,omitempty"`
+	Error         string     `json:"error,omitempty"`
+	NextAttemptAt *time.Time `gorm:"index" json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+// WebhookEvent is the data of a delivery. User is the account
+// the event is about and Actor is who caused it, when that is
+// someone else.
+type WebhookEvent struct {
+	User  string `json:"user"`
+	Actor string `json:"actor,omitempty"`
+	Tweet *Tweet `json:"tweet,omitempty"`
+}
+
+// webhookPayload is the body of deliveries.
+type webhookPayload struct {
+	Event     string        `json:"event"`
+	CreatedAt time.Time     `json:"created_at"`
+	Data      *WebhookEvent `json:"data"`
+}
+
+type WebhookService interface {
+	// Redeliver logs a new delivery with the payload of an
+	// earlier one and sends it in the background.
+	Redeliver(webhook *Webhook, delivery *WebhookDelivery) (*WebhookDelivery, error)
+	// Deliver makes an attempt at the delivery and logs it
+	// along with when to try again. Failed attempts are retried
+	// by the background worker with exponential backoff until
+	// the delivery runs out of attempts, across restarts.
+	Deliver(webhook *Webhook, delivery *WebhookDelivery) error
+	// Start starts the background worker, see EventBus.
+	Start()
+	// Close stops the background worker.
+	Close() error
+	// queue logs a delivery of the event to each of the user's
+	// webhooks and each global webhook subscribed to it, in the
+	// transaction tx, and leaves sending them to the worker. It
+	// is used by the event subscriber.
+	queue(tx *gorm.DB, event string, userID uint, data *WebhookEvent) error
+	WebhookDB
+}
+
+type WebhookDB interface {
+	// ByID returns the user's webhook.
+	ByID(userID, id uint) (*Webhook, error)
+	ByUserID(userID uint) ([]Webhook, error)
+	// Subscribed returns the user's webhooks and the global
+	// webhooks that are subscribed to the event.
+	Subscribed(event string, userID uint) ([]Webhook, error)
+	Create(webhook *Webhook) error
+	// Delete removes the user's webhook along with its
+	// deliveries.
+	Delete(userID, id uint) error
+
+	// WebhookByID returns the webhook of any user, for
+	// sending its deliveries.
+	WebhookByID(id uint) (*Webhook, error)
+
+	// DeliveryByID returns a delivery of the webhook.
+	DeliveryByID(webhookID, id uint) (*WebhookDelivery, error)
+	// DeliveriesPaginated returns the deliveries of the
+	// webhook, newest first.
+	DeliveriesPaginated(webhookID uint, page Page) ([]WebhookDelivery, string, error)
+	CreateDelivery(delivery *WebhookDelivery) error
+	// UpdateDelivery stores the status and the outcome of the
+	// last attempt.
+	UpdateDelivery(delivery *WebhookDelivery) error
+	// ClaimDue returns up to limit pending deliveries whose next
+	// attempt is due at t and puts their next attempt off by
+	// lease, so other processes leave them alone while they are
+	// sent.
+	ClaimDue(t time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error)
+}
+
+// NewWebhookService only delivers to public addresses unless
+// allowPrivate is set, which tests and local development need
+// to reach receivers on the same machine.
+//
+// Its worker, which sends the deliveries logged by the event
+// subscriber and retries failed ones, is started by Start.
+func NewWebhookService(db *gorm.DB, allowPrivate bool) WebhookService {
+	ws := &webhookService{
+		WebhookDB: &webhookValidator{
+			WebhookDB: &webhookGorm{db},
+		},
+		client: newWebhookClient(allowPrivate),
+		txDB: func(tx *gorm.DB) WebhookDB {
+			return &webhookGorm{tx}
+		},
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	return ws
+}
+
+// newWebhookClient checks the address of every connection
+// after the host is resolved, so neither the URL nor its DNS
+// records can point a webhook at the internal network.
+// Redirects are not followed since they could lead anywhere;
+// the 3xx response counts as a failed attempt.
+func newWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !allowPrivate {
+		dialer.Control = publicAddressOnly
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// reservedNetworks are the networks that are not reachable on
+// the internet and are not covered by the net.IP methods used
+// in publicIP.
+var reservedNetworks = parseNetworks(
+	"0.0.0.0/8",     // this network
+	"100.64.0.0/10", // carrier-grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // benchmarking
+	"240.0.0.0/4",   // reserved
+	"64:ff9b::/96",  // NAT64, which maps to IPv4 addresses
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// publicIP reports whether the address can be reached on the
+// internet, as opposed to loopback, private and link-local
+// addresses such as cloud metadata services.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicAddressOnly is a net.Dialer Control function that stops
+// connections to addresses that are not public.
+func publicAddressOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("webhooks cannot be sent to %s", host)
+	}
+	return nil
+}
+
+var _ WebhookService = &webhookService{}
+
+type webhookService struct {
+	WebhookDB
+	client *http.Client
+	// txDB returns the webhooks written in the transaction tx
+	txDB      func(tx *gorm.DB) WebhookDB
+	quit      chan struct{}
+	done      chan struct{}
+	startOnce sync.Once
+	closeOnce sync.Once
+}
+
+func (ws *webhookService) queue(tx *gorm.DB, event string, userID uint, data *WebhookEvent) error {
+	webhooks, err := ws.Subscribed(event, userID)
+	if err != nil || len(webhooks) == 0 {
+		return err
+	}
+	payload, err := json.Marshal(&webhookPayload{
+		Event:     event,
+		CreatedAt: time.Now(),
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	db := ws.txDB(tx)
+	for i := range webhooks {
+		delivery := WebhookDelivery{
+			WebhookID:     webhooks[i].ID,
+			Event:         event,
+			Payload:       string(payload),
+			Status:        DeliveryPending,
+			NextAttemptAt: &now,
+		}
+		if err := db.CreateDelivery(&delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ws *webhookService) Redeliver(webhook *Webhook, delivery *WebhookDelivery) (*WebhookDelivery, error) {
+	redelivery := WebhookDelivery{
+		WebhookID:     webhook.ID,
+		Event:         delivery.Event,
+		Payload:       delivery.Payload,
+		Status:        DeliveryPending,
+		NextAttemptAt: leaseEnd(),
+	}
+	if err := ws.CreateDelivery(&redelivery); err != nil {
+		return nil, err
+	}
+	ws.deliverInBackground(*webhook, redelivery)
+	return &redelivery, nil
+}
+
+// leaseEnd is when a new delivery is left to the worker, in
+// case the process stops before its first attempt is logged.
+func leaseEnd() *time.Time {
+	t := time.Now().Add(webhookLease)
+	return &t
+}
+
+// deliverInBackground takes copies so the caller's values are
+// not shared with the goroutine.
+func (ws *webhookService) deliverInBackground(webhook Webhook, delivery WebhookDelivery) {
+	go func() {
+		if err := ws.Deliver(&webhook, &delivery); err != nil {
+			log.Printf("webhook %d delivery %d: %v", webhook.ID, delivery.ID, err)
+		}
+	}()
+}
+
+func (ws *webhookService) Deliver(webhook *Webhook, delivery *WebhookDelivery) error {
+	delivery.Attempts++
+	err := ws.send(webhook, delivery)
+	now := time.Now()
+	switch {
+	case err == nil:
+		delivery.Status = DeliverySucceeded
+		delivery.Error = ""
+		delivery.NextAttemptAt = nil
+		delivery.DeliveredAt = &now
+		return ws.UpdateDelivery(delivery)
+	case delivery.Attempts >= webhookMaxAttempts:
+		delivery.Status = DeliveryFailed
+		delivery.NextAttemptAt = nil
+	default:
+		next := now.Add(webhookRetryDelay << uint(delivery.Attempts-1))
+		delivery.NextAttemptAt = &next
+	}
+	delivery.Error = err.Error()
+	if uerr := ws.UpdateDelivery(delivery); uerr != nil {
+		log.Printf("webhook %d delivery %d: %v", webhook.ID, delivery.ID, uerr)
+	}
+	return err
+}
+
+func (ws *webhookService) work() {
+	defer close(ws.done)
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		ws.deliverDue()
+		select {
+		case <-ws.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverDue sends the due deliveries a batch at a time, the
+// deliveries of a batch at the same time so that slow
+// receivers do not hold up the others.
+func (ws *webhookService) deliverDue() {
+	for {
+		deliveries, err := ws.ClaimDue(time.Now(), webhookLease, webhookBatchSize)
+		if err != nil {
+			log.Printf("webhooks: %v", err)
+			return
+		}
+		var wg sync.WaitGroup
+		for i := range deliveries {
+			wg.Add(1)
+			go func(delivery *WebhookDelivery) {
+				defer wg.Done()
+				ws.deliverClaimed(delivery)
+			}(&deliveries[i])
+		}
+		wg.Wait()
+		if len(deliveries) < webhookBatchSize {
+			return
+		}
+		select {
+		case <-ws.quit:
+			return
+		default:
+		}
+	}
+}
+
+func (ws *webhookService) deliverClaimed(delivery *WebhookDelivery) {
+	webhook, err := ws.WebhookByID(delivery.WebhookID)
+	if err == ErrNotFound {
+		// the webhook was deleted along with its deliveries
+		return
+	}
+	if err == nil {
+		err = ws.Deliver(webhook, delivery)
+	}
+	if err != nil {
+		log.Printf("webhook %d delivery %d: %v", delivery.WebhookID, delivery.ID, err)
+	}
+}
+
+func (ws *webhookService) Start() {
+	ws.startOnce.Do(func() {
+		go ws.work()
+	})
+}
+
+func (ws *webhookService) Close() error {
+	ws.closeOnce.Do(func() {
+		close(ws.quit)
+		ws.startOnce.Do(func() {
+			close(ws.done)
+		})
+	})
+	<-ws.done
+	return nil
+}
+
+// send makes one attempt at the delivery. Any 2xx response
+// counts as delivered.
+func (ws *webhookService) send(webhook *Webhook, delivery *WebhookDelivery) error {
+	delivery.ResponseCode = 0
+	req, err := http.NewRequest("POST", webhook.URL, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Chirp-Webhooks")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, strconv.Itoa(int(delivery.ID)))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(webhook.Secret, delivery.Payload))
+	res, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// reading the body lets the connection be reused
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+	delivery.ResponseCode = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("receiver responded with %s", res.Status)
+	}
+	return nil
+}
+
+// SignWebhook returns the signature header of the payload.
+// Receivers compute it over the raw body with their copy of
+// the secret and compare.
+func SignWebhook(secret, payload string) string {
+	return "sha256=" + hash.NewHMAC(secret).Hash(payload)
+}
+
+type webhookValidator struct {
+	WebhookDB
+}
+
+func (wv *webhookValidator) Create(webhook *Webhook) error {
+	err := runWebhookValFuncs(webhook,
+		wv.userIDRequired,
+		wv.urlValid,
+		wv.eventsValid,
+		wv.belowLimit,
+		wv.setSecret,
+	)
+	if err != nil {
+		return err
+	}
+	return wv.WebhookDB.Create(webhook)
+}
+
+func (wv *webhookValidator) Delete(userID, id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return wv.WebhookDB.Delete(userID, id)
+}
+
+type webhookValFunc func(*Webhook) error
+
+func runWebhookValFuncs(webhook *Webhook, fns ...webhookValFunc) error {
+	for _, fn := range fns {
+		if err := fn(webhook); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wv *webhookValidator) userIDRequired(webhook *Webhook) error {
+	if webhook.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (wv *webhookValidator) urlValid(webhook *Webhook) error {
+	webhook.URL = strings.TrimSpace(webhook.URL)
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrWebhookURLInvalid
+	}
+	return nil
+}
+
+// eventsValid drops repeated events so each is delivered once.
+func (wv *webhookValidator) eventsValid(webhook *Webhook) error {
+	if len(webhook.Events) == 0 {
+		return ErrWebhookEventsRequired
+	}
+	seen := make(map[string]bool, len(webhook.Events))
+	var events pq.StringArray
+	for _, event := range webhook.Events {
+		event = strings.ToLower(strings.TrimSpace(event))
+		if !validWebhookEvent(event) {
+			return ErrWebhookEventInvalid
+		}
+		if !seen[event] {
+			seen[event] = true
+			events = append(events, event)
+		}
+	}
+	webhook.Events = events
+	return nil
+}
+
+func validWebhookEvent(event string) bool {
+	for _, e := range WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (wv *webhookValidator) belowLimit(webhook *Webhook) error {
+	webhooks, err := wv.ByUserID(webhook.UserID)
+	if err != nil {
+		return err
+	}
+	if len(webhooks) >= maxWebhooks {
+		return ErrWebhookLimit
+	}
+	return nil
+}
+
+func (wv *webhookValidator) setSecret(webhook *Webhook) error {
+	secret, err := rand.String(32)
+	if err != nil {
+		return err
+	}
+	webhook.Secret = secret
+	return nil
+}
+
+var _ WebhookDB = &webhookGorm{}
+
+type webhookGorm struct {
+	db *gorm.DB
+}
+
+func (wg *webhookGorm) ByID(userID, id uint) (*Webhook, error) {
+	var webhook Webhook
+	if err := first(wg.db.Where("id = ? AND user_id = ?", id, userID), &webhook); err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// ByUserID returns the user's webhooks, newest first.
+func (wg *webhookGorm) ByUserID(userID uint) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	err := wg.db.Where("user_id = ?", userID).Order("id desc").Find(&webhooks).Error
+	if err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (wg *webhookGorm) Subscribed(event string, userID uint) ([]Webhook, error) {
+	var webhooks []Webhook
+	err := wg.db.Where("(user_id = ? OR global) AND ? = ANY(events)", userID, event).
+		Find(&webhooks).Error
+	if err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (wg *webhookGorm) Create(webhook *Webhook) error {
+	return wg.db.Create(webhook).Error
+}
+
+// Delete returns ErrNotFound if the user has no such webhook so
+// users cannot delete each other's webhooks.
+func (wg *webhookGorm) Delete(userID, id uint) error {
+	tx := wg.db.Begin()
+	db := tx.Where("id = ? AND user_id = ?", id, userID).Delete(&Webhook{})
+	if db.Error != nil {
+		tx.Rollback()
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		tx.Rollback()
+		return ErrNotFound
+	}
+	if err := tx.Where("webhook_id = ?", id).Delete(&WebhookDelivery{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (wg *webhookGorm) WebhookByID(id uint) (*Webhook, error) {
+	var webhook Webhook
+	if err := first(wg.db.Where("id = ?", id), &webhook); err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+func (wg *webhookGorm) DeliveryByID(webhookID, id uint) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	db := wg.db.Where("id = ? AND webhook_id = ?", id, webhookID)
+	if err := first(db, &delivery); err != nil {
+		return nil, err
+	}
+	return &delivery, nil
+}
+
+func (wg *webhookGorm) DeliveriesPaginated(webhookID uint, page Page) ([]WebhookDelivery, string, error) {
+	var deliveries []WebhookDelivery
+	db := wg.db.Where("webhook_id = ?", webhookID)
+	if err := page.scope(db, "id").Find(&deliveries).Error; err != nil {
+		return nil, "", err
+	}
+	deliveries, next := page.pageDeliveries(deliveries)
+	return deliveries, next, nil
+}
+
+func (wg *webhookGorm) CreateDelivery(delivery *WebhookDelivery) error {
+	return wg.db.Create(delivery).Error
+}
+
+func (wg *webhookGorm) UpdateDelivery(delivery *WebhookDelivery) error {
+	return wg.db.Model(delivery).Updates(map[string]interface{}{
+		"status":          delivery.Status,
+		"attempts":        delivery.Attempts,
+		"response_code":   delivery.ResponseCode,
+		"error":           delivery.Error,
+		"next_attempt_at": delivery.NextAttemptAt,
+		"delivered_at":    delivery.DeliveredAt,
+	}).Error
+}
+
+// ClaimDue skips deliveries that are locked by another process
+// so several workers can share them.
+func (wg *webhookGorm) ClaimDue(t time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := wg.db.Raw(`UPDATE webhook_deliveries SET next_attempt_at = ?
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY next_attempt_at
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED)
+		RETURNING *`, t.Add(lease), DeliveryPending, t, limit).
+		Scan(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,333 @@
+package models
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryWebhooks keeps webhooks and deliveries in memory so the
+// delivery logic can be tested without a database.
+type memoryWebhooks struct {
+	WebhookDB
+	mu         sync.Mutex
+	webhooks   []Webhook
+	deliveries map[uint]WebhookDelivery
+}
+
+func newMemoryWebhooks(webhooks ...Webhook) *memoryWebhooks {
+	return &memoryWebhooks{
+		webhooks:   webhooks,
+		deliveries: make(map[uint]WebhookDelivery),
+	}
+}
+
+func (m *memoryWebhooks) ByUserID(userID uint) ([]Webhook, error) {
+	var webhooks []Webhook
+	for _, webhook := range m.webhooks {
+		if webhook.UserID == userID {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	return webhooks, nil
+}
+
+func (m *memoryWebhooks) Subscribed(event string, userID uint) ([]Webhook, error) {
+	var webhooks []Webhook
+	for _, webhook := range m.webhooks {
+		if webhook.UserID != userID && !webhook.Global {
+			continue
+		}
+		for _, e := range webhook.Events {
+			if e == event {
+				webhooks = append(webhooks, webhook)
+			}
+		}
+	}
+	return webhooks, nil
+}
+
+func (m *memoryWebhooks) Create(webhook *Webhook) error {
+	webhook.ID = uint(len(m.webhooks) + 1)
+	m.webhooks = append(m.webhooks, *webhook)
+	return nil
+}
+
+func (m *memoryWebhooks) CreateDelivery(delivery *WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delivery.ID = uint(len(m.deliveries) + 1)
+	m.deliveries[delivery.ID] = *delivery
+	return nil
+}
+
+func (m *memoryWebhooks) UpdateDelivery(delivery *WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries[delivery.ID] = *delivery
+	return nil
+}
+
+func (m *memoryWebhooks) WebhookByID(id uint) (*Webhook, error) {
+	for _, webhook := range m.webhooks {
+		if webhook.ID == id {
+			return &webhook, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memoryWebhooks) ClaimDue(t time.Time, lease time.Duration, limit int) ([]WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deliveries []WebhookDelivery
+	for id := uint(1); id <= uint(len(m.deliveries)) && len(deliveries) < limit; id++ {
+		delivery := m.deliveries[id]
+		if delivery.Status != DeliveryPending || delivery.NextAttemptAt == nil || delivery.NextAttemptAt.After(t) {
+			continue
+		}
+		next := t.Add(lease)
+		delivery.NextAttemptAt = &next
+		m.deliveries[id] = delivery
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+func (m *memoryWebhooks) delivery(id uint) WebhookDelivery {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deliveries[id]
+}
+
+// receiver records the requests it gets and responds with the
+// statuses in turn, then with 200s.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+	received chan struct{}
+}
+
+func newReceiver(statuses ...int) (*receiver, *httptest.Server) {
+	rec := &receiver{statuses: statuses, received: make(chan struct{}, 16)}
+	return rec, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rec.mu.Lock()
+		rec.requests = append(rec.requests, r)
+		rec.bodies = append(rec.bodies, string(body))
+		status := http.StatusOK
+		if len(rec.statuses) > 0 {
+			status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+		}
+		rec.mu.Unlock()
+		w.WriteHeader(status)
+		rec.received <- struct{}{}
+	}))
+}
+
+func testWebhookService(db WebhookDB) *webhookService {
+	return &webhookService{
+		WebhookDB: &webhookValidator{db},
+		client:    &http.Client{Timeout: time.Second},
+		txDB: func(tx *gorm.DB) WebhookDB {
+			return db
+		},
+	}
+}
+
+func TestWebhookValidation(t *testing.T) {
+	ws := testWebhookService(newMemoryWebhooks())
+	cases := []struct {
+		webhook Webhook
+		err     error
+	}{
+		{Webhook{URL: "http://example.com", Events: []string{WebhookFollowed}}, ErrUserIDRequired},
+		{Webhook{UserID: 1, URL: "example.com/hook", Events: []string{WebhookFollowed}}, ErrWebhookURLInvalid},
+		{Webhook{UserID: 1, URL: "ftp://example.com", Events: []string{WebhookFollowed}}, ErrWebhookURLInvalid},
+		{Webhook{UserID: 1, URL: "https://example.com"}, ErrWebhookEventsRequired},
+		{Webhook{UserID: 1, URL: "https://example.com", Events: []string{"tweet.edited"}}, ErrWebhookEventInvalid},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.err, ws.Create(&c.webhook), c.webhook.URL)
+	}
+
+	webhook := Webhook{UserID: 1, URL: " https://example.com/hook ", Events: []string{"Tweet.Liked", WebhookTweetLiked, WebhookFollowed}}
+	if assert.NoError(t, ws.Create(&webhook)) {
+		assert.Equal(t, "https://example.com/hook", webhook.URL)
+		assert.Equal(t, []string{WebhookTweetLiked, WebhookFollowed}, []string(webhook.Events), "repeated events are dropped")
+		assert.NotEmpty(t, webhook.Secret)
+	}
+	for i := 1; i < maxWebhooks; i++ {
+		assert.NoError(t, ws.Create(&Webhook{UserID: 1, URL: "https://example.com", Events: []string{WebhookFollowed}}))
+	}
+	err := ws.Create(&Webhook{UserID: 1, URL: "https://example.com", Events: []string{WebhookFollowed}})
+	assert.Equal(t, ErrWebhookLimit, err)
+}
+
+func TestWebhookQueue(t *testing.T) {
+	rec, server := newReceiver()
+	defer server.Close()
+	db := newMemoryWebhooks(
+		Webhook{ID: 1, UserID: 1, URL: server.URL, Events: []string{WebhookFollowed}, Secret: "one"},
+		Webhook{ID: 2, UserID: 1, URL: server.URL, Events: []string{WebhookMentioned}, Secret: "two"},
+		Webhook{ID: 3, UserID: 2, URL: server.URL, Events: []string{WebhookFollowed}, Secret: "three"},
+		Webhook{ID: 4, UserID: 3, URL: server.URL, Events: []string{WebhookFollowed}, Secret: "four", Global: true},
+	)
+	ws := testWebhookService(db)
+	err := ws.queue(nil, WebhookFollowed, 1, &WebhookEvent{User: "samsmith", Actor: "bobbyd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint{1, 2} {
+		delivery := db.delivery(id)
+		assert.Equal(t, DeliveryPending, delivery.Status, "deliveries are left to the worker")
+		assert.NotNil(t, delivery.NextAttemptAt)
+	}
+	assert.Empty(t, rec.received)
+	ws.deliverDue()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-rec.received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a delivery")
+		}
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	secrets := map[string]string{"1": "one", "2": "two", "3": "three", "4": "four"}
+	var signedWith []string
+	for i, req := range rec.requests {
+		body := rec.bodies[i]
+		assert.Equal(t, WebhookFollowed, req.Header.Get(WebhookEventHeader))
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		for id, secret := range secrets {
+			if req.Header.Get(WebhookSignatureHeader) == SignWebhook(secret, body) {
+				signedWith = append(signedWith, id)
+			}
+		}
+		var payload struct {
+			Event string       `json:"event"`
+			Data  WebhookEvent `json:"data"`
+		}
+		json.Unmarshal([]byte(body), &payload)
+		assert.Equal(t, WebhookFollowed, payload.Event)
+		assert.Equal(t, WebhookEvent{User: "samsmith", Actor: "bobbyd"}, payload.Data)
+	}
+	assert.ElementsMatch(t, []string{"1", "4"}, signedWith, "the user's and the global webhooks get the event")
+}
+
+// waitForDelivery runs the worker until the delivery is no
+// longer pending.
+func waitForDelivery(t *testing.T, ws *webhookService, db *memoryWebhooks, id uint) WebhookDelivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ws.deliverDue()
+		if delivery := db.delivery(id); delivery.Status != DeliveryPending {
+			return delivery
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the delivery")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	delay := webhookRetryDelay
+	webhookRetryDelay = time.Millisecond
+	defer func() { webhookRetryDelay = delay }()
+
+	rec, server := newReceiver(http.StatusInternalServerError, http.StatusBadGateway)
+	defer server.Close()
+	failing := make([]int, webhookMaxAttempts)
+	for i := range failing {
+		failing[i] = http.StatusServiceUnavailable
+	}
+	_, down := newReceiver(failing...)
+	defer down.Close()
+	webhook := Webhook{ID: 1, URL: server.URL, Secret: "secret"}
+	downHook := Webhook{ID: 2, URL: down.URL, Secret: "secret"}
+	db := newMemoryWebhooks(webhook, downHook)
+	ws := testWebhookService(db)
+
+	delivery := WebhookDelivery{WebhookID: 1, Event: WebhookTweetCreated, Payload: `{}`, Status: DeliveryPending}
+	db.CreateDelivery(&delivery)
+	assert.Error(t, ws.Deliver(&webhook, &delivery))
+	logged := db.delivery(delivery.ID)
+	assert.Equal(t, DeliveryPending, logged.Status)
+	assert.Equal(t, 1, logged.Attempts)
+	assert.Equal(t, http.StatusInternalServerError, logged.ResponseCode)
+	assert.NotNil(t, logged.NextAttemptAt, "the retry is stored so it survives a restart")
+
+	logged = waitForDelivery(t, ws, db, delivery.ID)
+	assert.Equal(t, DeliverySucceeded, logged.Status)
+	assert.Equal(t, 3, logged.Attempts)
+	assert.Equal(t, http.StatusOK, logged.ResponseCode)
+	assert.Empty(t, logged.Error)
+	assert.NotNil(t, logged.DeliveredAt)
+	assert.Nil(t, logged.NextAttemptAt)
+	rec.mu.Lock()
+	assert.Equal(t, strconv.Itoa(int(delivery.ID)), rec.requests[2].Header.Get(WebhookDeliveryHeader))
+	rec.mu.Unlock()
+
+	now := time.Now()
+	delivery = WebhookDelivery{WebhookID: 2, Event: WebhookTweetCreated, Payload: `{}`, Status: DeliveryPending, NextAttemptAt: &now}
+	db.CreateDelivery(&delivery)
+	logged = waitForDelivery(t, ws, db, delivery.ID)
+	assert.Equal(t, DeliveryFailed, logged.Status)
+	assert.Equal(t, webhookMaxAttempts, logged.Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, logged.ResponseCode)
+	assert.Contains(t, logged.Error, "503")
+	assert.Nil(t, logged.NextAttemptAt, "failed deliveries are not tried again")
+
+	redelivery, err := ws.Redeliver(&downHook, &logged)
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, logged.ID, redelivery.ID)
+		assert.Equal(t, DeliveryPending, redelivery.Status)
+		assert.Equal(t, logged.Payload, redelivery.Payload)
+		// the receiver is back up for the redelivery
+		deadline := time.Now().Add(5 * time.Second)
+		for db.delivery(redelivery.ID).Status != DeliverySucceeded {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for the redelivery")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestWebhookPublicAddresses(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "10.1.2.3", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fd00::1", "::ffff:192.168.0.1", "64:ff9b::a9fe:a9fe"} {
+		assert.False(t, publicIP(net.ParseIP(addr)), addr)
+	}
+	for _, addr := range []string{"93.184.216.34", "2606:2800:220:1::1"} {
+		assert.True(t, publicIP(net.ParseIP(addr)), addr)
+	}
+
+	_, server := newReceiver()
+	defer server.Close()
+	_, err := newWebhookClient(false).Post(server.URL, "application/json", nil)
+	if assert.Error(t, err, "loopback receivers are refused") {
+		assert.Contains(t, err.Error(), "webhooks cannot be sent to 127.0.0.1")
+	}
+
+	redirect := httptest.NewServer(http.RedirectHandler(server.URL, http.StatusFound))
+	defer redirect.Close()
+	res, err := newWebhookClient(true).Post(redirect.URL, "application/json", nil)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusFound, res.StatusCode, "redirects are not followed")
+	}
+}
@@ -0,0 +1,60 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The test vectors of RFC 6238 appendix B use eight digits,
+// the last six of which are the six digit codes.
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, test := range tests {
+		got, err := Code(secret, Step(time.Unix(test.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("at %d want %s got %s", test.unix, test.want, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	code, _ := Code(secret, Step(now)-1)
+	step, ok := Validate(secret, code, now, 0)
+	if !ok || step != Step(now)-1 {
+		t.Errorf("want previous step to be accepted, got %d %v", step, ok)
+	}
+	if _, ok := Validate(secret, code, now, step); ok {
+		t.Error("want a used code to be rejected")
+	}
+	old, _ := Code(secret, Step(now)-2)
+	if _, ok := Validate(secret, old, now, 0); ok {
+		t.Error("want a code outside the skew to be rejected")
+	}
+}
+
+func TestURI(t *testing.T) {
+	got := URI("Chirp", "vince@gmail.com", "ABC")
+	if !strings.HasPrefix(got, "otpauth://totp/Chirp:vince@gmail.com?") || !strings.Contains(got, "secret=ABC") {
+		t.Errorf("unexpected uri %s", got)
+	}
+}
@@ -0,0 +1,447 @@
+// Package websocket implements the parts of the WebSocket
+// protocol of RFC 6455 the API needs: the opening handshake on
+// both sides, text messages, fragmentation, pings and the
+// closing handshake. Extensions and subprotocols are not
+// supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"chirp.com/pkg/rand"
+)
+
+// Close codes of RFC 6455 section 7.4.1
+const (
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseUnsupported   = 1003
+	ClosePolicy        = 1008
+	CloseTooBig        = 1009
+	CloseInternal      = 1011
+	CloseTryAgainLater = 1013
+	// closeNoStatus is reported when a close frame has no code
+	closeNoStatus = 1005
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	finBit  = 0x80
+	maskBit = 0x80
+
+	maxControlPayload = 125
+	// DefaultReadLimit is the largest message read unless
+	// SetReadLimit is called.
+	DefaultReadLimit = 1 << 20
+)
+
+// acceptGUID is appended to the client's key to build the
+// Sec-WebSocket-Accept header.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	// ErrBadHandshake is returned when a request is not a valid
+	// WebSocket opening handshake.
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	// ErrMessageTooLarge is returned by ReadMessage when a
+	// message is over the read limit. The connection is closed.
+	ErrMessageTooLarge = errors.New("websocket: message too large")
+	// ErrClosed is returned when writing after Close.
+	ErrClosed   = errors.New("websocket: connection closed")
+	errProtocol = errors.New("websocket: protocol error")
+)
+
+// CloseError is returned by ReadMessage once the peer closes
+// the connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with code %d %s", e.Code, e.Reason)
+}
+
+// Conn is a WebSocket connection. ReadMessage must be called
+// from a single goroutine, while writes may come from several.
+type Conn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool
+
+	readLimit   int64
+	readTimeout time.Duration
+
+	mu        sync.Mutex
+	closeSent bool
+	closeOnce sync.Once
+}
+
+// Upgrade completes the opening handshake of the request and
+// takes over its connection. If the request is not a valid
+// handshake ErrBadHandshake is returned and nothing is written,
+// so the caller can render an error.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != "GET" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, ErrBadHandshake
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		return nil, ErrBadHandshake
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("websocket: response does not support hijacking")
+	}
+	netConn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	res := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := netConn.Write([]byte(res)); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return newConn(netConn, brw.Reader, false), nil
+}
+
+// Dial opens a client connection to a ws:// or http:// URL,
+// sending the headers along with the handshake.
+func Dial(rawURL string, header http.Header) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws", "http":
+		u.Scheme = "http"
+	default:
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host += ":80"
+	}
+	netConn, err := net.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	b, err := rand.Bytes(16)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(b)
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       u.Host,
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if err := req.Write(netConn); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(netConn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols ||
+		res.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		netConn.Close()
+		return nil, &HandshakeError{Response: res}
+	}
+	return newConn(netConn, br, true), nil
+}
+
+// HandshakeError is returned by Dial when the server turns the
+// handshake down. The response body is left unread.
+type HandshakeError struct {
+	Response *http.Response
+}
+
+func (e *HandshakeError) Error() string {
+	return "websocket: handshake failed with status " + e.Response.Status
+}
+
+func newConn(netConn net.Conn, br *bufio.Reader, client bool) *Conn {
+	return &Conn{
+		conn:      netConn,
+		br:        br,
+		client:    client,
+		readLimit: DefaultReadLimit,
+	}
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+acceptGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains reports whether the comma separated header
+// has the token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetReadLimit sets the size of the largest message that can
+// be read.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// SetReadTimeout closes the connection if no frame, including
+// pongs, arrives for d. Zero disables the timeout.
+func (c *Conn) SetReadTimeout(d time.Duration) {
+	c.readTimeout = d
+}
+
+// ReadMessage returns the next text or binary message. Pings
+// are answered and pongs skipped along the way. Once the peer
+// closes the connection a *CloseError is returned.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err == errProtocol {
+			c.Close(CloseProtocolError, "")
+			return nil, err
+		}
+		if err != nil {
+			c.closeConn()
+			return nil, err
+		}
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			closeErr := &CloseError{Code: closeNoStatus}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+			}
+			c.Close(CloseNormal, "")
+			return nil, closeErr
+		case opText, opBinary:
+			if started {
+				c.Close(CloseProtocolError, "")
+				return nil, errProtocol
+			}
+			started = true
+		case opContinuation:
+			if !started {
+				c.Close(CloseProtocolError, "")
+				return nil, errProtocol
+			}
+		default:
+			c.Close(CloseProtocolError, "")
+			return nil, errProtocol
+		}
+		if int64(len(message)+len(payload)) > c.readLimit {
+			c.Close(CloseTooBig, "")
+			return nil, ErrMessageTooLarge
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	if c.readTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	var h [2]byte
+	if _, err := io.ReadFull(c.br, h[:]); err != nil {
+		return false, 0, nil, err
+	}
+	// the reserved bits are only used by extensions
+	if h[0]&0x70 != 0 {
+		return false, 0, nil, errProtocol
+	}
+	fin = h[0]&finBit != 0
+	op = h[0] & 0x0f
+	masked := h[1]&maskBit != 0
+	// clients mask their frames and servers do not
+	if masked == c.client {
+		return false, 0, nil, errProtocol
+	}
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if op&0x8 != 0 && (!fin || n > maxControlPayload) {
+		return false, 0, nil, errProtocol
+	}
+	if n > uint64(c.readLimit) {
+		c.Close(CloseTooBig, "")
+		return false, 0, nil, ErrMessageTooLarge
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, payload, nil
+}
+
+// WriteMessage sends the data as a single text frame.
+func (c *Conn) WriteMessage(data []byte) error {
+	return c.writeFrame(opText, data)
+}
+
+// Ping sends a ping, which the peer answers with a pong.
+func (c *Conn) Ping() error {
+	return c.writeFrame(opPing, nil)
+}
+
+// SetWriteDeadline limits how long writes may block, so that a
+// peer that stops reading cannot hold a writer forever.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	return c.writeFrameLocked(op, payload)
+}
+
+func (c *Conn) writeFrameLocked(op byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, finBit|op)
+	var maskFlag byte
+	if c.client {
+		maskFlag = maskBit
+	}
+	n := len(payload)
+	switch {
+	case n < 126:
+		frame = append(frame, maskFlag|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskFlag|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, maskFlag|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if c.client {
+		mask, err := rand.Bytes(4)
+		if err != nil {
+			return err
+		}
+		frame = append(frame, mask...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame with the code and reason, unless
+// one was sent already, and closes the connection. It is safe
+// to call more than once and from several goroutines.
+func (c *Conn) Close(code int, reason string) error {
+	c.mu.Lock()
+	var err error
+	if !c.closeSent {
+		c.closeSent = true
+		payload := make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, reason...)
+		if len(payload) > maxControlPayload {
+			payload = payload[:maxControlPayload]
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		err = c.writeFrameLocked(opClose, payload)
+	}
+	c.mu.Unlock()
+	c.closeConn()
+	return err
+}
+
+func (c *Conn) closeConn() {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+	})
+}
@@ -0,0 +1,128 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// echoServer echoes every message until the client closes the
+// connection.
+func echoServer(t *testing.T, limit int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		conn.SetReadLimit(limit)
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(msg); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func TestEcho(t *testing.T) {
+	server := echoServer(t, DefaultReadLimit)
+	defer server.Close()
+	conn, err := Dial(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(CloseNormal, "")
+
+	// sizes around the 7, 16 and 64 bit length encodings
+	for _, size := range []int{0, 5, 125, 126, 65535, 65536, 70000} {
+		sent := strings.Repeat("a", size)
+		assert.NoError(t, conn.WriteMessage([]byte(sent)))
+		got, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, sent, string(got), size)
+	}
+	assert.NoError(t, conn.Ping())
+	assert.NoError(t, conn.WriteMessage([]byte("after the ping")))
+	got, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "after the ping", string(got), "pongs are skipped")
+}
+
+func TestFragmentedMessage(t *testing.T) {
+	server := echoServer(t, DefaultReadLimit)
+	defer server.Close()
+	conn, err := Dial(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(CloseNormal, "")
+
+	// a ping may come between the fragments
+	frames := []struct {
+		op      byte
+		fin     bool
+		payload string
+	}{
+		{opText, false, "hello "},
+		{opPing, true, ""},
+		{opContinuation, false, "there "},
+		{opContinuation, true, "world"},
+	}
+	conn.mu.Lock()
+	for _, f := range frames {
+		var err error
+		if f.fin {
+			err = conn.writeFrameLocked(f.op, []byte(f.payload))
+		} else {
+			err = writeUnfinished(conn, f.op, []byte(f.payload))
+		}
+		assert.NoError(t, err)
+	}
+	conn.mu.Unlock()
+	got, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello there world", string(got))
+}
+
+// writeUnfinished writes a masked frame without the fin bit.
+func writeUnfinished(c *Conn, op byte, payload []byte) error {
+	frame := []byte{op, maskBit | byte(len(payload)), 0, 0, 0, 0}
+	frame = append(frame, payload...)
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func TestReadLimit(t *testing.T) {
+	server := echoServer(t, 10)
+	defer server.Close()
+	conn, err := Dial(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, conn.WriteMessage([]byte("way more than ten bytes")))
+	_, err = conn.ReadMessage()
+	if closeErr, ok := err.(*CloseError); assert.True(t, ok, "%v", err) {
+		assert.Equal(t, CloseTooBig, closeErr.Code)
+	}
+	assert.Equal(t, ErrClosed, conn.WriteMessage([]byte("hi")))
+}
+
+func TestBadHandshake(t *testing.T) {
+	server := echoServer(t, DefaultReadLimit)
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	_, err = Dial(strings.Replace(server.URL, "http", "wss", 1), nil)
+	assert.Error(t, err)
+}
@@ -4,20 +4,44 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
 
 	"chirp.com/app"
 	"chirp.com/config"
 	"chirp.com/controllers"
 	"chirp.com/email"
+	"chirp.com/internal/utils"
 	"chirp.com/middleware"
+	"chirp.com/models"
 )
 
 func main() {
 	boolPtr := flag.Bool("prod", false, "Provide this flag in production. This ensures that a .config file is provided before the application starts.")
+	rebuildSearchPtr := flag.Bool("rebuild-search", false, "Backfill the tweet search index for existing tweets and exit.")
+	purgePtr := flag.Bool("purge-deactivated", false, "Delete the accounts whose deactivation period is over and exit. Meant to be run daily, for example from cron.")
+	importPtr := flag.String("import-tweets", "", "Import the tweet archive (JSON lines) at this path for the -import-user user and exit.")
+	importUserPtr := flag.String("import-user", "", "The username to import the -import-tweets archive for.")
 	flag.Parse()
 	cfg := config.LoadConfig(*boolPtr)
 	services := app.Setup(cfg)
 	defer services.Close()
+	if *rebuildSearchPtr {
+		n, err := services.Search.Rebuild()
+		utils.Must(err)
+		fmt.Printf("Indexed %d tweets.\n", n)
+		return
+	}
+	if *purgePtr {
+		n, err := services.User.PurgeDeactivated()
+		utils.Must(err)
+		fmt.Printf("Purged %d accounts.\n", n)
+		return
+	}
+	if *importPtr != "" {
+		importTweets(services, *importPtr, *importUserPtr)
+		return
+	}
+	services.Start()
 	mgCfg := cfg.Mailgun
 	emailer := email.NewClient(
 		email.WithSender("Lenslocked.com Support", "support@mg.lenslocked.com"),
@@ -26,20 +50,45 @@ func main() {
 
 	router := app.NewRouter()
 
-	tweetsAPI := controllers.NewTweets(services.Tweet, services.Like, services.Tag, services.Tagging)
+	tweetsAPI := controllers.NewTweets(services.Tweet, services.Like, services.Block, services.User)
 	tagsAPI := controllers.NewTags(services.Tag, services.Tagging)
-	usersAPI := controllers.NewUsers(services.User, services.Like, services.Follow, services.Tweet, emailer)
+	usersAPI := controllers.NewUsers(services.User, services.Like, services.Follow, services.Block, services.Mute, services.Tweet, services.Session, emailer)
+	timelineAPI := controllers.NewTimeline(services.Timeline)
+	notificationsAPI := controllers.NewNotifications(services.Notification)
+	searchAPI := controllers.NewSearch(services.Search)
+	apiTokensAPI := controllers.NewAPITokens(services.APIToken)
+	sessionsAPI := controllers.NewSessions(services.Session)
+	exportsAPI := controllers.NewExports(services.Export)
+	importsAPI := controllers.NewImports(services.Import)
+	messagesAPI := controllers.NewMessages(services.Message, services.User)
+	webhooksAPI := controllers.NewWebhooks(services.Webhook, cfg.Admins)
+	streamAPI := controllers.NewStream(services.Stream)
 
 	//init middleware
-	userMw := middleware.NewUserMw(services.User)
+	userMw := middleware.NewUserMw(services.User, services.APIToken, services.Session)
 	requireUserMw := middleware.NewRequireUserMw(userMw)
+	requireVerifiedMw := middleware.NewRequireVerifiedUserMw(requireUserMw, cfg.RequireVerifiedEmail)
+	requireSessionMw := middleware.NewRequireSessionMw(requireUserMw)
+	socketsAPI := controllers.NewSockets(tweetsAPI, usersAPI, services.Stream, &requireVerifiedMw)
 
 	//test route
 	router.HandleFunc("/ping", ping).Methods("GET")
 	//api routes
 	subRouter := router.PathPrefix("/api").Subrouter()
-	controllers.ServeUserResource(subRouter, usersAPI, &requireUserMw)
-	controllers.ServeTweetResource(subRouter, tweetsAPI, &requireUserMw)
+	// fixed paths have to be registered before /{username}
+	controllers.ServeTimelineResource(subRouter, timelineAPI, &requireUserMw)
+	controllers.ServeNotificationResource(subRouter, notificationsAPI, &requireUserMw)
+	controllers.ServeSearchResource(subRouter, searchAPI)
+	controllers.ServeAPITokenResource(subRouter, apiTokensAPI, &requireSessionMw)
+	controllers.ServeSessionResource(subRouter, sessionsAPI, &requireUserMw)
+	controllers.ServeExportResource(subRouter, exportsAPI, &requireUserMw)
+	controllers.ServeImportResource(subRouter, importsAPI, &requireVerifiedMw)
+	controllers.ServeMessageResource(subRouter, messagesAPI, &requireUserMw)
+	controllers.ServeWebhookResource(subRouter, webhooksAPI, &requireUserMw)
+	controllers.ServeStreamResource(subRouter, streamAPI, &requireUserMw)
+	controllers.ServeSocketResource(subRouter, socketsAPI, &requireUserMw)
+	controllers.ServeUserResource(subRouter, usersAPI, &requireUserMw, &requireVerifiedMw)
+	controllers.ServeTweetResource(subRouter, tweetsAPI, &requireUserMw, &requireVerifiedMw)
 	controllers.ServeTagResource(subRouter, tagsAPI, &requireUserMw)
 
 	fmt.Printf("Starting the server on :%d...\n", cfg.Port)
@@ -47,6 +96,25 @@ func main() {
 		userMw.Apply(router))
 }
 
+// importTweets prints the line of every row that could not be
+// imported along with the reason.
+func importTweets(services *models.Services, path, username string) {
+	user, err := services.User.ByUsername(username)
+	utils.Must(err)
+	f, err := os.Open(path)
+	utils.Must(err)
+	defer f.Close()
+	result, err := services.Import.Import(user, f)
+	if result != nil {
+		for _, rowErr := range result.Errors {
+			fmt.Printf("line %d: %s\n", rowErr.Line, rowErr.Error)
+		}
+		fmt.Printf("Imported %d tweets, skipped %d already imported, %d errors.\n",
+			result.Imported, result.Skipped, len(result.Errors))
+	}
+	utils.Must(err)
+}
+
 func ping(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Pinging the server...Success!\n")
 }
@@ -1,9 +1,31 @@
 DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS pw_resets;
 DROP TABLE IF EXISTS follows;
 DROP TABLE IF EXISTS tweets;
 DROP TABLE IF EXISTS likes;
 DROP TABLE IF EXISTS tags;
 DROP TABLE IF EXISTS taggings;
+DROP TABLE IF EXISTS notifications;
+DROP TABLE IF EXISTS api_tokens;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS login_challenges;
+DROP TABLE IF EXISTS email_verifications;
+DROP TABLE IF EXISTS username_changes;
+DROP TABLE IF EXISTS exports;
+DROP TABLE IF EXISTS tweet_imports;
+DROP TABLE IF EXISTS blocks;
+DROP TABLE IF EXISTS mutes;
+DROP TABLE IF EXISTS follow_requests;
+DROP TABLE IF EXISTS conversations;
+DROP TABLE IF EXISTS conversation_participants;
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS webhooks;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS outbox_events;
+DROP TABLE IF EXISTS schema_migrations;
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
 
 CREATE TABLE public.users
 (
@@ -15,7 +37,13 @@ CREATE TABLE public.users
     updated_at timestamptz NULL,
     deleted_at timestamptz NULL,
     password_hash text null,
-    remember_hash text null,
+    totp_secret text NULL,
+    totp_enabled_at timestamptz NULL,
+    totp_last_step int8 NOT NULL DEFAULT 0,
+    email_verified_at timestamptz NULL,
+    deactivated_at timestamptz NULL,
+    protected bool NOT NULL DEFAULT false,
+    dm_followers_only bool NOT NULL DEFAULT false,
     CONSTRAINT users_pkey PRIMARY KEY (id)
 )
 WITH (
@@ -25,15 +53,45 @@ CREATE UNIQUE INDEX uix_users_email ON public.users USING btree
 (email) ;
 CREATE UNIQUE INDEX uix_users_username ON public.users USING btree
 (username) ;
+CREATE INDEX idx_users_username_trgm ON public.users USING gin
+(username gin_trgm_ops) ;
+CREATE INDEX idx_users_name_trgm ON public.users USING gin
+(lower(name) gin_trgm_ops) ;
+CREATE INDEX idx_users_deactivated_at ON public.users USING btree
+(deactivated_at) ;
+
+CREATE TABLE public.pw_resets
+(
+    id serial NOT NULL,
+    created_at timestamptz NULL,
+    updated_at timestamptz NULL,
+    deleted_at timestamptz NULL,
+    user_id int4 NOT NULL,
+    token_hash text NOT NULL,
+    CONSTRAINT pw_resets_pkey PRIMARY KEY (id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+CREATE INDEX idx_pw_resets_deleted_at ON public.pw_resets USING btree
+(deleted_at) ;
+CREATE UNIQUE INDEX uix_pw_resets_token_hash ON public.pw_resets USING btree
+(token_hash) ;
 
 CREATE TABLE public.tweets
 (
     id serial NOT NULL,
     post text NULL,
     username text NOT NULL,
+    entities jsonb NULL,
     likes_count int4 NULL,
     retweets_count int4 NULL,
     retweet_id int4 NULL,
+    quote boolean NOT NULL DEFAULT false,
+    in_reply_to_id int4 NULL,
+    conversation_id int4 NULL,
+    replies_count int4 NULL,
+    search_vector tsvector NULL,
     created_at timestamptz NULL,
     updated_at timestamptz NULL,
     deleted_at timestamptz NULL,
@@ -46,6 +104,14 @@ CREATE INDEX idx_tweets_deleted_at ON public.tweets USING btree
 (deleted_at) ;
 CREATE INDEX idx_tweets_username ON public.tweets USING btree
 (username) ;
+CREATE INDEX idx_tweets_in_reply_to_id ON public.tweets USING btree
+(in_reply_to_id) ;
+CREATE INDEX idx_tweets_conversation_id ON public.tweets USING btree
+(conversation_id) ;
+CREATE INDEX idx_tweets_search_vector ON public.tweets USING gin
+(search_vector) ;
+CREATE TRIGGER tweets_search_vector_update BEFORE INSERT OR UPDATE OF post ON public.tweets
+FOR EACH ROW EXECUTE PROCEDURE tsvector_update_trigger(search_vector, 'pg_catalog.english', post) ;
 
 CREATE TABLE public.likes
 (
@@ -84,45 +150,349 @@ WITH (
 ) ;
 
 
+CREATE TABLE public.notifications
+(
+    id serial NOT NULL,
+    user_id int4 NOT NULL,
+    actor_id int4 NOT NULL,
+    "type" text NOT NULL,
+    tweet_id int4 NULL,
+    read_at timestamptz NULL,
+    created_at timestamptz NULL,
+    CONSTRAINT notifications_pkey PRIMARY KEY (id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+CREATE INDEX idx_notifications_user_id ON public.notifications USING btree
+(user_id) ;
+
+CREATE TABLE public.api_tokens
+(
+    id serial NOT NULL,
+    user_id int4 NOT NULL,
+    "name" text NOT NULL,
+    "scope" text NOT NULL,
+    token_hash text NOT NULL,
+    last_used_at timestamptz NULL,
+    created_at timestamptz NULL,
+    CONSTRAINT api_tokens_pkey PRIMARY KEY (id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+CREATE INDEX idx_api_tokens_user_id ON public.api_tokens USING btree
+(user_id) ;
+CREATE UNIQUE INDEX uix_api_tokens_token_hash ON public.api_tokens USING btree
+(token_hash) ;
+
+CREATE TABLE public.sessions
+(
+    id serial NOT NULL,
+    user_id int4 NOT NULL,
+    token_hash text NOT NULL,
+    user_agent text NULL,
+    ip text NULL,
+    created_at timestamptz NULL,
+    last_seen_at timestamptz NULL,
+    expires_at timestamptz NOT NULL,
+    CONSTRAINT sessions_pkey PRIMARY KEY (id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+CREATE INDEX idx_sessions_user_id ON public.sessions USING btree
+(user_id) ;
+CREATE UNIQUE INDEX uix_sessions_token_hash ON public.sessions USING btree
+(token_hash) ;
+
+CREATE TABLE public.recovery_codes
+(
+    id serial NOT NULL,
+    user_id int4 NOT NULL,
+    code_hash text NOT NULL,
+    created_at timestamptz NULL,
+    CONSTRAINT recovery_codes_pkey PRIMARY KEY (id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+CREATE INDEX idx_recovery_codes_user_id ON public.recovery_codes USING btree
+(user_id) ;
+CREATE UNIQUE INDEX uix_recovery_codes_code_hash ON public.recovery_codes USING btree
+(code_hash) ;
+
+CREATE TABLE public.login_challenges
+(
+    id serial NOT NULL,
+    user_id int4 NOT NULL,
+    token_hash text NOT NULL,
+    attempts int4 NOT NULL DEFAULT 0,
+    created_at timestamptz NULL,
+    expires_at timestamptz NOT NULL,
+    CONSTRAINT login_challenges_pkey PRIMARY KEY (id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+CREATE UNIQUE INDEX uix_login_challenges_token_hash ON public.login_challenges USING btree
+(token_hash) ;
+
+CREATE TABLE public.email_verifications
+(
+    id serial NOT NULL,
+    created_at timestamptz NULL,
+    updated_at timestamptz NULL,
+    deleted_at timestamptz NULL,
+    user_id int4 NOT NULL,
+    token_hash text NOT NULL,
+    CONSTRAINT email_verifications_pkey PRIMARY KEY (id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+CREATE INDEX idx_email_verifications_user_id ON public.email_verifications USING btree
+(user_id) ;
+CREATE UNIQUE INDEX uix_email_verifications_token_hash ON public.email_verifications USING btree
+(token_hash) ;
+
+CREATE TABLE public.username_changes
+(
+    id serial NOT NULL,
+    user_id int4 NOT NULL,
+    old_username text NOT NULL,
+    created_at timestamptz NULL,
+    CONSTRAINT username_changes_pkey PRIMARY KEY (id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+CREATE INDEX idx_username_changes_user_id ON public.username_changes USING btree
+(user_id) ;
+CREATE INDEX idx_username_changes_old_username ON public.username_changes USING btree
+(old_username) ;
+
+CREATE TABLE public.exports
+(
+    id serial NOT NULL,
+    user_id int4 NOT NULL,
+    status text NOT NULL,
+    archive bytea NULL,
+    created_at timestamptz NULL,
+    completed_at timestamptz NULL,
+    CONSTRAINT exports_pkey PRIMARY KEY (id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+CREATE INDEX idx_exports_user_id ON public.exports USING btree
+(user_id) ;
+
+CREATE TABLE public.tweet_imports
+(
+    id serial NOT NULL,
+    user_id int4 NOT NULL,
+    external_id text NOT NULL,
+    tweet_id int4 NOT NULL,
+    created_at timestamptz NULL,
+    CONSTRAINT tweet_imports_pkey PRIMARY KEY (id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+CREATE UNIQUE INDEX uix_tweet_imports_user_id_external_id ON public.tweet_imports USING btree
+(user_id, external_id) ;
+
+CREATE TABLE public.blocks
+(
+    blocker_id int4 NOT NULL,
+    user_id int4 NOT NULL,
+    created_at timestamptz NULL,
+    CONSTRAINT blocks_pkey PRIMARY KEY (blocker_id, user_id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+
+CREATE TABLE public.mutes
+(
+    muter_id int4 NOT NULL,
+    user_id int4 NOT NULL,
+    created_at timestamptz NULL,
+    CONSTRAINT mutes_pkey PRIMARY KEY (muter_id, user_id)
+)
+WITH (
+	OIDS=FALSE
+) ;
 
+CREATE TABLE public.follow_requests
+(
+    follower_id int4 NOT NULL,
+    user_id int4 NOT NULL,
+    created_at timestamptz NULL,
+    CONSTRAINT follow_requests_pkey PRIMARY KEY (follower_id, user_id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+
+CREATE TABLE public.conversations
+(
+    id serial NOT NULL,
+    direct bool NOT NULL DEFAULT false,
+    last_message_id int4 NOT NULL DEFAULT 0,
+    created_at timestamptz NULL,
+    CONSTRAINT conversations_pkey PRIMARY KEY (id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+CREATE INDEX idx_conversations_last_message_id ON public.conversations USING btree
+(last_message_id) ;
+
+CREATE TABLE public.conversation_participants
+(
+    conversation_id int4 NOT NULL,
+    user_id int4 NOT NULL,
+    last_read_id int4 NOT NULL DEFAULT 0,
+    cleared_id int4 NOT NULL DEFAULT 0,
+    created_at timestamptz NULL,
+    CONSTRAINT conversation_participants_pkey PRIMARY KEY (conversation_id, user_id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+
+CREATE TABLE public.messages
+(
+    id serial NOT NULL,
+    conversation_id int4 NOT NULL,
+    sender_id int4 NOT NULL,
+    body text NOT NULL,
+    created_at timestamptz NULL,
+    CONSTRAINT messages_pkey PRIMARY KEY (id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+CREATE INDEX idx_messages_conversation_id ON public.messages USING btree
+(conversation_id) ;
+
+CREATE TABLE public.webhooks
+(
+    id serial NOT NULL,
+    user_id int4 NOT NULL,
+    url text NOT NULL,
+    events text[] NOT NULL,
+    secret text NOT NULL,
+    "global" bool NOT NULL DEFAULT false,
+    created_at timestamptz NULL,
+    CONSTRAINT webhooks_pkey PRIMARY KEY (id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+CREATE INDEX idx_webhooks_user_id ON public.webhooks USING btree
+(user_id) ;
+
+CREATE TABLE public.webhook_deliveries
+(
+    id serial NOT NULL,
+    webhook_id int4 NOT NULL,
+    "event" text NOT NULL,
+    payload text NOT NULL,
+    status text NOT NULL,
+    attempts int4 NOT NULL DEFAULT 0,
+    response_code int4 NULL,
+    error text NULL,
+    next_attempt_at timestamptz NULL,
+    created_at timestamptz NULL,
+    delivered_at timestamptz NULL,
+    CONSTRAINT webhook_deliveries_pkey PRIMARY KEY (id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+CREATE INDEX idx_webhook_deliveries_webhook_id ON public.webhook_deliveries USING btree
+(webhook_id) ;
+CREATE INDEX idx_webhook_deliveries_next_attempt_at ON public.webhook_deliveries USING btree
+(next_attempt_at) ;
+
+CREATE TABLE public.outbox_events
+(
+    id serial NOT NULL,
+    "name" text NOT NULL,
+    subscriber text NOT NULL,
+    payload text NOT NULL,
+    attempts int4 NOT NULL DEFAULT 0,
+    error text NULL,
+    next_attempt_at timestamptz NULL,
+    processed_at timestamptz NULL,
+    created_at timestamptz NULL,
+    CONSTRAINT outbox_events_pkey PRIMARY KEY (id)
+)
+WITH (
+	OIDS=FALSE
+) ;
+CREATE INDEX idx_outbox_events_next_attempt_at ON public.outbox_events USING btree
+(next_attempt_at) ;
+CREATE INDEX idx_outbox_events_processed_at ON public.outbox_events USING btree
+(processed_at) ;
+
+CREATE TABLE public.schema_migrations
+(
+    "name" text NOT NULL,
+    applied_at timestamptz NULL,
+    CONSTRAINT schema_migrations_pkey PRIMARY KEY ("name")
+)
+WITH (
+	OIDS=FALSE
+) ;
 
 
 -- Insert Users
 INSERT INTO public.users
-    ("name", username, email, password_hash, remember_hash)
+    ("name", username, email, password_hash)
 VALUES
-    ('Sam Smith', 'samsmith', 'sam2018@gmail.com', 'fake-pw-hash', 'fake-hash');
+    ('Sam Smith', 'samsmith', 'sam2018@gmail.com', 'fake-pw-hash');
 
 INSERT INTO public.users
-    ("name", username, email, password_hash, remember_hash)
+    ("name", username, email, password_hash)
 VALUES
-    ('Kanye West', 'kanye_west', 'kanye@kanye.com', 'fake-pw-hash', 'fake-hash');
+    ('Kanye West', 'kanye_west', 'kanye@kanye.com', 'fake-pw-hash');
 
 INSERT INTO public.users
-    ("name", username, email, password_hash, remember_hash)
+    ("name", username, email, password_hash)
 VALUES
-    ('Dua Lipa', 'duasings', 'dua@lipa.com', 'fake-pw-hash', 'fake-hash');
+    ('Dua Lipa', 'duasings', 'dua@lipa.com', 'fake-pw-hash');
 
 INSERT INTO public.users
-    ("name", username, email, password_hash, remember_hash)
+    ("name", username, email, password_hash)
 VALUES
-    ('Bob Dylan', 'bobbyd', 'bob@dylan.com', 'fake-pw-hash', 'fake-hash');
+    ('Bob Dylan', 'bobbyd', 'bob@dylan.com', 'fake-pw-hash');
 
--- this user's remember_hash based on
--- HMACKey: "secret-hmac-key" 
--- Used to test logout
 INSERT INTO public.users
-    ("name", username, email, password_hash, remember_hash)
+    ("name", username, email, password_hash)
 VALUES
-    ('Tom Tester', 'tommytesterton', 'tommy@gmail.com', 'fake-pw-hash',
-        'M-QQp9qW_mhAZK5s1651k_ODELJZTP1EBahOOByjfJE=');
--- this user's remember_hash based on
--- HMACKey: "secret-hmac-key" 
+    ('Tom Tester', 'tommytesterton', 'tommy@gmail.com', 'fake-pw-hash');
+
 INSERT INTO public.users
-    ("name", username, email, password_hash, remember_hash)
+    ("name", username, email, password_hash)
+VALUES
+    ('Vince Main', 'vincetester', 'vtester@gmail.com', 'fake-pw-hash');
+
+-- Insert sessions
+-- the token hashes are based on
+-- HMACKey: "secret-hmac-key"
+-- tommytesterton's session is used to test logout
+INSERT INTO public.sessions
+    (user_id, token_hash, user_agent, ip, created_at, last_seen_at, expires_at)
+VALUES
+    (5, 'M-QQp9qW_mhAZK5s1651k_ODELJZTP1EBahOOByjfJE=', 'test', '127.0.0.1', now(), now(), now() + interval '30 days');
+INSERT INTO public.sessions
+    (user_id, token_hash, user_agent, ip, created_at, last_seen_at, expires_at)
 VALUES
-    ('Vince Main', 'vincetester', 'vtester@gmail.com', 'fake-pw-hash',
-        'Dt0b9x7U0tO22dNEX3f1uLMd5STOl5hbDU2ATW6pMjw=');
+    (6, 'Dt0b9x7U0tO22dNEX3f1uLMd5STOl5hbDU2ATW6pMjw=', 'test', '127.0.0.1', now(), now(), now() + interval '30 days');
 
 -- Drop table
 